@@ -1,23 +1,36 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/DIMO-Network/enclave-bridge/pkg/audit"
 	"github.com/DIMO-Network/enclave-bridge/pkg/config"
 	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
+	"github.com/DIMO-Network/enclave-bridge/pkg/logs"
+	"github.com/DIMO-Network/enclave-bridge/pkg/redact"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tracing"
 	"github.com/DIMO-Network/enclave-bridge/pkg/tunnel"
 	"github.com/DIMO-Network/enclave-bridge/pkg/watchdog"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
 	"github.com/mdlayher/vsock"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 	"inet.af/tcpproxy"
 )
@@ -26,23 +39,96 @@ import (
 const (
 	InitPortEnvVar   = "ENCLAVE_BRIDGE_VSOCK_INIT_PORT"
 	StdoutPortEnvVar = "ENCLAVE_BRIDGE_VSOCK_STDOUT_PORT"
-	readTimeout      = time.Second * 10
+	// AliasesFileEnvVar is the environment variable used to set the path of the upstream alias file.
+	AliasesFileEnvVar = "ENCLAVE_BRIDGE_ALIASES_FILE"
+	// AuditLogFileEnvVar is the environment variable used to set the path of the egress audit log, or - for stdout.
+	AuditLogFileEnvVar = "ENCLAVE_BRIDGE_AUDIT_LOG_FILE"
+	// AuditLogMaxBytesEnvVar is the environment variable used to set the size at which the audit log is rotated.
+	AuditLogMaxBytesEnvVar = "ENCLAVE_BRIDGE_AUDIT_LOG_MAX_BYTES"
+	// AuditLogMaxFilesEnvVar is the environment variable used to set the number of rotated audit logs to keep.
+	AuditLogMaxFilesEnvVar = "ENCLAVE_BRIDGE_AUDIT_LOG_MAX_FILES"
+	// LogFormatEnvVar is the environment variable used to set the format of forwarded enclave logs: json, logfmt or console.
+	LogFormatEnvVar = "ENCLAVE_BRIDGE_LOG_FORMAT"
+	// LogSinksFileEnvVar is the environment variable used to set the path of the log sink file.
+	// Forwarded enclave logs are written to stdout if it is not set.
+	LogSinksFileEnvVar = "ENCLAVE_BRIDGE_LOG_SINKS_FILE"
+	// LogRedactionFileEnvVar is the environment variable used to set the path of the log redaction rules.
+	LogRedactionFileEnvVar = "ENCLAVE_BRIDGE_LOG_REDACTION_FILE"
+	// WatchdogActionsFileEnvVar is the environment variable used to set the path of the actions taken when the
+	// watchdog of the active enclave fails. The bridge exits with code 1 if it is not set.
+	WatchdogActionsFileEnvVar = "ENCLAVE_BRIDGE_WATCHDOG_ACTIONS_FILE"
+	// TracesEndpointEnvVar is the environment variable used to set the OTLP/HTTP endpoint spans are exported to,
+	// e.g. http://localhost:4318/v1/traces. Tracing is disabled if it is not set.
+	TracesEndpointEnvVar = "ENCLAVE_BRIDGE_TRACES_ENDPOINT"
+	// RequireAuthenticatedHeartbeatsEnvVar is the environment variable that makes the bridge reject handshakes of
+	// enclaves that do not establish a session key to authenticate their watchdog heartbeats, e.g. "true".
+	RequireAuthenticatedHeartbeatsEnvVar = "ENCLAVE_BRIDGE_REQUIRE_AUTHENTICATED_HEARTBEATS"
+	// HeartbeatMetricKeysEnvVar is the environment variable used to set the comma separated custom heartbeat keys
+	// whose numeric values are exported as metrics. No custom values are exported if it is not set.
+	HeartbeatMetricKeysEnvVar = "ENCLAVE_BRIDGE_HEARTBEAT_METRIC_KEYS"
+	// OperatorAddrEnvVar is the environment variable used to set the address of the operator server that promotes
+	// standby enclaves and rolls back. It listens on 127.0.0.1:8889 if it is not set.
+	OperatorAddrEnvVar = "ENCLAVE_BRIDGE_OPERATOR_ADDR"
+	// OperatorTokenEnvVar is the environment variable used to set a bearer token required by the operator server.
+	OperatorTokenEnvVar = "ENCLAVE_BRIDGE_OPERATOR_TOKEN"
+	readTimeout         = time.Second * 10
+
+	defaultAuditLogMaxBytes = 100 * 1024 * 1024
+	defaultAuditLogMaxFiles = 10
+	// logSinkFlushTimeout is how long buffered enclave logs are flushed to the log sinks on shutdown.
+	logSinkFlushTimeout = 5 * time.Second
+	// traceFlushTimeout is how long queued spans are exported on shutdown.
+	traceFlushTimeout = 5 * time.Second
+	tracerServiceName = "enclave-bridge"
+
+	// maxInitLineLength is the maximum length of the first message on the init port, a handshake ACK or a watchdog
+	// heartbeat including the custom key/values of the enclave.
+	maxInitLineLength = 64 * 1024
+	// initReadBufferSize is the size of the buffer the first message on the init port is read through.
+	initReadBufferSize = 4 * 1024
+	// standbyHealthyProbes is the number of consecutive successful probes before a standby enclave can be promoted.
+	standbyHealthyProbes  = 3
+	standbyProbeInterval  = time.Second
+	standbyHealthyTimeout = time.Minute * 2
 )
 
 // Bridge is a struct that handles running the enclave-bridge.
 type Bridge struct {
 	settings  *config.BridgeSettings
+	cid       uint32
 	readyFunc func() error
-	listener  net.Listener
+	// sessionKey authenticates the heartbeats of the enclave. It is nil for enclaves that do not support it.
+	sessionKey []byte
+	listener   net.Listener
+	deploy     *deployment
+	aliases    *tunnel.AliasTable
+	auditLog   *audit.Log
+	stdout     *tunnel.StdoutTunnel
+	tracer     trace.Tracer
+	// watchdogActions are taken when the watchdog of the active enclave fails.
+	watchdogActions *watchdogActions
+	// requireAuthenticatedHeartbeats rejects handshakes of enclaves that do not establish a session key.
+	requireAuthenticatedHeartbeats bool
 }
 
+// errUnauthenticatedHeartbeats is returned by the handshake of an enclave without a session key when authenticated
+// heartbeats are required.
+var errUnauthenticatedHeartbeats = errors.New("enclave does not authenticate its watchdog heartbeats")
+
 // CreateBridge listens for a new connection and then starts a new bridge instance.
-func CreateBridge(parentCtx context.Context) (*Bridge, error) {
+// Enclaves that connect later are handed to deploy as standby enclaves.
+// The app name of every enclave that completes a handshake is added to its log lines forwarded by stdout.
+// Connections through the tunnels are traced with tracer.
+func CreateBridge(parentCtx context.Context, deploy *deployment, stdout *tunnel.StdoutTunnel, tracer trace.Tracer) (*Bridge, error) {
 	logger := zerolog.Ctx(parentCtx)
 	initPort, err := getInitPort()
 	if err != nil {
 		return nil, err
 	}
+	requireAuthenticatedHeartbeats, err := getEnvBool(RequireAuthenticatedHeartbeatsEnvVar)
+	if err != nil {
+		return nil, err
+	}
 	// Create new listener that waits for a new enclave to initiate a handshake
 	listener, err := vsock.ListenContextID(enclave.DefaultHostCID, initPort, nil)
 	if err != nil {
@@ -82,21 +168,32 @@ func CreateBridge(parentCtx context.Context) (*Bridge, error) {
 	}
 	logger.Info().Msg("Starting new bridge")
 
-	bridge, err := completeHandshake(parentCtx, logger, conn)
+	bridge, err := completeHandshake(parentCtx, logger, conn, requireAuthenticatedHeartbeats)
 	if err != nil {
 		_ = listener.Close()
 		_ = conn.Close()
 		return nil, fmt.Errorf("failed to complete handshake: %w", err)
 	}
 	bridge.listener = listener
+	bridge.deploy = deploy
+	bridge.stdout = stdout
+	bridge.tracer = tracer
+	bridge.requireAuthenticatedHeartbeats = requireAuthenticatedHeartbeats
+	bridge.stdout.SetAppName(bridge.cid, bridge.settings.AppName)
 	return bridge, nil
 }
 
-func completeHandshake(ctx context.Context, logger *zerolog.Logger, conn net.Conn) (*Bridge, error) {
+// completeHandshake exchanges the environment and bridge settings with a new enclave. If requireAuthenticatedHeartbeats
+// is set, enclaves that do not establish a session key for their heartbeats are rejected.
+func completeHandshake(ctx context.Context, logger *zerolog.Logger, conn net.Conn, requireAuthenticatedHeartbeats bool) (*Bridge, error) {
 	logger.Info().Msg("Sending Environment to enclave")
-	environment, err := config.SerializeEnvironment("")
+	keyExchange, err := watchdog.NewKeyExchange()
 	if err != nil {
-		return nil, fmt.Errorf("failed to serialize environment: %w", err)
+		return nil, err
+	}
+	environment, err := serializeEnvironment(keyExchange.PublicKey())
+	if err != nil {
+		return nil, err
 	}
 	err = enclave.WriteWithContext(ctx, conn, append(environment, '\n'))
 	if err != nil {
@@ -115,6 +212,20 @@ func completeHandshake(ctx context.Context, logger *zerolog.Logger, conn net.Con
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
+	var sessionKey []byte
+	if settings.Watchdog.SessionPublicKey != nil {
+		sessionKey, err = keyExchange.SessionKey(settings.Watchdog.SessionPublicKey, settings.Watchdog.EnclaveID)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if requireAuthenticatedHeartbeats {
+			unauthenticatedHandshakesTotal.WithLabelValues("rejected").Inc()
+			return nil, errUnauthenticatedHeartbeats
+		}
+		unauthenticatedHandshakesTotal.WithLabelValues("accepted").Inc()
+		logger.Warn().Msg("Enclave does not authenticate its watchdog heartbeats")
+	}
 
 	// readyFunc is a function that sends an ACK to the enclave and closes the connection when the bridge is all setup
 	readyFunc := func() error {
@@ -133,7 +244,27 @@ func completeHandshake(ctx context.Context, logger *zerolog.Logger, conn net.Con
 		}
 		return nil
 	}
-	return &Bridge{settings: &settings, readyFunc: readyFunc}, nil
+	return &Bridge{settings: &settings, cid: tunnel.EnclaveCID(conn), readyFunc: readyFunc, sessionKey: sessionKey}, nil
+}
+
+// serializeEnvironment serializes the environment sent to the enclave together with the heartbeat version the
+// bridge supports and its public key of the key exchange that authenticates heartbeats.
+func serializeEnvironment(sessionPublicKey []byte) ([]byte, error) {
+	serialized, err := config.SerializeEnvironment("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize environment: %w", err)
+	}
+	environment := map[string]string{}
+	if err := json.Unmarshal(serialized, &environment); err != nil {
+		return nil, fmt.Errorf("failed to serialize environment: %w", err)
+	}
+	environment[watchdog.HeartbeatVersionEnvVar] = strconv.Itoa(watchdog.HeartbeatVersion)
+	environment[watchdog.SessionKeyEnvVar] = base64.StdEncoding.EncodeToString(sessionPublicKey)
+	serialized, err = json.Marshal(environment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize environment: %w", err)
+	}
+	return serialized, nil
 }
 
 // Run runs the bridge by starting all client and server tunnels.
@@ -151,26 +282,52 @@ func (b *Bridge) Run(ctx context.Context) error {
 
 	// Set up server tunnels.
 	for _, serversSettings := range b.settings.Servers {
-		serverTunnel := tunnel.NewServerTunnel(serversSettings.EnclaveCID, serversSettings.EnclaveListenPort, logger.With().Str("component", "server-tunnel").Logger())
+		serverTunnel, err := tunnel.NewServerTunnelFromSettings(&serversSettings, logger.With().Str("component", "server-tunnel").Logger())
+		if err != nil {
+			return fmt.Errorf("failed to create server tunnel: %w", err)
+		}
+		serverTunnel.SetTracer(b.tracer)
+		b.deploy.addServer(serversSettings.BridgeTCPPort, serverTunnel)
 		portStr := strconv.FormatUint(uint64(serversSettings.BridgeTCPPort), 10)
 		logger.Info().Str("port", portStr).Msgf("Starting Bridge server")
 		runServerTunnel(groupCtx, serverTunnel, ":"+portStr, group)
+		group.Go(func() error {
+			return serverTunnel.RunHealthChecks(groupCtx)
+		})
+		group.Go(func() error {
+			return serverTunnel.RunWarmPool(groupCtx)
+		})
 	}
 
 	// Set up client tunnels.
-	for _, clientSettings := range b.settings.Clients {
-		clientTunnel := tunnel.NewClientTunnel(clientSettings.EnclaveDialPort, clientSettings.RequestTimeout, logger.With().Str("component", "client-tunnel").Logger())
-		portStr := strconv.FormatUint(uint64(clientSettings.EnclaveDialPort), 10)
-		logger.Info().Str("port", portStr).Msgf("Starting Bridge client")
-		runClientTunnel(groupCtx, clientTunnel, group)
+	b.aliases, err = newAliasTable(groupCtx, &logger, group)
+	if err != nil {
+		return fmt.Errorf("failed to create alias table: %w", err)
+	}
+	b.auditLog, err = newAuditLog(groupCtx, &logger, group)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	b.watchdogActions, err = loadWatchdogActions(&logger)
+	if err != nil {
+		return fmt.Errorf("failed to load watchdog actions: %w", err)
+	}
+	err = b.startClientTunnels(groupCtx, b.settings, group)
+	if err != nil {
+		return err
 	}
 
-	watchDog, err := watchdog.New(&b.settings.Watchdog)
+	active, err := newGeneration(groupCtx, b.settings, b.cid, b.sessionKey)
 	if err != nil {
-		return fmt.Errorf("failed to create watchdog: %w", err)
+		return err
 	}
+	b.deploy.activate(active)
+	b.runWatchdog(active)
+	group.Go(func() error {
+		return b.deploy.waitFatal(groupCtx)
+	})
 	group.Go(func() error {
-		return watchDog.StartServerSide(groupCtx, b.listener)
+		return b.acceptInitConns(groupCtx, group)
 	})
 
 	err = b.readyFunc()
@@ -185,6 +342,235 @@ func (b *Bridge) Run(ctx context.Context) error {
 	return nil
 }
 
+// startClientTunnels starts a client tunnel for every port of settings, and the DNS tunnel if configured,
+// that is not already being served. Ports that are already served must use the same settings, since the running
+// tunnel keeps serving them.
+func (b *Bridge) startClientTunnels(ctx context.Context, settings *config.BridgeSettings, group *errgroup.Group) error {
+	logger := zerolog.Ctx(ctx)
+	for _, clientSettings := range settings.Clients {
+		claimed, err := b.deploy.claimClientPort(clientSettings.EnclaveDialPort, clientPort{appName: settings.AppName, settings: clientSettings})
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+		clientTunnel, err := tunnel.NewClientTunnelFromSettings(&clientSettings, logger.With().Str("component", "client-tunnel").Logger())
+		if err != nil {
+			return fmt.Errorf("failed to create client tunnel: %w", err)
+		}
+		clientTunnel.SetAliases(b.aliases)
+		clientTunnel.SetTracer(b.tracer)
+		if b.auditLog != nil {
+			clientTunnel.SetAuditLog(b.auditLog, settings.AppName)
+		}
+		portStr := strconv.FormatUint(uint64(clientSettings.EnclaveDialPort), 10)
+		logger.Info().Str("port", portStr).Msgf("Starting Bridge client")
+		runClientTunnel(ctx, clientTunnel, group)
+	}
+	if settings.DNS.EnclaveDialPort == 0 {
+		return nil
+	}
+	claimed, err := b.deploy.claimClientPort(settings.DNS.EnclaveDialPort, clientPort{appName: settings.AppName, settings: settings.DNS})
+	if err != nil || !claimed {
+		return err
+	}
+	dnsTunnel, err := tunnel.NewDNSTunnel(&settings.DNS, logger.With().Str("component", "dns-tunnel").Logger())
+	if err != nil {
+		return fmt.Errorf("failed to create DNS tunnel: %w", err)
+	}
+	runClientTunnel(ctx, dnsTunnel, group)
+	return nil
+}
+
+// runWatchdog runs the watchdog of an enclave until its context is canceled. A failure discards a standby or
+// previous enclave. For the active enclave the watchdog actions are taken, and unless one of them exits the bridge,
+// the watchdog keeps watching, so alerts repeat until heartbeats resume.
+func (b *Bridge) runWatchdog(gen *generation) {
+	go func() {
+		for {
+			err := gen.watchdog.Run(gen.ctx)
+			if err == nil {
+				return
+			}
+			logger := zerolog.Ctx(gen.ctx).With().Str("enclaveId", gen.watchdog.EnclaveID().String()).Logger()
+			logger.Error().Err(err).Msg("Enclave watchdog failed")
+			if !b.deploy.isActive(gen) {
+				b.deploy.discard(gen)
+				return
+			}
+			exitCode, exit := b.watchdogActions.Run(gen.ctx, watchdogFailure{
+				AppName:   gen.settings.AppName,
+				EnclaveID: gen.watchdog.EnclaveID(),
+				Error:     err.Error(),
+				Time:      time.Now(),
+			})
+			if exit {
+				b.deploy.fail(&exitError{code: exitCode, err: err})
+				return
+			}
+			logger.Warn().Msg("Keeping the bridge up after the enclave watchdog failed")
+		}
+	}()
+}
+
+// acceptInitConns accepts connections on the init port. A connection that starts with an ACK is a handshake
+// from a new enclave, any other connection carries watchdog heartbeats.
+func (b *Bridge) acceptInitConns(ctx context.Context, group *errgroup.Group) error {
+	logger := zerolog.Ctx(ctx)
+	go func() {
+		<-ctx.Done()
+		_ = b.listener.Close() //nolint:errcheck
+	}()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			logger.Error().Err(err).Msg("Failed to accept init connection")
+			continue
+		}
+		go b.handleInitConn(ctx, conn, group)
+	}
+}
+
+func (b *Bridge) handleInitConn(ctx context.Context, conn net.Conn, group *errgroup.Group) {
+	// The first message must arrive within readTimeout, so idle connections do not hold a goroutine.
+	_ = conn.SetReadDeadline(time.Now().Add(readTimeout))
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	reader := bufio.NewReaderSize(conn, initReadBufferSize)
+	firstLine, err := readLine(reader)
+	stop()
+	if err != nil {
+		_ = conn.Close()
+		zerolog.Ctx(ctx).Debug().Err(err).Msg("Failed to read first message on init connection")
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if bytes.Equal(firstLine, enclave.ACK) {
+		b.handleStandbyHandshake(ctx, &replayConn{Conn: conn, reader: reader}, group)
+		return
+	}
+	var enclaveID uuid.UUID
+	if heartbeat, err := watchdog.ParseHeartbeat(firstLine[:len(firstLine)-1]); err == nil {
+		enclaveID = heartbeat.EnclaveID
+	}
+	gen := b.deploy.generationFor(enclaveID)
+	err = gen.watchdog.HandleConn(gen.ctx, &replayConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(firstLine), reader)})
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Str("enclaveId", enclaveID.String()).Msg("Closed watchdog connection")
+	}
+}
+
+// handleStandbyHandshake completes the handshake of a new enclave and holds it as standby.
+// Once all of its server targets accept connections, it can be promoted with POST /deployment/promote on the
+// operator server, which starts its client tunnels and switches new server tunnel connections to it.
+// Any process that can reach the init port can complete a handshake, so standbys are never promoted automatically
+// and are rejected while another standby waits.
+func (b *Bridge) handleStandbyHandshake(ctx context.Context, conn net.Conn, group *errgroup.Group) {
+	logger := zerolog.Ctx(ctx)
+	logger.Info().Msg("Received handshake from standby enclave")
+	standby, err := completeHandshake(ctx, logger, conn, b.requireAuthenticatedHeartbeats)
+	if err == nil {
+		err = b.deploy.checkCompatible(standby.settings)
+	}
+	var gen *generation
+	if err == nil {
+		gen, err = newGeneration(ctx, standby.settings, standby.cid, standby.sessionKey)
+	}
+	if err != nil {
+		_ = conn.Close()
+		logger.Error().Err(err).Msg("Rejected standby enclave")
+		return
+	}
+	gen.startClientTunnels = func() error {
+		return b.startClientTunnels(ctx, standby.settings, group)
+	}
+	if err := b.deploy.setStandby(gen); err != nil {
+		gen.cancel()
+		_ = conn.Close()
+		logger.Error().Err(err).Msg("Rejected standby enclave")
+		return
+	}
+	standbyLogger := logger.With().Str("enclaveId", gen.watchdog.EnclaveID().String()).Logger()
+	b.stdout.SetAppName(standby.cid, standby.settings.AppName)
+	b.runWatchdog(gen)
+	err = standby.readyFunc()
+	if err != nil {
+		b.deploy.discard(gen)
+		standbyLogger.Error().Err(err).Msg("Failed to ACK to standby enclave")
+		return
+	}
+	err = b.waitForStandby(gen)
+	if err == nil {
+		err = b.deploy.markHealthy(gen)
+	}
+	if err != nil {
+		b.deploy.discard(gen)
+		standbyLogger.Error().Err(err).Msg("Standby enclave did not become healthy")
+		return
+	}
+	standbyLogger.Info().Msg("Standby enclave is healthy and waiting to be promoted")
+}
+
+// waitForStandby waits until every server target of the standby enclave passes consecutive probes.
+func (b *Bridge) waitForStandby(gen *generation) error {
+	ctx, cancel := context.WithTimeout(gen.ctx, standbyHealthyTimeout)
+	defer cancel()
+	ticker := time.NewTicker(standbyProbeInterval)
+	defer ticker.Stop()
+	successes := 0
+	for successes < standbyHealthyProbes {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("standby enclave was not healthy within %s: %w", standbyHealthyTimeout, ctx.Err())
+		case <-ticker.C:
+		}
+		err := b.deploy.probeStandby(ctx, gen)
+		if errors.Is(err, errStandbyReplaced) {
+			return err
+		}
+		if err != nil {
+			successes = 0
+			continue
+		}
+		successes++
+	}
+	return nil
+}
+
+// readLine reads a single line of at most maxInitLineLength bytes from reader.
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxInitLineLength {
+			return nil, errors.New("init message too long")
+		}
+		if err == nil {
+			return line, nil
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+	}
+}
+
+// replayConn is a net.Conn that replays bytes that were already read from it.
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+// Read reads the replayed bytes first and then from the connection.
+func (r *replayConn) Read(p []byte) (int, error) {
+	return r.reader.Read(p)
+}
+
 // runFiber runs a fiber server and returns a context that can be used to stop the server.
 func runFiber(ctx context.Context, fiberApp *fiber.App, addr string, group *errgroup.Group) {
 	group.Go(func() error {
@@ -237,6 +623,207 @@ func runServerTunnel(ctx context.Context, target tcpproxy.Target, addr string, g
 	})
 }
 
+// newAliasTable creates the alias table from the file named by AliasesFileEnvVar.
+// The file is reloaded whenever the bridge receives SIGHUP so backends can change without restarting the enclave.
+func newAliasTable(ctx context.Context, logger *zerolog.Logger, group *errgroup.Group) (*tunnel.AliasTable, error) {
+	aliasFile := os.Getenv(AliasesFileEnvVar)
+	if aliasFile == "" {
+		return tunnel.NewAliasTable(nil)
+	}
+	settings, err := config.LoadAliasSettings(aliasFile)
+	if err != nil {
+		return nil, err
+	}
+	aliases, err := tunnel.NewAliasTable(settings)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info().Int("aliases", len(settings)).Msgf("Loaded upstream aliases from %s", aliasFile)
+
+	group.Go(func() error {
+		reloadChan := make(chan os.Signal, 1)
+		signal.Notify(reloadChan, syscall.SIGHUP)
+		defer signal.Stop(reloadChan)
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-reloadChan:
+				settings, err := config.LoadAliasSettings(aliasFile)
+				if err == nil {
+					err = aliases.Update(settings)
+				}
+				if err != nil {
+					logger.Error().Err(err).Msg("Failed to reload upstream aliases, keeping previous aliases")
+					continue
+				}
+				logger.Info().Int("aliases", len(settings)).Msg("Reloaded upstream aliases")
+			}
+		}
+	})
+	return aliases, nil
+}
+
+// newLogSink creates the sink of forwarded enclave logs from the file named by LogSinksFileEnvVar.
+// It returns stdout if no log sinks are configured. The sinks are flushed and closed on shutdown.
+func newLogSink(ctx context.Context, stdout *logs.WriterSink, logger *zerolog.Logger, group *errgroup.Group) (logs.Sink, error) {
+	sinkFile := os.Getenv(LogSinksFileEnvVar)
+	if sinkFile == "" {
+		return stdout, nil
+	}
+	settings, err := config.LoadLogSinkSettings(sinkFile)
+	if err != nil {
+		return nil, err
+	}
+	fanOut, err := logs.NewFanOutFromSettings(settings, stdout, logger.With().Str("component", "log-sinks").Logger())
+	if err != nil {
+		return nil, err
+	}
+	logger.Info().Int("sinks", len(settings)).Msgf("Forwarding enclave logs to sinks from %s", sinkFile)
+
+	group.Go(func() error {
+		<-ctx.Done()
+		flushCtx, cancel := context.WithTimeout(context.Background(), logSinkFlushTimeout)
+		defer cancel()
+		if err := fanOut.Close(flushCtx); err != nil {
+			logger.Warn().Err(err).Msg("Failed to flush log sinks")
+		}
+		return nil
+	})
+	return fanOut, nil
+}
+
+// newLogRedactor creates the redactor of forwarded enclave logs from the file named by LogRedactionFileEnvVar.
+// It returns nil if no redaction rules are configured.
+func newLogRedactor(logger *zerolog.Logger) (*redact.Redactor, error) {
+	redactionFile := os.Getenv(LogRedactionFileEnvVar)
+	if redactionFile == "" {
+		return nil, nil
+	}
+	settings, err := config.LoadLogRedactionSettings(redactionFile)
+	if err != nil {
+		return nil, err
+	}
+	redactor, err := redact.New(settings)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info().Int("patterns", len(settings.Patterns)).Int("fields", len(settings.Fields)).
+		Msgf("Loaded log redaction rules from %s", redactionFile)
+	return redactor, nil
+}
+
+// newTracer creates the tracer of tunnel connections exporting to the endpoint named by TracesEndpointEnvVar.
+// It returns the global no-op tracer if tracing is not configured. Queued spans are exported on shutdown.
+func newTracer(ctx context.Context, logger *zerolog.Logger, group *errgroup.Group) (trace.Tracer, error) {
+	endpoint := os.Getenv(TracesEndpointEnvVar)
+	if endpoint == "" {
+		return otel.Tracer(tracing.ScopeName), nil
+	}
+	provider, err := tracing.NewTracerProvider(tracerServiceName, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	exporterLogger := logger.With().Str("component", "tracing").Logger()
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		exporterLogger.Warn().Err(err).Msg("Failed to export spans")
+	}))
+	logger.Info().Msgf("Exporting spans to %s", endpoint)
+	group.Go(func() error {
+		<-ctx.Done()
+		flushCtx, cancel := context.WithTimeout(context.Background(), traceFlushTimeout)
+		defer cancel()
+		if err := provider.Shutdown(flushCtx); err != nil {
+			logger.Warn().Err(err).Msg("Failed to export spans")
+		}
+		return nil
+	})
+	return provider.Tracer(tracing.ScopeName), nil
+}
+
+// loadWatchdogActions loads the watchdog actions named by WatchdogActionsFileEnvVar, or the default exit action.
+func loadWatchdogActions(logger *zerolog.Logger) (*watchdogActions, error) {
+	settings := defaultWatchdogActionSettings()
+	actionsFile := os.Getenv(WatchdogActionsFileEnvVar)
+	if actionsFile != "" {
+		var err error
+		settings, err = config.LoadWatchdogActionSettings(actionsFile)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info().Int("actions", len(settings)).Msgf("Loaded watchdog actions from %s", actionsFile)
+	}
+	return newWatchdogActions(settings, logger.With().Str("component", "watchdog-actions").Logger())
+}
+
+// newAuditLog opens the egress audit log named by AuditLogFileEnvVar. It returns nil if no audit log is configured.
+func newAuditLog(ctx context.Context, logger *zerolog.Logger, group *errgroup.Group) (*audit.Log, error) {
+	auditFile := os.Getenv(AuditLogFileEnvVar)
+	if auditFile == "" {
+		return nil, nil
+	}
+	if auditFile == "-" {
+		logger.Info().Msg("Writing egress audit log to stdout")
+		return audit.NewLog(os.Stdout, ""), nil
+	}
+	maxBytes, err := getEnvInt(AuditLogMaxBytesEnvVar, defaultAuditLogMaxBytes)
+	if err != nil {
+		return nil, err
+	}
+	maxFiles, err := getEnvInt(AuditLogMaxFilesEnvVar, defaultAuditLogMaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	auditLog, err := audit.OpenFileLog(auditFile, maxBytes, int(maxFiles))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info().Msgf("Writing egress audit log to %s", auditFile)
+	group.Go(func() error {
+		<-ctx.Done()
+		if err := auditLog.Close(); err != nil {
+			return fmt.Errorf("failed to close audit log: %w", err)
+		}
+		return nil
+	})
+	return auditLog, nil
+}
+
+func getEnvInt(envVar string, defaultValue int64) (int64, error) {
+	value := os.Getenv(envVar)
+	if value == "" {
+		return defaultValue, nil
+	}
+	valueInt64, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to convert %s to int: %w", envVar, err)
+	}
+	return valueInt64, nil
+}
+
+func getEnvBool(envVar string) (bool, error) {
+	value := os.Getenv(envVar)
+	if value == "" {
+		return false, nil
+	}
+	valueBool, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("failed to convert %s to bool: %w", envVar, err)
+	}
+	return valueBool, nil
+}
+
+// getEnvList returns the comma separated values of envVar without surrounding spaces and empty values.
+func getEnvList(envVar string) []string {
+	var values []string
+	for value := range strings.SplitSeq(os.Getenv(envVar), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
 func getInitPort() (uint32, error) {
 	initPort := os.Getenv(InitPortEnvVar)
 	if initPort == "" {
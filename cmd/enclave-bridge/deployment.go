@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tunnel"
+	"github.com/DIMO-Network/enclave-bridge/pkg/watchdog"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofrs/uuid"
+)
+
+var (
+	errNoActiveEnclave   = errors.New("no active enclave")
+	errNoPreviousEnclave = errors.New("no previous enclave to roll back to")
+	errStandbyReplaced   = errors.New("standby enclave was replaced or discarded")
+	errNoStandbyEnclave  = errors.New("no standby enclave to promote")
+	errStandbyWaiting    = errors.New("a standby enclave is already waiting to be promoted or discarded")
+	errStandbyNotHealthy = errors.New("standby enclave has not passed its health checks yet")
+)
+
+// generation is an enclave that completed a handshake with the bridge.
+type generation struct {
+	settings *config.BridgeSettings
+	watchdog *watchdog.Watchdog
+	// cid is the context ID the enclave connected from.
+	cid       uint32
+	ctx       context.Context //nolint:containedctx // The context bounds the lifetime of the generation's watchdog.
+	cancel    context.CancelFunc
+	startedAt time.Time
+	// healthy is set once a standby enclave passed its health checks. It is guarded by the deployment's lock.
+	healthy bool
+	// startClientTunnels starts the client tunnels of a standby enclave when it is promoted.
+	startClientTunnels func() error
+}
+
+// newGeneration creates the generation of an enclave. Its heartbeats are authenticated with sessionKey if it is set.
+func newGeneration(ctx context.Context, settings *config.BridgeSettings, cid uint32, sessionKey []byte) (*generation, error) {
+	var opts []watchdog.Option
+	if sessionKey != nil {
+		opts = append(opts, watchdog.WithSessionKey(sessionKey))
+	}
+	watchDog, err := watchdog.New(&settings.Watchdog, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watchdog: %w", err)
+	}
+	genCtx, cancel := context.WithCancel(ctx)
+	return &generation{
+		settings:  settings,
+		watchdog:  watchDog,
+		cid:       cid,
+		ctx:       genCtx,
+		cancel:    cancel,
+		startedAt: time.Now(),
+	}, nil
+}
+
+// deployment tracks the enclaves served by the bridge.
+// The active enclave receives new server tunnel connections, a standby enclave waits to become healthy
+// before it is promoted, and the previous enclave drains its connections and can be rolled back to.
+type deployment struct {
+	mu          sync.Mutex
+	active      *generation
+	standby     *generation
+	previous    *generation
+	servers     map[uint32]*tunnel.ServerTunnel
+	clientPorts map[uint32]clientPort
+	fatalChan   chan error
+}
+
+// clientPort is the settings a client or DNS tunnel was started with. Tunnels keep running across promotions,
+// so a standby enclave can only share a port whose tunnel was started with the same settings.
+type clientPort struct {
+	// appName is the app name the tunnel writes to the audit log.
+	appName string
+	// settings is the config.ClientSettings or config.DNSSettings of the tunnel.
+	settings any
+}
+
+func newDeployment() *deployment {
+	return &deployment{
+		servers:     map[uint32]*tunnel.ServerTunnel{},
+		clientPorts: map[uint32]clientPort{},
+		fatalChan:   make(chan error, 1),
+	}
+}
+
+// addServer registers the server tunnel that serves a bridge TCP port.
+func (d *deployment) addServer(bridgePort uint32, serverTunnel *tunnel.ServerTunnel) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.servers[bridgePort] = serverTunnel
+}
+
+// claimClientPort returns true if no client tunnel has been started for the port yet. It returns an error if
+// the tunnel of the port was started with different settings.
+func (d *deployment) claimClientPort(port uint32, owner clientPort) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if existing, ok := d.clientPorts[port]; ok {
+		if !reflect.DeepEqual(existing, owner) {
+			return false, fmt.Errorf("client tunnel on enclave dial port %d was started with different settings", port)
+		}
+		return false, nil
+	}
+	d.clientPorts[port] = owner
+	return true, nil
+}
+
+// activate sets the first active enclave.
+func (d *deployment) activate(gen *generation) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.active = gen
+}
+
+// generationFor returns the enclave with the given ID, or the active enclave if no enclave matches.
+func (d *deployment) generationFor(enclaveID uuid.UUID) *generation {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, gen := range []*generation{d.active, d.standby, d.previous} {
+		if gen != nil && gen.watchdog.EnclaveID() == enclaveID {
+			return gen
+		}
+	}
+	return d.active
+}
+
+// checkCompatible returns an error if settings do not serve exactly the same bridge TCP ports as the active enclave,
+// change anything but the targets of a server tunnel, or use a running client tunnel with different settings.
+// Promotion only switches the targets of the running server tunnels, so any other change would be dropped.
+func (d *deployment) checkCompatible(settings *config.BridgeSettings) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	active := map[uint32]config.ServerSettings{}
+	if d.active != nil {
+		for _, server := range d.active.settings.Servers {
+			active[server.BridgeTCPPort] = server
+		}
+	}
+	ports := make([]uint32, 0, len(settings.Servers))
+	for _, server := range settings.Servers {
+		if _, ok := d.servers[server.BridgeTCPPort]; !ok {
+			return fmt.Errorf("bridge TCP port %d is not served by the active enclave", server.BridgeTCPPort)
+		}
+		if running, ok := active[server.BridgeTCPPort]; ok && !reflect.DeepEqual(withoutTargets(running), withoutTargets(server)) {
+			return fmt.Errorf("server tunnel on bridge TCP port %d has different settings than the running tunnel",
+				server.BridgeTCPPort)
+		}
+		ports = append(ports, server.BridgeTCPPort)
+	}
+	for port := range d.servers {
+		if !slices.Contains(ports, port) {
+			return fmt.Errorf("bridge TCP port %d is missing from the standby enclave", port)
+		}
+	}
+	for port, owner := range clientPorts(settings) {
+		if existing, ok := d.clientPorts[port]; ok && !reflect.DeepEqual(existing, owner) {
+			return fmt.Errorf("client tunnel on enclave dial port %d has different settings than the running tunnel", port)
+		}
+	}
+	return nil
+}
+
+// withoutTargets returns server without the targets that a promotion switches.
+func withoutTargets(server config.ServerSettings) config.ServerSettings {
+	server.EnclaveCID, server.EnclaveListenPort, server.Targets = 0, 0, nil
+	return server
+}
+
+// clientPorts returns the client and DNS tunnels of settings by enclave dial port.
+func clientPorts(settings *config.BridgeSettings) map[uint32]clientPort {
+	ports := make(map[uint32]clientPort, len(settings.Clients)+1)
+	for _, client := range settings.Clients {
+		ports[client.EnclaveDialPort] = clientPort{appName: settings.AppName, settings: client}
+	}
+	if settings.DNS.EnclaveDialPort != 0 {
+		ports[settings.DNS.EnclaveDialPort] = clientPort{appName: settings.AppName, settings: settings.DNS}
+	}
+	return ports
+}
+
+// setStandby sets the standby enclave. Any process that can reach the init port can complete a handshake, so
+// an existing standby is never replaced; the operator discards it first.
+func (d *deployment) setStandby(gen *generation) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.standby != nil {
+		return errStandbyWaiting
+	}
+	d.standby = gen
+	return nil
+}
+
+// discardStandby stops tracking the standby enclave, so another enclave can become the standby.
+func (d *deployment) discardStandby() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.standby == nil {
+		return errNoStandbyEnclave
+	}
+	d.standby.cancel()
+	d.standby = nil
+	return nil
+}
+
+// probeStandby dials every server target of the standby enclave once.
+func (d *deployment) probeStandby(ctx context.Context, gen *generation) error {
+	d.mu.Lock()
+	if d.standby != gen {
+		d.mu.Unlock()
+		return errStandbyReplaced
+	}
+	servers := make([]*tunnel.ServerTunnel, len(gen.settings.Servers))
+	for i, server := range gen.settings.Servers {
+		servers[i] = d.servers[server.BridgeTCPPort]
+	}
+	d.mu.Unlock()
+
+	var errs []error
+	for i, server := range gen.settings.Servers {
+		errs = append(errs, servers[i].Probe(ctx, server.EnclaveTargets()))
+	}
+	return errors.Join(errs...)
+}
+
+// markHealthy records that the standby enclave passed its health checks, so it can be promoted.
+func (d *deployment) markHealthy(gen *generation) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.standby != gen {
+		return errStandbyReplaced
+	}
+	gen.healthy = true
+	return nil
+}
+
+// promoteStandby promotes the standby enclave once it passed its health checks. Its client tunnels are
+// started first, so a standby that is never promoted never serves the enclave's outbound connections.
+func (d *deployment) promoteStandby() error {
+	d.mu.Lock()
+	gen := d.standby
+	var err error
+	switch {
+	case gen == nil:
+		err = errNoStandbyEnclave
+	case !gen.healthy:
+		err = errStandbyNotHealthy
+	}
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if gen.startClientTunnels != nil {
+		if err := gen.startClientTunnels(); err != nil {
+			return fmt.Errorf("failed to start client tunnels of standby enclave: %w", err)
+		}
+	}
+	return d.promote(gen)
+}
+
+// promote atomically switches new server tunnel connections to the standby enclave.
+// The active enclave becomes the previous enclave and keeps serving its open connections.
+func (d *deployment) promote(gen *generation) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.standby != gen {
+		return errStandbyReplaced
+	}
+	d.switchServers(gen)
+	if d.previous != nil {
+		d.previous.cancel()
+	}
+	d.previous, d.active, d.standby = d.active, gen, nil
+	return nil
+}
+
+// rollback switches new server tunnel connections back to the previous enclave.
+func (d *deployment) rollback() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.previous == nil {
+		return errNoPreviousEnclave
+	}
+	d.switchServers(d.previous)
+	d.active, d.previous = d.previous, d.active
+	return nil
+}
+
+// switchServers points every server tunnel at the targets of gen. Must be called with the lock held.
+func (d *deployment) switchServers(gen *generation) {
+	for _, server := range gen.settings.Servers {
+		d.servers[server.BridgeTCPPort].SetTargets(server.EnclaveTargets())
+	}
+}
+
+// discard stops tracking gen if it is the standby or previous enclave.
+func (d *deployment) discard(gen *generation) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch gen {
+	case d.standby:
+		d.standby = nil
+	case d.previous:
+		d.previous = nil
+	}
+	gen.cancel()
+}
+
+// isActive reports whether gen is the active enclave.
+func (d *deployment) isActive(gen *generation) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return gen == d.active
+}
+
+// fail stops the bridge with err.
+func (d *deployment) fail(err error) {
+	select {
+	case d.fatalChan <- err:
+	default:
+	}
+}
+
+// exitError stops the bridge with an exit code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+
+func (e *exitError) Unwrap() error { return e.err }
+
+// waitFatal blocks until the active enclave fails or the context is canceled.
+func (d *deployment) waitFatal(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-d.fatalChan:
+		return err
+	}
+}
+
+// generationStatus describes an enclave tracked by the deployment.
+type generationStatus struct {
+	AppName   string    `json:"appName"`
+	EnclaveID uuid.UUID `json:"enclaveId"`
+	StartedAt time.Time `json:"startedAt"`
+	// AuthenticatedHeartbeats reports whether the enclave authenticates its heartbeats with a session key.
+	AuthenticatedHeartbeats bool `json:"authenticatedHeartbeats"`
+}
+
+// deploymentStatus is the response of the deployment status endpoint.
+type deploymentStatus struct {
+	Active   *generationStatus `json:"active"`
+	Standby  *generationStatus `json:"standby"`
+	Previous *generationStatus `json:"previous"`
+	// StandbyHealthy reports whether the standby enclave passed its health checks and can be promoted.
+	StandbyHealthy bool `json:"standbyHealthy"`
+	// ActiveConnections is the number of open connections to the active enclave by bridge TCP port.
+	ActiveConnections map[uint32]int64 `json:"activeConnections"`
+}
+
+func (d *deployment) status() deploymentStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := deploymentStatus{
+		Active:            d.active.status(),
+		Standby:           d.standby.status(),
+		Previous:          d.previous.status(),
+		StandbyHealthy:    d.standby != nil && d.standby.healthy,
+		ActiveConnections: make(map[uint32]int64, len(d.servers)),
+	}
+	for port, server := range d.servers {
+		status.ActiveConnections[port] = server.ActiveConnections()
+	}
+	return status
+}
+
+func (g *generation) status() *generationStatus {
+	if g == nil {
+		return nil
+	}
+	return &generationStatus{
+		AppName:                 g.settings.AppName,
+		EnclaveID:               g.watchdog.EnclaveID(),
+		StartedAt:               g.startedAt,
+		AuthenticatedHeartbeats: g.watchdog.Authenticated(),
+	}
+}
+
+// registerDeploymentRoutes adds the read-only deployment status route to the monitoring server.
+func registerDeploymentRoutes(app *fiber.App, deploy *deployment) {
+	app.Get("/deployment", func(ctx *fiber.Ctx) error {
+		status := deploy.status()
+		if status.Active == nil {
+			return fiber.NewError(fiber.StatusServiceUnavailable, errNoActiveEnclave.Error())
+		}
+		return ctx.JSON(status)
+	})
+}
+
+// registerOperatorRoutes adds the promote, rollback and discard routes to the operator server.
+// If token is set, requests must carry it as a bearer token.
+func registerOperatorRoutes(app *fiber.App, deploy *deployment, token string) {
+	if token != "" {
+		app.Use(func(ctx *fiber.Ctx) error {
+			provided, ok := strings.CutPrefix(ctx.Get(fiber.HeaderAuthorization), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+				return fiber.NewError(fiber.StatusUnauthorized, "missing or invalid operator token")
+			}
+			return ctx.Next()
+		})
+	}
+	app.Post("/deployment/promote", func(ctx *fiber.Ctx) error {
+		err := deploy.promoteStandby()
+		switch {
+		case errors.Is(err, errNoStandbyEnclave), errors.Is(err, errStandbyNotHealthy), errors.Is(err, errStandbyReplaced):
+			return fiber.NewError(fiber.StatusConflict, err.Error())
+		case err != nil:
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+		return ctx.JSON(deploy.status())
+	})
+	app.Post("/deployment/rollback", func(ctx *fiber.Ctx) error {
+		if err := deploy.rollback(); err != nil {
+			return fiber.NewError(fiber.StatusConflict, err.Error())
+		}
+		return ctx.JSON(deploy.status())
+	})
+	app.Post("/deployment/discard", func(ctx *fiber.Ctx) error {
+		if err := deploy.discardStandby(); err != nil {
+			return fiber.NewError(fiber.StatusConflict, err.Error())
+		}
+		return ctx.JSON(deploy.status())
+	})
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tunnel"
+	"github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testBridgePort = uint32(8080)
+	testClientPort = uint32(6000)
+)
+
+// newTestGeneration creates a generation of an enclave with the given CID that serves bridgePorts and dials
+// out through a client tunnel on testClientPort.
+func newTestGeneration(t *testing.T, cid uint32, bridgePorts ...uint32) *generation {
+	t.Helper()
+	settings := &config.BridgeSettings{
+		AppName: "test-app",
+		Watchdog: config.WatchdogSettings{
+			EnclaveID: uuid.Must(uuid.NewV4()),
+			Interval:  time.Minute,
+		},
+		Clients: []config.ClientSettings{{EnclaveDialPort: testClientPort}},
+	}
+	for _, port := range bridgePorts {
+		settings.Servers = append(settings.Servers, config.ServerSettings{
+			EnclaveCID:        cid,
+			EnclaveListenPort: port + 1,
+			BridgeTCPPort:     port,
+		})
+	}
+	gen, err := newGeneration(t.Context(), settings, cid, nil)
+	require.NoError(t, err)
+	t.Cleanup(gen.cancel)
+	return gen
+}
+
+// newTestDeployment creates a deployment whose server and client tunnels were started by active.
+func newTestDeployment(t *testing.T, active *generation) *deployment {
+	t.Helper()
+	deploy := newDeployment()
+	for _, server := range active.settings.Servers {
+		deploy.addServer(server.BridgeTCPPort, tunnel.NewServerTunnel(server.EnclaveCID, server.EnclaveListenPort, zerolog.Nop()))
+	}
+	for port, owner := range clientPorts(active.settings) {
+		started, err := deploy.claimClientPort(port, owner)
+		require.NoError(t, err)
+		require.True(t, started)
+	}
+	deploy.activate(active)
+	return deploy
+}
+
+func TestDeploymentTransitions(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name string
+		// setup prepares the deployment before action runs. The standby generation is not tracked unless setup
+		// sets it.
+		setup    func(t *testing.T, deploy *deployment, standby *generation)
+		action   func(deploy *deployment) error
+		wantErr  error
+		promoted bool
+	}{
+		{
+			name:    "promote without standby",
+			action:  (*deployment).promoteStandby,
+			wantErr: errNoStandbyEnclave,
+		},
+		{
+			name: "promote unhealthy standby",
+			setup: func(_ *testing.T, deploy *deployment, standby *generation) {
+				require.NoError(t, deploy.setStandby(standby))
+			},
+			action:  (*deployment).promoteStandby,
+			wantErr: errStandbyNotHealthy,
+		},
+		{
+			name: "promote healthy standby",
+			setup: func(t *testing.T, deploy *deployment, standby *generation) {
+				require.NoError(t, deploy.setStandby(standby))
+				require.NoError(t, deploy.markHealthy(standby))
+			},
+			action:   (*deployment).promoteStandby,
+			promoted: true,
+		},
+		{
+			name: "handshake while standby waits",
+			setup: func(t *testing.T, deploy *deployment, standby *generation) {
+				require.NoError(t, deploy.setStandby(standby))
+				require.NoError(t, deploy.markHealthy(standby))
+				// Another handshake must not replace the healthy standby before the operator promotes it.
+				require.ErrorIs(t, deploy.setStandby(newTestGeneration(t, 18, testBridgePort)), errStandbyWaiting)
+			},
+			action:   (*deployment).promoteStandby,
+			promoted: true,
+		},
+		{
+			name: "discard standby",
+			setup: func(t *testing.T, deploy *deployment, standby *generation) {
+				require.NoError(t, deploy.setStandby(standby))
+			},
+			action: func(deploy *deployment) error {
+				if err := deploy.discardStandby(); err != nil {
+					return err
+				}
+				return deploy.promoteStandby()
+			},
+			wantErr: errNoStandbyEnclave,
+		},
+		{
+			name:    "rollback without previous",
+			action:  (*deployment).rollback,
+			wantErr: errNoPreviousEnclave,
+		},
+		{
+			name: "rollback after promotion",
+			setup: func(t *testing.T, deploy *deployment, standby *generation) {
+				require.NoError(t, deploy.setStandby(standby))
+				require.NoError(t, deploy.markHealthy(standby))
+				require.NoError(t, deploy.promoteStandby())
+			},
+			action: (*deployment).rollback,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			active := newTestGeneration(t, 16, testBridgePort)
+			standby := newTestGeneration(t, 17, testBridgePort)
+			deploy := newTestDeployment(t, active)
+			if tc.setup != nil {
+				tc.setup(t, deploy, standby)
+			}
+			err := tc.action(deploy)
+			require.ErrorIs(t, err, tc.wantErr)
+			if tc.promoted {
+				require.Same(t, standby, deploy.active)
+				require.Same(t, active, deploy.previous)
+				require.Nil(t, deploy.standby)
+			} else {
+				require.Same(t, active, deploy.active)
+			}
+		})
+	}
+}
+
+func TestDeploymentCheckCompatible(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name    string
+		modify  func(settings *config.BridgeSettings)
+		wantErr string
+	}{
+		{
+			name: "same ports and settings",
+		},
+		{
+			name: "new client port",
+			modify: func(settings *config.BridgeSettings) {
+				settings.Clients = append(settings.Clients, config.ClientSettings{EnclaveDialPort: testClientPort + 1})
+			},
+		},
+		{
+			name: "missing server port",
+			modify: func(settings *config.BridgeSettings) {
+				settings.Servers = nil
+			},
+			wantErr: "bridge TCP port 8080 is missing from the standby enclave",
+		},
+		{
+			name: "extra server port",
+			modify: func(settings *config.BridgeSettings) {
+				settings.Servers = append(settings.Servers, config.ServerSettings{BridgeTCPPort: 9090})
+			},
+			wantErr: "bridge TCP port 9090 is not served by the active enclave",
+		},
+		{
+			name: "different targets",
+			modify: func(settings *config.BridgeSettings) {
+				settings.Servers[0].Targets = []config.EnclaveTarget{{CID: 17, Port: 5001}, {CID: 17, Port: 5002}}
+			},
+		},
+		{
+			name: "different server settings",
+			modify: func(settings *config.BridgeSettings) {
+				settings.Servers[0].LoadBalancing = config.LoadBalancingLeastConnections
+			},
+			wantErr: "server tunnel on bridge TCP port 8080 has different settings than the running tunnel",
+		},
+		{
+			name: "different mutual TLS settings",
+			modify: func(settings *config.BridgeSettings) {
+				settings.Servers[0].MutualTLS.Enabled = true
+			},
+			wantErr: "server tunnel on bridge TCP port 8080 has different settings than the running tunnel",
+		},
+		{
+			name: "different client settings",
+			modify: func(settings *config.BridgeSettings) {
+				settings.Clients[0].RequestTimeout = time.Second
+			},
+			wantErr: "client tunnel on enclave dial port 6000 has different settings than the running tunnel",
+		},
+		{
+			name: "different app name",
+			modify: func(settings *config.BridgeSettings) {
+				settings.AppName = "other-app"
+			},
+			wantErr: "client tunnel on enclave dial port 6000 has different settings than the running tunnel",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			deploy := newTestDeployment(t, newTestGeneration(t, 16, testBridgePort))
+			standby := newTestGeneration(t, 17, testBridgePort)
+			if tc.modify != nil {
+				tc.modify(standby.settings)
+			}
+			err := deploy.checkCompatible(standby.settings)
+			if tc.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestDeploymentClientPortHandover(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name    string
+		modify  func(settings *config.BridgeSettings)
+		wantErr bool
+	}{
+		{name: "same settings"},
+		{
+			name: "different settings",
+			modify: func(settings *config.BridgeSettings) {
+				settings.Clients[0].RequestTimeout = time.Second
+			},
+			wantErr: true,
+		},
+		{
+			name: "different app name",
+			modify: func(settings *config.BridgeSettings) {
+				settings.AppName = "other-app"
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			active := newTestGeneration(t, 16, testBridgePort)
+			deploy := newTestDeployment(t, active)
+			standby := newTestGeneration(t, 17, testBridgePort)
+			if tc.modify != nil {
+				tc.modify(standby.settings)
+			}
+			var started []uint32
+			standby.startClientTunnels = func() error {
+				for port, owner := range clientPorts(standby.settings) {
+					start, err := deploy.claimClientPort(port, owner)
+					if err != nil {
+						return err
+					}
+					if start {
+						started = append(started, port)
+					}
+				}
+				return nil
+			}
+			require.NoError(t, deploy.setStandby(standby))
+			require.NoError(t, deploy.markHealthy(standby))
+
+			err := deploy.promoteStandby()
+			if tc.wantErr {
+				require.Error(t, err)
+				require.Same(t, active, deploy.active)
+				return
+			}
+			require.NoError(t, err)
+			require.Same(t, standby, deploy.active)
+			// The running tunnel keeps serving the port instead of a second tunnel being started.
+			require.Empty(t, started)
+		})
+	}
+}
+
+func TestDeploymentDiscard(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name string
+		// discarded returns the generation to discard after the standby was promoted.
+		discarded func(deploy *deployment) *generation
+	}{
+		{name: "previous", discarded: func(deploy *deployment) *generation { return deploy.previous }},
+		{name: "standby", discarded: func(deploy *deployment) *generation { return deploy.standby }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			active := newTestGeneration(t, 16, testBridgePort)
+			deploy := newTestDeployment(t, active)
+			promoted := newTestGeneration(t, 17, testBridgePort)
+			require.NoError(t, deploy.setStandby(promoted))
+			require.NoError(t, deploy.markHealthy(promoted))
+			require.NoError(t, deploy.promoteStandby())
+			require.NoError(t, deploy.setStandby(newTestGeneration(t, 18, testBridgePort)))
+
+			gen := tc.discarded(deploy)
+			deploy.discard(gen)
+
+			require.ErrorIs(t, gen.ctx.Err(), context.Canceled)
+			require.Same(t, promoted, deploy.active)
+			require.NotSame(t, gen, deploy.previous)
+			require.NotSame(t, gen, deploy.standby)
+			// Heartbeats of the discarded enclave are no longer matched to it.
+			require.Same(t, promoted, deploy.generationFor(gen.watchdog.EnclaveID()))
+			if gen == active {
+				require.ErrorIs(t, deploy.rollback(), errNoPreviousEnclave)
+				require.Nil(t, deploy.status().Previous)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/watchdog"
+	"github.com/gofiber/fiber/v2"
+)
+
+// readinessStatus is the response of the readiness endpoint.
+type readinessStatus struct {
+	Ready bool `json:"ready"`
+	// Servers reports whether each server tunnel has at least one healthy target, by bridge TCP port.
+	Servers map[uint32]bool `json:"servers"`
+	// Enclave is the status the active enclave reported in its last heartbeat.
+	Enclave *enclaveStatus `json:"enclave,omitempty"`
+}
+
+// enclaveStatus is the last heartbeat of an enclave.
+type enclaveStatus struct {
+	*watchdog.HeartbeatMessage
+	LastHeartbeatAt time.Time `json:"lastHeartbeatAt"`
+}
+
+// readiness reports whether an enclave is active, every server tunnel has a healthy target and the active enclave
+// does not declare a state that fails readiness.
+func (d *deployment) readiness() readinessStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := readinessStatus{
+		Ready:   d.active != nil,
+		Servers: make(map[uint32]bool, len(d.servers)),
+	}
+	for port, server := range d.servers {
+		healthy := server.Healthy()
+		status.Servers[port] = healthy
+		status.Ready = status.Ready && healthy
+	}
+	if d.active == nil {
+		return status
+	}
+	if heartbeat := d.active.watchdog.LastHeartbeat(); heartbeat != nil {
+		status.Enclave = &enclaveStatus{HeartbeatMessage: heartbeat, LastHeartbeatAt: heartbeat.ReceivedAt}
+		status.Ready = status.Ready && stateReady(heartbeat, d.active.settings.Watchdog.FailReadinessWhenDegraded)
+	}
+	return status
+}
+
+// stateReady reports whether the state declared in a heartbeat allows readiness. Legacy heartbeats carry no state.
+func stateReady(heartbeat *watchdog.HeartbeatMessage, failWhenDegraded bool) bool {
+	switch heartbeat.State {
+	case watchdog.StateStarting, watchdog.StateDraining:
+		return false
+	case watchdog.StateDegraded:
+		return !failWhenDegraded
+	default:
+		return true
+	}
+}
+
+// registerHealthRoutes adds the readiness route to the monitoring server.
+func registerHealthRoutes(app *fiber.App, deploy *deployment) {
+	app.Get("/healthz", func(ctx *fiber.Ctx) error {
+		status := deploy.readiness()
+		if !status.Ready {
+			ctx.Status(fiber.StatusServiceUnavailable)
+		}
+		return ctx.JSON(status)
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/watchdog"
+	"github.com/gofrs/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// heartbeatStates are the states exported by enclave_bridge_enclave_state.
+var heartbeatStates = []watchdog.State{
+	watchdog.StateStarting, watchdog.StateReady, watchdog.StateDegraded, watchdog.StateDraining,
+}
+
+// enclaveHeartbeat is the last heartbeat received from an enclave tracked by the deployment.
+type enclaveHeartbeat struct {
+	appName   string
+	heartbeat *watchdog.HeartbeatMessage
+}
+
+// heartbeats returns the last heartbeat of every enclave tracked by the deployment that has sent one.
+// Enclaves of the same image can report the same enclave ID, in which case only the most current one is returned.
+func (d *deployment) heartbeats() []enclaveHeartbeat {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var heartbeats []enclaveHeartbeat
+	seen := map[uuid.UUID]bool{}
+	for _, gen := range []*generation{d.active, d.standby, d.previous} {
+		if gen == nil {
+			continue
+		}
+		heartbeat := gen.watchdog.LastHeartbeat()
+		if heartbeat == nil || seen[heartbeat.EnclaveID] {
+			continue
+		}
+		seen[heartbeat.EnclaveID] = true
+		heartbeats = append(heartbeats, enclaveHeartbeat{appName: gen.settings.AppName, heartbeat: heartbeat})
+	}
+	return heartbeats
+}
+
+// heartbeatCollector exports the status enclaves report in their heartbeats.
+type heartbeatCollector struct {
+	deploy     *deployment
+	customKeys map[string]bool
+	age        *prometheus.Desc
+	info       *prometheus.Desc
+	uptime     *prometheus.Desc
+	state      *prometheus.Desc
+	memory     *prometheus.Desc
+	goroutines *prometheus.Desc
+	custom     *prometheus.Desc
+}
+
+// newHeartbeatCollector creates a collector of the heartbeats of deploy. Only the custom values of customKeys are
+// exported, since every key is a label value.
+func newHeartbeatCollector(deploy *deployment, customKeys []string) *heartbeatCollector {
+	labels := []string{"enclave_app", "enclave_id"}
+	desc := func(name, help string, extraLabels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "enclave", name), help,
+			append(labels, extraLabels...), nil)
+	}
+	keys := map[string]bool{}
+	for _, key := range customKeys {
+		keys[key] = true
+	}
+	return &heartbeatCollector{
+		deploy:     deploy,
+		customKeys: keys,
+		age:        desc("heartbeat_age_seconds", "Time since the last heartbeat of an enclave was received."),
+		info:       desc("info", "Version of the app and heartbeat format an enclave reports.", "app_version", "heartbeat_version"),
+		uptime:     desc("uptime_seconds", "Uptime an enclave reports in its heartbeats."),
+		state:      desc("state", "Health state an enclave declares in its heartbeats (1 for the current state).", "state"),
+		memory:     desc("memory_bytes", "Memory obtained from the OS by the Go runtime of an enclave."),
+		goroutines: desc("goroutines", "Number of goroutines of an enclave."),
+		custom:     desc("custom", "Numeric custom values an enclave reports in its heartbeats.", "key"),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *heartbeatCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{c.age, c.info, c.uptime, c.state, c.memory, c.goroutines, c.custom} {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector. Only the age and info are exported for legacy heartbeats.
+func (c *heartbeatCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, enclave := range c.deploy.heartbeats() {
+		heartbeat := enclave.heartbeat
+		labels := []string{enclave.appName, heartbeat.EnclaveID.String()}
+		gauge := func(desc *prometheus.Desc, value float64, extraLabels ...string) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, append(labels, extraLabels...)...)
+		}
+		gauge(c.age, time.Since(heartbeat.ReceivedAt).Seconds())
+		gauge(c.info, 1, heartbeat.AppVersion, strconv.Itoa(heartbeat.Version))
+		if heartbeat.Version == 0 {
+			continue
+		}
+		gauge(c.uptime, heartbeat.Uptime.Seconds())
+		gauge(c.memory, float64(heartbeat.MemoryBytes))
+		gauge(c.goroutines, float64(heartbeat.Goroutines))
+		for _, state := range heartbeatStates {
+			value := 0.0
+			if heartbeat.State == state {
+				value = 1
+			}
+			gauge(c.state, value, string(state))
+		}
+		for key, value := range heartbeat.Custom {
+			if !c.customKeys[key] {
+				continue
+			}
+			if number, err := strconv.ParseFloat(value, 64); err == nil {
+				gauge(c.custom, number, key)
+			}
+		}
+	}
+}
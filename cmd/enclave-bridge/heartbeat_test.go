@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/watchdog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+// receiveHeartbeat hands a heartbeat with the given custom values to the watchdog of gen.
+func receiveHeartbeat(t *testing.T, gen *generation, custom map[string]string) {
+	t.Helper()
+	heartbeat := &watchdog.HeartbeatMessage{EnclaveID: gen.settings.Watchdog.EnclaveID, State: watchdog.StateReady, Custom: custom}
+	line, err := heartbeat.Encode(watchdog.HeartbeatVersion)
+	require.NoError(t, err)
+	bridgeSide, enclaveSide := net.Pipe()
+	defer enclaveSide.Close() //nolint:errcheck
+	go func() {
+		_ = gen.watchdog.HandleConn(t.Context(), bridgeSide)
+	}()
+	_, err = enclaveSide.Write(line)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return gen.watchdog.LastHeartbeat() != nil
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestHeartbeatCollector(t *testing.T) {
+	t.Parallel()
+	active := newTestGeneration(t, 16, testBridgePort)
+	deploy := newTestDeployment(t, active)
+	// A new enclave of the same image reports the same enclave ID.
+	previousSettings := *active.settings
+	previous, err := newGeneration(t.Context(), &previousSettings, 17, nil)
+	require.NoError(t, err)
+	t.Cleanup(previous.cancel)
+	deploy.mu.Lock()
+	deploy.previous = previous
+	deploy.mu.Unlock()
+	receiveHeartbeat(t, active, map[string]string{"requests": "5", "user_42": "1", "region": "eu"})
+	receiveHeartbeat(t, previous, map[string]string{"requests": "3"})
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(newHeartbeatCollector(deploy, []string{"requests", "region"}))
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	metrics := map[string][]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			metrics[family.GetName()] = append(metrics[family.GetName()], metric.GetGauge().GetValue())
+		}
+	}
+	require.Len(t, metrics["enclave_bridge_enclave_uptime_seconds"], 1)
+	// Keys that are not listed and values that are not numbers are not exported.
+	require.Equal(t, []float64{5}, metrics["enclave_bridge_enclave_custom"])
+}
@@ -9,15 +9,21 @@ import (
 	"syscall"
 
 	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
+	"github.com/DIMO-Network/enclave-bridge/pkg/logs"
 	"github.com/DIMO-Network/enclave-bridge/pkg/tunnel"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
 	"golang.org/x/sync/errgroup"
 )
 
 const (
 	defaultMonPort = 8888
+	// defaultOperatorAddr is the address of the operator server. It only listens on localhost, since its routes
+	// switch live traffic between enclaves.
+	defaultOperatorAddr = "127.0.0.1:8889"
 )
 
 // ReadyFunc is a function that returns an error if the enclave is not ready.
@@ -26,7 +32,16 @@ type ReadyFunc func() error
 func main() {
 	parentCtx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
-	logger := enclave.GetAndSetDefaultLogger("enclave-bridge", os.Stdout)
+	formatter, formatErr := logs.NewFormatter(os.Getenv(LogFormatEnvVar))
+	if formatErr != nil {
+		formatter, _ = logs.NewFormatter(logs.FormatJSON)
+	}
+	// The bridge logs through the same sink as the enclave so their lines are never interleaved.
+	stdout := logs.NewWriterSink(os.Stdout, formatter)
+	logger := enclave.GetAndSetDefaultLogger("enclave-bridge", stdout)
+	if formatErr != nil {
+		logger.Fatal().Err(formatErr).Msg("Invalid log format")
+	}
 	go func() {
 		<-parentCtx.Done()
 		logger.Info().Msg("Received signal, shutting down...")
@@ -38,12 +53,36 @@ func main() {
 		logger.Fatal().Err(err).Msg("Failed to get stdout port")
 	}
 	stdoutTunnel := tunnel.NewStdoutTunnel(stdoutPort, logger.With().Str("component", "stdout-tunnel").Logger())
+	logSink, err := newLogSink(groupCtx, stdout, &logger, group)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create log sinks")
+	}
+	redactor, err := newLogRedactor(&logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to load log redaction rules")
+	}
+	if redactor != nil {
+		// Entries are masked before any sink sees them.
+		logSink = logs.NewRedactingSink(redactor, logSink)
+	}
+	stdoutTunnel.SetSink(logSink)
 	runClientTunnel(groupCtx, stdoutTunnel, group)
 
 	// Start monitoring server
-	monApp := CreateMonitoringServer()
+	deploy := newDeployment()
+	prometheus.MustRegister(newHeartbeatCollector(deploy, getEnvList(HeartbeatMetricKeysEnvVar)))
+	monApp := CreateMonitoringServer(deploy, logger.With().Str("component", "metrics-federation").Logger())
 	runFiber(groupCtx, monApp, ":"+strconv.Itoa(defaultMonPort), group)
-	bridge, err := CreateBridge(groupCtx)
+	operatorAddr := os.Getenv(OperatorAddrEnvVar)
+	if operatorAddr == "" {
+		operatorAddr = defaultOperatorAddr
+	}
+	runFiber(groupCtx, CreateOperatorServer(deploy, os.Getenv(OperatorTokenEnvVar)), operatorAddr, group)
+	tracer, err := newTracer(groupCtx, &logger, group)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create tracer")
+	}
+	bridge, err := CreateBridge(groupCtx, deploy, stdoutTunnel, tracer)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("Failed to create bridge")
 	}
@@ -51,15 +90,32 @@ func main() {
 		return bridge.Run(groupCtx)
 	})
 	err = group.Wait()
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		logger.Error().Err(err).Int("exitCode", exitErr.code).Msg("Bridge failed")
+		os.Exit(exitErr.code)
+	}
 	if err != nil && !errors.Is(err, context.Canceled) {
 		logger.Fatal().Err(err).Msg("Bridge failed")
 	}
 }
 
 // CreateMonitoringServer creates a fiber server that listens for requests on the given port.
-func CreateMonitoringServer() *fiber.App {
+// The logger reports failed scrapes of enclave metrics.
+func CreateMonitoringServer(deploy *deployment, logger zerolog.Logger) *fiber.App {
 	monApp := fiber.New(fiber.Config{DisableStartupMessage: true})
 	monApp.Get("/", func(*fiber.Ctx) error { return nil })
 	monApp.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler()))
+	registerMetricsRoutes(monApp, deploy, logger)
+	registerHealthRoutes(monApp, deploy)
+	registerDeploymentRoutes(monApp, deploy)
 	return monApp
 }
+
+// CreateOperatorServer creates a fiber server for the routes that change which enclave serves traffic.
+// Requests must carry token as a bearer token if it is set.
+func CreateOperatorServer(deploy *deployment, token string) *fiber.App {
+	operatorApp := fiber.New(fiber.Config{DisableStartupMessage: true})
+	registerOperatorRoutes(operatorApp, deploy, token)
+	return operatorApp
+}
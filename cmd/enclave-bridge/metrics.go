@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/DIMO-Network/enclave-bridge/pkg/federate"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+)
+
+const metricsNamespace = "enclave_bridge"
+
+var unauthenticatedHandshakesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "unauthenticated_handshakes_total",
+	Help:      "Number of handshakes of enclaves that do not authenticate their watchdog heartbeats, by result.",
+}, []string{"result"})
+
+var watchdogActionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "watchdog_actions_total",
+	Help:      "Number of actions taken on watchdog failures by type and result.",
+}, []string{"type", "result"})
+
+// metricsTargets returns the enclaves tracked by the deployment that serve metrics.
+func (d *deployment) metricsTargets() []federate.Target {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var targets []federate.Target
+	for _, gen := range []*generation{d.active, d.standby, d.previous} {
+		if gen == nil || gen.settings.Metrics.EnclaveListenPort == 0 {
+			continue
+		}
+		targets = append(targets, federate.Target{
+			AppName: gen.settings.AppName,
+			CID:     gen.cid,
+			Port:    gen.settings.Metrics.EnclaveListenPort,
+			Timeout: gen.settings.Metrics.ScrapeTimeout,
+		})
+	}
+	return targets
+}
+
+// registerMetricsRoutes adds the route serving the federated metrics of the enclaves to the monitoring server.
+// The enclaves are scraped on every request, so scrapes of the route should be no more frequent than needed.
+func registerMetricsRoutes(app *fiber.App, deploy *deployment, logger zerolog.Logger) {
+	gatherer := federate.NewGatherer(deploy.metricsTargets, logger)
+	app.Get("/metrics/enclave", adaptor.HTTPHandler(promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		// Enclaves that fail to scrape are reported by enclave_bridge_enclave_up instead of failing the response.
+		ErrorHandling: promhttp.ContinueOnError,
+	})))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultWatchdogActionTimeout = 30 * time.Second
+	// maxWatchdogActionOutput is the number of bytes of command output and webhook responses included in errors.
+	maxWatchdogActionOutput = 512
+)
+
+// watchdogFailure is a watchdog failure passed to actions. Webhooks receive it as JSON and commands as environment
+// variables.
+type watchdogFailure struct {
+	AppName   string    `json:"appName"`
+	EnclaveID uuid.UUID `json:"enclaveId"`
+	Error     string    `json:"error"`
+	Time      time.Time `json:"time"`
+}
+
+// defaultWatchdogActionSettings returns the actions taken if none are configured: the bridge exits with code 1.
+func defaultWatchdogActionSettings() []config.WatchdogActionSettings {
+	return []config.WatchdogActionSettings{{Type: config.WatchdogActionExit, ExitCode: 1}}
+}
+
+// watchdogActions are the actions taken when the watchdog of an enclave fails. They run on the host, so they live
+// in the bridge rather than in the watchdog package shared with the enclave.
+type watchdogActions struct {
+	settings []config.WatchdogActionSettings
+	client   *http.Client
+	logger   zerolog.Logger
+}
+
+// newWatchdogActions validates the action settings and creates the actions.
+func newWatchdogActions(settings []config.WatchdogActionSettings, logger zerolog.Logger) (*watchdogActions, error) {
+	for i := range settings {
+		action := &settings[i]
+		switch action.Type {
+		case config.WatchdogActionExit, config.WatchdogActionAlert:
+		case config.WatchdogActionCommand:
+			if len(action.Command) == 0 {
+				return nil, fmt.Errorf("watchdog action %d: command is required", i)
+			}
+		case config.WatchdogActionWebhook:
+			parsed, err := url.Parse(action.URL)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return nil, fmt.Errorf("watchdog action %d: invalid webhook URL %q", i, action.URL)
+			}
+		default:
+			return nil, fmt.Errorf("watchdog action %d: unknown type %q", i, action.Type)
+		}
+	}
+	return &watchdogActions{
+		settings: settings,
+		client:   &http.Client{},
+		logger:   logger,
+	}, nil
+}
+
+// Run takes the actions in order for failure. It stops at the first exit action and returns its exit code and
+// true; if there is none, the caller stays up. Failed command and webhook actions are logged and do not stop the
+// following actions.
+func (a *watchdogActions) Run(ctx context.Context, failure watchdogFailure) (int, bool) {
+	for _, action := range a.settings {
+		if action.Type == config.WatchdogActionExit {
+			watchdogActionsTotal.WithLabelValues(action.Type, "success").Inc()
+			return action.ExitCode, true
+		}
+		err := a.run(ctx, &action, &failure)
+		if err != nil {
+			watchdogActionsTotal.WithLabelValues(action.Type, "failed").Inc()
+			a.logger.Error().Err(err).Str("action", action.Type).Msg("Watchdog action failed")
+			continue
+		}
+		watchdogActionsTotal.WithLabelValues(action.Type, "success").Inc()
+	}
+	return 0, false
+}
+
+func (a *watchdogActions) run(ctx context.Context, action *config.WatchdogActionSettings, failure *watchdogFailure) error {
+	timeout := action.Timeout
+	if timeout <= 0 {
+		timeout = defaultWatchdogActionTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	switch action.Type {
+	case config.WatchdogActionCommand:
+		return runCommand(ctx, action.Command, failure)
+	case config.WatchdogActionWebhook:
+		return a.postWebhook(ctx, action, failure)
+	default:
+		a.logger.Error().Str("appName", failure.AppName).Str("enclaveId", failure.EnclaveID.String()).
+			Str("failure", failure.Error).Msg("Watchdog alert")
+		return nil
+	}
+}
+
+// runCommand runs a host command with the failure in the ENCLAVE_BRIDGE_APP_NAME, ENCLAVE_BRIDGE_ENCLAVE_ID and
+// ENCLAVE_BRIDGE_WATCHDOG_ERROR environment variables.
+func runCommand(ctx context.Context, command []string, failure *watchdogFailure) error {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...) //nolint:gosec // Commands are configured on the host.
+	cmd.Env = append(os.Environ(),
+		"ENCLAVE_BRIDGE_APP_NAME="+failure.AppName,
+		"ENCLAVE_BRIDGE_ENCLAVE_ID="+failure.EnclaveID.String(),
+		"ENCLAVE_BRIDGE_WATCHDOG_ERROR="+failure.Error,
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("command %s failed: %w: %s", command[0], err, bytes.TrimSpace(truncate(output)))
+	}
+	return nil
+}
+
+func (a *watchdogActions) postWebhook(ctx context.Context, action *config.WatchdogActionSettings, failure *watchdogFailure) error {
+	body, err := json.Marshal(failure)
+	if err != nil {
+		return fmt.Errorf("failed to encode watchdog failure: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, action.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range action.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post webhook: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, maxWatchdogActionOutput))
+		return fmt.Errorf("failed to post webhook: status %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func truncate(output []byte) []byte {
+	if len(output) > maxWatchdogActionOutput {
+		return output[:maxWatchdogActionOutput]
+	}
+	return output
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/gofrs/uuid"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchdogActions(t *testing.T) {
+	t.Parallel()
+	failures := make(chan watchdogFailure, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var failure watchdogFailure
+		if r.Header.Get("Authorization") != "Bearer token" || json.NewDecoder(r.Body).Decode(&failure) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		failures <- failure
+	}))
+	t.Cleanup(webhook.Close)
+	output := filepath.Join(t.TempDir(), "output")
+
+	actions, err := newWatchdogActions([]config.WatchdogActionSettings{
+		{Type: config.WatchdogActionAlert},
+		{Type: config.WatchdogActionCommand, Command: []string{"false"}},
+		{Type: config.WatchdogActionCommand, Command: []string{"sh", "-c", `echo "$ENCLAVE_BRIDGE_APP_NAME $ENCLAVE_BRIDGE_WATCHDOG_ERROR" > "$0"`, output}},
+		{Type: config.WatchdogActionWebhook, URL: webhook.URL, Headers: map[string]string{"Authorization": "Bearer token"}},
+		{Type: config.WatchdogActionExit, ExitCode: 3},
+		{Type: config.WatchdogActionCommand, Command: []string{"sh", "-c", `echo after > "$0"`, output}},
+	}, zerolog.Nop())
+	require.NoError(t, err)
+
+	failure := watchdogFailure{
+		AppName:   "app",
+		EnclaveID: uuid.Must(uuid.NewV4()),
+		Error:     "enclave heartbeat timeout",
+		Time:      time.Now().UTC().Truncate(time.Second),
+	}
+	exitCode, exit := actions.Run(t.Context(), failure)
+	require.True(t, exit)
+	require.Equal(t, 3, exitCode)
+
+	written, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, "app enclave heartbeat timeout\n", string(written))
+	select {
+	case received := <-failures:
+		require.Equal(t, failure, received)
+	default:
+		t.Fatal("webhook was not posted")
+	}
+}
+
+func TestWatchdogActionsAlertOnly(t *testing.T) {
+	t.Parallel()
+	actions, err := newWatchdogActions([]config.WatchdogActionSettings{{Type: config.WatchdogActionAlert}}, zerolog.Nop())
+	require.NoError(t, err)
+	_, exit := actions.Run(t.Context(), watchdogFailure{AppName: "app"})
+	require.False(t, exit)
+
+	actions, err = newWatchdogActions(defaultWatchdogActionSettings(), zerolog.Nop())
+	require.NoError(t, err)
+	exitCode, exit := actions.Run(t.Context(), watchdogFailure{AppName: "app"})
+	require.True(t, exit)
+	require.Equal(t, 1, exitCode)
+}
+
+func TestInvalidWatchdogActions(t *testing.T) {
+	t.Parallel()
+	for _, action := range []config.WatchdogActionSettings{
+		{Type: "reboot"},
+		{Type: config.WatchdogActionCommand},
+		{Type: config.WatchdogActionWebhook, URL: "ftp://example.com"},
+		{Type: config.WatchdogActionWebhook},
+	} {
+		_, err := newWatchdogActions([]config.WatchdogActionSettings{action}, zerolog.Nop())
+		require.Error(t, err, action.Type)
+	}
+}
@@ -0,0 +1,119 @@
+// Command verify-enclave-logs checks stored enclave logs written by a logchain.Writer for gaps and tampering.
+//
+// Usage:
+//
+//	verify-enclave-logs [-pcr 0=<hex>]... [-allow-any-pcrs] [-allow-debug] [-allow-unattested] <file>...
+//
+// At least one -pcr is required to accept an attestation unless -allow-any-pcrs is given, and attestations of
+// enclaves in debug mode, whose PCR0 is all zeros, are rejected unless -allow-debug is given.
+// The files must contain the JSON lines written by a json log sink of the bridge; - reads stdin.
+// It exits with status 1 if any chain has a problem.
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/logchain"
+)
+
+// pcrFlag collects expected PCR values given as index=hex.
+type pcrFlag map[uint][]byte
+
+func (p pcrFlag) String() string {
+	return fmt.Sprint(map[uint][]byte(p))
+}
+
+func (p pcrFlag) Set(value string) error {
+	index, digest, ok := strings.Cut(value, "=")
+	if !ok {
+		return errors.New("expected index=hex")
+	}
+	pcrIndex, err := strconv.ParseUint(index, 10, 8)
+	if err != nil {
+		return fmt.Errorf("invalid PCR index: %w", err)
+	}
+	decoded, err := hex.DecodeString(digest)
+	if err != nil {
+		return fmt.Errorf("invalid PCR value: %w", err)
+	}
+	p[uint(pcrIndex)] = decoded
+	return nil
+}
+
+func main() {
+	pcrs := pcrFlag{}
+	flag.Var(pcrs, "pcr", "expected PCR value of the attestation as index=hex, may be repeated")
+	allowAnyPCRs := flag.Bool("allow-any-pcrs", false, "accept attestations of any enclave image if no -pcr is given")
+	allowDebug := flag.Bool("allow-debug", false, "accept attestations of enclaves in debug mode, whose PCR0 is all zeros")
+	allowUnattested := flag.Bool("allow-unattested", false, "accept chains signed by a key without attestation")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	opts := logchain.VerifyOptions{
+		PCRs:               pcrs,
+		AllowAnyPCRs:       *allowAnyPCRs,
+		AllowDebugEnclaves: *allowDebug,
+		AllowUnattested:    *allowUnattested,
+	}
+	failed := false
+	for _, path := range flag.Args() {
+		ok, err := verifyFile(path, opts, os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			os.Exit(2)
+		}
+		failed = failed || !ok
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// verifyFile prints a report for every chain in the file and returns whether all chains are intact.
+func verifyFile(path string, opts logchain.VerifyOptions, out io.Writer) (bool, error) {
+	var reader io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return false, err
+		}
+		defer file.Close() //nolint:errcheck
+		reader = file
+	}
+	reports, err := logchain.Verify(reader, opts)
+	if err != nil {
+		return false, err
+	}
+	if len(reports) == 0 {
+		fmt.Fprintf(out, "%s: no chained records found\n", path)
+		return false, nil
+	}
+	ok := true
+	for _, report := range reports {
+		status := "OK"
+		if !report.OK() {
+			status = "FAILED"
+			ok = false
+		}
+		fmt.Fprintf(out, "%s: chain %s (app %q, cid %s): %s, %d records, attested: %t",
+			path, report.ChainID, report.AppName, report.EnclaveCID, status, report.Records, report.Attested)
+		if report.Signed {
+			fmt.Fprintf(out, ", signed through record %d, %d unsigned records at the end", report.SignedThrough, report.Unsigned())
+		}
+		fmt.Fprintln(out)
+		for _, problem := range report.Problems {
+			fmt.Fprintf(out, "  %s\n", problem)
+		}
+	}
+	return ok, nil
+}
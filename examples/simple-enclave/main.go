@@ -17,6 +17,7 @@ import (
 	bridgecfg "github.com/DIMO-Network/enclave-bridge/pkg/config"
 	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
 	"github.com/DIMO-Network/enclave-bridge/pkg/enclave/handshake"
+	"github.com/DIMO-Network/enclave-bridge/pkg/server"
 	"github.com/DIMO-Network/enclave-bridge/pkg/watchdog"
 	"github.com/gofiber/fiber/v2"
 	"github.com/mdlayher/vsock"
@@ -33,6 +34,11 @@ const (
 	// clientTunnelPort is the VSOCK port used for outbound connections from the enclave
 	// This allows the enclave to make HTTP requests to external services
 	clientTunnelPort uint32 = 5002
+	// metricsPort is the VSOCK port the enclave serves its Prometheus metrics on
+	// The bridge scrapes it and exposes the metrics at /metrics/enclave on its monitoring server
+	metricsPort uint32 = 5003
+	// shutdownTimeout is how long open connections may take to finish when shutting down
+	shutdownTimeout = 10 * time.Second
 )
 
 func main() {
@@ -44,7 +50,7 @@ func main() {
 
 	// Setup logging to bridge
 	// This creates a logger that sends logs through VSOCK to the bridge
-	// If the VSOCK connection fails, it falls back to stdout
+	// Logs are buffered while the bridge is unreachable and flushed by cleanup on shutdown
 	logger, cleanup, err := enclave.GetAndSetDefaultLoggerWithSocket(appName, enclave.StdoutPort)
 	if err != nil {
 		logger = zerolog.New(os.Stdout).With().Timestamp().Logger()
@@ -100,10 +106,19 @@ func main() {
 				RequestTimeout:  time.Minute * 5,
 			},
 		},
+		// Metrics settings tell the bridge where to scrape the enclave's metrics
+		Metrics: bridgecfg.MetricsSettings{
+			EnclaveListenPort: metricsPort,
+		},
 		// Watchdog settings ensure the bridge can monitor the enclave's health
 		Watchdog: watchdog.NewStandardSettings(),
 	}
 
+	// Report the app's health state in the watchdog heartbeats
+	// The bridge fails readiness on /healthz until the enclave declares it is ready
+	status := watchdog.NewStatus("v0.1.0")
+	bridgeSetup.SetStatus(status)
+
 	// Run handshake in background
 	// This completes the handshake process and starts the watchdog
 	group.Go(func() error {
@@ -123,13 +138,14 @@ func main() {
 	}
 
 	// Create VSOCK listener for the enclave server
-	// This creates a listener on the specified VSOCK port
+	// This creates a listener on the port of the server settings
 	// The bridge will forward TCP connections from the host to this port
-	listener, err := vsock.Listen(serverTunnelPort, nil)
+	listener, err := server.Listen(&bridgeSettings.Servers[0])
 	if err != nil {
 		logger.Fatal().Err(err).Msgf("Couldn't listen on port %d.", serverTunnelPort)
 	}
 	logger.Info().Msgf("Listening on %s", listener.Addr())
+	status.SetState(watchdog.StateReady)
 
 	// Create simple Fiber app
 	// This is a basic HTTP server that will run inside the enclave
@@ -139,22 +155,20 @@ func main() {
 	})
 
 	// Run the server
-	// This starts the HTTP server using the VSOCK listener
+	// This serves the Fiber app on the VSOCK listener until the context is cancelled,
+	// then waits for open connections to finish before shutting down
 	group.Go(func() error {
-		if err := app.Listener(listener); err != nil {
-			return fmt.Errorf("failed to start server: %w", err)
-		}
-		return nil
+		return server.Serve(gCtx, listener, server.Fiber(app), shutdownTimeout)
 	})
 
-	// Handle shutdown
-	// This ensures the server shuts down gracefully when the context is cancelled
+	// Serve metrics
+	// This serves the default Prometheus registry to the bridge until the context is cancelled
+	metricsListener, err := server.ListenMetrics(&bridgeSettings.Metrics)
+	if err != nil {
+		logger.Fatal().Err(err).Msgf("Couldn't listen on port %d.", metricsPort)
+	}
 	group.Go(func() error {
-		<-gCtx.Done()
-		if err := app.Shutdown(); err != nil {
-			return fmt.Errorf("failed to shutdown server: %w", err)
-		}
-		return nil
+		return server.ServeMetrics(gCtx, metricsListener, nil)
 	})
 
 	// Wait for all goroutines
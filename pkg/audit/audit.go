@@ -0,0 +1,137 @@
+// Package audit writes a tamper-evident record of the external endpoints contacted by enclaves.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Outcomes of an egress connection.
+const (
+	// OutcomeConnected is written when a connection is established, before the record of its final outcome, so
+	// long-lived connections and connections cut off by the bridge exiting are audited.
+	OutcomeConnected = "connected"
+	// OutcomeSuccess is a connection that was established and closed normally.
+	OutcomeSuccess = "success"
+	// OutcomeDialFailed is a connection whose target could not be dialed.
+	OutcomeDialFailed = "dial_failed"
+	// OutcomeQuotaExceeded is a connection that was denied or closed because the byte quota was exceeded.
+	OutcomeQuotaExceeded = "quota_exceeded"
+	// OutcomePolicyViolation is a connection that was closed because it violated the TLS server name policy.
+	OutcomePolicyViolation = "policy_violation"
+	// OutcomeError is a connection that was established and closed with an error.
+	OutcomeError = "error"
+)
+
+// ErrChainBroken is returned by Verify when a record does not match the hash chain.
+var ErrChainBroken = errors.New("audit hash chain broken")
+
+// Record is a single egress connection made by an enclave through a client tunnel.
+type Record struct {
+	Time       time.Time `json:"time"`
+	AppName    string    `json:"appName"`
+	EnclaveCID uint32    `json:"enclaveCid"`
+	// Target is the address requested by the enclave.
+	Target string `json:"target"`
+	// ResolvedIP is the IP address the bridge connected to. When dialing through a proxy this is the proxy's IP.
+	ResolvedIP    string `json:"resolvedIp,omitempty"`
+	Outcome       string `json:"outcome"`
+	Error         string `json:"error,omitempty"`
+	BytesOutbound int64  `json:"bytesOutbound"`
+	BytesInbound  int64  `json:"bytesInbound"`
+	DurationMs    int64  `json:"durationMs"`
+	// PrevHash is the hash of the previous record in the log.
+	PrevHash string `json:"prevHash"`
+	// Hash is the SHA-256 of PrevHash and the record without Hash.
+	Hash string `json:"hash,omitempty"`
+}
+
+// Log writes records as JSON lines, chaining each record to the previous one by hash.
+type Log struct {
+	mu       sync.Mutex
+	writer   io.Writer
+	lastHash string
+}
+
+// NewLog creates a Log that writes to w. lastHash is the hash of the last record already written to w, if any.
+func NewLog(w io.Writer, lastHash string) *Log {
+	return &Log{writer: w, lastHash: lastHash}
+}
+
+// Write sets the hashes of record and appends it to the log.
+func (l *Log) Write(record *Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	record.Time = record.Time.UTC()
+	record.PrevHash = l.lastHash
+	hash, err := hashRecord(record)
+	if err != nil {
+		return err
+	}
+	record.Hash = hash
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %w", err)
+	}
+	if _, err := l.writer.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	l.lastHash = hash
+	return nil
+}
+
+// Close closes the underlying writer if it is an io.Closer.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if closer, ok := l.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Verify checks the hash chain of the records read from r, starting from prevHash,
+// and returns the hash of the last record.
+func Verify(r io.Reader, prevHash string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return "", fmt.Errorf("line %d: failed to unmarshal audit record: %w", line, err)
+		}
+		if record.PrevHash != prevHash {
+			return "", fmt.Errorf("%w: line %d does not follow the previous record", ErrChainBroken, line)
+		}
+		hash, err := hashRecord(&record)
+		if err != nil {
+			return "", err
+		}
+		if hash != record.Hash {
+			return "", fmt.Errorf("%w: line %d was modified", ErrChainBroken, line)
+		}
+		prevHash = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return prevHash, nil
+}
+
+func hashRecord(record *Record) (string, error) {
+	unhashed := *record
+	unhashed.Hash = ""
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal audit record: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
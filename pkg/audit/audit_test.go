@@ -0,0 +1,121 @@
+package audit_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/audit"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogHashChain(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	auditLog := audit.NewLog(&buf, "")
+	for _, target := range []string{"a.example.com:443", "b.example.com:443", "c.example.com:443"} {
+		require.NoError(t, auditLog.Write(&audit.Record{Time: time.Now(), Target: target, Outcome: audit.OutcomeSuccess}))
+	}
+	lastHash, err := audit.Verify(bytes.NewReader(buf.Bytes()), "")
+	require.NoError(t, err)
+	require.NotEmpty(t, lastHash)
+
+	tampered := strings.Replace(buf.String(), "b.example.com", "x.example.com", 1)
+	_, err = audit.Verify(strings.NewReader(tampered), "")
+	require.ErrorIs(t, err, audit.ErrChainBroken)
+
+	lines := strings.SplitAfter(buf.String(), "\n")
+	removed := lines[0] + lines[2]
+	_, err = audit.Verify(strings.NewReader(removed), "")
+	require.ErrorIs(t, err, audit.ErrChainBroken)
+}
+
+func TestFileLogRotation(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := audit.OpenFileLog(path, 600, 5)
+	require.NoError(t, err)
+	for range 5 {
+		require.NoError(t, auditLog.Write(&audit.Record{Time: time.Now(), Target: "example.com:443"}))
+	}
+	require.NoError(t, auditLog.Close())
+
+	// Reopening the log continues the chain of the existing records.
+	auditLog, err = audit.OpenFileLog(path, 600, 5)
+	require.NoError(t, err)
+	require.NoError(t, auditLog.Write(&audit.Record{Time: time.Now(), Target: "example.com:443"}))
+	require.NoError(t, auditLog.Close())
+
+	// The rotated files form a single chain from the oldest backup to the current file.
+	var combined bytes.Buffer
+	for i := 5; i >= 1; i-- {
+		data, err := os.ReadFile(path + "." + strconv.Itoa(i))
+		if os.IsNotExist(err) {
+			continue
+		}
+		require.NoError(t, err)
+		combined.Write(data)
+	}
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	combined.Write(data)
+	require.Greater(t, combined.Len(), len(data), "expected the log to be rotated")
+	require.Equal(t, 6, strings.Count(combined.String(), "\n"))
+	_, err = audit.Verify(&combined, "")
+	require.NoError(t, err)
+}
+
+func TestFileLogTruncatesPartialRecord(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := audit.OpenFileLog(path, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, auditLog.Write(&audit.Record{Time: time.Now(), Target: "a.example.com:443"}))
+	require.NoError(t, auditLog.Close())
+
+	// A crash while writing a record leaves a line without a newline.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"time":"2024-01-01T00:00:00Z","tar`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	auditLog, err = audit.OpenFileLog(path, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, auditLog.Write(&audit.Record{Time: time.Now(), Target: "b.example.com:443"}))
+	require.NoError(t, auditLog.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 2, strings.Count(string(data), "\n"))
+	_, err = audit.Verify(bytes.NewReader(data), "")
+	require.NoError(t, err)
+}
+
+func TestRotatingFileReopensOnFailedRotation(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	rotatingFile, err := audit.OpenRotatingFile(path, 10, 1)
+	require.NoError(t, err)
+	defer rotatingFile.Close() //nolint:errcheck
+	_, err = rotatingFile.Write([]byte("first\n"))
+	require.NoError(t, err)
+
+	// A non-empty directory at the backup path makes renaming the current file fail.
+	require.NoError(t, os.MkdirAll(filepath.Join(path+".1", "blocked"), 0o700))
+	_, err = rotatingFile.Write([]byte("second\n"))
+	require.Error(t, err)
+
+	// The current file is still open, so writes succeed once the backup path is free again.
+	require.NoError(t, os.RemoveAll(path+".1"))
+	_, err = rotatingFile.Write([]byte("third\n"))
+	require.NoError(t, err)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "third\n", string(data))
+}
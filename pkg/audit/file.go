@@ -0,0 +1,189 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const filePerm = 0o600
+
+// RotatingFile is an io.WriteCloser that appends to a file and rotates it once it reaches a maximum size.
+// Rotated files are renamed to path.1, path.2, ... with path.1 being the most recent.
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// OpenRotatingFile opens path for appending. If maxBytes is zero the file is never rotated.
+// At most maxBackups rotated files are kept.
+func OpenRotatingFile(path string, maxBytes int64, maxBackups int) (*RotatingFile, error) {
+	rotatingFile := &RotatingFile{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := rotatingFile.open(); err != nil {
+		return nil, err
+	}
+	return rotatingFile, nil
+}
+
+// OpenFileLog opens a Log that appends to a rotating file, continuing the hash chain of the existing records.
+func OpenFileLog(path string, maxBytes int64, maxBackups int) (*Log, error) {
+	lastHash, err := lastFileHash(path)
+	if err != nil {
+		return nil, err
+	}
+	rotatingFile, err := OpenRotatingFile(path, maxBytes, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return NewLog(rotatingFile, lastHash), nil
+}
+
+// Write writes p to the file, rotating it first if p would exceed the maximum size.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return 0, fs.ErrClosed
+	}
+	if r.maxBytes > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the file.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, filePerm)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+// rotate shifts the backups, renames the current file to path.1 and opens a new file. Must be called with the lock held.
+// If the file can not be rotated it is reopened, so later writes can still succeed.
+func (r *RotatingFile) rotate() error {
+	err := r.file.Close()
+	r.file = nil
+	if err != nil {
+		err = fmt.Errorf("failed to close log file: %w", err)
+	} else {
+		err = r.shiftBackups()
+	}
+	if openErr := r.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+// shiftBackups moves the current file to path.1, or removes it if no backups are kept.
+func (r *RotatingFile) shiftBackups() error {
+	if r.maxBackups <= 0 {
+		if err := os.Remove(r.path); err != nil {
+			return fmt.Errorf("failed to remove log file: %w", err)
+		}
+		return nil
+	}
+	_ = os.Remove(backupPath(r.path, r.maxBackups))
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		err := os.Rename(backupPath(r.path, i), backupPath(r.path, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to rotate log file: %w", err)
+		}
+	}
+	if err := os.Rename(r.path, backupPath(r.path, 1)); err != nil {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+	return nil
+}
+
+func backupPath(path string, index int) string {
+	return path + "." + strconv.Itoa(index)
+}
+
+// lastFileHash returns the hash of the last record in path, falling back to the most recent backup if path is empty.
+// A partial record at the end of path, left by a crash while it was written, is truncated.
+func lastFileHash(path string) (string, error) {
+	hash, err := lastHashInFile(path, true)
+	if err != nil || hash != "" {
+		return hash, err
+	}
+	return lastHashInFile(backupPath(path, 1), false)
+}
+
+// lastHashInFile returns the hash of the last complete record in path. A trailing line without a newline is a
+// partial record; it is removed from the file if truncate is set and ignored otherwise.
+func lastHashInFile(path string, truncate bool) (string, error) {
+	file, err := os.Open(path) //nolint:gosec // The path is configured by the operator.
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close() //nolint:errcheck
+	reader := bufio.NewReader(file)
+	var lastLine []byte
+	var complete, offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			offset += int64(len(line))
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read audit log: %w", err)
+		}
+		offset += int64(len(line))
+		complete = offset
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			lastLine = trimmed
+		}
+	}
+	if truncate && offset > complete {
+		if err := os.Truncate(path, complete); err != nil {
+			return "", fmt.Errorf("failed to truncate partial audit record: %w", err)
+		}
+	}
+	if lastLine == nil {
+		return "", nil
+	}
+	var record Record
+	if err := json.Unmarshal(lastLine, &record); err != nil {
+		return "", fmt.Errorf("failed to unmarshal last audit record: %w", err)
+	}
+	return record.Hash, nil
+}
@@ -1,20 +1,21 @@
 package client
 
 import (
-	"bufio"
-	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"net/http"
 	"strings"
-
-	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
-	"github.com/mdlayher/vsock"
+	"time"
 )
 
-const defaultHostCID = 3
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 10
+	defaultIdleConnTimeout     = 90 * time.Second
+)
 
 var emptyConfig tls.Config
 
@@ -22,20 +23,92 @@ func defaultConfig() *tls.Config {
 	return &emptyConfig
 }
 
+// HTTPClientOption configures the client created by NewHTTPClient.
+type HTTPClientOption func(*httpClientOptions)
+
+type httpClientOptions struct {
+	dialer              *Dialer
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	pingInterval        time.Duration
+	pingTimeout         time.Duration
+	disableHTTP2        bool
+	rootCAs             *x509.CertPool
+	minTLSVersion       uint16
+	cipherSuites        []uint16
+	pins                map[string][]string
+	pinFailureHook      func(PinFailure)
+}
+
+// WithDialer sets the dialer used to reach the bridge, e.g. to use a different host CID or dial timeout.
+func WithDialer(dialer *Dialer) HTTPClientOption {
+	return func(opts *httpClientOptions) {
+		opts.dialer = dialer
+	}
+}
+
+// WithMaxIdleConnsPerHost sets the maximum number of idle connections kept per host. Defaults to 10.
+func WithMaxIdleConnsPerHost(maxIdleConnsPerHost int) HTTPClientOption {
+	return func(opts *httpClientOptions) {
+		opts.maxIdleConnsPerHost = maxIdleConnsPerHost
+	}
+}
+
+// WithIdleConnTimeout sets how long an idle connection is kept before it is closed. Defaults to 90 seconds.
+func WithIdleConnTimeout(idleConnTimeout time.Duration) HTTPClientOption {
+	return func(opts *httpClientOptions) {
+		opts.idleConnTimeout = idleConnTimeout
+	}
+}
+
+// WithHTTP2HealthCheck sends a ping on HTTP/2 connections that received no frames for interval
+// and closes the connection if no response arrives within timeout.
+// This detects tunnels that were silently dropped, e.g. while the bridge restarted.
+func WithHTTP2HealthCheck(interval, timeout time.Duration) HTTPClientOption {
+	return func(opts *httpClientOptions) {
+		opts.pingInterval = interval
+		opts.pingTimeout = timeout
+	}
+}
+
+// WithoutHTTP2 disables HTTP/2 so every request uses HTTP/1.1.
+func WithoutHTTP2() HTTPClientOption {
+	return func(opts *httpClientOptions) {
+		opts.disableHTTP2 = true
+	}
+}
+
 // NewHTTPClient creates a new HTTP client that tunnels connections to the enclave Host on the given port.
-func NewHTTPClient(port uint32, tlsConfig *tls.Config) *http.Client {
+// HTTPS connections negotiate HTTP/2 with ALPN unless the TLS config sets its own NextProtos.
+// Since the host can intercept the traffic, TLS verification can be tightened with WithRootCAs,
+// WithSPKIPins, WithMinTLSVersion and WithCipherSuites.
+func NewHTTPClient(port uint32, tlsConfig *tls.Config, options ...HTTPClientOption) *http.Client {
+	opts := httpClientOptions{
+		dialer:              NewDialer(port),
+		maxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+		idleConnTimeout:     defaultIdleConnTimeout,
+	}
+	for _, option := range options {
+		option(&opts)
+	}
 	if tlsConfig == nil {
 		tlsConfig = defaultConfig()
 	}
+	tlsConfig = opts.applyTLSOptions(tlsConfig)
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{"http/1.1"}
+		if !opts.disableHTTP2 {
+			tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+	}
+	dialer := opts.dialer
 	client := &http.Client{}
 	client.Transport = &http.Transport{
-		DialContext: func(_ context.Context, network, addr string) (net.Conn, error) {
-			return dialVsock(port, network, addr)
-		},
+		DialContext: dialer.DialContext,
 		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			vsockConn, err := dialVsock(port, network, addr)
+			vsockConn, err := dialer.DialContext(ctx, network, addr)
 			if err != nil {
-				return nil, fmt.Errorf("failed to dial vsock: %w", err)
+				return nil, err
 			}
 			config := modifiedConfig(addr, tlsConfig)
 			tlsConn := tls.Client(vsockConn, config)
@@ -46,10 +119,24 @@ func NewHTTPClient(port uint32, tlsConfig *tls.Config) *http.Client {
 			}
 			return tlsConn, nil
 		},
+		// A custom DialTLSContext disables HTTP/2 unless it is forced.
+		ForceAttemptHTTP2:   !opts.disableHTTP2,
+		MaxIdleConns:        defaultMaxIdleConns,
+		MaxIdleConnsPerHost: opts.maxIdleConnsPerHost,
+		IdleConnTimeout:     opts.idleConnTimeout,
+		HTTP2: &http.HTTP2Config{
+			SendPingTimeout: opts.pingInterval,
+			PingTimeout:     opts.pingTimeout,
+		},
 	}
 	return client
 }
 
+// DialAlias opens a tunnel connection on the given port to a backend of the named bridge-side alias.
+func DialAlias(port uint32, alias string) (net.Conn, error) {
+	return NewDialer(port).DialAliasContext(context.Background(), alias)
+}
+
 // modifiedConfig modifies the TLS config to use the correct server name.
 // copied from https://cs.opensource.google/go/go/+/refs/tags/go1.24.2:src/crypto/tls/tls.go;l=140-156
 func modifiedConfig(addr string, config *tls.Config) *tls.Config {
@@ -72,25 +159,3 @@ func modifiedConfig(addr string, config *tls.Config) *tls.Config {
 	}
 	return config
 }
-
-func dialVsock(port uint32, network, addr string) (net.Conn, error) {
-	if network != "tcp" {
-		return nil, fmt.Errorf("unsupported network: %s", network)
-	}
-	vsockConn, err := vsock.Dial(defaultHostCID, port, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to dial vsock: %w", err)
-	}
-	_, err = vsockConn.Write([]byte(addr + "\n"))
-	if err != nil {
-		return nil, fmt.Errorf("failed to write to vsock: %w", err)
-	}
-	resp, err := bufio.NewReader(vsockConn).ReadBytes('\n')
-	if err != nil {
-		return nil, fmt.Errorf("failed to read from vsock: %w", err)
-	}
-	if bytes.Equal(resp, enclave.ACK) {
-		return vsockConn, nil
-	}
-	return nil, fmt.Errorf("invalid response from vsock: %d", resp)
-}
@@ -0,0 +1,88 @@
+package client_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/client"
+	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
+	"github.com/stretchr/testify/require"
+)
+
+// newTunnelDialer returns a dialer whose stand-in bridge dials the requested target over TCP.
+func newTunnelDialer(t *testing.T) *client.Dialer {
+	t.Helper()
+	dialer := client.NewDialer(5002)
+	dialer.SetDialVsock(func(uint32, uint32) (net.Conn, error) {
+		enclaveSide, bridgeSide := net.Pipe()
+		go func() {
+			defer bridgeSide.Close() //nolint:errcheck
+			reader := bufio.NewReader(bridgeSide)
+			target, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			targetConn, err := net.Dial("tcp", strings.TrimSuffix(target, "\n"))
+			if err != nil {
+				return
+			}
+			defer targetConn.Close() //nolint:errcheck
+			if _, err := bridgeSide.Write(enclave.ACK); err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(targetConn, reader) }()
+			_, _ = io.Copy(bridgeSide, targetConn)
+		}()
+		return enclaveSide, nil
+	})
+	return dialer
+}
+
+func TestHTTPClientNegotiatesHTTP2(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	for _, tc := range []struct {
+		name    string
+		options []client.HTTPClientOption
+		proto   string
+	}{
+		{name: "default", proto: "HTTP/2.0"},
+		{name: "health check", options: []client.HTTPClientOption{client.WithHTTP2HealthCheck(time.Second, time.Second)}, proto: "HTTP/2.0"},
+		{name: "without HTTP/2", options: []client.HTTPClientOption{client.WithoutHTTP2()}, proto: "HTTP/1.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			options := append([]client.HTTPClientOption{client.WithDialer(newTunnelDialer(t))}, tc.options...)
+			httpClient := client.NewHTTPClient(5002, &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}, options...)
+			defer httpClient.CloseIdleConnections()
+
+			for range 2 {
+				req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, server.URL, nil)
+				require.NoError(t, err)
+				resp, err := httpClient.Do(req)
+				require.NoError(t, err)
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				require.NoError(t, resp.Body.Close())
+				require.Equal(t, tc.proto, resp.Proto)
+				require.Equal(t, tc.proto, string(body))
+			}
+		})
+	}
+}
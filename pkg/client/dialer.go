@@ -0,0 +1,178 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tracing"
+	"github.com/mdlayher/vsock"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Dialer connects to targets outside the enclave through a client tunnel of the enclave-bridge.
+// It can be used in place of a net.Dialer by libraries that accept a custom dial function.
+type Dialer struct {
+	// HostCID is the context ID of the host running the bridge. Defaults to enclave.DefaultHostCID.
+	HostCID uint32
+	// Port is the vsock port of the client tunnel on the host.
+	Port uint32
+	// Timeout is the maximum amount of time a dial, including target negotiation with the bridge, will take.
+	// If zero, only the context limits the dial.
+	Timeout time.Duration
+	// Tracer records a span for every dial, including the vsock dial and the negotiation of the target.
+	// Spans are children of the span context of the dial's context. Nil selects the tracer of the global tracer
+	// provider.
+	Tracer trace.Tracer
+	// PropagateTrace sends the trace context of the dial to the bridge, so the span of its client tunnel joins
+	// the trace. It requires a bridge that reads trace context from the target line.
+	PropagateTrace bool
+
+	// dialVsock replaces vsock.Dial in tests.
+	dialVsock func(cid, port uint32) (net.Conn, error)
+}
+
+// NewDialer creates a Dialer for the client tunnel on port of the default host.
+func NewDialer(port uint32) *Dialer {
+	return &Dialer{HostCID: enclave.DefaultHostCID, Port: port}
+}
+
+// Dial connects to addr through the bridge.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the bridge. Only TCP networks are supported.
+// The context bounds both the vsock dial and the negotiation of the target with the bridge;
+// once the connection is returned the context no longer affects it.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("unsupported network: %s", network)}
+	}
+	return d.dialTarget(ctx, addr)
+}
+
+// DialAliasContext connects to a backend of the named bridge-side alias.
+func (d *Dialer) DialAliasContext(ctx context.Context, alias string) (net.Conn, error) {
+	return d.dialTarget(ctx, enclave.AliasPrefix+alias)
+}
+
+// dialTarget opens a vsock connection to the bridge and requests target.
+func (d *Dialer) dialTarget(ctx context.Context, target string) (net.Conn, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	tracer := d.Tracer
+	if tracer == nil {
+		tracer = otel.Tracer(tracing.ScopeName)
+	}
+	ctx, span := tracer.Start(ctx, "bridge.dial", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("target", target)))
+	defer span.End()
+	vsockConn, err := d.dialHost(ctx)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return nil, fmt.Errorf("failed to dial vsock: %w", err)
+	}
+	line := target
+	if traceparent := tracing.Traceparent(ctx); d.PropagateTrace && traceparent != "" {
+		line += " " + tracing.TraceparentKey + "=" + traceparent
+	}
+	err = negotiate(ctx, vsockConn, line)
+	if err != nil {
+		tracing.RecordError(span, err)
+		_ = vsockConn.Close()
+		return nil, err
+	}
+	return vsockConn, nil
+}
+
+// dialHost dials the bridge, returning early if the context is done.
+func (d *Dialer) dialHost(ctx context.Context) (net.Conn, error) {
+	hostCID := d.HostCID
+	if hostCID == 0 {
+		hostCID = enclave.DefaultHostCID
+	}
+	dial := d.dialVsock
+	if dial == nil {
+		dial = func(cid, port uint32) (net.Conn, error) {
+			return vsock.Dial(cid, port, nil)
+		}
+	}
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	resultChan := make(chan dialResult, 1)
+	go func() {
+		conn, err := dial(hostCID, d.Port)
+		if err != nil {
+			resultChan <- dialResult{err: err}
+			return
+		}
+		resultChan <- dialResult{conn: conn}
+	}()
+	select {
+	case <-ctx.Done():
+		go func() {
+			// Close the connection if the dial completes after we stopped waiting.
+			if result := <-resultChan; result.conn != nil {
+				_ = result.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	case result := <-resultChan:
+		return result.conn, result.err
+	}
+}
+
+// negotiate sends the target line to the bridge and waits for the ACK.
+// If the context is done before the ACK is received the negotiation is aborted.
+func negotiate(ctx context.Context, conn net.Conn, target string) error {
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	err := requestTarget(conn, target)
+	if !stop() {
+		// The deadline may have interrupted the exchange, report the context's error.
+		if err == nil {
+			err = errors.New("negotiation aborted")
+		}
+		return errors.Join(ctx.Err(), err)
+	}
+	return err
+}
+
+// requestTarget writes the target line and reads the ACK. The ACK is read byte by byte
+// so no data the target sends right after the connection is established is consumed.
+func requestTarget(conn net.Conn, target string) error {
+	_, err := conn.Write([]byte(target + "\n"))
+	if err != nil {
+		return fmt.Errorf("failed to write to vsock: %w", err)
+	}
+	resp := make([]byte, 0, len(enclave.ACK))
+	buf := make([]byte, 1)
+	for len(resp) < len(enclave.ACK) {
+		if _, err := conn.Read(buf); err != nil {
+			return fmt.Errorf("failed to read from vsock: %w", err)
+		}
+		resp = append(resp, buf[0])
+		if buf[0] == '\n' {
+			break
+		}
+	}
+	if !bytes.Equal(resp, enclave.ACK) {
+		return fmt.Errorf("invalid response from vsock: %d", resp)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package client_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/client"
+	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tracing"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newFakeBridge returns a dialer connected to a stand-in bridge. The bridge sends every requested
+// target on the returned channel and then writes reply.
+func newFakeBridge(t *testing.T, reply []byte) (*client.Dialer, <-chan string) {
+	t.Helper()
+	targets := make(chan string, 1)
+	dialer := &client.Dialer{HostCID: 7, Port: 5002}
+	dialer.SetDialVsock(func(cid, port uint32) (net.Conn, error) {
+		require.Equal(t, uint32(7), cid)
+		require.Equal(t, uint32(5002), port)
+		enclaveSide, bridgeSide := net.Pipe()
+		t.Cleanup(func() { _ = bridgeSide.Close() })
+		go func() {
+			target, err := bufio.NewReader(bridgeSide).ReadString('\n')
+			if err != nil {
+				return
+			}
+			targets <- target
+			if reply != nil {
+				_, _ = bridgeSide.Write(reply)
+			}
+		}()
+		return enclaveSide, nil
+	})
+	return dialer, targets
+}
+
+func TestDialerDialContext(t *testing.T) {
+	t.Parallel()
+	// The target greets the client right after the ACK, in the same write.
+	dialer, targets := newFakeBridge(t, append(append([]byte{}, enclave.ACK...), "hello"...))
+
+	conn, err := dialer.DialContext(t.Context(), "tcp", "db.example.com:5432")
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+	require.Equal(t, "db.example.com:5432\n", <-targets)
+
+	greeting := make([]byte, 5)
+	_, err = io.ReadFull(conn, greeting)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(greeting))
+}
+
+func TestDialerPropagatesTrace(t *testing.T) {
+	t.Parallel()
+	dialer, targets := newFakeBridge(t, enclave.ACK)
+	dialer.Tracer = sdktrace.NewTracerProvider().Tracer(tracing.ScopeName)
+	dialer.PropagateTrace = true
+	ctx, err := tracing.ContextWithTraceparent(t.Context(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+	parent := trace.SpanContextFromContext(ctx)
+
+	conn, err := dialer.DialContext(ctx, "tcp", "db.example.com:5432")
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+	target, traceparent, ok := strings.Cut(strings.TrimSuffix(<-targets, "\n"), " "+tracing.TraceparentKey+"=")
+	require.True(t, ok)
+	require.Equal(t, "db.example.com:5432", target)
+	propagated, err := tracing.ContextWithTraceparent(context.Background(), traceparent)
+	require.NoError(t, err)
+	sc := trace.SpanContextFromContext(propagated)
+	require.Equal(t, parent.TraceID(), sc.TraceID())
+	require.NotEqual(t, parent.SpanID(), sc.SpanID())
+}
+
+func TestDialerCanceledDuringNegotiation(t *testing.T) {
+	t.Parallel()
+	// The bridge never sends an ACK.
+	dialer, _ := newFakeBridge(t, nil)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := dialer.DialContext(ctx, "tcp", "db.example.com:5432")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), time.Second)
+
+	dialer.Timeout = 50 * time.Millisecond
+	_, err = dialer.Dial("tcp", "db.example.com:5432")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestDialerRejectsInvalidResponse(t *testing.T) {
+	t.Parallel()
+	dialer, _ := newFakeBridge(t, []byte("no\n"))
+	_, err := dialer.DialContext(t.Context(), "tcp", "db.example.com:5432")
+	require.Error(t, err)
+
+	_, err = dialer.DialContext(t.Context(), "udp", "db.example.com:53")
+	require.Error(t, err)
+}
@@ -0,0 +1,25 @@
+package client
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// SetDialVsock replaces the function used to dial the host.
+func (d *Dialer) SetDialVsock(dialVsock func(cid, port uint32) (net.Conn, error)) {
+	d.dialVsock = dialVsock
+}
+
+// Resolver returns a resolver that sends queries through the dialer.
+func (d *Dialer) Resolver() *net.Resolver {
+	return d.resolver()
+}
+
+// VerifyPins checks the certificates of a connection against the pins set by options.
+func VerifyPins(state tls.ConnectionState, options ...HTTPClientOption) error {
+	var opts httpClientOptions
+	for _, option := range options {
+		option(&opts)
+	}
+	return opts.verifyPins(state)
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrPinMismatch is returned when no certificate presented by a host matches the pins configured for it.
+var ErrPinMismatch = errors.New("certificate does not match pinned public keys")
+
+// PinFailure describes a TLS connection that was rejected because of a pin mismatch.
+type PinFailure struct {
+	// Host is the server name that was verified.
+	Host string
+	// Presented are the SPKI pins of the certificates the host presented.
+	Presented []string
+	// Err wraps ErrPinMismatch.
+	Err error
+}
+
+// SPKIPin returns the pin of the certificate's public key: the base64 encoded SHA-256 digest
+// of its DER encoded SubjectPublicKeyInfo, the same format HPKP used.
+func SPKIPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// RootCAsFromPEM builds a certificate pool from a PEM bundle, e.g. one embedded with go:embed.
+func RootCAsFromPEM(pemCerts []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return nil, errors.New("no certificates found in PEM bundle")
+	}
+	return pool, nil
+}
+
+// WithSPKIPins pins hosts to public keys. Keys are host names or wildcards like "*.example.com" that
+// match a single label; values are pins as returned by SPKIPin. A connection to a pinned host succeeds
+// only if a certificate of its verified chain matches one of the pins, so pinning an intermediate or
+// root key keeps working across leaf renewals. If the chain is not verified, e.g. with InsecureSkipVerify,
+// only the leaf key is matched. Hosts without pins are only verified against the roots.
+func WithSPKIPins(pins map[string][]string) HTTPClientOption {
+	return func(opts *httpClientOptions) {
+		if opts.pins == nil {
+			opts.pins = map[string][]string{}
+		}
+		for host, hostPins := range pins {
+			host = strings.ToLower(host)
+			opts.pins[host] = append(opts.pins[host], hostPins...)
+		}
+	}
+}
+
+// WithPinFailureHook sets a function that is called for every connection rejected by WithSPKIPins,
+// e.g. to alert on a host presenting an unexpected certificate.
+func WithPinFailureHook(hook func(PinFailure)) HTTPClientOption {
+	return func(opts *httpClientOptions) {
+		opts.pinFailureHook = hook
+	}
+}
+
+// WithRootCAs verifies servers against roots only, ignoring the system roots and any RootCAs of the TLS config.
+// Use RootCAsFromPEM to build the pool from an embedded bundle.
+func WithRootCAs(roots *x509.CertPool) HTTPClientOption {
+	return func(opts *httpClientOptions) {
+		opts.rootCAs = roots
+	}
+}
+
+// WithMinTLSVersion sets the minimum TLS version, e.g. tls.VersionTLS13.
+func WithMinTLSVersion(version uint16) HTTPClientOption {
+	return func(opts *httpClientOptions) {
+		opts.minTLSVersion = version
+	}
+}
+
+// WithCipherSuites restricts the TLS 1.0-1.2 cipher suites. TLS 1.3 suites are not configurable in Go.
+func WithCipherSuites(suites ...uint16) HTTPClientOption {
+	return func(opts *httpClientOptions) {
+		opts.cipherSuites = suites
+	}
+}
+
+// applyTLSOptions returns a copy of tlsConfig with the trust store, version, cipher and pinning options applied.
+func (opts *httpClientOptions) applyTLSOptions(tlsConfig *tls.Config) *tls.Config {
+	tlsConfig = tlsConfig.Clone()
+	if opts.rootCAs != nil {
+		tlsConfig.RootCAs = opts.rootCAs
+	}
+	if opts.minTLSVersion != 0 {
+		tlsConfig.MinVersion = opts.minTLSVersion
+	}
+	if opts.cipherSuites != nil {
+		tlsConfig.CipherSuites = opts.cipherSuites
+	}
+	if len(opts.pins) != 0 {
+		verifyConnection := tlsConfig.VerifyConnection
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if err := opts.verifyPins(state); err != nil {
+				return err
+			}
+			if verifyConnection != nil {
+				return verifyConnection(state)
+			}
+			return nil
+		}
+	}
+	return tlsConfig
+}
+
+// verifyPins checks the certificates of the connection against the pins of its server name.
+func (opts *httpClientOptions) verifyPins(state tls.ConnectionState) error {
+	host := strings.ToLower(state.ServerName)
+	pins := opts.pinsFor(host)
+	if len(pins) == 0 {
+		return nil
+	}
+	// Without verified chains, e.g. with InsecureSkipVerify, only the leaf can be pinned: any other presented
+	// certificate could be a public intermediate or root the server appended to its own chain.
+	chains := state.VerifiedChains
+	if len(chains) == 0 && len(state.PeerCertificates) > 0 {
+		chains = [][]*x509.Certificate{state.PeerCertificates[:1]}
+	}
+	var presented []string
+	for _, chain := range chains {
+		for _, cert := range chain {
+			pin := SPKIPin(cert)
+			for _, expected := range pins {
+				if pin == expected {
+					return nil
+				}
+			}
+			presented = append(presented, pin)
+		}
+	}
+	err := fmt.Errorf("%w for %s", ErrPinMismatch, host)
+	if opts.pinFailureHook != nil {
+		opts.pinFailureHook(PinFailure{Host: host, Presented: presented, Err: err})
+	}
+	return err
+}
+
+// pinsFor returns the pins of host, falling back to a wildcard for its parent domain.
+func (opts *httpClientOptions) pinsFor(host string) []string {
+	if pins, ok := opts.pins[host]; ok {
+		return pins
+	}
+	if _, parent, ok := strings.Cut(host, "."); ok {
+		return opts.pins["*."+parent]
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package client_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPClientTLSPolicy(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12, MinVersion: tls.VersionTLS12}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	// httptest certificates are issued for example.com and its subdomains.
+	serverPin := client.SPKIPin(server.Certificate())
+	roots, err := client.RootCAsFromPEM(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name       string
+		options    []client.HTTPClientOption
+		pinFailure bool
+		fails      bool
+	}{
+		{name: "roots", options: []client.HTTPClientOption{client.WithRootCAs(roots)}},
+		{name: "system roots ignored", options: []client.HTTPClientOption{client.WithRootCAs(x509.NewCertPool())}, fails: true},
+		{name: "pinned", options: []client.HTTPClientOption{
+			client.WithRootCAs(roots),
+			client.WithSPKIPins(map[string][]string{"example.com": {serverPin}}),
+		}},
+		{name: "unpinned host", options: []client.HTTPClientOption{
+			client.WithRootCAs(roots),
+			client.WithSPKIPins(map[string][]string{"*.example.com": {"AAAA"}}),
+		}},
+		{name: "wildcard pin mismatch", options: []client.HTTPClientOption{
+			client.WithRootCAs(roots),
+			client.WithSPKIPins(map[string][]string{"*.com": {"AAAA"}}),
+		}, pinFailure: true, fails: true},
+		{name: "pin mismatch", options: []client.HTTPClientOption{
+			client.WithRootCAs(roots),
+			client.WithSPKIPins(map[string][]string{"Example.com": {"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}}),
+		}, pinFailure: true, fails: true},
+		{name: "minimum version", options: []client.HTTPClientOption{
+			client.WithRootCAs(roots),
+			client.WithMinTLSVersion(tls.VersionTLS13),
+		}, fails: true},
+		{name: "cipher suites", options: []client.HTTPClientOption{
+			client.WithRootCAs(roots),
+			client.WithCipherSuites(tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384),
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var mu sync.Mutex
+			var failures []client.PinFailure
+			options := append([]client.HTTPClientOption{
+				client.WithDialer(newTunnelDialer(t)),
+				client.WithPinFailureHook(func(failure client.PinFailure) {
+					mu.Lock()
+					defer mu.Unlock()
+					failures = append(failures, failure)
+				}),
+			}, tc.options...)
+			// The TLS config is verified against the system roots unless WithRootCAs replaces them.
+			httpClient := client.NewHTTPClient(5002, &tls.Config{ServerName: "example.com", MinVersion: tls.VersionTLS12}, options...)
+			defer httpClient.CloseIdleConnections()
+
+			req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, server.URL, nil)
+			require.NoError(t, err)
+			resp, err := httpClient.Do(req)
+			if tc.fails {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.NoError(t, resp.Body.Close())
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !tc.pinFailure {
+				require.Empty(t, failures)
+				return
+			}
+			require.ErrorIs(t, err, client.ErrPinMismatch)
+			require.Len(t, failures, 1)
+			require.Equal(t, "example.com", failures[0].Host)
+			require.Contains(t, failures[0].Presented, serverPin)
+			require.ErrorIs(t, failures[0].Err, client.ErrPinMismatch)
+		})
+	}
+}
+
+func TestUnverifiedChainPinsLeafOnly(t *testing.T) {
+	t.Parallel()
+	// Pins only depend on the public key, so the certificates only need distinct keys.
+	pinned := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("pinned")}
+	attacker := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("attacker")}
+	pins := client.WithSPKIPins(map[string][]string{"example.com": {client.SPKIPin(pinned)}})
+
+	// An attacker appending the pinned certificate to its own chain does not match.
+	err := client.VerifyPins(tls.ConnectionState{
+		ServerName:       "example.com",
+		PeerCertificates: []*x509.Certificate{attacker, pinned},
+	}, pins)
+	require.ErrorIs(t, err, client.ErrPinMismatch)
+
+	require.NoError(t, client.VerifyPins(tls.ConnectionState{
+		ServerName:       "example.com",
+		PeerCertificates: []*x509.Certificate{pinned},
+	}, pins))
+
+	// Verified chains are matched in full, so intermediates and roots can be pinned.
+	require.NoError(t, client.VerifyPins(tls.ConnectionState{
+		ServerName:     "example.com",
+		VerifiedChains: [][]*x509.Certificate{{attacker, pinned}},
+	}, pins))
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+const (
+	dohContentType = "application/dns-message"
+	// maxDNSMessageSize is the largest DNS message that fits the two byte length prefix.
+	maxDNSMessageSize = 0xFFFF
+)
+
+// NewResolver returns a net.Resolver that sends queries to the DNS service of the bridge on the given vsock port.
+// The host answers the queries, so callers that need answers the host can not spoof should use NewDoHResolver.
+func NewResolver(port uint32) *net.Resolver {
+	return NewDialer(port).resolver()
+}
+
+// resolver returns a net.Resolver that sends queries over vsock connections to d.Port without target negotiation.
+func (d *Dialer) resolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		// The Go resolver uses DNS over TCP framing since vsock connections are not packet connections.
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.dialHost(ctx)
+		},
+	}
+}
+
+// NewDoHResolver returns a net.Resolver that sends queries as DNS over HTTPS POST requests to url.
+// With a client from NewHTTPClient, TLS is terminated inside the enclave so the host can not modify answers.
+func NewDoHResolver(httpClient *http.Client, url string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(context.Context, string, string) (net.Conn, error) {
+			resolverSide, dohSide := net.Pipe()
+			go serveDoH(dohSide, httpClient, url)
+			return resolverSide, nil
+		},
+	}
+}
+
+// serveDoH reads length prefixed queries from conn, sends them to url and writes the length prefixed answers back.
+func serveDoH(conn net.Conn, httpClient *http.Client, url string) {
+	defer conn.Close() //nolint:errcheck
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for {
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		query := make([]byte, length)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		answer, err := exchangeDoH(ctx, httpClient, url, query)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(answer)))); err != nil { //nolint:gosec // checked by exchangeDoH
+			return
+		}
+		if _, err := conn.Write(answer); err != nil {
+			return
+		}
+	}
+}
+
+func exchangeDoH(ctx context.Context, httpClient *http.Client, url string, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(query))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DoH request: %w", err)
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send DoH request: %w", err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected DoH response status: %s", resp.Status)
+	}
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DoH response: %w", err)
+	}
+	if len(answer) > maxDNSMessageSize {
+		return nil, fmt.Errorf("DoH response is larger than %d bytes", maxDNSMessageSize)
+	}
+	return answer, nil
+}
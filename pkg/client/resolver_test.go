@@ -0,0 +1,77 @@
+package client_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/client"
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tunnel"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// answer replies to A queries for example.test with 192.0.2.10.
+func answer(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg).SetReply(req)
+	if question := req.Question[0]; question.Qtype == dns.TypeA && question.Name == "example.test." {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.10"),
+		})
+	}
+	return resp
+}
+
+func TestResolverThroughBridge(t *testing.T) {
+	t.Parallel()
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	upstream := &dns.Server{PacketConn: packetConn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		_ = w.WriteMsg(answer(req))
+	})}
+	go func() { _ = upstream.ActivateAndServe() }()
+	defer upstream.Shutdown() //nolint:errcheck
+
+	dnsTunnel, err := tunnel.NewDNSTunnel(&config.DNSSettings{Upstream: packetConn.LocalAddr().String()}, zerolog.Nop())
+	require.NoError(t, err)
+	dialer := client.NewDialer(53)
+	dialer.SetDialVsock(func(uint32, uint32) (net.Conn, error) {
+		enclaveSide, bridgeSide := net.Pipe()
+		go dnsTunnel.HandleConn(t.Context(), bridgeSide)
+		return enclaveSide, nil
+	})
+
+	addrs, err := dialer.Resolver().LookupHost(t.Context(), "example.test.")
+	require.NoError(t, err)
+	require.Equal(t, []string{"192.0.2.10"}, addrs)
+}
+
+func TestDoHResolver(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err != nil || r.Header.Get("Content-Type") != "application/dns-message" || req.Unpack(body) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp, err := answer(req).Pack()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(resp)
+	}))
+	defer server.Close()
+
+	resolver := client.NewDoHResolver(server.Client(), server.URL+"/dns-query")
+	addrs, err := resolver.LookupHost(t.Context(), "example.test.")
+	require.NoError(t, err)
+	require.Equal(t, []string{"192.0.2.10"}, addrs)
+}
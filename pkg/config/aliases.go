@@ -0,0 +1,25 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// AliasSettings maps alias names requested by the enclave to one or more backend addresses.
+// Backends are tried in order. A backend is either a host:port or unix:/path/to/socket.
+type AliasSettings map[string][]string
+
+// LoadAliasSettings reads alias settings from a JSON file.
+func LoadAliasSettings(path string) (AliasSettings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alias file: %w", err)
+	}
+	var settings AliasSettings
+	err = json.Unmarshal(data, &settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal alias file: %w", err)
+	}
+	return settings, nil
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// LogRedactionSettings is the configuration of the masking of secrets in enclave logs.
+type LogRedactionSettings struct {
+	// Patterns are regular expressions masked in every string value, including messages of non-JSON lines.
+	Patterns []RedactionPattern `json:"patterns"`
+	// Fields are dot separated paths of fields whose values are masked. Keys are compared case-insensitively
+	// and a * segment matches any number of keys, so *.password masks password fields at any depth.
+	Fields []string `json:"fields"`
+	// Replacement replaces masked values. Defaults to [REDACTED].
+	Replacement string `json:"replacement"`
+}
+
+// RedactionPattern is a named regular expression masked in log values.
+type RedactionPattern struct {
+	// Name identifies the pattern in metrics. Defaults to the pattern.
+	Name string `json:"name"`
+	// Pattern is a regular expression in RE2 syntax, e.g. \b[0-9a-fA-F]{64}\b for 32 byte hex keys.
+	Pattern string `json:"pattern"`
+}
+
+// LoadLogRedactionSettings reads log redaction settings from a JSON file.
+func LoadLogRedactionSettings(path string) (*LogRedactionSettings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read log redaction file: %w", err)
+	}
+	var settings LogRedactionSettings
+	err = json.Unmarshal(data, &settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal log redaction file: %w", err)
+	}
+	return &settings, nil
+}
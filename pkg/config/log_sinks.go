@@ -0,0 +1,66 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Types of log sinks.
+const (
+	LogSinkStdout = "stdout"
+	LogSinkFile   = "file"
+	LogSinkSyslog = "syslog"
+	LogSinkOTLP   = "otlp"
+)
+
+// LogSinkSettings is the configuration of a destination of forwarded enclave logs.
+type LogSinkSettings struct {
+	// Type is the kind of sink: stdout, file, syslog or otlp.
+	Type string `json:"type"`
+	// Name identifies the sink in metrics. Defaults to the type and must be unique.
+	Name string `json:"name"`
+	// Level is the minimum level of entries written to the sink. Entries without a level are always written.
+	Level string `json:"level"`
+	// Format is the format of entries written by stdout, file and syslog sinks: json (default), logfmt or console.
+	Format string `json:"format"`
+	// BufferSize is the number of entries buffered for the sink. New entries are dropped while it is full.
+	// Defaults to 1024.
+	BufferSize int `json:"bufferSize"`
+
+	// Path is the file written by file sinks.
+	Path string `json:"path"`
+	// MaxBytes is the size at which the file is rotated. The file is never rotated if zero.
+	MaxBytes int64 `json:"maxBytes"`
+	// MaxFiles is the number of rotated files to keep.
+	MaxFiles int `json:"maxFiles"`
+
+	// Network is the transport of syslog sinks: udp, tcp, unix (stream) or unixgram.
+	Network string `json:"network"`
+	// Address is the host:port or socket path of the syslog server.
+	Address string `json:"address"`
+	// Facility is the syslog facility, e.g. user (default), daemon or local0.
+	Facility string `json:"facility"`
+
+	// Endpoint is the OTLP/HTTP logs URL of otlp sinks, e.g. http://collector:4318/v1/logs.
+	Endpoint string `json:"endpoint"`
+	// Headers are added to every export request, e.g. for authentication.
+	Headers map[string]string `json:"headers"`
+	// Timeout is the timeout of a single export request. Defaults to 10 seconds.
+	Timeout time.Duration `json:"timeout"`
+}
+
+// LoadLogSinkSettings reads log sink settings from a JSON file containing an array of sinks.
+func LoadLogSinkSettings(path string) ([]LogSinkSettings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read log sink file: %w", err)
+	}
+	var settings []LogSinkSettings
+	err = json.Unmarshal(data, &settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal log sink file: %w", err)
+	}
+	return settings, nil
+}
@@ -13,9 +13,9 @@ type TLSConfig struct {
 // LocalCertConfig contains the settings for the local certificates.
 type LocalCertConfig struct {
 	// CertFile is the path to the certificate file.
-	CertFile string `env:"CERT_FILE" yaml:"certFile"`
+	CertFile string `env:"CERT_FILE" json:"certFile" yaml:"certFile"`
 	// KeyFile is the path to the key file for the certificate.
-	KeyFile string `env:"KEY_FILE"  yaml:"keyFile"`
+	KeyFile string `env:"KEY_FILE"  json:"keyFile"  yaml:"keyFile"`
 }
 
 // ACMEConfig contains the settings for the ACME certificates.
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Types of actions the bridge takes when the watchdog of the active enclave fails.
+const (
+	WatchdogActionExit    = "exit"
+	WatchdogActionCommand = "command"
+	WatchdogActionWebhook = "webhook"
+	WatchdogActionAlert   = "alert"
+)
+
+// WatchdogActionSettings is the configuration of an action the bridge takes when the watchdog of the active
+// enclave fails. Actions are configured on the host, never by the enclave.
+type WatchdogActionSettings struct {
+	// Type is the kind of action: exit, command, webhook or alert.
+	Type string `json:"type"`
+	// ExitCode is the exit code of the bridge for exit actions.
+	ExitCode int `json:"exitCode"`
+	// Command is the program and arguments run by command actions, e.g. ["nitro-cli", "run-enclave", ...].
+	Command []string `json:"command"`
+	// URL is the URL webhook actions post the failure to.
+	URL string `json:"url"`
+	// Headers are added to webhook requests, e.g. for authentication.
+	Headers map[string]string `json:"headers"`
+	// Timeout limits command and webhook actions. Defaults to 30 seconds.
+	Timeout time.Duration `json:"timeout"`
+}
+
+// LoadWatchdogActionSettings reads watchdog action settings from a JSON file containing an array of actions.
+func LoadWatchdogActionSettings(path string) ([]WatchdogActionSettings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read watchdog action file: %w", err)
+	}
+	var settings []WatchdogActionSettings
+	err = json.Unmarshal(data, &settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal watchdog action file: %w", err)
+	}
+	return settings, nil
+}
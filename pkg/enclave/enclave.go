@@ -9,6 +9,7 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/ethereum/go-ethereum/crypto"
 )
@@ -20,6 +21,14 @@ const (
 	InitPort = uint32(5000)
 	// StdoutPort is the port used to send stdout to the enclave-bridge.
 	StdoutPort = uint32(4999)
+	// AliasPrefix is the prefix of a client tunnel target that names a bridge-side alias instead of a host:port.
+	AliasPrefix = "alias:"
+	// ClientIdentityPrefix is the prefix of the line a server tunnel with mutual TLS sends before forwarding
+	// a connection. The rest of the line is the distinguished name of the verified client certificate.
+	ClientIdentityPrefix = "client-identity:"
+	// ClientIdentityTimeout is how long an enclave server waits for the client identity or PROXY protocol header
+	// a server tunnel sends before the data of a connection.
+	ClientIdentityTimeout = 10 * time.Second
 )
 
 // ACK returns the ACK message used for communication between the enclave and the enclave-bridge.
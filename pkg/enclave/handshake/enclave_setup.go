@@ -3,9 +3,11 @@ package handshake
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -35,6 +37,21 @@ type BridgeHandshake struct {
 	ready       chan struct{}
 	err         error
 	environment map[string]string
+	status      *watchdog.Status
+	// heartbeatVersion is the highest heartbeat version the bridge supports, 0 for bridges that only accept
+	// legacy heartbeats.
+	heartbeatVersion int
+	// bridgeSessionKey is the bridge's public key of the key exchange that authenticates heartbeats,
+	// or nil if the bridge does not authenticate heartbeats.
+	bridgeSessionKey []byte
+}
+
+// SetStatus sets the status reported in the watchdog heartbeats to the enclave-bridge.
+// It must be called before FinishHandshakeAndWait.
+func (b *BridgeHandshake) SetStatus(status *watchdog.Status) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.status = status
 }
 
 // StartHandshake starts the enclave-bridge handshake process.
@@ -71,6 +88,22 @@ func (b *BridgeHandshake) StartHandshakeWithPort(ctx context.Context, initPort u
 		_ = b.conn.Close()
 		return retErr
 	}
+	if version, ok := b.environment[watchdog.HeartbeatVersionEnvVar]; ok {
+		delete(b.environment, watchdog.HeartbeatVersionEnvVar)
+		b.heartbeatVersion, err = strconv.Atoi(version)
+		if err != nil {
+			_ = b.conn.Close()
+			return fmt.Errorf("failed to parse heartbeat version: %w", err)
+		}
+	}
+	if sessionKey, ok := b.environment[watchdog.SessionKeyEnvVar]; ok {
+		delete(b.environment, watchdog.SessionKeyEnvVar)
+		b.bridgeSessionKey, err = base64.StdEncoding.DecodeString(sessionKey)
+		if err != nil {
+			_ = b.conn.Close()
+			return fmt.Errorf("failed to decode watchdog session key: %w", err)
+		}
+	}
 	return nil
 }
 
@@ -104,13 +137,29 @@ func (b *BridgeHandshake) Environment() map[string]string {
 
 // FinishHandshakeAndWait sends the final config to the enclave-bridge and starts the watchdog. This function runs indefinitely.
 // It returns an error if the handshake fails to complete or the watchdog fails for any reason.
+// If the enclave-bridge offered a session key, the heartbeats are authenticated with it.
 func (b *BridgeHandshake) FinishHandshakeAndWait(ctx context.Context, bridgeConfig *config.BridgeSettings) error {
 	b.mutex.Lock()
 	if b.conn == nil {
 		b.mutex.Unlock()
 		return ErrConnectionNotEstablished
 	}
-	marshaledSettings, err := json.Marshal(bridgeConfig)
+	settings := *bridgeConfig
+	var sessionKey []byte
+	if b.bridgeSessionKey != nil {
+		keyExchange, err := watchdog.NewKeyExchange()
+		if err != nil {
+			b.mutex.Unlock()
+			return err
+		}
+		sessionKey, err = keyExchange.SessionKey(b.bridgeSessionKey, settings.Watchdog.EnclaveID)
+		if err != nil {
+			b.mutex.Unlock()
+			return err
+		}
+		settings.Watchdog.SessionPublicKey = keyExchange.PublicKey()
+	}
+	marshaledSettings, err := json.Marshal(&settings)
 	if err != nil {
 		b.mutex.Unlock()
 		return fmt.Errorf("failed to marshal config: %w", err)
@@ -132,8 +181,12 @@ func (b *BridgeHandshake) FinishHandshakeAndWait(ctx context.Context, bridgeConf
 		_ = b.conn.Close()
 		b.markReady()
 	}()
+	opts := []watchdog.Option{watchdog.WithStatus(b.status), watchdog.WithHeartbeatVersion(b.heartbeatVersion)}
+	if sessionKey != nil {
+		opts = append(opts, watchdog.WithSessionKey(sessionKey))
+	}
 	b.mutex.Unlock()
-	return b.runWatchdog(ctx, bridgeConfig)
+	return b.runWatchdog(ctx, bridgeConfig, opts...)
 }
 
 // WaitForBridgeSetup waits for the enclave-bridge to be ready.
@@ -142,8 +195,8 @@ func (b *BridgeHandshake) WaitForBridgeSetup() error {
 	return b.err
 }
 
-func (b *BridgeHandshake) runWatchdog(ctx context.Context, bridgeConfig *config.BridgeSettings) error {
-	wd, err := watchdog.New(&bridgeConfig.Watchdog)
+func (b *BridgeHandshake) runWatchdog(ctx context.Context, bridgeConfig *config.BridgeSettings, opts ...watchdog.Option) error {
+	wd, err := watchdog.New(&bridgeConfig.Watchdog, opts...)
 	if err != nil {
 		return fmt.Errorf("failed to create watchdog: %w", err)
 	}
@@ -0,0 +1,335 @@
+package enclave
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/redact"
+	"github.com/mdlayher/vsock"
+)
+
+const (
+	// DefaultLogBufferSize is the default number of bytes of log lines buffered while the bridge is unreachable.
+	DefaultLogBufferSize = 1024 * 1024
+	// DefaultLogFlushTimeout is how long the cleanup function of GetAndSetDefaultLoggerWithSocket flushes buffered logs.
+	DefaultLogFlushTimeout = 5 * time.Second
+
+	logWriteTimeout     = 5 * time.Second
+	minLogDialBackoff   = 100 * time.Millisecond
+	maxLogDialBackoff   = 5 * time.Second
+	droppedLinesMessage = "Dropped log lines while the bridge was unreachable"
+)
+
+// LogWriterOption configures a LogWriter.
+type LogWriterOption func(*LogWriter)
+
+// WithLogBufferSize sets the number of bytes of log lines buffered while the bridge is unreachable.
+// The oldest lines are dropped once the buffer is full.
+func WithLogBufferSize(size int) LogWriterOption {
+	return func(w *LogWriter) {
+		w.maxBuffered = size
+	}
+}
+
+// WithConsoleMirror also writes every log line to console, e.g. os.Stderr, which is visible with
+// nitro-cli console when the enclave runs in debug mode.
+func WithConsoleMirror(console io.Writer) LogWriterOption {
+	return func(w *LogWriter) {
+		w.console = console
+	}
+}
+
+// WithLogRedactor masks secrets in every line before it is buffered or mirrored, so they never leave the enclave.
+// zerolog hooks can not rewrite fields of an event, so redaction happens on the encoded line instead.
+func WithLogRedactor(redactor *redact.Redactor) LogWriterOption {
+	return func(w *LogWriter) {
+		w.redactor = redactor
+	}
+}
+
+// WithLogDialer replaces the vsock dial to the bridge's stdout port, e.g. for tests.
+func WithLogDialer(dial func(ctx context.Context) (net.Conn, error)) LogWriterOption {
+	return func(w *LogWriter) {
+		w.dial = dial
+	}
+}
+
+// LogWriterStats are the counters of a LogWriter.
+type LogWriterStats struct {
+	// Buffered is the number of lines waiting to be sent.
+	Buffered int
+	// Dropped is the number of lines dropped because the buffer was full.
+	Dropped uint64
+	// Reconnects is the number of times the connection to the bridge was re-established.
+	Reconnects uint64
+}
+
+// LogWriter is an io.Writer that forwards log lines to the bridge over vsock.
+// Writes never block on the bridge: lines are buffered in a bounded ring and sent by a background goroutine
+// that dials the bridge, reconnects with backoff when it is unreachable or restarts, and replays the buffered
+// lines. Once reconnected after lines were dropped, a warning with the number of dropped lines is sent first.
+// Every call to Write is treated as one line, as written by zerolog.
+type LogWriter struct {
+	dial        func(ctx context.Context) (net.Conn, error)
+	console     io.Writer
+	redactor    *redact.Redactor
+	maxBuffered int
+
+	mu             sync.Mutex
+	lines          [][]byte
+	firstSeq       uint64
+	bufferedBytes  int
+	dropped        uint64
+	droppedPending uint64
+	reconnects     uint64
+	closed         bool
+	drained        chan struct{}
+	conn           net.Conn
+
+	notify chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewLogWriter starts forwarding log lines to the bridge's stdout tunnel on port, e.g. StdoutPort.
+func NewLogWriter(port uint32, opts ...LogWriterOption) *LogWriter {
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := &LogWriter{
+		dial: func(context.Context) (net.Conn, error) {
+			return vsock.Dial(DefaultHostCID, port, nil)
+		},
+		maxBuffered: DefaultLogBufferSize,
+		notify:      make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	for _, opt := range opts {
+		opt(writer)
+	}
+	go writer.run()
+	return writer
+}
+
+// Write buffers a copy of p to be sent to the bridge. It returns net.ErrClosed after Shutdown.
+func (w *LogWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	if w.redactor != nil {
+		line, counts := w.redactor.Line(bytes.TrimSuffix(p, []byte("\n")))
+		if len(counts) > 0 {
+			p = append(line, '\n')
+		}
+	}
+	if w.console != nil {
+		_, _ = w.console.Write(p)
+	}
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	if len(p) > w.maxBuffered {
+		w.dropped++
+		w.droppedPending++
+		w.mu.Unlock()
+		return written, nil
+	}
+	for w.bufferedBytes+len(p) > w.maxBuffered {
+		w.bufferedBytes -= len(w.lines[0])
+		w.lines[0] = nil
+		w.lines = w.lines[1:]
+		w.firstSeq++
+		w.dropped++
+		w.droppedPending++
+	}
+	w.lines = append(w.lines, append([]byte(nil), p...))
+	w.bufferedBytes += len(p)
+	w.mu.Unlock()
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+	return written, nil
+}
+
+// Stats returns the counters of the writer.
+func (w *LogWriter) Stats() LogWriterStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return LogWriterStats{Buffered: len(w.lines), Dropped: w.dropped, Reconnects: w.reconnects}
+}
+
+// Shutdown stops accepting lines and waits until the buffered lines are sent or ctx is done.
+// The connection to the bridge is closed afterwards.
+func (w *LogWriter) Shutdown(ctx context.Context) error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	var drained chan struct{}
+	if len(w.lines) > 0 {
+		drained = make(chan struct{})
+		w.drained = drained
+	}
+	w.mu.Unlock()
+
+	var err error
+	if drained != nil {
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			err = fmt.Errorf("failed to flush %d log lines: %w", w.Stats().Buffered, ctx.Err())
+		}
+	}
+	close(w.stop)
+	w.cancel()
+	// Closing the connection interrupts a pending write.
+	w.mu.Lock()
+	if w.conn != nil {
+		_ = w.conn.Close()
+	}
+	w.mu.Unlock()
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+	}
+	return err
+}
+
+// run sends the buffered lines until the writer is shut down.
+func (w *LogWriter) run() {
+	defer close(w.done)
+	defer w.setConn(nil)
+	backoff := minLogDialBackoff
+	wait := func() bool {
+		select {
+		case <-w.stop:
+			return false
+		case <-time.After(backoff):
+			backoff = min(backoff*2, maxLogDialBackoff)
+			return true
+		}
+	}
+	var conn net.Conn
+	connected := false
+	for {
+		line, seq, dropped, ok := w.next()
+		if !ok {
+			return
+		}
+		if conn == nil {
+			var err error
+			conn, err = w.dial(w.ctx)
+			if err != nil {
+				conn = nil
+				if !wait() {
+					return
+				}
+				continue
+			}
+			if !w.setConn(conn) {
+				return
+			}
+			if connected {
+				w.mu.Lock()
+				w.reconnects++
+				w.mu.Unlock()
+			}
+			connected = true
+			backoff = minLogDialBackoff
+		}
+		if dropped > 0 {
+			line = fmt.Appendf(nil, `{"level":"warn","time":%q,"message":%q,"dropped_lines":%d}`+"\n",
+				time.Now().UTC().Format(time.RFC3339), droppedLinesMessage, dropped)
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(logWriteTimeout))
+		if _, err := conn.Write(line); err != nil {
+			// The line stays buffered and is replayed on the next connection.
+			conn = nil
+			w.setConn(nil)
+			if !wait() {
+				return
+			}
+			continue
+		}
+		w.sent(seq, dropped)
+	}
+}
+
+// setConn replaces the connection to the bridge, closing the previous one.
+// It closes conn and returns false if the writer was stopped in the meantime.
+func (w *LogWriter) setConn(conn net.Conn) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn != nil {
+		_ = w.conn.Close()
+	}
+	w.conn = conn
+	select {
+	case <-w.stop:
+		if conn != nil {
+			_ = conn.Close()
+			w.conn = nil
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+// next waits for the next line to send and returns it with its sequence number. If lines were dropped since
+// the last notice, it returns their number instead so the notice is sent first.
+// It returns false once the writer is stopped.
+func (w *LogWriter) next() ([]byte, uint64, uint64, bool) {
+	for {
+		w.mu.Lock()
+		if w.droppedPending > 0 {
+			dropped := w.droppedPending
+			w.mu.Unlock()
+			return nil, 0, dropped, true
+		}
+		if len(w.lines) > 0 {
+			line, seq := w.lines[0], w.firstSeq
+			w.mu.Unlock()
+			return line, seq, 0, true
+		}
+		w.mu.Unlock()
+		select {
+		case <-w.notify:
+		case <-w.stop:
+			return nil, 0, 0, false
+		}
+	}
+}
+
+// sent removes the line with sequence number seq, unless it was dropped while it was sent, or the dropped notice.
+func (w *LogWriter) sent(seq, dropped uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if dropped > 0 {
+		w.droppedPending -= dropped
+		return
+	}
+	if len(w.lines) == 0 || w.firstSeq != seq {
+		return
+	}
+	w.bufferedBytes -= len(w.lines[0])
+	w.lines[0] = nil
+	w.lines = w.lines[1:]
+	w.firstSeq++
+	if len(w.lines) == 0 && w.drained != nil {
+		close(w.drained)
+		w.drained = nil
+	}
+}
@@ -0,0 +1,154 @@
+package enclave_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
+	"github.com/DIMO-Network/enclave-bridge/pkg/redact"
+	"github.com/stretchr/testify/require"
+)
+
+// logBridge is a stand-in for the bridge's stdout tunnel that can be taken offline.
+type logBridge struct {
+	listener net.Listener
+	online   atomic.Bool
+	conns    chan net.Conn
+}
+
+func newLogBridge(t *testing.T) *logBridge {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	bridge := &logBridge{listener: listener, conns: make(chan net.Conn, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			bridge.conns <- conn
+		}
+	}()
+	return bridge
+}
+
+func (b *logBridge) dial(ctx context.Context) (net.Conn, error) {
+	if !b.online.Load() {
+		return nil, errors.New("connection refused")
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", b.listener.Addr().String())
+}
+
+// readLines reads n lines from the next connection.
+func (b *logBridge) readLines(t *testing.T, n int) (net.Conn, []string) {
+	t.Helper()
+	var conn net.Conn
+	select {
+	case conn = <-b.conns:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection from log writer")
+	}
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	reader := bufio.NewReader(conn)
+	lines := make([]string, 0, n)
+	for range n {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	return conn, lines
+}
+
+func TestLogWriterBuffersAndReplays(t *testing.T) {
+	t.Parallel()
+	bridge := newLogBridge(t)
+	var console bytes.Buffer
+	// Room for three of the ten byte lines.
+	writer := enclave.NewLogWriter(0, enclave.WithLogDialer(bridge.dial), enclave.WithLogBufferSize(30),
+		enclave.WithConsoleMirror(&console))
+
+	for i := range 5 {
+		_, err := fmt.Fprintf(writer, "line %04d\n", i)
+		require.NoError(t, err)
+	}
+	require.Equal(t, enclave.LogWriterStats{Buffered: 3, Dropped: 2}, writer.Stats())
+	require.Equal(t, 5, strings.Count(console.String(), "\n"))
+
+	bridge.online.Store(true)
+	conn, lines := bridge.readLines(t, 4)
+	require.Contains(t, lines[0], `"dropped_lines":2`)
+	require.Equal(t, []string{"line 0002", "line 0003", "line 0004"}, lines[1:])
+
+	// The bridge restarts: lines written while it is down are replayed on the next connection.
+	bridge.online.Store(false)
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool {
+		_, _ = fmt.Fprintf(writer, "probe\n")
+		return writer.Stats().Buffered > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err := fmt.Fprintf(writer, "line 0005\n")
+	require.NoError(t, err)
+	bridge.online.Store(true)
+
+	require.NoError(t, writer.Shutdown(t.Context()))
+	stats := writer.Stats()
+	require.Zero(t, stats.Buffered)
+	require.Equal(t, uint64(1), stats.Reconnects)
+	conn, lines = bridge.readLines(t, 1)
+	defer conn.Close() //nolint:errcheck
+	rest := bufio.NewScanner(conn)
+	for rest.Scan() {
+		lines = append(lines, rest.Text())
+	}
+	require.Equal(t, "line 0005", lines[len(lines)-1])
+
+	_, err = writer.Write([]byte("late\n"))
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestLogWriterShutdownDeadline(t *testing.T) {
+	t.Parallel()
+	bridge := newLogBridge(t)
+	writer := enclave.NewLogWriter(0, enclave.WithLogDialer(bridge.dial))
+	_, err := writer.Write([]byte("never sent\n"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	err = writer.Shutdown(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorContains(t, err, "1 log lines")
+}
+
+func TestLogWriterRedacts(t *testing.T) {
+	t.Parallel()
+	bridge := newLogBridge(t)
+	bridge.online.Store(true)
+	redactor, err := redact.New(&config.LogRedactionSettings{Fields: []string{"*.token"}})
+	require.NoError(t, err)
+	var console bytes.Buffer
+	writer := enclave.NewLogWriter(0, enclave.WithLogDialer(bridge.dial), enclave.WithLogRedactor(redactor),
+		enclave.WithConsoleMirror(&console))
+	line := `{"level":"info","token":"secret"}` + "\n"
+	n, err := writer.Write([]byte(line))
+	require.NoError(t, err)
+	require.Equal(t, len(line), n)
+	require.NoError(t, writer.Shutdown(t.Context()))
+
+	conn, lines := bridge.readLines(t, 1)
+	defer conn.Close() //nolint:errcheck
+	require.Equal(t, `{"level":"info","token":"[REDACTED]"}`, lines[0])
+	require.NotContains(t, console.String(), "secret")
+}
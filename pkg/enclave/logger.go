@@ -1,11 +1,11 @@
 package enclave
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"runtime/debug"
 
-	"github.com/mdlayher/vsock"
 	"github.com/rs/zerolog"
 )
 
@@ -36,15 +36,17 @@ func SetLoggerLevel(level string) error {
 	return nil
 }
 
-// GetAndSetDefaultLoggerWithSocket creates a new logger that logs to a vsock socket and sets it as the default context logger.
-func GetAndSetDefaultLoggerWithSocket(appName string, port uint32) (zerolog.Logger, func(), error) {
-	conn, err := vsock.Dial(DefaultHostCID, port, nil)
-	if err != nil {
-		return zerolog.Logger{}, nil, fmt.Errorf("failed to dial socket: %w", err)
+// GetAndSetDefaultLoggerWithSocket creates a new logger that logs to the bridge's stdout tunnel on port and sets it
+// as the default context logger. Logs are written through a LogWriter, so the bridge does not need to be listening
+// yet and logs survive bridge restarts. The returned function flushes buffered logs for up to
+// DefaultLogFlushTimeout and closes the connection.
+func GetAndSetDefaultLoggerWithSocket(appName string, port uint32, opts ...LogWriterOption) (zerolog.Logger, func(), error) {
+	writer := NewLogWriter(port, opts...)
+	closeWriter := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultLogFlushTimeout)
+		defer cancel()
+		_ = writer.Shutdown(ctx) //nolint:errcheck
 	}
-	close := func() {
-		_ = conn.Close() //nolint:errcheck
-	}
-	logger := GetAndSetDefaultLogger(appName, conn)
-	return logger, close, nil
+	logger := GetAndSetDefaultLogger(appName, writer)
+	return logger, closeWriter, nil
 }
@@ -0,0 +1,359 @@
+// Package federate exposes the Prometheus metrics of enclaves on the host. Enclaves have no network, so the bridge
+// scrapes the metrics an enclave serves on a vsock port and re-labels them with the app name and context ID of the
+// enclave.
+package federate
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/vsock"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// LabelEnclaveApp is the label added to every scraped series with the app name of the enclave.
+	LabelEnclaveApp = "enclave_app"
+	// LabelEnclaveCID is the label added to every scraped series with the context ID of the enclave.
+	LabelEnclaveCID = "enclave_cid"
+	// exportedLabelPrefix is prepended to labels of scraped series that clash with the labels added by the bridge.
+	exportedLabelPrefix = "exported_"
+
+	// DefaultScrapeTimeout is the default timeout of a scrape of an enclave, including connecting to it.
+	DefaultScrapeTimeout = 5 * time.Second
+	// DefaultMaxScrapeBytes is the default maximum size of the metrics of an enclave.
+	DefaultMaxScrapeBytes = 16 * 1024 * 1024
+	// DefaultMaxScrapeFamilies is the default maximum number of metric families of an enclave.
+	DefaultMaxScrapeFamilies = 1000
+	// DefaultMaxScrapeSeries is the default maximum number of series of an enclave.
+	DefaultMaxScrapeSeries = 20000
+
+	// upMetricName is the name of the series reporting whether the last scrape of an enclave succeeded.
+	upMetricName = metricsNamespace + "_enclave_up"
+	// acceptHeader prefers the protobuf format and falls back to the text format.
+	acceptHeader = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3`
+)
+
+// Target is an enclave whose metrics are scraped.
+type Target struct {
+	AppName string
+	CID     uint32
+	Port    uint32
+	// Timeout is the timeout of a scrape. Defaults to DefaultScrapeTimeout.
+	Timeout time.Duration
+}
+
+// ErrScrapeLimit is returned for the scrape of an enclave whose metrics exceed the ScrapeLimits of the Gatherer.
+var ErrScrapeLimit = errors.New("scrape limit exceeded")
+
+// DialFunc dials the metrics port of an enclave. The Gatherer stops waiting for it when the scrape times out.
+type DialFunc func(ctx context.Context, cid, port uint32) (net.Conn, error)
+
+// ScrapeLimits bounds the metrics scraped from one enclave. Scrapes that exceed a limit fail.
+type ScrapeLimits struct {
+	// MaxBytes is the maximum size of the response. Defaults to DefaultMaxScrapeBytes.
+	MaxBytes int64
+	// MaxFamilies is the maximum number of metric families. Defaults to DefaultMaxScrapeFamilies.
+	MaxFamilies int
+	// MaxSeries is the maximum number of series across all families. Defaults to DefaultMaxScrapeSeries.
+	MaxSeries int
+}
+
+// Option configures a Gatherer.
+type Option func(*Gatherer)
+
+// WithDialer replaces the vsock dialer, e.g. for tests.
+func WithDialer(dial DialFunc) Option {
+	return func(g *Gatherer) {
+		g.dial = dial
+	}
+}
+
+// WithScrapeLimits replaces the default limits of a scrape. Zero fields keep their defaults.
+func WithScrapeLimits(limits ScrapeLimits) Option {
+	return func(g *Gatherer) {
+		if limits.MaxBytes > 0 {
+			g.limits.MaxBytes = limits.MaxBytes
+		}
+		if limits.MaxFamilies > 0 {
+			g.limits.MaxFamilies = limits.MaxFamilies
+		}
+		if limits.MaxSeries > 0 {
+			g.limits.MaxSeries = limits.MaxSeries
+		}
+	}
+}
+
+// Gatherer is a prometheus.Gatherer that scrapes the metrics of enclaves whenever it is gathered.
+// Scraped series get the LabelEnclaveApp and LabelEnclaveCID labels and lose their timestamps, and an
+// enclave_bridge_enclave_up series reports whether the scrape of each enclave succeeded.
+// Nothing is cached: series of an enclave that can not be scraped or has gone disappear from the next gather,
+// so Prometheus marks them stale instead of repeating their last values.
+type Gatherer struct {
+	targets func() []Target
+	dial    DialFunc
+	limits  ScrapeLimits
+	client  *http.Client
+	logger  zerolog.Logger
+}
+
+// NewGatherer creates a Gatherer for the enclaves returned by targets.
+func NewGatherer(targets func() []Target, logger zerolog.Logger, opts ...Option) *Gatherer {
+	gatherer := &Gatherer{
+		targets: targets,
+		dial: func(_ context.Context, cid, port uint32) (net.Conn, error) {
+			return vsock.Dial(cid, port, nil)
+		},
+		limits: ScrapeLimits{
+			MaxBytes:    DefaultMaxScrapeBytes,
+			MaxFamilies: DefaultMaxScrapeFamilies,
+			MaxSeries:   DefaultMaxScrapeSeries,
+		},
+		logger: logger,
+	}
+	for _, opt := range opts {
+		opt(gatherer)
+	}
+	gatherer.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+				cid, port, err := parseTargetAddr(addr)
+				if err != nil {
+					return nil, err
+				}
+				return dialContext(ctx, gatherer.dial, cid, port)
+			},
+			// Enclaves come and go with deployments, so connections are not kept.
+			DisableKeepAlives: true,
+		},
+	}
+	return gatherer
+}
+
+// Gather scrapes all targets concurrently. Families of scraped series are merged across enclaves.
+// The returned error joins the errors of failed scrapes and conflicting families; the families gathered anyway
+// are returned with it.
+func (g *Gatherer) Gather() ([]*dto.MetricFamily, error) {
+	targets := slices.Clone(g.targets())
+	slices.SortFunc(targets, func(a, b Target) int {
+		return cmp.Compare(a.CID, b.CID)
+	})
+	results := make([][]*dto.MetricFamily, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = g.scrape(target)
+		}()
+	}
+	wg.Wait()
+
+	up := &dto.MetricFamily{
+		Name: proto.String(upMetricName),
+		Help: proto.String("Whether the last scrape of the metrics of an enclave succeeded (1) or failed (0)."),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	families := map[string]*dto.MetricFamily{upMetricName: up}
+	for i, target := range targets {
+		value := 1.0
+		if errs[i] != nil {
+			value = 0
+			g.logger.Warn().Err(errs[i]).Str("appName", target.AppName).Uint32("cid", target.CID).
+				Msg("Failed to scrape enclave metrics")
+		}
+		up.Metric = append(up.Metric, &dto.Metric{
+			Label: targetLabels(target),
+			Gauge: &dto.Gauge{Value: proto.Float64(value)},
+		})
+		for _, family := range results[i] {
+			merged, ok := families[family.GetName()]
+			if !ok {
+				families[family.GetName()] = family
+				continue
+			}
+			if merged.GetType() != family.GetType() {
+				errs = append(errs, fmt.Errorf("metric family %s of enclave %d has type %s but was gathered as %s",
+					family.GetName(), target.CID, family.GetType(), merged.GetType()))
+				continue
+			}
+			merged.Metric = append(merged.Metric, family.Metric...)
+		}
+	}
+	gathered := make([]*dto.MetricFamily, 0, len(families))
+	for _, family := range families {
+		gathered = append(gathered, family)
+	}
+	slices.SortFunc(gathered, func(a, b *dto.MetricFamily) int {
+		return strings.Compare(a.GetName(), b.GetName())
+	})
+	return gathered, errors.Join(errs...)
+}
+
+// scrape gets the metrics of an enclave and re-labels them.
+func (g *Gatherer) scrape(target Target) ([]*dto.MetricFamily, error) {
+	timeout := target.Timeout
+	if timeout <= 0 {
+		timeout = DefaultScrapeTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	start := time.Now()
+	families, err := g.fetch(ctx, target)
+	scrapeDuration.WithLabelValues(target.AppName).Observe(time.Since(start).Seconds())
+	if err != nil {
+		scrapesTotal.WithLabelValues(target.AppName, "failed").Inc()
+		return nil, err
+	}
+	scrapesTotal.WithLabelValues(target.AppName, "success").Inc()
+	labels := targetLabels(target)
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			relabel(metric, labels)
+		}
+	}
+	return families, nil
+}
+
+func (g *Gatherer) fetch(ctx context.Context, target Target) ([]*dto.MetricFamily, error) {
+	url := "http://" + net.JoinHostPort(strconv.FormatUint(uint64(target.CID), 10),
+		strconv.FormatUint(uint64(target.Port), 10)) + "/metrics"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scrape request: %w", err)
+	}
+	req.Header.Set("Accept", acceptHeader)
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scrape enclave %d: %w", target.CID, err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to scrape enclave %d: unexpected status %s", target.CID, resp.Status)
+	}
+	body := &limitedReader{reader: io.LimitReader(resp.Body, g.limits.MaxBytes+1), remaining: g.limits.MaxBytes}
+	decoder := expfmt.NewDecoder(body, expfmt.ResponseFormat(resp.Header))
+	var families []*dto.MetricFamily
+	series := 0
+	for {
+		family := &dto.MetricFamily{}
+		err := decoder.Decode(family)
+		if errors.Is(err, io.EOF) {
+			return families, nil
+		}
+		if errors.Is(err, ErrScrapeLimit) {
+			return nil, fmt.Errorf("failed to scrape enclave %d: %w", target.CID, err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode metrics of enclave %d: %w", target.CID, err)
+		}
+		series += len(family.Metric)
+		switch {
+		case len(families) >= g.limits.MaxFamilies:
+			return nil, fmt.Errorf("failed to scrape enclave %d: %w: more than %d metric families",
+				target.CID, ErrScrapeLimit, g.limits.MaxFamilies)
+		case series > g.limits.MaxSeries:
+			return nil, fmt.Errorf("failed to scrape enclave %d: %w: more than %d series",
+				target.CID, ErrScrapeLimit, g.limits.MaxSeries)
+		}
+		families = append(families, family)
+	}
+}
+
+// limitedReader fails with ErrScrapeLimit once more than remaining bytes are read.
+type limitedReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.reader.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return 0, fmt.Errorf("%w: response is larger than the maximum size", ErrScrapeLimit)
+	}
+	return n, err
+}
+
+// dialContext calls dial, returning early if the context is done, since the vsock dialer does not take a context.
+func dialContext(ctx context.Context, dial DialFunc, cid, port uint32) (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	resultChan := make(chan dialResult, 1)
+	go func() {
+		conn, err := dial(ctx, cid, port)
+		resultChan <- dialResult{conn: conn, err: err}
+	}()
+	select {
+	case <-ctx.Done():
+		go func() {
+			// Close the connection if the dial completes after we stopped waiting.
+			if result := <-resultChan; result.conn != nil {
+				_ = result.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	case result := <-resultChan:
+		return result.conn, result.err
+	}
+}
+
+// relabel adds labels to a scraped metric, renaming clashing labels of the enclave with exportedLabelPrefix, and
+// drops its timestamp so Prometheus applies staleness to it.
+func relabel(metric *dto.Metric, labels []*dto.LabelPair) {
+	for _, pair := range metric.Label {
+		for _, label := range labels {
+			if pair.GetName() == label.GetName() {
+				pair.Name = proto.String(exportedLabelPrefix + pair.GetName())
+			}
+		}
+	}
+	metric.Label = append(metric.Label, labels...)
+	slices.SortFunc(metric.Label, func(a, b *dto.LabelPair) int {
+		return strings.Compare(a.GetName(), b.GetName())
+	})
+	metric.TimestampMs = nil
+}
+
+func targetLabels(target Target) []*dto.LabelPair {
+	return []*dto.LabelPair{
+		{Name: proto.String(LabelEnclaveApp), Value: proto.String(target.AppName)},
+		{Name: proto.String(LabelEnclaveCID), Value: proto.String(strconv.FormatUint(uint64(target.CID), 10))},
+	}
+}
+
+// parseTargetAddr parses the cid:port address of a scrape request.
+func parseTargetAddr(addr string) (uint32, uint32, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid enclave address %q: %w", addr, err)
+	}
+	cid, err := strconv.ParseUint(host, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid enclave context ID %q: %w", host, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid enclave port %q: %w", portStr, err)
+	}
+	return uint32(cid), uint32(port), nil
+}
+
+var _ prometheus.Gatherer = (*Gatherer)(nil)
@@ -0,0 +1,188 @@
+package federate_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/federate"
+	"github.com/DIMO-Network/enclave-bridge/pkg/server"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// enclaves maps context IDs to the addresses of stand-ins for the metrics servers of enclaves.
+type enclaves map[uint32]string
+
+func (e enclaves) dial(ctx context.Context, cid, _ uint32) (net.Conn, error) {
+	addr, ok := e[cid]
+	if !ok {
+		return nil, fmt.Errorf("no enclave with context ID %d", cid)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// serveEnclaveMetrics serves a registry with server.ServeMetrics like an enclave does and returns its address.
+func serveEnclaveMetrics(t *testing.T, registry *prometheus.Registry) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- server.ServeMetrics(ctx, listener, registry)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+	return listener.Addr().String()
+}
+
+func TestGathererRelabelsEnclaveMetrics(t *testing.T) {
+	t.Parallel()
+	registry := prometheus.NewRegistry()
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "app_requests_total", Help: "Requests."}, []string{"code"})
+	registry.MustRegister(requests)
+	requests.WithLabelValues("200").Add(3)
+
+	// An enclave exposing its own enclave_app label and a timestamp.
+	legacy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = fmt.Fprint(w, "# HELP app_requests_total Requests.\n# TYPE app_requests_total counter\n"+
+			`app_requests_total{code="500",enclave_app="inner"} 2 1700000000000`+"\n")
+	}))
+	t.Cleanup(legacy.Close)
+
+	addrs := enclaves{16: serveEnclaveMetrics(t, registry), 17: strings.TrimPrefix(legacy.URL, "http://")}
+	targets := []federate.Target{
+		{AppName: "legacy", CID: 17, Port: 9000},
+		{AppName: "app", CID: 16, Port: 9000},
+		{AppName: "gone", CID: 18, Port: 9000},
+	}
+	gatherer := federate.NewGatherer(func() []federate.Target { return targets }, zerolog.Nop(),
+		federate.WithDialer(addrs.dial))
+
+	families, err := gatherer.Gather()
+	require.ErrorContains(t, err, "no enclave with context ID 18")
+	require.Len(t, families, 2)
+	require.Equal(t, "app_requests_total", families[0].GetName())
+	require.Equal(t, "enclave_bridge_enclave_up", families[1].GetName())
+
+	require.Equal(t, []string{
+		`code="200",enclave_app="app",enclave_cid="16"`,
+		`code="500",enclave_app="legacy",enclave_cid="17",exported_enclave_app="inner"`,
+	}, labelStrings(families[0]))
+	for _, metric := range families[0].Metric {
+		require.Nil(t, metric.TimestampMs)
+	}
+	require.InDelta(t, 3, families[0].Metric[0].GetCounter().GetValue(), 0)
+
+	require.Equal(t, []string{
+		`enclave_app="app",enclave_cid="16"`,
+		`enclave_app="legacy",enclave_cid="17"`,
+		`enclave_app="gone",enclave_cid="18"`,
+	}, labelStrings(families[1]))
+	up := make([]float64, 0, len(families[1].Metric))
+	for _, metric := range families[1].Metric {
+		up = append(up, metric.GetGauge().GetValue())
+	}
+	require.Equal(t, []float64{1, 1, 0}, up)
+}
+
+func TestGathererScrapeTimeout(t *testing.T) {
+	t.Parallel()
+	hanging := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(hanging.Close)
+	addrs := enclaves{16: strings.TrimPrefix(hanging.URL, "http://")}
+	gatherer := federate.NewGatherer(func() []federate.Target {
+		return []federate.Target{{AppName: "app", CID: 16, Port: 9000, Timeout: 100 * time.Millisecond}}
+	}, zerolog.Nop(), federate.WithDialer(addrs.dial))
+
+	start := time.Now()
+	families, err := gatherer.Gather()
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Len(t, families, 1)
+	require.Zero(t, families[0].Metric[0].GetGauge().GetValue())
+}
+
+func TestGathererDialTimeout(t *testing.T) {
+	t.Parallel()
+	// A dialer that ignores the context, like vsock.Dial.
+	blocked := make(chan struct{})
+	t.Cleanup(func() { close(blocked) })
+	gatherer := federate.NewGatherer(func() []federate.Target {
+		return []federate.Target{{AppName: "app", CID: 16, Port: 9000, Timeout: 100 * time.Millisecond}}
+	}, zerolog.Nop(), federate.WithDialer(func(context.Context, uint32, uint32) (net.Conn, error) {
+		<-blocked
+		return nil, errors.New("unreachable")
+	}))
+
+	start := time.Now()
+	_, err := gatherer.Gather()
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestGathererScrapeLimits(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name    string
+		limits  federate.ScrapeLimits
+		wantErr string
+	}{
+		{name: "within limits", limits: federate.ScrapeLimits{MaxBytes: 1024, MaxFamilies: 2, MaxSeries: 3}},
+		{name: "too large", limits: federate.ScrapeLimits{MaxBytes: 50}, wantErr: "larger than the maximum size"},
+		{name: "too many families", limits: federate.ScrapeLimits{MaxFamilies: 1}, wantErr: "more than 1 metric families"},
+		{name: "too many series", limits: federate.ScrapeLimits{MaxSeries: 2}, wantErr: "more than 2 series"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			enclave := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+				_, _ = fmt.Fprint(w, "# TYPE a_total counter\n"+`a_total{code="200"} 1`+"\n"+`a_total{code="500"} 2`+"\n"+
+					"# TYPE b gauge\nb 3\n")
+			}))
+			t.Cleanup(enclave.Close)
+			addrs := enclaves{16: strings.TrimPrefix(enclave.URL, "http://")}
+			gatherer := federate.NewGatherer(func() []federate.Target {
+				return []federate.Target{{AppName: "app", CID: 16, Port: 9000}}
+			}, zerolog.Nop(), federate.WithDialer(addrs.dial), federate.WithScrapeLimits(tc.limits))
+
+			families, err := gatherer.Gather()
+			if tc.wantErr == "" {
+				require.NoError(t, err)
+				require.Len(t, families, 3)
+				return
+			}
+			require.ErrorIs(t, err, federate.ErrScrapeLimit)
+			require.ErrorContains(t, err, tc.wantErr)
+			require.Len(t, families, 1)
+			require.Zero(t, families[0].Metric[0].GetGauge().GetValue())
+		})
+	}
+}
+
+func labelStrings(family *dto.MetricFamily) []string {
+	labels := make([]string, 0, len(family.Metric))
+	for _, metric := range family.Metric {
+		pairs := make([]string, 0, len(metric.Label))
+		for _, pair := range metric.Label {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", pair.GetName(), pair.GetValue()))
+		}
+		labels = append(labels, strings.Join(pairs, ","))
+	}
+	return labels
+}
@@ -0,0 +1,23 @@
+package federate
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "enclave_bridge"
+
+var (
+	scrapesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "enclave_metrics_scrapes_total",
+		Help:      "Number of scrapes of enclave metrics by result.",
+	}, []string{"enclave_app", "result"})
+
+	scrapeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "enclave_metrics_scrape_duration_seconds",
+		Help:      "Duration of scrapes of enclave metrics.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"enclave_app"})
+)
@@ -0,0 +1,13 @@
+package logchain
+
+import "crypto/ecdsa"
+
+// NewTestAttestedSigner creates a signer that writes document as its attestation, so tests can stub the verifier.
+func NewTestAttestedSigner(key *ecdsa.PrivateKey, document []byte) (*Signer, error) {
+	signer, err := NewUnattestedSigner(key)
+	if err != nil {
+		return nil, err
+	}
+	signer.attestation = document
+	return signer, nil
+}
@@ -0,0 +1,209 @@
+package logchain_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/logchain"
+	"github.com/DIMO-Network/enclave-bridge/pkg/logs"
+	"github.com/DIMO-Network/enclave-bridge/pkg/redact"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/hf/nitrite"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// writeChain writes count log lines through a chain and returns them as stored by the bridge's json sink.
+func writeChain(t *testing.T, count int) []string {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signer, err := logchain.NewUnattestedSigner(key)
+	require.NoError(t, err)
+	return writeSignedChain(t, signer, count)
+}
+
+func writeSignedChain(t *testing.T, signer *logchain.Signer, count int) []string {
+	t.Helper()
+	var enclaveOutput bytes.Buffer
+	writer, err := logchain.NewWriter(&enclaveOutput, signer, logchain.WithCheckpointEvery(4), logchain.WithCheckpointInterval(0))
+	require.NoError(t, err)
+	logger := zerolog.New(writer).With().Timestamp().Logger()
+	for i := range count {
+		logger.Info().Int("i", i).Float64("ratio", 0.5).Str("enclave_cid", "spoofed").Msg("hello <world>")
+	}
+	_, err = writer.Write([]byte("plain line\n"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	// The bridge parses every line, adds its fields and encodes it again.
+	formatter, err := logs.NewFormatter(logs.FormatJSON)
+	require.NoError(t, err)
+	var stored []string
+	source := logs.Source{EnclaveCID: 16, AppName: "app", ConnID: 1}
+	for line := range strings.SplitSeq(strings.TrimSuffix(enclaveOutput.String(), "\n"), "\n") {
+		encoded, err := formatter(logs.ParseLine([]byte(line), source, time.Now()))
+		require.NoError(t, err)
+		stored = append(stored, strings.TrimSuffix(string(encoded), "\n"))
+	}
+	return stored
+}
+
+func verify(t *testing.T, lines []string, opts logchain.VerifyOptions) *logchain.ChainReport {
+	t.Helper()
+	input := `{"level":"info","message":"bridge line"}` + "\n" + strings.Join(lines, "\n") + "\n"
+	reports, err := logchain.Verify(strings.NewReader(input), opts)
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	return reports[0]
+}
+
+func TestVerifyIntactChain(t *testing.T) {
+	t.Parallel()
+	lines := writeChain(t, 10)
+	// First record, ten lines, the plain line and the final checkpoint.
+	require.Len(t, lines, 13)
+
+	report := verify(t, lines, logchain.VerifyOptions{AllowUnattested: true})
+	require.Empty(t, report.Problems)
+	require.Equal(t, "app", report.AppName)
+	require.Equal(t, "16", report.EnclaveCID)
+	require.Equal(t, 13, report.Records)
+	require.True(t, report.Signed)
+	require.Equal(t, uint64(12), report.SignedThrough)
+	require.Zero(t, report.Unsigned())
+	require.False(t, report.Attested)
+
+	report = verify(t, lines, logchain.VerifyOptions{})
+	require.Equal(t, []string{"line 2: signing key is not attested"}, report.Problems)
+}
+
+func TestVerifyAttestation(t *testing.T) {
+	t.Parallel()
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signer, err := logchain.NewTestAttestedSigner(key, []byte("document"))
+	require.NoError(t, err)
+	lines := writeSignedChain(t, signer, 2)
+	release := bytes.Repeat([]byte{1}, 48)
+	debug := make([]byte, 48)
+
+	for _, tc := range []struct {
+		name    string
+		pcr0    []byte
+		opts    logchain.VerifyOptions
+		problem string
+	}{
+		{
+			name: "matching PCR",
+			pcr0: release,
+			opts: logchain.VerifyOptions{PCRs: map[uint][]byte{0: release}},
+		},
+		{
+			name:    "different PCR",
+			pcr0:    release,
+			opts:    logchain.VerifyOptions{PCRs: map[uint][]byte{0: debug}},
+			problem: "line 2: PCR0 of the attestation does not match",
+		},
+		{
+			name:    "no expected PCRs",
+			pcr0:    release,
+			problem: "line 2: no expected PCRs given to check the attestation against",
+		},
+		{
+			name: "any PCRs allowed",
+			pcr0: release,
+			opts: logchain.VerifyOptions{AllowAnyPCRs: true},
+		},
+		{
+			name:    "debug enclave",
+			pcr0:    debug,
+			opts:    logchain.VerifyOptions{PCRs: map[uint][]byte{0: debug}},
+			problem: "line 2: attestation was issued to an enclave in debug mode (PCR0 is all zeros)",
+		},
+		{
+			name: "debug enclave allowed",
+			pcr0: debug,
+			opts: logchain.VerifyOptions{AllowAnyPCRs: true, AllowDebugEnclaves: true},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			tc.opts.VerifyAttestation = func(document []byte, _ time.Time) (*nitrite.Document, error) {
+				require.Equal(t, "document", string(document))
+				return &nitrite.Document{
+					PCRs:      map[uint][]byte{0: tc.pcr0},
+					PublicKey: crypto.FromECDSAPub(&key.PublicKey),
+					UserData:  []byte(signer.ChainID()),
+				}, nil
+			}
+			report := verify(t, lines, tc.opts)
+			if tc.problem == "" {
+				require.Empty(t, report.Problems)
+				require.True(t, report.Attested)
+				return
+			}
+			// The checkpoints can not be verified with a rejected key either.
+			require.Equal(t, tc.problem, report.Problems[0])
+			require.False(t, report.Attested)
+		})
+	}
+}
+
+func TestVerifyAfterBridgeRedaction(t *testing.T) {
+	t.Parallel()
+	lines := writeChain(t, 10)
+	// The example rule of the README matches log_hash, log_prev and parts of log_signature.
+	redactor, err := redact.New(&config.LogRedactionSettings{
+		Patterns: []config.RedactionPattern{{Name: "hex64", Pattern: `\b[0-9a-fA-F]{64}\b`}},
+	})
+	require.NoError(t, err)
+	formatter, err := logs.NewFormatter(logs.FormatJSON)
+	require.NoError(t, err)
+	var stored bytes.Buffer
+	sink := logs.NewRedactingSink(redactor, logs.NewWriterSink(&stored, formatter))
+	source := logs.Source{EnclaveCID: 16, AppName: "app", ConnID: 1}
+	unchained := `{"message":"key ` + strings.Repeat("ab", 32) + `"}`
+	for _, line := range append(lines, unchained) {
+		require.NoError(t, sink.WriteEntry(logs.ParseLine([]byte(line), source, time.Now())))
+	}
+
+	redacted := strings.Split(strings.TrimSuffix(stored.String(), "\n"), "\n")
+	require.Empty(t, verify(t, redacted[:len(lines)], logchain.VerifyOptions{AllowUnattested: true}).Problems)
+	// Entries outside a chain are still redacted.
+	require.Contains(t, redacted[len(lines)], "[REDACTED]")
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	t.Parallel()
+	lines := writeChain(t, 10)
+	opts := logchain.VerifyOptions{AllowUnattested: true}
+
+	modified := append([]string(nil), lines...)
+	modified[3] = strings.Replace(modified[3], `"i":2`, `"i":20`, 1)
+	require.NotEqual(t, lines[3], modified[3])
+	require.Equal(t, []string{"line 5: record 3 was modified"}, verify(t, modified, opts).Problems)
+
+	dropped := append(append([]string(nil), lines[:5]...), lines[6:]...)
+	require.Equal(t, []string{"line 7: records 5 to 5 are missing"}, verify(t, dropped, opts).Problems)
+
+	replayed := append(append([]string(nil), lines...), lines[2])
+	require.Equal(t, []string{"line 15: record 2 was replayed or is out of order"}, verify(t, replayed, opts).Problems)
+
+	// Removing records from the end is detected up to the last checkpoint.
+	truncated := lines[:7]
+	report := verify(t, truncated, opts)
+	require.Empty(t, report.Problems)
+	require.Equal(t, uint64(4), report.SignedThrough)
+	require.Equal(t, uint64(2), report.Unsigned())
+
+	// A checkpoint whose signature was replaced is rejected.
+	forged := append([]string(nil), lines...)
+	signatureAt := strings.Index(forged[4], `"log_signature":"`) + len(`"log_signature":"`)
+	require.Greater(t, signatureAt, len(`"log_signature":"`))
+	forged[4] = forged[4][:signatureAt] + strings.Repeat("0", 130) + forged[4][signatureAt+130:]
+	require.Equal(t, []string{"line 6: checkpoint 4 has an invalid signature"}, verify(t, forged, opts).Problems)
+}
@@ -0,0 +1,263 @@
+package logchain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/logs"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/hf/nitrite"
+	"github.com/rs/zerolog"
+)
+
+// maxRecordLength is the maximum length of a stored record. Records carrying an attestation are a few KiB.
+const maxRecordLength = 1024 * 1024
+
+// AttestationVerifier verifies an attestation document as of the time it was presented and returns its content.
+type AttestationVerifier func(document []byte, at time.Time) (*nitrite.Document, error)
+
+// VerifyOptions configures Verify.
+type VerifyOptions struct {
+	// PCRs are the expected values of platform configuration registers in the attestation. Attestations are
+	// rejected if none are given, unless AllowAnyPCRs is set.
+	PCRs map[uint][]byte
+	// AllowAnyPCRs accepts attestations of any enclave image if PCRs is empty.
+	AllowAnyPCRs bool
+	// AllowDebugEnclaves accepts attestations with an all-zero PCR0, which are issued to enclaves in debug mode.
+	AllowDebugEnclaves bool
+	// AllowUnattested accepts chains signed by an unattested key.
+	AllowUnattested bool
+	// VerifyAttestation verifies attestation documents. Defaults to VerifyNitroAttestation.
+	VerifyAttestation AttestationVerifier
+}
+
+// ChainReport is the result of verifying one chain.
+type ChainReport struct {
+	ChainID    string
+	AppName    string
+	EnclaveCID string
+	// Records is the number of records of the chain found.
+	Records int
+	// LastSeq is the sequence number of the last record found.
+	LastSeq uint64
+	// Signed reports whether a valid checkpoint was found; SignedThrough is the sequence number of the last one.
+	Signed        bool
+	SignedThrough uint64
+	// Attested reports whether the signing key is bound to a valid attestation.
+	Attested bool
+	// Problems are the gaps, modifications and invalid signatures found, or an empty slice if the chain is intact.
+	Problems []string
+
+	prevHash  string
+	publicKey []byte
+	started   bool
+}
+
+// Unsigned returns the number of records after the last valid checkpoint. They are chained but their removal from
+// the end of the log can not be detected.
+func (r *ChainReport) Unsigned() uint64 {
+	if !r.Signed {
+		return r.LastSeq + 1
+	}
+	return r.LastSeq - r.SignedThrough
+}
+
+// OK reports whether no problems were found.
+func (r *ChainReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *ChainReport) problem(line int, format string, args ...any) {
+	r.Problems = append(r.Problems, fmt.Sprintf("line %d: ", line)+fmt.Sprintf(format, args...))
+}
+
+// VerifyNitroAttestation verifies an AWS Nitro attestation document against the AWS root certificate.
+func VerifyNitroAttestation(document []byte, at time.Time) (*nitrite.Document, error) {
+	result, err := nitrite.Verify(document, nitrite.VerifyOptions{CurrentTime: at})
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify attestation document: %w", err)
+	}
+	if !result.SignatureOK {
+		return nil, errors.New("attestation document signature is invalid")
+	}
+	return result.Document, nil
+}
+
+// Verify checks the chains of the JSON log lines read from r, e.g. a file written by a log sink of the bridge.
+// Lines that do not belong to a chain, such as logs of the bridge itself, are skipped.
+// Reports are returned in the order the chains first appear.
+func Verify(r io.Reader, opts VerifyOptions) ([]*ChainReport, error) {
+	if opts.VerifyAttestation == nil {
+		opts.VerifyAttestation = VerifyNitroAttestation
+	}
+	var reports []*ChainReport
+	chains := map[string]*ChainReport{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxRecordLength)
+	for line := 1; scanner.Scan(); line++ {
+		var fields map[string]any
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.UseNumber()
+		if err := decoder.Decode(&fields); err != nil {
+			continue
+		}
+		chainID, ok := fields[FieldChain].(string)
+		if !ok {
+			continue
+		}
+		report, ok := chains[chainID]
+		if !ok {
+			report = &ChainReport{ChainID: chainID, Problems: []string{}}
+			chains[chainID] = report
+			reports = append(reports, report)
+		}
+		report.verifyRecord(line, fields, &opts)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read log: %w", err)
+	}
+	for _, report := range reports {
+		if !report.Signed {
+			report.Problems = append(report.Problems, "no valid checkpoint found")
+		}
+	}
+	return reports, nil
+}
+
+func (r *ChainReport) verifyRecord(line int, fields map[string]any, opts *VerifyOptions) {
+	seqNumber, _ := fields[FieldSeq].(json.Number)
+	seq, err := strconv.ParseUint(seqNumber.String(), 10, 64)
+	if err != nil {
+		r.problem(line, "invalid sequence number")
+		return
+	}
+	if appName, ok := fields[logs.FieldEnclaveApp].(string); ok {
+		r.AppName = appName
+	}
+	if cid, ok := fields[logs.FieldEnclaveCID].(json.Number); ok {
+		r.EnclaveCID = cid.String()
+	}
+
+	hash, err := Hash(fields)
+	if err != nil {
+		r.problem(line, "record %d: %v", seq, err)
+		return
+	}
+	// A modified record still links the chain by its claimed hash, so the records after it are checked normally.
+	claimedHash, _ := fields[FieldHash].(string)
+	modified := claimedHash != hex.EncodeToString(hash)
+
+	expected := r.LastSeq + 1
+	switch {
+	case !r.started && seq != 0:
+		r.problem(line, "records 0 to %d are missing", seq-1)
+	case !r.started:
+	case seq > expected:
+		r.problem(line, "records %d to %d are missing", expected, seq-1)
+	case seq < expected:
+		r.problem(line, "record %d was replayed or is out of order", seq)
+		return
+	default:
+		if prev, _ := fields[FieldPrev].(string); prev != r.prevHash {
+			r.problem(line, "record %d does not follow record %d", seq, seq-1)
+		}
+	}
+	r.started = true
+	r.Records++
+	r.LastSeq = seq
+	r.prevHash = claimedHash
+	if modified {
+		r.problem(line, "record %d was modified", seq)
+		return
+	}
+
+	if seq == 0 {
+		r.verifyKey(line, fields, opts)
+	}
+	if signatureHex, ok := fields[FieldSignature].(string); ok {
+		signature, err := hex.DecodeString(signatureHex)
+		switch {
+		case r.publicKey == nil:
+			r.problem(line, "checkpoint %d can not be verified without the first record of the chain", seq)
+		case err != nil || len(signature) != crypto.SignatureLength ||
+			!crypto.VerifySignature(r.publicKey, hash, signature[:crypto.RecoveryIDOffset]):
+			r.problem(line, "checkpoint %d has an invalid signature", seq)
+		default:
+			r.Signed = true
+			r.SignedThrough = seq
+		}
+	}
+}
+
+// verifyKey reads the signing key from the first record of a chain and checks its attestation.
+func (r *ChainReport) verifyKey(line int, fields map[string]any, opts *VerifyOptions) {
+	if encoded, ok := fields[FieldAttestation].(string); ok {
+		document, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			r.problem(line, "invalid attestation encoding")
+			return
+		}
+		at := time.Now()
+		if timestamp, ok := fields[zerolog.TimestampFieldName].(string); ok {
+			if parsed, err := time.Parse(time.RFC3339Nano, timestamp); err == nil {
+				at = parsed
+			}
+		}
+		attestation, err := opts.VerifyAttestation(document, at)
+		if err != nil {
+			r.problem(line, "%v", err)
+			return
+		}
+		if string(attestation.UserData) != r.ChainID {
+			r.problem(line, "attestation was issued for another chain")
+			return
+		}
+		if len(opts.PCRs) == 0 && !opts.AllowAnyPCRs {
+			r.problem(line, "no expected PCRs given to check the attestation against")
+			return
+		}
+		if !opts.AllowDebugEnclaves && isZero(attestation.PCRs[0]) {
+			r.problem(line, "attestation was issued to an enclave in debug mode (PCR0 is all zeros)")
+			return
+		}
+		for index, expected := range opts.PCRs {
+			if !bytes.Equal(attestation.PCRs[index], expected) {
+				r.problem(line, "PCR%d of the attestation does not match", index)
+				return
+			}
+		}
+		r.publicKey = attestation.PublicKey
+		r.Attested = true
+		return
+	}
+	if encoded, ok := fields[FieldPublicKey].(string); ok {
+		publicKey, err := hex.DecodeString(encoded)
+		if err != nil {
+			r.problem(line, "invalid public key encoding")
+			return
+		}
+		if !opts.AllowUnattested {
+			r.problem(line, "signing key is not attested")
+		}
+		r.publicKey = publicKey
+		return
+	}
+	r.problem(line, "first record has no signing key")
+}
+
+func isZero(digest []byte) bool {
+	for _, b := range digest {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
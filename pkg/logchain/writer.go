@@ -0,0 +1,304 @@
+// Package logchain makes the logs of an enclave tamper-evident. Every record is chained to the previous one by
+// hash, and checkpoint records are signed with a key bound to an NSM attestation, so a verifier can detect records
+// that the host modified, dropped or injected on their way from the enclave to storage.
+package logchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/attest"
+	"github.com/DIMO-Network/enclave-bridge/pkg/logs"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/hf/nsm/request"
+	"github.com/rs/zerolog"
+)
+
+// Fields added to every chained record.
+const (
+	// FieldChain identifies the chain. It is included in the user data of the attestation.
+	FieldChain = logs.FieldChain
+	// FieldSeq is the position of the record in the chain, starting at zero.
+	FieldSeq = "log_seq"
+	// FieldPrev is the hash of the previous record.
+	FieldPrev = "log_prev"
+	// FieldHash is the SHA-256 of the record without FieldHash, FieldSignature and the fields added by the bridge.
+	FieldHash = "log_hash"
+	// FieldSignature is the signature of FieldHash on checkpoint records.
+	FieldSignature = "log_signature"
+	// FieldAttestation is the NSM attestation document of the signing key on the first record of a chain.
+	FieldAttestation = "log_attestation"
+	// FieldPublicKey is the public key of an unattested signer on the first record of a chain.
+	FieldPublicKey = "log_public_key"
+)
+
+const (
+	// DefaultCheckpointEvery is the default number of records between checkpoints.
+	DefaultCheckpointEvery = 100
+	// DefaultCheckpointInterval is the default maximum time between checkpoints while records are written.
+	DefaultCheckpointInterval = time.Minute
+
+	chainIDLength = 16
+)
+
+// excludedFields are not covered by the hash. The bridge fields are replaced by the bridge on every line.
+var excludedFields = []string{
+	FieldHash, FieldSignature,
+	logs.FieldEnclaveCID, logs.FieldEnclaveApp, logs.FieldReceivedAt, logs.FieldConnID, logs.FieldTruncated,
+}
+
+// Signer signs the checkpoints of a chain.
+type Signer struct {
+	chainID     string
+	key         *ecdsa.PrivateKey
+	attestation []byte
+}
+
+// NewAttestedSigner creates a new signing key and gets an NSM attestation of it with the chain ID as user data.
+// It only works inside an enclave.
+func NewAttestedSigner() (*Signer, error) {
+	chainID, err := newChainID()
+	if err != nil {
+		return nil, err
+	}
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate log signing key: %w", err)
+	}
+	document, _, err := attest.GetNSMAttestation(&request.Attestation{
+		PublicKey: crypto.FromECDSAPub(&key.PublicKey),
+		UserData:  []byte(chainID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{chainID: chainID, key: key, attestation: document}, nil
+}
+
+// NewUnattestedSigner creates a signer whose public key is written to the chain instead of an attestation,
+// e.g. for development outside an enclave. The verifier rejects such chains unless told otherwise.
+func NewUnattestedSigner(key *ecdsa.PrivateKey) (*Signer, error) {
+	chainID, err := newChainID()
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{chainID: chainID, key: key}, nil
+}
+
+// ChainID returns the ID of the chain signed by the signer.
+func (s *Signer) ChainID() string {
+	return s.chainID
+}
+
+func newChainID() (string, error) {
+	id := make([]byte, chainIDLength)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate log chain ID: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Option configures a Writer.
+type Option func(*Writer)
+
+// WithCheckpointEvery sets the number of records between checkpoints.
+func WithCheckpointEvery(records int) Option {
+	return func(w *Writer) {
+		w.checkpointEvery = records
+	}
+}
+
+// WithCheckpointInterval sets the maximum time between checkpoints while records are written.
+// Periodic checkpoints are disabled if zero.
+func WithCheckpointInterval(interval time.Duration) Option {
+	return func(w *Writer) {
+		w.interval = interval
+	}
+}
+
+// Writer is an io.Writer that chains the JSON log lines written by zerolog and writes them to the next writer,
+// e.g. an enclave.LogWriter. Lines that are not JSON objects are wrapped in the message field. The first record
+// carries the attestation of the signer. Every DefaultCheckpointEvery-th record is signed, which makes it a
+// checkpoint of the chain so far, and extra checkpoint records are written every DefaultCheckpointInterval and on
+// Close if records are not covered by a checkpoint yet.
+// Redaction must happen before chaining, since every change to a record after it was hashed breaks the chain.
+// The bridge's redaction rules skip chained records for the same reason.
+type Writer struct {
+	mu              sync.Mutex
+	next            io.Writer
+	signer          *Signer
+	seq             uint64
+	prevHash        string
+	sinceCheckpoint int
+	checkpointEvery int
+	interval        time.Duration
+	closed          bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewWriter starts a chain signed by signer and writes its first record to next.
+func NewWriter(next io.Writer, signer *Signer, opts ...Option) (*Writer, error) {
+	writer := &Writer{
+		next:            next,
+		signer:          signer,
+		checkpointEvery: DefaultCheckpointEvery,
+		interval:        DefaultCheckpointInterval,
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(writer)
+	}
+	first := writer.newRecord("Log chain started")
+	if signer.attestation != nil {
+		first[FieldAttestation] = base64.StdEncoding.EncodeToString(signer.attestation)
+	} else {
+		first[FieldPublicKey] = hex.EncodeToString(crypto.FromECDSAPub(&signer.key.PublicKey))
+	}
+	if err := writer.write(first, true); err != nil {
+		return nil, err
+	}
+	if writer.interval > 0 {
+		go writer.run()
+	} else {
+		close(writer.done)
+	}
+	return writer, nil
+}
+
+// Write chains a log line and writes it to the next writer.
+func (w *Writer) Write(p []byte) (int, error) {
+	line := bytes.TrimRight(p, "\r\n")
+	var fields map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil || fields == nil || decoder.More() {
+		fields = map[string]any{zerolog.MessageFieldName: string(line)}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	sign := w.checkpointEvery > 0 && w.sinceCheckpoint+1 >= w.checkpointEvery
+	if err := w.write(fields, sign); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Checkpoint writes a signed checkpoint record if records were written since the last one.
+func (w *Writer) Checkpoint() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.checkpoint()
+}
+
+// Close stops periodic checkpoints and writes a final checkpoint. It does not close the next writer.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	err := w.checkpoint()
+	w.closed = true
+	w.mu.Unlock()
+	close(w.stop)
+	<-w.done
+	return err
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			_ = w.Checkpoint()
+		}
+	}
+}
+
+// checkpoint writes a checkpoint record. Must be called with the lock held.
+func (w *Writer) checkpoint() error {
+	if w.closed || w.sinceCheckpoint == 0 {
+		return nil
+	}
+	return w.write(w.newRecord("Log checkpoint"), true)
+}
+
+func (w *Writer) newRecord(message string) map[string]any {
+	return map[string]any{
+		zerolog.TimestampFieldName: time.Now().UTC().Format(time.RFC3339Nano),
+		zerolog.LevelFieldName:     zerolog.InfoLevel.String(),
+		zerolog.MessageFieldName:   message,
+	}
+}
+
+// write adds the chain fields to a record, signs it if sign is set and writes it. Must be called with the lock held.
+func (w *Writer) write(fields map[string]any, sign bool) error {
+	for _, field := range excludedFields {
+		delete(fields, field)
+	}
+	fields[FieldChain] = w.signer.chainID
+	fields[FieldSeq] = w.seq
+	fields[FieldPrev] = w.prevHash
+	hash, err := Hash(fields)
+	if err != nil {
+		return err
+	}
+	hashHex := hex.EncodeToString(hash)
+	fields[FieldHash] = hashHex
+	if sign {
+		signature, err := crypto.Sign(hash, w.signer.key)
+		if err != nil {
+			return fmt.Errorf("failed to sign log checkpoint: %w", err)
+		}
+		fields[FieldSignature] = hex.EncodeToString(signature)
+	}
+	line, err := json.Marshal(fields)
+	if err != nil {
+		return fmt.Errorf("failed to encode log record: %w", err)
+	}
+	if _, err := w.next.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write log record: %w", err)
+	}
+	w.seq++
+	w.prevHash = hashHex
+	if sign {
+		w.sinceCheckpoint = 0
+	} else {
+		w.sinceCheckpoint++
+	}
+	return nil
+}
+
+// Hash returns the SHA-256 of the JSON encoding of a record with sorted keys, without the excluded fields.
+func Hash(fields map[string]any) ([]byte, error) {
+	hashed := maps.Clone(fields)
+	for _, field := range excludedFields {
+		delete(hashed, field)
+	}
+	data, err := json.Marshal(hashed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode log record: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
@@ -0,0 +1,138 @@
+// Package logs parses, formats and delivers log lines forwarded from enclaves to the bridge.
+package logs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Fields added to every entry by the bridge. They replace fields of the same name sent by the enclave.
+const (
+	// FieldEnclaveCID is the context ID of the enclave that sent the line.
+	FieldEnclaveCID = "enclave_cid"
+	// FieldEnclaveApp is the app name the enclave sent in its bridge settings.
+	FieldEnclaveApp = "enclave_app"
+	// FieldReceivedAt is the time the bridge received the line.
+	FieldReceivedAt = "received_at"
+	// FieldConnID identifies the vsock connection the line was received on.
+	FieldConnID = "conn_id"
+	// FieldTruncated is set on lines that were cut at the maximum line length.
+	FieldTruncated = "truncated"
+)
+
+// FieldChain identifies the hash chain of entries written by a logchain.Writer. Chained entries are not redacted
+// by the bridge, since changing any field breaks the chain.
+const FieldChain = "log_chain"
+
+// DefaultMaxLineLength is the default maximum length of a log line. Longer lines are truncated.
+const DefaultMaxLineLength = 64 * 1024
+
+// Source identifies the connection a log line was received on.
+type Source struct {
+	EnclaveCID uint32
+	AppName    string
+	ConnID     uint64
+}
+
+// Entry is a log line received from an enclave.
+type Entry struct {
+	// Fields are the fields of the line, including the fields added by the bridge.
+	// Lines that are not JSON objects are wrapped in the message field.
+	Fields     map[string]any
+	Source     Source
+	ReceivedAt time.Time
+}
+
+// ParseLine parses a log line without its line break into an entry and adds the bridge fields.
+func ParseLine(line []byte, source Source, receivedAt time.Time) *Entry {
+	var fields map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil || fields == nil || decoder.More() {
+		fields = map[string]any{zerolog.MessageFieldName: string(bytes.TrimRight(line, "\r"))}
+	}
+	fields[FieldEnclaveCID] = source.EnclaveCID
+	fields[FieldConnID] = source.ConnID
+	fields[FieldReceivedAt] = receivedAt.UTC().Format(time.RFC3339Nano)
+	if source.AppName != "" {
+		fields[FieldEnclaveApp] = source.AppName
+	} else {
+		delete(fields, FieldEnclaveApp)
+	}
+	return &Entry{Fields: fields, Source: source, ReceivedAt: receivedAt}
+}
+
+// ReadLines calls fn with every line read from r, without the line break.
+// Lines longer than maxLength are truncated and the rest of the line is discarded.
+// The line is only valid until fn returns. ReadLines returns nil once r is exhausted.
+func ReadLines(r io.Reader, maxLength int, fn func(line []byte, truncated bool) error) error {
+	reader := bufio.NewReaderSize(r, min(maxLength, DefaultMaxLineLength))
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		switch {
+		case err == nil:
+			line = append(line, chunk[:len(chunk)-1]...)
+			if len(line) > maxLength {
+				line = line[:maxLength]
+			}
+			if err := fn(line, false); err != nil {
+				return err
+			}
+			line = line[:0]
+		case errors.Is(err, bufio.ErrBufferFull):
+			line = append(line, chunk...)
+			if len(line) < maxLength {
+				continue
+			}
+			if err := fn(line[:maxLength], true); err != nil {
+				return err
+			}
+			line = line[:0]
+			if err := discardLine(reader); err != nil {
+				return ignoreEOF(err)
+			}
+		default:
+			line = append(line, chunk...)
+			if len(line) > 0 {
+				if err := fn(line[:min(len(line), maxLength)], len(line) > maxLength); err != nil {
+					return err
+				}
+			}
+			return ignoreEOF(err)
+		}
+	}
+}
+
+// discardLine skips the rest of the current line.
+func discardLine(reader *bufio.Reader) error {
+	for {
+		_, err := reader.ReadSlice('\n')
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return err
+		}
+	}
+}
+
+func ignoreEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+// entryTimestamp returns the time field of an entry if it is an RFC 3339 timestamp.
+func entryTimestamp(entry *Entry) (time.Time, bool) {
+	value, ok := entry.Fields[zerolog.TimestampFieldName].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, value)
+	return timestamp, err == nil
+}
@@ -0,0 +1,201 @@
+package logs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// DefaultBufferSize is the default number of entries buffered for every sink of a FanOut.
+const DefaultBufferSize = 1024
+
+// maxBatchSize is the maximum number of buffered entries handed to a BatchSink at once.
+const maxBatchSize = 512
+
+// BatchSink is implemented by sinks that write several entries more efficiently at once.
+type BatchSink interface {
+	Sink
+	WriteEntries(entries []*Entry) error
+}
+
+// FanOut is a Sink that hands every entry to several sinks concurrently.
+// Every sink has its own bounded buffer and goroutine, so a slow or unreachable sink never blocks the enclave
+// or the other sinks. Entries are dropped and counted while the buffer of a sink is full.
+// Entries are shared between the sinks and must not be modified by them.
+type FanOut struct {
+	mu     sync.RWMutex
+	closed bool
+	sinks  []*bufferedSink
+	wg     sync.WaitGroup
+	logger zerolog.Logger
+}
+
+type bufferedSink struct {
+	name     string
+	sink     Sink
+	minLevel zerolog.Level
+	entries  chan *Entry
+
+	buffered prometheus.Gauge
+	written  prometheus.Counter
+	dropped  prometheus.Counter
+	failed   prometheus.Counter
+}
+
+// NewFanOut creates a fan-out without sinks. Failing sinks are reported to logger.
+func NewFanOut(logger zerolog.Logger) *FanOut {
+	return &FanOut{logger: logger}
+}
+
+// Add starts writing entries with at least minLevel to sink, buffering up to bufferSize entries.
+// Entries without a level are always written. A bufferSize of zero selects DefaultBufferSize.
+func (f *FanOut) Add(name string, sink Sink, minLevel zerolog.Level, bufferSize int) {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	buffered := &bufferedSink{
+		name:     name,
+		sink:     sink,
+		minLevel: minLevel,
+		entries:  make(chan *Entry, bufferSize),
+		buffered: sinkBufferedEntries.WithLabelValues(name),
+		written:  sinkEntriesTotal.WithLabelValues(name, resultWritten),
+		dropped:  sinkEntriesTotal.WithLabelValues(name, resultDropped),
+		failed:   sinkEntriesTotal.WithLabelValues(name, resultFailed),
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	f.sinks = append(f.sinks, buffered)
+	f.wg.Add(1)
+	go f.run(buffered)
+}
+
+// WriteEntry queues entry for every sink whose level it passes. It never blocks.
+func (f *FanOut) WriteEntry(entry *Entry) error {
+	level := entryLevel(entry)
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.closed {
+		return nil
+	}
+	for _, sink := range f.sinks {
+		if level != zerolog.NoLevel && level < sink.minLevel {
+			continue
+		}
+		sink.buffered.Inc()
+		select {
+		case sink.entries <- entry:
+		default:
+			sink.buffered.Dec()
+			sink.dropped.Inc()
+		}
+	}
+	return nil
+}
+
+// Close stops accepting entries and waits until the buffered entries are written or ctx is done.
+// Sinks that implement io.Closer are closed afterwards.
+func (f *FanOut) Close(ctx context.Context) error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	for _, sink := range f.sinks {
+		close(sink.entries)
+	}
+	f.mu.Unlock()
+
+	flushed := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(flushed)
+	}()
+	var err error
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		err = fmt.Errorf("failed to flush log sinks: %w", ctx.Err())
+	}
+	for _, sink := range f.sinks {
+		if closer, ok := sink.sink.(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil {
+				err = errors.Join(err, fmt.Errorf("failed to close log sink %s: %w", sink.name, closeErr))
+			}
+		}
+	}
+	return err
+}
+
+// run writes the buffered entries of sink until its buffer is closed.
+func (f *FanOut) run(sink *bufferedSink) {
+	defer f.wg.Done()
+	batch := make([]*Entry, 0, maxBatchSize)
+	failing := false
+	for entry := range sink.entries {
+		batch = append(batch[:0], entry)
+	drain:
+		for len(batch) < maxBatchSize {
+			select {
+			case entry, ok := <-sink.entries:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, entry)
+			default:
+				break drain
+			}
+		}
+		sink.buffered.Sub(float64(len(batch)))
+
+		err := sink.write(batch)
+		switch {
+		case err != nil && !failing:
+			f.logger.Warn().Err(err).Str("sink", sink.name).Msg("Failed to write forwarded logs to sink")
+		case err == nil && failing:
+			f.logger.Info().Str("sink", sink.name).Msg("Log sink recovered")
+		}
+		failing = err != nil
+	}
+}
+
+// write writes a batch of entries and counts the written and failed entries. It returns the last error.
+func (s *bufferedSink) write(batch []*Entry) error {
+	if batchSink, ok := s.sink.(BatchSink); ok {
+		if err := batchSink.WriteEntries(batch); err != nil {
+			s.failed.Add(float64(len(batch)))
+			return err
+		}
+		s.written.Add(float64(len(batch)))
+		return nil
+	}
+	var lastErr error
+	for _, entry := range batch {
+		if err := s.sink.WriteEntry(entry); err != nil {
+			s.failed.Inc()
+			lastErr = err
+			continue
+		}
+		s.written.Inc()
+	}
+	return lastErr
+}
+
+// entryLevel returns the level of an entry, or zerolog.NoLevel if it has no known level.
+func entryLevel(entry *Entry) zerolog.Level {
+	levelName, _ := entry.Fields[zerolog.LevelFieldName].(string)
+	level, err := zerolog.ParseLevel(levelName)
+	if err != nil || level == zerolog.Disabled {
+		return zerolog.NoLevel
+	}
+	return level
+}
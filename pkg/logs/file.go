@@ -0,0 +1,26 @@
+package logs
+
+import (
+	"github.com/DIMO-Network/enclave-bridge/pkg/audit"
+)
+
+// FileSink writes entries to a file that is rotated once it reaches a maximum size.
+type FileSink struct {
+	*WriterSink
+	file *audit.RotatingFile
+}
+
+// OpenFileSink opens path for appending. If maxBytes is zero the file is never rotated.
+// At most maxFiles rotated files are kept.
+func OpenFileSink(path string, maxBytes int64, maxFiles int, formatter Formatter) (*FileSink, error) {
+	file, err := audit.OpenRotatingFile(path, maxBytes, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{WriterSink: NewWriterSink(file, formatter), file: file}, nil
+}
+
+// Close closes the file.
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
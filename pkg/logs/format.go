@@ -0,0 +1,128 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// Output formats of forwarded log lines.
+const (
+	// FormatJSON writes every entry as a JSON object.
+	FormatJSON = "json"
+	// FormatLogfmt writes every entry as space separated key=value pairs.
+	FormatLogfmt = "logfmt"
+	// FormatConsole writes every entry in the human readable format of zerolog.ConsoleWriter.
+	FormatConsole = "console"
+)
+
+// Formatter encodes an entry as a single line including the line break.
+type Formatter func(entry *Entry) ([]byte, error)
+
+// NewFormatter returns the formatter for format. An empty format selects FormatJSON.
+func NewFormatter(format string) (Formatter, error) {
+	switch format {
+	case "", FormatJSON:
+		return formatJSON, nil
+	case FormatLogfmt:
+		return formatLogfmt, nil
+	case FormatConsole:
+		return formatConsole, nil
+	default:
+		return nil, fmt.Errorf("unsupported log format: %q", format)
+	}
+}
+
+func formatJSON(entry *Entry) ([]byte, error) {
+	data, err := json.Marshal(entry.Fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode log entry: %w", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// formatLogfmt writes the time, level and message first, followed by the other fields sorted by key.
+func formatLogfmt(entry *Entry) ([]byte, error) {
+	leading := []string{zerolog.TimestampFieldName, zerolog.LevelFieldName, zerolog.MessageFieldName}
+	keys := make([]string, 0, len(entry.Fields))
+	for key := range entry.Fields {
+		if !slices.Contains(leading, key) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	var buf bytes.Buffer
+	for _, key := range append(leading, keys...) {
+		value, ok := entry.Fields[key]
+		if !ok {
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(logfmtKey(key))
+		buf.WriteByte('=')
+		encoded, err := logfmtValue(value)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(encoded)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// logfmtKey replaces characters that are not allowed in logfmt keys.
+func logfmtKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' {
+			return '_'
+		}
+		return r
+	}, key)
+}
+
+// logfmtValue encodes a value, quoting it if needed. Objects and arrays are encoded as JSON.
+func logfmtValue(value any) (string, error) {
+	var str string
+	switch v := value.(type) {
+	case string:
+		str = v
+	case nil:
+		return "", nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case map[string]any, []any:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode log field: %w", err)
+		}
+		str = string(data)
+	default:
+		str = fmt.Sprint(v)
+	}
+	if str == "" || strings.ContainsAny(str, " =\"\\\n\r\t") || !strconv.CanBackquote(str) {
+		return strconv.Quote(str), nil
+	}
+	return str, nil
+}
+
+func formatConsole(entry *Entry) ([]byte, error) {
+	data, err := json.Marshal(entry.Fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode log entry: %w", err)
+	}
+	var buf bytes.Buffer
+	console := zerolog.ConsoleWriter{Out: &buf, NoColor: true}
+	if _, err := console.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to format log entry: %w", err)
+	}
+	return buf.Bytes(), nil
+}
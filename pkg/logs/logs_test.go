@@ -0,0 +1,94 @@
+package logs_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/logs"
+	"github.com/stretchr/testify/require"
+)
+
+var receivedAt = time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func TestParseLine(t *testing.T) {
+	t.Parallel()
+	source := logs.Source{EnclaveCID: 16, AppName: "app", ConnID: 3}
+
+	entry := logs.ParseLine([]byte(`{"level":"info","message":"hello","count":12345678901234567890,"enclave_cid":1}`), source, receivedAt)
+	require.Equal(t, "info", entry.Fields["level"])
+	require.Equal(t, "hello", entry.Fields["message"])
+	require.Equal(t, json.Number("12345678901234567890"), entry.Fields["count"])
+	// Bridge fields can not be spoofed by the enclave.
+	require.Equal(t, uint32(16), entry.Fields[logs.FieldEnclaveCID])
+	require.Equal(t, "app", entry.Fields[logs.FieldEnclaveApp])
+	require.Equal(t, uint64(3), entry.Fields[logs.FieldConnID])
+	require.Equal(t, "2025-06-01T12:00:00Z", entry.Fields[logs.FieldReceivedAt])
+
+	for _, line := range []string{"panic: boom\r", `{"a":1} {"b":2}`, "[1,2]", "null"} {
+		entry = logs.ParseLine([]byte(line), logs.Source{}, receivedAt)
+		require.Equal(t, strings.TrimSuffix(line, "\r"), entry.Fields["message"])
+		require.NotContains(t, entry.Fields, logs.FieldEnclaveApp)
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	t.Parallel()
+	input := "short\n" + strings.Repeat("a", 40) + "\n\nlast"
+	type line struct {
+		text      string
+		truncated bool
+	}
+	var lines []line
+	err := logs.ReadLines(strings.NewReader(input), 20, func(text []byte, truncated bool) error {
+		lines = append(lines, line{string(text), truncated})
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []line{
+		{"short", false},
+		{strings.Repeat("a", 20), true},
+		{"", false},
+		{"last", false},
+	}, lines)
+}
+
+func TestFormatters(t *testing.T) {
+	t.Parallel()
+	entry := logs.ParseLine([]byte(`{"time":"2025-06-01T11:59:59Z","level":"warn","message":"disk full","path":"/var/data x","ok":false,"nested":{"a":1}}`),
+		logs.Source{EnclaveCID: 16, AppName: "app", ConnID: 1}, receivedAt)
+
+	for _, tc := range []struct {
+		format string
+		want   string
+	}{
+		{
+			format: logs.FormatJSON,
+			want:   `{"conn_id":1,"enclave_app":"app","enclave_cid":16,"level":"warn","message":"disk full","nested":{"a":1},"ok":false,"path":"/var/data x","received_at":"2025-06-01T12:00:00Z","time":"2025-06-01T11:59:59Z"}` + "\n",
+		},
+		{
+			format: logs.FormatLogfmt,
+			want:   `time=2025-06-01T11:59:59Z level=warn message="disk full" conn_id=1 enclave_app=app enclave_cid=16 nested="{\"a\":1}" ok=false path="/var/data x" received_at=2025-06-01T12:00:00Z` + "\n",
+		},
+	} {
+		formatter, err := logs.NewFormatter(tc.format)
+		require.NoError(t, err)
+		line, err := formatter(entry)
+		require.NoError(t, err)
+		require.Equal(t, tc.want, string(line), tc.format)
+	}
+
+	formatter, err := logs.NewFormatter(logs.FormatConsole)
+	require.NoError(t, err)
+	line, err := formatter(entry)
+	require.NoError(t, err)
+	require.Equal(t, 1, bytes.Count(line, []byte("\n")))
+	require.Contains(t, string(line), "WRN")
+	require.Contains(t, string(line), "disk full")
+	require.Contains(t, string(line), "enclave_app=app")
+
+	_, err = logs.NewFormatter("xml")
+	require.Error(t, err)
+}
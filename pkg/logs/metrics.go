@@ -0,0 +1,35 @@
+package logs
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "enclave_bridge"
+
+// Results of entries handed to a sink.
+const (
+	resultWritten = "written"
+	resultDropped = "dropped"
+	resultFailed  = "failed"
+)
+
+var (
+	sinkEntriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "log_sink_entries_total",
+		Help:      "Number of forwarded log entries handed to a sink by result: written, dropped (buffer full) or failed.",
+	}, []string{"sink", "result"})
+
+	sinkBufferedEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "log_sink_buffered_entries",
+		Help:      "Number of forwarded log entries waiting in the buffer of a sink.",
+	}, []string{"sink"})
+
+	redactionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "log_redactions_total",
+		Help:      "Number of values masked in forwarded log entries by redaction rule.",
+	}, []string{"rule"})
+)
@@ -0,0 +1,201 @@
+package logs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	"go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+)
+
+const (
+	defaultOTLPTimeout = 10 * time.Second
+	otlpScopeName      = "github.com/DIMO-Network/enclave-bridge"
+)
+
+// otlpSeverities maps zerolog levels to OpenTelemetry severities.
+var otlpSeverities = map[zerolog.Level]log.Severity{
+	zerolog.TraceLevel: log.SeverityTrace,
+	zerolog.DebugLevel: log.SeverityDebug,
+	zerolog.InfoLevel:  log.SeverityInfo,
+	zerolog.WarnLevel:  log.SeverityWarn,
+	zerolog.ErrorLevel: log.SeverityError,
+	zerolog.FatalLevel: log.SeverityFatal,
+	zerolog.PanicLevel: log.SeverityFatal2,
+}
+
+// OTLPSink exports entries to an OpenTelemetry collector with the OTLP/HTTP exporter of OpenTelemetry.
+// The message field becomes the body of a log record, the level its severity, the time field its timestamp
+// and all other fields its attributes. Every enclave app is exported as a resource with its service.name.
+// Entries are exported synchronously without retries, so a failed export is counted like a failure of any other sink.
+type OTLPSink struct {
+	mu        sync.Mutex
+	exporter  *otlploghttp.Exporter
+	providers map[Source]*sdklog.LoggerProvider
+	// pending collects the records emitted by the providers until they are exported.
+	pending []sdklog.Record
+}
+
+// NewOTLPSink creates a sink that posts entries to the OTLP/HTTP logs endpoint, e.g. http://collector:4318/v1/logs.
+// headers are added to every request. A timeout of zero selects 10 seconds.
+func NewOTLPSink(endpoint string, headers map[string]string, timeout time.Duration) (*OTLPSink, error) {
+	if endpoint == "" {
+		return nil, errors.New("OTLP endpoint is required")
+	}
+	if timeout <= 0 {
+		timeout = defaultOTLPTimeout
+	}
+	exporter, err := otlploghttp.New(context.Background(),
+		otlploghttp.WithEndpointURL(endpoint),
+		otlploghttp.WithHeaders(headers),
+		otlploghttp.WithTimeout(timeout),
+		otlploghttp.WithRetry(otlploghttp.RetryConfig{Enabled: false}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP log exporter: %w", err)
+	}
+	return &OTLPSink{exporter: exporter, providers: map[Source]*sdklog.LoggerProvider{}}, nil
+}
+
+// WriteEntry exports a single entry.
+func (s *OTLPSink) WriteEntry(entry *Entry) error {
+	return s.WriteEntries([]*Entry{entry})
+}
+
+// WriteEntries exports entries in a single request.
+func (s *OTLPSink) WriteEntries(entries []*Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ctx := context.Background()
+	for _, entry := range entries {
+		record := newOTLPLogRecord(entry)
+		s.logger(entry.Source).Emit(ctx, record)
+	}
+	records := s.pending
+	s.pending = nil
+	if err := s.exporter.Export(ctx, records); err != nil {
+		return fmt.Errorf("failed to export logs: %w", err)
+	}
+	return nil
+}
+
+// Close shuts the exporter down.
+func (s *OTLPSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for _, provider := range s.providers {
+		err = errors.Join(err, provider.Shutdown(context.Background()))
+	}
+	return errors.Join(err, s.exporter.Shutdown(context.Background()))
+}
+
+// logger returns the logger of the enclave an entry was received from. Must be called with the lock held.
+func (s *OTLPSink) logger(source Source) log.Logger {
+	// Entries of the same enclave share a resource regardless of the connection they were received on.
+	key := Source{EnclaveCID: source.EnclaveCID, AppName: source.AppName}
+	provider, ok := s.providers[key]
+	if !ok {
+		attributes := []attribute.KeyValue{attribute.Int64("enclave.cid", int64(key.EnclaveCID))}
+		if key.AppName != "" {
+			attributes = append(attributes, semconv.ServiceName(key.AppName))
+		}
+		provider = sdklog.NewLoggerProvider(
+			sdklog.WithResource(resource.NewSchemaless(attributes...)),
+			sdklog.WithProcessor(otlpCollector{sink: s}),
+			sdklog.WithAttributeCountLimit(-1),
+		)
+		s.providers[key] = provider
+	}
+	return provider.Logger(otlpScopeName)
+}
+
+// otlpCollector is a processor that adds the emitted records to the pending records of the sink, which exports
+// them synchronously.
+type otlpCollector struct {
+	sink *OTLPSink
+}
+
+func (c otlpCollector) OnEmit(_ context.Context, record *sdklog.Record) error {
+	c.sink.pending = append(c.sink.pending, record.Clone())
+	return nil
+}
+
+func (c otlpCollector) Shutdown(context.Context) error   { return nil }
+func (c otlpCollector) ForceFlush(context.Context) error { return nil }
+
+func newOTLPLogRecord(entry *Entry) log.Record {
+	var record log.Record
+	record.SetObservedTimestamp(entry.ReceivedAt)
+	if timestamp, ok := entryTimestamp(entry); ok {
+		record.SetTimestamp(timestamp)
+	}
+	if level := entryLevel(entry); level != zerolog.NoLevel {
+		record.SetSeverity(otlpSeverities[level])
+		record.SetSeverityText(level.String())
+	}
+	if message, ok := entry.Fields[zerolog.MessageFieldName]; ok {
+		record.SetBody(otlpValue(message))
+	}
+	for _, key := range slices.Sorted(maps.Keys(entry.Fields)) {
+		switch key {
+		case zerolog.TimestampFieldName, zerolog.LevelFieldName, zerolog.MessageFieldName:
+			continue
+		}
+		record.AddAttributes(log.KeyValue{Key: key, Value: otlpValue(entry.Fields[key])})
+	}
+	return record
+}
+
+// otlpValue converts a decoded JSON value or a bridge field to a log value.
+func otlpValue(value any) log.Value {
+	switch v := value.(type) {
+	case string:
+		return log.StringValue(v)
+	case bool:
+		return log.BoolValue(v)
+	case json.Number:
+		if i, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			return log.Int64Value(i)
+		}
+		if f, err := v.Float64(); err == nil {
+			return log.Float64Value(f)
+		}
+		return log.StringValue(v.String())
+	case uint32:
+		return log.Int64Value(int64(v))
+	case uint64:
+		if v > 1<<63-1 {
+			return log.StringValue(strconv.FormatUint(v, 10))
+		}
+		return log.Int64Value(int64(v))
+	case []any:
+		values := make([]log.Value, len(v))
+		for i, item := range v {
+			values[i] = otlpValue(item)
+		}
+		return log.SliceValue(values...)
+	case map[string]any:
+		values := make([]log.KeyValue, 0, len(v))
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			values = append(values, log.KeyValue{Key: key, Value: otlpValue(v[key])})
+		}
+		return log.MapValue(values...)
+	case nil:
+		return log.Value{}
+	default:
+		return log.StringValue(fmt.Sprint(v))
+	}
+}
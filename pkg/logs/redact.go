@@ -0,0 +1,29 @@
+package logs
+
+import (
+	"github.com/DIMO-Network/enclave-bridge/pkg/redact"
+)
+
+// RedactingSink masks secrets in entries before passing them to the next sink.
+// It must be the first sink, since entries are masked in place. Entries with FieldChain are passed on unchanged,
+// since the enclave redacts them before chaining and any change would fail their verification.
+type RedactingSink struct {
+	redactor *redact.Redactor
+	next     Sink
+}
+
+// NewRedactingSink creates a sink that masks entries with redactor and writes them to next.
+func NewRedactingSink(redactor *redact.Redactor, next Sink) *RedactingSink {
+	return &RedactingSink{redactor: redactor, next: next}
+}
+
+// WriteEntry masks an entry and writes it to the next sink.
+func (s *RedactingSink) WriteEntry(entry *Entry) error {
+	if _, chained := entry.Fields[FieldChain]; chained {
+		return s.next.WriteEntry(entry)
+	}
+	for rule, count := range s.redactor.Fields(entry.Fields) {
+		redactionsTotal.WithLabelValues(rule).Add(float64(count))
+	}
+	return s.next.WriteEntry(entry)
+}
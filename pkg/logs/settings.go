@@ -0,0 +1,85 @@
+package logs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/rs/zerolog"
+)
+
+// NewFanOutFromSettings creates a fan-out with a sink for every entry of settings.
+// stdout sinks write to stdout, which must write every line with a single Write call.
+// Failing sinks are reported to logger.
+func NewFanOutFromSettings(settings []config.LogSinkSettings, stdout io.Writer, logger zerolog.Logger) (*FanOut, error) {
+	type namedSink struct {
+		name     string
+		sink     Sink
+		minLevel zerolog.Level
+		buffer   int
+	}
+	sinks := make([]namedSink, 0, len(settings))
+	closeAll := func() {
+		for _, sink := range sinks {
+			if closer, ok := sink.sink.(io.Closer); ok {
+				_ = closer.Close()
+			}
+		}
+	}
+	names := map[string]bool{}
+	for _, sinkSettings := range settings {
+		name := sinkSettings.Name
+		if name == "" {
+			name = sinkSettings.Type
+		}
+		if names[name] {
+			closeAll()
+			return nil, fmt.Errorf("duplicate log sink name %q", name)
+		}
+		names[name] = true
+		minLevel := zerolog.TraceLevel
+		if sinkSettings.Level != "" {
+			var err error
+			minLevel, err = zerolog.ParseLevel(sinkSettings.Level)
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("invalid level of log sink %s: %w", name, err)
+			}
+		}
+		sink, err := newSink(sinkSettings, stdout)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to create log sink %s: %w", name, err)
+		}
+		sinks = append(sinks, namedSink{name: name, sink: sink, minLevel: minLevel, buffer: sinkSettings.BufferSize})
+	}
+
+	fanOut := NewFanOut(logger)
+	for _, sink := range sinks {
+		fanOut.Add(sink.name, sink.sink, sink.minLevel, sink.buffer)
+	}
+	return fanOut, nil
+}
+
+func newSink(settings config.LogSinkSettings, stdout io.Writer) (Sink, error) {
+	formatter, err := NewFormatter(settings.Format)
+	if err != nil {
+		return nil, err
+	}
+	switch settings.Type {
+	case config.LogSinkStdout:
+		return NewWriterSink(stdout, formatter), nil
+	case config.LogSinkFile:
+		if settings.Path == "" {
+			return nil, errors.New("file path is required")
+		}
+		return OpenFileSink(settings.Path, settings.MaxBytes, settings.MaxFiles, formatter)
+	case config.LogSinkSyslog:
+		return NewSyslogSink(settings.Network, settings.Address, settings.Facility, formatter)
+	case config.LogSinkOTLP:
+		return NewOTLPSink(settings.Endpoint, settings.Headers, settings.Timeout)
+	default:
+		return nil, fmt.Errorf("unsupported log sink type: %q", settings.Type)
+	}
+}
@@ -0,0 +1,47 @@
+package logs
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Sink receives the entries forwarded from enclaves. Sinks must be safe for concurrent use.
+type Sink interface {
+	WriteEntry(entry *Entry) error
+}
+
+// WriterSink formats entries and writes them to an io.Writer.
+// Each entry is written with a single Write call while holding a lock, so lines from concurrent
+// connections are never interleaved.
+type WriterSink struct {
+	mu        sync.Mutex
+	writer    io.Writer
+	formatter Formatter
+}
+
+// NewWriterSink creates a sink that writes entries to writer in the given format.
+func NewWriterSink(writer io.Writer, formatter Formatter) *WriterSink {
+	return &WriterSink{writer: writer, formatter: formatter}
+}
+
+// Write writes p as is, e.g. lines of the bridge's own logger, without interleaving it with entries.
+func (s *WriterSink) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writer.Write(p)
+}
+
+// WriteEntry formats and writes an entry.
+func (s *WriterSink) WriteEntry(entry *Entry) error {
+	line, err := s.formatter(entry)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.writer.Write(line); err != nil {
+		return fmt.Errorf("failed to write log entry: %w", err)
+	}
+	return nil
+}
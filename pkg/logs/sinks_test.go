@@ -0,0 +1,357 @@
+package logs_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/logs"
+	"github.com/DIMO-Network/enclave-bridge/pkg/redact"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	collectorlogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// recordingSink records entries and blocks while its gate is closed.
+type recordingSink struct {
+	mu      sync.Mutex
+	gate    chan struct{}
+	entries []*logs.Entry
+}
+
+func (s *recordingSink) WriteEntry(entry *logs.Entry) error {
+	if s.gate != nil {
+		<-s.gate
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+func (s *recordingSink) messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	messages := make([]string, 0, len(s.entries))
+	for _, entry := range s.entries {
+		messages = append(messages, entry.Fields["message"].(string)) //nolint:forcetypeassert
+	}
+	return messages
+}
+
+func newEntry(line string) *logs.Entry {
+	return logs.ParseLine([]byte(line), logs.Source{EnclaveCID: 16, AppName: "app", ConnID: 1}, receivedAt)
+}
+
+func TestFanOutFiltersAndDrops(t *testing.T) {
+	t.Parallel()
+	fanOut := logs.NewFanOut(zerolog.Nop())
+	all := &recordingSink{}
+	warnings := &recordingSink{}
+	blocked := &recordingSink{gate: make(chan struct{})}
+	fanOut.Add("all", all, zerolog.TraceLevel, 0)
+	fanOut.Add("warnings", warnings, zerolog.WarnLevel, 0)
+	fanOut.Add("blocked", blocked, zerolog.TraceLevel, 2)
+
+	lines := []string{
+		`{"level":"debug","message":"debug"}`,
+		`{"level":"warn","message":"warn"}`,
+		`no level`,
+		`{"level":"error","message":"error"}`,
+	}
+	for range 5 {
+		for _, line := range lines {
+			// The blocked sink must not block the other sinks or the caller.
+			require.NoError(t, fanOut.WriteEntry(newEntry(line)))
+		}
+	}
+	close(blocked.gate)
+	require.NoError(t, fanOut.Close(t.Context()))
+
+	require.Len(t, all.messages(), 20)
+	for _, message := range warnings.messages() {
+		require.Contains(t, []string{"warn", "no level", "error"}, message)
+	}
+	require.Len(t, warnings.messages(), 15)
+	// One entry is held by the blocked write and two are buffered, the rest is dropped.
+	require.LessOrEqual(t, len(blocked.messages()), 3)
+	require.NotEmpty(t, blocked.messages())
+
+	require.NoError(t, fanOut.WriteEntry(newEntry("after close")))
+}
+
+func TestFanOutCloseDeadline(t *testing.T) {
+	t.Parallel()
+	fanOut := logs.NewFanOut(zerolog.Nop())
+	blocked := &recordingSink{gate: make(chan struct{})}
+	defer close(blocked.gate)
+	fanOut.Add("blocked", blocked, zerolog.TraceLevel, 0)
+	require.NoError(t, fanOut.WriteEntry(newEntry("stuck")))
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, fanOut.Close(ctx), context.DeadlineExceeded)
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "enclave.log")
+	formatter, err := logs.NewFormatter(logs.FormatLogfmt)
+	require.NoError(t, err)
+	sink, err := logs.OpenFileSink(path, 200, 1, formatter)
+	require.NoError(t, err)
+	for i := range 5 {
+		require.NoError(t, sink.WriteEntry(newEntry(`{"message":"line `+strconv.Itoa(i)+`"}`)))
+	}
+	require.NoError(t, sink.Close())
+
+	current, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(current), `message="line 4"`)
+	rotated, err := os.ReadFile(path + ".1")
+	require.NoError(t, err)
+	require.Contains(t, string(rotated), `message="line`)
+	require.NoFileExists(t, path+".2")
+}
+
+// syslogPattern matches an RFC 5424 message with the nil PROCID, MSGID and STRUCTURED-DATA.
+var syslogPattern = regexp.MustCompile(`^<(\d+)>1 (\S+) (\S+) (\S+) - - - (.*)$`)
+
+func TestSyslogSinkDatagram(t *testing.T) {
+	t.Parallel()
+	formatter, err := logs.NewFormatter(logs.FormatJSON)
+	require.NoError(t, err)
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer udpConn.Close() //nolint:errcheck
+	socketPath := filepath.Join(t.TempDir(), "log.sock")
+	unixConn, err := net.ListenPacket("unixgram", socketPath)
+	require.NoError(t, err)
+	defer unixConn.Close() //nolint:errcheck
+
+	for _, receiver := range []struct {
+		network string
+		conn    net.PacketConn
+	}{
+		{logs.SyslogUDP, udpConn},
+		{logs.SyslogUnixgram, unixConn},
+	} {
+		sink, err := logs.NewSyslogSink(receiver.network, receiver.conn.LocalAddr().String(), "local3", formatter)
+		require.NoError(t, err)
+		require.NoError(t, sink.WriteEntry(newEntry(`{"time":"2025-06-01T11:59:59.123Z","level":"error","message":"boom"}`)))
+		require.NoError(t, sink.Close())
+
+		buf := make([]byte, 4096)
+		require.NoError(t, receiver.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := receiver.conn.ReadFrom(buf)
+		require.NoError(t, err)
+		match := syslogPattern.FindStringSubmatch(string(buf[:n]))
+		require.NotNil(t, match, string(buf[:n]))
+		// local3 (19) * 8 + err (3)
+		require.Equal(t, "155", match[1])
+		require.Equal(t, "2025-06-01T11:59:59.123000Z", match[2])
+		require.Equal(t, "app", match[4])
+		var fields map[string]any
+		require.NoError(t, json.Unmarshal([]byte(match[5]), &fields))
+		require.Equal(t, "boom", fields["message"])
+	}
+}
+
+func TestSyslogSinkStreamReconnects(t *testing.T) {
+	t.Parallel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close() //nolint:errcheck
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// Every connection receives a single message before it is closed by the server.
+			reader := bufio.NewReader(conn)
+			length, err := reader.ReadString(' ')
+			if err == nil {
+				n, _ := strconv.Atoi(strings.TrimSpace(length))
+				message := make([]byte, n)
+				if _, err := io.ReadFull(reader, message); err == nil {
+					messages <- string(message)
+				}
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	formatter, err := logs.NewFormatter(logs.FormatLogfmt)
+	require.NoError(t, err)
+	sink, err := logs.NewSyslogSink(logs.SyslogTCP, listener.Addr().String(), "", formatter)
+	require.NoError(t, err)
+	defer sink.Close() //nolint:errcheck
+
+	for i := range 3 {
+		// Writes to a connection closed by the server can succeed locally, so retry until the message arrives.
+		want := `message="hello ` + strconv.Itoa(i) + `"`
+		var match []string
+		require.Eventually(t, func() bool {
+			if err := sink.WriteEntry(newEntry(`{"level":"info","message":"hello ` + strconv.Itoa(i) + `"}`)); err != nil {
+				return false
+			}
+			select {
+			case message := <-messages:
+				match = syslogPattern.FindStringSubmatch(message)
+				return match != nil && strings.Contains(match[5], want)
+			case <-time.After(100 * time.Millisecond):
+				return false
+			}
+		}, 5*time.Second, 10*time.Millisecond)
+		// user (1) * 8 + info (6)
+		require.Equal(t, "14", match[1])
+	}
+
+	_, err = logs.NewSyslogSink("sctp", "localhost:514", "", formatter)
+	require.Error(t, err)
+	_, err = logs.NewSyslogSink(logs.SyslogUDP, "localhost:514", "local9", formatter)
+	require.Error(t, err)
+}
+
+func TestOTLPSink(t *testing.T) {
+	t.Parallel()
+	requests := make(chan *collectorlogs.ExportLogsServiceRequest, 1)
+	var fail bool
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			http.Error(w, "collector unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path != "/v1/logs" || r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		request := &collectorlogs.ExportLogsServiceRequest{}
+		if err := proto.Unmarshal(body, request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		requests <- request
+	}))
+	defer server.Close()
+
+	sink, err := logs.NewOTLPSink(server.URL+"/v1/logs", map[string]string{"Authorization": "Bearer token"}, 0)
+	require.NoError(t, err)
+	defer sink.Close() //nolint:errcheck
+	other := logs.ParseLine([]byte("plain"), logs.Source{EnclaveCID: 17, ConnID: 2}, receivedAt)
+	require.NoError(t, sink.WriteEntries([]*logs.Entry{
+		newEntry(`{"time":"2025-06-01T11:59:59Z","level":"warn","message":"disk full","free":0.5,"tags":["a"]}`),
+		other,
+		newEntry(`{"message":"second"}`),
+	}))
+
+	request := <-requests
+	require.Len(t, request.GetResourceLogs(), 2)
+	// Resources are exported in no particular order.
+	resources := map[string]*logspb.ResourceLogs{}
+	for _, resourceLogs := range request.GetResourceLogs() {
+		attributes := map[string]*commonpb.AnyValue{}
+		for _, attribute := range resourceLogs.GetResource().GetAttributes() {
+			attributes[attribute.GetKey()] = attribute.GetValue()
+		}
+		resources[strconv.FormatInt(attributes["enclave.cid"].GetIntValue(), 10)] = resourceLogs
+		if attributes["enclave.cid"].GetIntValue() == 16 {
+			require.Equal(t, "app", attributes["service.name"].GetStringValue())
+		} else {
+			require.NotContains(t, attributes, "service.name")
+		}
+	}
+	records := resources["16"].GetScopeLogs()[0].GetLogRecords()
+	require.Len(t, records, 2)
+	require.Equal(t, uint64(time.Date(2025, 6, 1, 11, 59, 59, 0, time.UTC).UnixNano()), records[0].GetTimeUnixNano())
+	require.Equal(t, uint64(receivedAt.UnixNano()), records[0].GetObservedTimeUnixNano())
+	require.Equal(t, logspb.SeverityNumber_SEVERITY_NUMBER_WARN, records[0].GetSeverityNumber())
+	require.Equal(t, "warn", records[0].GetSeverityText())
+	require.Equal(t, "disk full", records[0].GetBody().GetStringValue())
+	attributes := map[string]*commonpb.AnyValue{}
+	for _, attribute := range records[0].GetAttributes() {
+		attributes[attribute.GetKey()] = attribute.GetValue()
+	}
+	require.InDelta(t, 0.5, attributes["free"].GetDoubleValue(), 0)
+	require.Equal(t, int64(16), attributes["enclave_cid"].GetIntValue())
+	require.Equal(t, "a", attributes["tags"].GetArrayValue().GetValues()[0].GetStringValue())
+	otherRecords := resources["17"].GetScopeLogs()[0].GetLogRecords()
+	require.Len(t, otherRecords, 1)
+	require.Equal(t, logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED, otherRecords[0].GetSeverityNumber())
+	require.Equal(t, "plain", otherRecords[0].GetBody().GetStringValue())
+
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	err = sink.WriteEntry(other)
+	require.ErrorContains(t, err, "collector unavailable")
+}
+
+func TestNewFanOutFromSettings(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	var stdout strings.Builder
+	fanOut, err := logs.NewFanOutFromSettings([]config.LogSinkSettings{
+		{Type: config.LogSinkStdout, Level: "info", Format: logs.FormatLogfmt},
+		{Type: config.LogSinkFile, Path: filepath.Join(dir, "enclave.log")},
+		{Type: config.LogSinkSyslog, Network: logs.SyslogUDP, Address: "127.0.0.1:9"},
+	}, &stdout, zerolog.Nop())
+	require.NoError(t, err)
+	require.NoError(t, fanOut.WriteEntry(newEntry(`{"level":"debug","message":"hidden"}`)))
+	require.NoError(t, fanOut.WriteEntry(newEntry(`{"level":"info","message":"shown"}`)))
+	require.NoError(t, fanOut.Close(t.Context()))
+	require.NotContains(t, stdout.String(), "hidden")
+	require.Contains(t, stdout.String(), "message=shown")
+	data, err := os.ReadFile(filepath.Join(dir, "enclave.log"))
+	require.NoError(t, err)
+	require.Equal(t, 2, strings.Count(string(data), "\n"))
+
+	for _, settings := range [][]config.LogSinkSettings{
+		{{Type: config.LogSinkStdout}, {Type: config.LogSinkStdout}},
+		{{Type: "kafka"}},
+		{{Type: config.LogSinkStdout, Level: "loud"}},
+		{{Type: config.LogSinkFile}},
+		{{Type: config.LogSinkOTLP}},
+	} {
+		_, err := logs.NewFanOutFromSettings(settings, &stdout, zerolog.Nop())
+		require.Error(t, err)
+	}
+}
+
+func TestRedactingSink(t *testing.T) {
+	t.Parallel()
+	redactor, err := redact.New(&config.LogRedactionSettings{Fields: []string{"*.password"}})
+	require.NoError(t, err)
+	recorded := &recordingSink{}
+	sink := logs.NewRedactingSink(redactor, recorded)
+	require.NoError(t, sink.WriteEntry(newEntry(`{"message":"login","db":{"password":"hunter2"}}`)))
+	require.Len(t, recorded.entries, 1)
+	require.Equal(t, map[string]any{"password": redact.DefaultReplacement}, recorded.entries[0].Fields["db"])
+}
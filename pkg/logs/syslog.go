@@ -0,0 +1,190 @@
+package logs
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Transports of syslog sinks.
+const (
+	SyslogUDP      = "udp"
+	SyslogTCP      = "tcp"
+	SyslogUnix     = "unix"
+	SyslogUnixgram = "unixgram"
+)
+
+const (
+	syslogDialTimeout  = 5 * time.Second
+	syslogWriteTimeout = 5 * time.Second
+	// syslogTimestamp is the RFC 5424 timestamp format, which allows at most six fractional digits.
+	syslogTimestamp       = "2006-01-02T15:04:05.000000Z07:00"
+	syslogMaxHostname     = 255
+	syslogMaxAppName      = 48
+	defaultSyslogFacility = 1
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverities maps zerolog levels to syslog severities. Entries without a level are sent as notice.
+var syslogSeverities = map[zerolog.Level]int{
+	zerolog.PanicLevel: 1,
+	zerolog.FatalLevel: 2,
+	zerolog.ErrorLevel: 3,
+	zerolog.WarnLevel:  4,
+	zerolog.NoLevel:    5,
+	zerolog.InfoLevel:  6,
+	zerolog.DebugLevel: 7,
+	zerolog.TraceLevel: 7,
+}
+
+// SyslogSink sends entries as RFC 5424 messages. Messages are sent as datagrams over udp and unixgram
+// and with octet counting framing (RFC 6587) over tcp and unix stream sockets.
+// The connection is dialed on the first entry and redialed after errors.
+type SyslogSink struct {
+	mu        sync.Mutex
+	network   string
+	address   string
+	facility  int
+	hostname  string
+	formatter Formatter
+	conn      net.Conn
+}
+
+// NewSyslogSink creates a sink that sends entries formatted by formatter to the syslog server at address.
+// An empty facility selects user.
+func NewSyslogSink(network, address, facility string, formatter Formatter) (*SyslogSink, error) {
+	switch network {
+	case SyslogUDP, SyslogTCP, SyslogUnix, SyslogUnixgram:
+	default:
+		return nil, fmt.Errorf("unsupported syslog network: %q", network)
+	}
+	if address == "" {
+		return nil, fmt.Errorf("syslog address is required")
+	}
+	facilityCode := defaultSyslogFacility
+	if facility != "" {
+		var ok bool
+		facilityCode, ok = syslogFacilities[facility]
+		if !ok {
+			return nil, fmt.Errorf("unsupported syslog facility: %q", facility)
+		}
+	}
+	hostname, _ := os.Hostname()
+	return &SyslogSink{
+		network:   network,
+		address:   address,
+		facility:  facilityCode,
+		hostname:  syslogHeaderField(hostname, syslogMaxHostname),
+		formatter: formatter,
+	}, nil
+}
+
+// WriteEntry sends an entry. A failed write is retried once on a new connection.
+func (s *SyslogSink) WriteEntry(entry *Entry) error {
+	message, err := s.message(entry)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.send(message)
+	if err != nil {
+		err = s.send(message)
+	}
+	return err
+}
+
+// Close closes the connection to the syslog server.
+func (s *SyslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// message encodes an entry as an RFC 5424 message including the framing of the transport.
+func (s *SyslogSink) message(entry *Entry) ([]byte, error) {
+	body, err := s.formatter(entry)
+	if err != nil {
+		return nil, err
+	}
+	body = bytes.TrimRight(body, "\n")
+
+	severity := syslogSeverities[entryLevel(entry)]
+	var buf bytes.Buffer
+	// HEADER: <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID, followed by STRUCTURED-DATA and MSG.
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s - - - ",
+		s.facility*8+severity,
+		entryTime(entry).UTC().Format(syslogTimestamp),
+		s.hostname,
+		syslogHeaderField(entry.Source.AppName, syslogMaxAppName),
+	)
+	buf.Write(body)
+
+	if s.network == SyslogTCP || s.network == SyslogUnix {
+		framed := make([]byte, 0, buf.Len()+8)
+		framed = strconv.AppendInt(framed, int64(buf.Len()), 10)
+		framed = append(framed, ' ')
+		return append(framed, buf.Bytes()...), nil
+	}
+	return buf.Bytes(), nil
+}
+
+// send writes a message, dialing first if needed. The connection is closed on errors. Must be called with the lock held.
+func (s *SyslogSink) send(message []byte) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.address, syslogDialTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to dial syslog server: %w", err)
+		}
+		s.conn = conn
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	if _, err := s.conn.Write(message); err != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+		return fmt.Errorf("failed to write to syslog server: %w", err)
+	}
+	return nil
+}
+
+// syslogHeaderField restricts a header field to printable ASCII without spaces and maxLength characters.
+// Empty fields are replaced by the nil value -.
+func syslogHeaderField(value string, maxLength int) string {
+	field := []byte(value)
+	for i, c := range field {
+		if c < '!' || c > '~' {
+			field[i] = '_'
+		}
+	}
+	if len(field) > maxLength {
+		field = field[:maxLength]
+	}
+	if len(field) == 0 {
+		return "-"
+	}
+	return string(field)
+}
+
+// entryTime returns the time field of an entry if it is an RFC 3339 timestamp, or else the time it was received.
+func entryTime(entry *Entry) time.Time {
+	if timestamp, ok := entryTimestamp(entry); ok {
+		return timestamp
+	}
+	return entry.ReceivedAt
+}
@@ -0,0 +1,231 @@
+// Package proxyproto encodes and parses version 2 PROXY protocol headers.
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Signature is the prefix of every version 2 PROXY protocol header.
+var Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// TLV types used by the bridge.
+const (
+	// TypeSSL describes the TLS connection of the client.
+	TypeSSL = 0x20
+	// SubtypeSSLVersion is the TLS version of the client connection, nested in TypeSSL.
+	SubtypeSSLVersion = 0x21
+	// SubtypeSSLCN is the common name of the client certificate, nested in TypeSSL.
+	SubtypeSSLCN = 0x22
+	// TypeClientSubject is the full distinguished name of the verified client certificate.
+	// It is in the range reserved for application specific TLVs.
+	TypeClientSubject = 0xE0
+	// TypeTraceparent is the W3C traceparent of the bridge span that forwarded the connection.
+	// It is in the range reserved for application specific TLVs.
+	TypeTraceparent = 0xE1
+)
+
+// Client flags of a TypeSSL TLV.
+const (
+	ClientSSL      = 0x01
+	ClientCertConn = 0x02
+)
+
+const (
+	versionCommandProxy = 0x21
+	versionCommandLocal = 0x20
+	familyTCP4          = 0x11
+	familyTCP6          = 0x21
+	familyUnspec        = 0x00
+	headerLength        = 16
+	maxPayloadLength    = 64 * 1024
+)
+
+// ErrInvalidHeader is returned when a PROXY protocol header can not be parsed.
+var ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+
+// TLV is a type-length-value extension of a header.
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header is a version 2 PROXY protocol header.
+type Header struct {
+	// Source and Destination are the addresses of the proxied connection.
+	// If either is nil the header uses the LOCAL command without addresses.
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+	TLVs        []TLV
+}
+
+// NewHeader creates a header for a connection, using the LOCAL command if the connection is not TCP.
+func NewHeader(conn net.Conn, tlvs ...TLV) *Header {
+	header := &Header{TLVs: tlvs}
+	source, sourceOK := conn.RemoteAddr().(*net.TCPAddr)
+	destination, destinationOK := conn.LocalAddr().(*net.TCPAddr)
+	if sourceOK && destinationOK {
+		header.Source, header.Destination = source, destination
+	}
+	return header
+}
+
+// TLV returns the value of the first TLV of type tlvType.
+func (h *Header) TLV(tlvType byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == tlvType {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+// WriteTo writes the encoded header to w.
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	data, err := h.Format()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	if err != nil {
+		return int64(n), fmt.Errorf("failed to write PROXY protocol header: %w", err)
+	}
+	return int64(n), nil
+}
+
+// Format encodes the header.
+func (h *Header) Format() ([]byte, error) {
+	var payload bytes.Buffer
+	command, family := byte(versionCommandLocal), byte(familyUnspec)
+	if h.Source != nil && h.Destination != nil {
+		command = versionCommandProxy
+		source4, destination4 := h.Source.IP.To4(), h.Destination.IP.To4()
+		if source4 != nil && destination4 != nil {
+			family = familyTCP4
+			payload.Write(source4)
+			payload.Write(destination4)
+		} else {
+			family = familyTCP6
+			payload.Write(h.Source.IP.To16())
+			payload.Write(h.Destination.IP.To16())
+		}
+		_ = binary.Write(&payload, binary.BigEndian, uint16(h.Source.Port))      //nolint:gosec // ports fit in 16 bits
+		_ = binary.Write(&payload, binary.BigEndian, uint16(h.Destination.Port)) //nolint:gosec // ports fit in 16 bits
+	}
+	for _, tlv := range h.TLVs {
+		if len(tlv.Value) > 0xFFFF {
+			return nil, fmt.Errorf("%w: TLV 0x%02x is too long", ErrInvalidHeader, tlv.Type)
+		}
+		payload.WriteByte(tlv.Type)
+		_ = binary.Write(&payload, binary.BigEndian, uint16(len(tlv.Value)))
+		payload.Write(tlv.Value)
+	}
+	if payload.Len() > 0xFFFF {
+		return nil, fmt.Errorf("%w: header is too long", ErrInvalidHeader)
+	}
+	header := make([]byte, 0, headerLength+payload.Len())
+	header = append(header, Signature...)
+	header = append(header, command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(payload.Len())) //nolint:gosec // checked above
+	return append(header, payload.Bytes()...), nil
+}
+
+// Read reads a header from r. The reader is left positioned at the first byte after the header.
+func Read(r *bufio.Reader) (*Header, error) {
+	prefix := make([]byte, headerLength)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+	if !bytes.Equal(prefix[:len(Signature)], Signature) {
+		return nil, fmt.Errorf("%w: missing signature", ErrInvalidHeader)
+	}
+	command, family := prefix[12], prefix[13]
+	if command != versionCommandProxy && command != versionCommandLocal {
+		return nil, fmt.Errorf("%w: unsupported version or command 0x%02x", ErrInvalidHeader, command)
+	}
+	length := int(binary.BigEndian.Uint16(prefix[14:]))
+	if length > maxPayloadLength {
+		return nil, fmt.Errorf("%w: header is too long", ErrInvalidHeader)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	}
+
+	header := &Header{}
+	var addrLength int
+	switch family {
+	case familyTCP4:
+		addrLength = 2*net.IPv4len + 4
+	case familyTCP6:
+		addrLength = 2*net.IPv6len + 4
+	default:
+		// Addresses of other families are skipped using the length of the header.
+		addrLength = 0
+	}
+	if len(payload) < addrLength {
+		return nil, fmt.Errorf("%w: address block is too short", ErrInvalidHeader)
+	}
+	if addrLength > 0 && command == versionCommandProxy {
+		ipLength := (addrLength - 4) / 2
+		header.Source = &net.TCPAddr{
+			IP:   net.IP(bytes.Clone(payload[:ipLength])),
+			Port: int(binary.BigEndian.Uint16(payload[2*ipLength:])),
+		}
+		header.Destination = &net.TCPAddr{
+			IP:   net.IP(bytes.Clone(payload[ipLength : 2*ipLength])),
+			Port: int(binary.BigEndian.Uint16(payload[2*ipLength+2:])),
+		}
+	}
+	tlvs, err := parseTLVs(payload[addrLength:])
+	if err != nil {
+		return nil, err
+	}
+	header.TLVs = tlvs
+	return header, nil
+}
+
+func parseTLVs(data []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, fmt.Errorf("%w: truncated TLV", ErrInvalidHeader)
+		}
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+length {
+			return nil, fmt.Errorf("%w: truncated TLV 0x%02x", ErrInvalidHeader, data[0])
+		}
+		tlvs = append(tlvs, TLV{Type: data[0], Value: bytes.Clone(data[3 : 3+length])})
+		data = data[3+length:]
+	}
+	return tlvs, nil
+}
+
+// SSLTLV creates a TypeSSL TLV for a client that connected with TLS and presented a verified certificate.
+func SSLTLV(version, commonName string) TLV {
+	value := []byte{ClientSSL | ClientCertConn, 0, 0, 0, 0}
+	for _, sub := range []TLV{{Type: SubtypeSSLVersion, Value: []byte(version)}, {Type: SubtypeSSLCN, Value: []byte(commonName)}} {
+		value = append(value, sub.Type)
+		value = binary.BigEndian.AppendUint16(value, uint16(len(sub.Value))) //nolint:gosec // TLS versions and common names are short
+		value = append(value, sub.Value...)
+	}
+	return TLV{Type: TypeSSL, Value: value}
+}
+
+// ParseSSLTLV returns the client flags and nested TLVs of a TypeSSL TLV value.
+func ParseSSLTLV(value []byte) (byte, []TLV, error) {
+	if len(value) < 5 {
+		return 0, nil, fmt.Errorf("%w: SSL TLV is too short", ErrInvalidHeader)
+	}
+	tlvs, err := parseTLVs(value[5:])
+	if err != nil {
+		return 0, nil, err
+	}
+	return value[0], tlvs, nil
+}
@@ -0,0 +1,58 @@
+package proxyproto_test
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/proxyproto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	t.Parallel()
+	for _, header := range []*proxyproto.Header{
+		{
+			Source:      &net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 50000},
+			Destination: &net.TCPAddr{IP: net.ParseIP("192.0.2.2").To4(), Port: 443},
+			TLVs:        []proxyproto.TLV{proxyproto.SSLTLV("TLS 1.3", "service")},
+		},
+		{
+			Source:      &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50000},
+			Destination: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		},
+		{TLVs: []proxyproto.TLV{{Type: proxyproto.TypeClientSubject, Value: []byte("CN=service")}}},
+	} {
+		var buf bytes.Buffer
+		_, err := header.WriteTo(&buf)
+		require.NoError(t, err)
+		buf.WriteString("payload")
+
+		reader := bufio.NewReader(&buf)
+		parsed, err := proxyproto.Read(reader)
+		require.NoError(t, err)
+		require.Equal(t, header, parsed)
+		rest, err := reader.ReadString(0)
+		require.Equal(t, "payload", rest)
+		require.Error(t, err)
+	}
+}
+
+func TestParseSSLTLV(t *testing.T) {
+	t.Parallel()
+	tlv := proxyproto.SSLTLV("TLS 1.3", "service")
+	client, subTLVs, err := proxyproto.ParseSSLTLV(tlv.Value)
+	require.NoError(t, err)
+	require.Equal(t, byte(proxyproto.ClientSSL|proxyproto.ClientCertConn), client)
+	require.Equal(t, []proxyproto.TLV{
+		{Type: proxyproto.SubtypeSSLVersion, Value: []byte("TLS 1.3")},
+		{Type: proxyproto.SubtypeSSLCN, Value: []byte("service")},
+	}, subTLVs)
+}
+
+func TestReadInvalidHeader(t *testing.T) {
+	t.Parallel()
+	_, err := proxyproto.Read(bufio.NewReader(bytes.NewReader([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))))
+	require.ErrorIs(t, err, proxyproto.ErrInvalidHeader)
+}
@@ -0,0 +1,164 @@
+// Package redact masks secrets in structured log lines, either on the bridge before logs reach a sink or in the
+// enclave before they leave it.
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+)
+
+// DefaultReplacement replaces masked values if no replacement is configured.
+const DefaultReplacement = "[REDACTED]"
+
+// Redactor masks values of configured fields and matches of configured patterns. It is safe for concurrent use.
+type Redactor struct {
+	patterns    []pattern
+	fields      []fieldRule
+	replacement string
+}
+
+type pattern struct {
+	name   string
+	regexp *regexp.Regexp
+}
+
+type fieldRule struct {
+	name     string
+	segments []string
+}
+
+// Counts are the number of masked values by rule name. Field rules are named by their path.
+type Counts map[string]int
+
+// New compiles the rules of settings.
+func New(settings *config.LogRedactionSettings) (*Redactor, error) {
+	redactor := &Redactor{replacement: settings.Replacement}
+	if redactor.replacement == "" {
+		redactor.replacement = DefaultReplacement
+	}
+	for _, setting := range settings.Patterns {
+		compiled, err := regexp.Compile(setting.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", setting.Pattern, err)
+		}
+		name := setting.Name
+		if name == "" {
+			name = setting.Pattern
+		}
+		redactor.patterns = append(redactor.patterns, pattern{name: name, regexp: compiled})
+	}
+	for _, path := range settings.Fields {
+		segments := strings.Split(path, ".")
+		if slices.Contains(segments, "") {
+			return nil, fmt.Errorf("invalid redaction field %q", path)
+		}
+		redactor.fields = append(redactor.fields, fieldRule{name: path, segments: segments})
+	}
+	return redactor, nil
+}
+
+// Fields masks fields in place and returns the number of masked values by rule.
+// Arrays are transparent to paths, so users.*.token also matches tokens of objects in an array of users.
+func (r *Redactor) Fields(fields map[string]any) Counts {
+	counts := Counts{}
+	r.redactObject(fields, nil, counts)
+	return counts
+}
+
+// Line masks a log line without its line break. JSON objects are decoded, masked and encoded again with sorted
+// keys; other lines are only masked by patterns. Unchanged lines are returned as is.
+func (r *Redactor) Line(line []byte) ([]byte, Counts) {
+	var fields map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil || fields == nil || decoder.More() {
+		counts := Counts{}
+		masked := r.redactString(string(line), counts)
+		if len(counts) == 0 {
+			return line, counts
+		}
+		return []byte(masked), counts
+	}
+	counts := r.Fields(fields)
+	if len(counts) == 0 {
+		return line, counts
+	}
+	encoded, err := json.Marshal(fields)
+	if err != nil {
+		// Never pass on a line that matched a rule unmasked.
+		return []byte(r.replacement), counts
+	}
+	return encoded, counts
+}
+
+func (r *Redactor) redactObject(object map[string]any, path []string, counts Counts) {
+	for key, value := range object {
+		keyPath := append(path[:len(path):len(path)], key)
+		if rule, ok := r.matchField(keyPath); ok {
+			object[key] = r.replacement
+			counts[rule]++
+			continue
+		}
+		object[key] = r.redactValue(value, keyPath, counts)
+	}
+}
+
+func (r *Redactor) redactValue(value any, path []string, counts Counts) any {
+	switch v := value.(type) {
+	case map[string]any:
+		r.redactObject(v, path, counts)
+	case []any:
+		for i, item := range v {
+			v[i] = r.redactValue(item, path, counts)
+		}
+	case string:
+		return r.redactString(v, counts)
+	case json.Number:
+		if masked := r.redactString(v.String(), counts); masked != v.String() {
+			return masked
+		}
+	}
+	return value
+}
+
+func (r *Redactor) redactString(value string, counts Counts) string {
+	for _, pattern := range r.patterns {
+		value = pattern.regexp.ReplaceAllStringFunc(value, func(string) string {
+			counts[pattern.name]++
+			return r.replacement
+		})
+	}
+	return value
+}
+
+// matchField returns the name of the first field rule matching path.
+func (r *Redactor) matchField(path []string) (string, bool) {
+	for _, rule := range r.fields {
+		if matchPath(rule.segments, path) {
+			return rule.name, true
+		}
+	}
+	return "", false
+}
+
+// matchPath reports whether path matches the segments of a field rule, where * matches any number of keys.
+func matchPath(segments, path []string) bool {
+	if len(segments) == 0 {
+		return len(path) == 0
+	}
+	if segments[0] == "*" {
+		for i := 0; i <= len(path); i++ {
+			if matchPath(segments[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	return len(path) > 0 && strings.EqualFold(segments[0], path[0]) && matchPath(segments[1:], path[1:])
+}
@@ -0,0 +1,79 @@
+package redact_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/redact"
+	"github.com/stretchr/testify/require"
+)
+
+var hexKey = "4f2b0c3a9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c1d0e9f8a7b6c5d4e3f2a"
+
+func newRedactor(t *testing.T) *redact.Redactor {
+	t.Helper()
+	redactor, err := redact.New(&config.LogRedactionSettings{
+		Patterns: []config.RedactionPattern{
+			{Name: "hex64", Pattern: `\b[0-9a-fA-F]{64}\b`},
+			{Pattern: `Bearer \S+`},
+		},
+		Fields: []string{"*.password", "user.email", "cards.*.number"},
+	})
+	require.NoError(t, err)
+	return redactor
+}
+
+func TestFields(t *testing.T) {
+	t.Parallel()
+	redactor := newRedactor(t)
+	var fields map[string]any
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"message": "signing with `+hexKey+` and Bearer abc.def",
+		"Password": "hunter2",
+		"user": {"email": "a@example.com", "name": "alice", "db": {"password": {"nested": true}}},
+		"cards": [{"number": "4111111111111111", "last4": "1111"}],
+		"other": {"email": "kept@example.com"}
+	}`), &fields))
+
+	counts := redactor.Fields(fields)
+	require.Equal(t, redact.Counts{"hex64": 1, `Bearer \S+`: 1, "*.password": 2, "user.email": 1, "cards.*.number": 1}, counts)
+	require.Equal(t, "signing with [REDACTED] and [REDACTED]", fields["message"])
+	require.Equal(t, "[REDACTED]", fields["Password"])
+	user := fields["user"].(map[string]any) //nolint:forcetypeassert
+	require.Equal(t, "[REDACTED]", user["email"])
+	require.Equal(t, "alice", user["name"])
+	require.Equal(t, map[string]any{"password": "[REDACTED]"}, user["db"])
+	require.Equal(t, []any{map[string]any{"number": "[REDACTED]", "last4": "1111"}}, fields["cards"])
+	require.Equal(t, map[string]any{"email": "kept@example.com"}, fields["other"])
+}
+
+func TestLine(t *testing.T) {
+	t.Parallel()
+	redactor := newRedactor(t)
+
+	line, counts := redactor.Line([]byte(`{"level":"info","password":"x","count":1}`))
+	require.Equal(t, `{"count":1,"level":"info","password":"[REDACTED]"}`, string(line))
+	require.Equal(t, redact.Counts{"*.password": 1}, counts)
+
+	unchanged := []byte(`{"level":"info","message":"nothing to hide"}`)
+	line, counts = redactor.Line(unchanged)
+	require.Equal(t, string(unchanged), string(line))
+	require.Empty(t, counts)
+
+	line, _ = redactor.Line([]byte("panic: key " + hexKey))
+	require.Equal(t, "panic: key [REDACTED]", string(line))
+}
+
+func TestNewInvalidRules(t *testing.T) {
+	t.Parallel()
+	_, err := redact.New(&config.LogRedactionSettings{Patterns: []config.RedactionPattern{{Pattern: "("}}})
+	require.Error(t, err)
+	_, err = redact.New(&config.LogRedactionSettings{Fields: []string{"user..email"}})
+	require.Error(t, err)
+
+	redactor, err := redact.New(&config.LogRedactionSettings{Fields: []string{"token"}, Replacement: "***"})
+	require.NoError(t, err)
+	line, _ := redactor.Line([]byte(`{"token":"t"}`))
+	require.Equal(t, `{"token":"***"}`, string(line))
+}
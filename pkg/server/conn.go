@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type identityContextKey struct{}
+
+// ClientIdentity is the identity of a host client verified by a server tunnel with mutual TLS.
+type ClientIdentity struct {
+	// Subject is the distinguished name of the client certificate.
+	Subject string
+	// CommonName is the common name of the client certificate. It is only sent with the PROXY protocol.
+	CommonName string
+	// Source is the address of the host client. It is only sent with the PROXY protocol.
+	Source *net.TCPAddr
+}
+
+// Conn is a connection accepted by a Listener.
+type Conn struct {
+	net.Conn
+	listener *Listener
+	reader   *bufio.Reader
+	identity *ClientIdentity
+	// span is the span of the connection, ended on Close; spanContext is its span context, or the trace context
+	// sent by the bridge if the tracer does not record spans.
+	span        trace.Span
+	spanContext trace.SpanContext
+	closeOnce   sync.Once
+	closeErr    error
+}
+
+// Read reads data that follows the client identity sent by the bridge.
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.reader != nil {
+		return c.reader.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr returns the address of the host client if the bridge sent it, and the vsock address otherwise.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.identity != nil && c.identity.Source != nil {
+		return c.identity.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// Close closes the connection and stops tracking it for Listener.Shutdown.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.Conn.Close()
+		c.span.End()
+		c.listener.untrack(c)
+	})
+	return c.closeErr
+}
+
+// Identity returns the client identity of the connection, or nil if the server tunnel does not use mutual TLS.
+func (c *Conn) Identity() *ClientIdentity {
+	return c.identity
+}
+
+// SpanContext returns the span context of the connection, or an invalid span context if the connection is
+// neither traced nor carries the trace context of the bridge.
+func (c *Conn) SpanContext() trace.SpanContext {
+	return c.spanContext
+}
+
+// Identity returns the client identity of a connection accepted by a Listener, unwrapping TLS connections.
+// With fiber, pass c.Context().Conn().
+func Identity(conn net.Conn) (*ClientIdentity, bool) {
+	serverConn, ok := unwrapConn(conn)
+	if !ok || serverConn.identity == nil {
+		return nil, false
+	}
+	return serverConn.identity, true
+}
+
+// SpanContext returns the span context of a connection accepted by a Listener, unwrapping TLS connections.
+// Pass it to trace.ContextWithSpanContext to join the trace. With fiber, pass c.Context().Conn().
+func SpanContext(conn net.Conn) (trace.SpanContext, bool) {
+	serverConn, ok := unwrapConn(conn)
+	if !ok || !serverConn.spanContext.IsValid() {
+		return trace.SpanContext{}, false
+	}
+	return serverConn.spanContext, true
+}
+
+func unwrapConn(conn net.Conn) (*Conn, bool) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	serverConn, ok := conn.(*Conn)
+	return serverConn, ok
+}
+
+// ConnContext adds the client identity and span context of conn to ctx. Use it as http.Server.ConnContext
+// and read the identity in handlers with IdentityFromContext(r.Context()). Spans started from the request
+// context, and client.Dialer dials with it, join the trace of the connection.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if sc, ok := SpanContext(conn); ok {
+		ctx = trace.ContextWithSpanContext(ctx, sc)
+	}
+	if identity, ok := Identity(conn); ok {
+		return context.WithValue(ctx, identityContextKey{}, identity)
+	}
+	return ctx
+}
+
+// IdentityFromContext returns the client identity added by ConnContext.
+func IdentityFromContext(ctx context.Context) (*ClientIdentity, bool) {
+	identity, ok := ctx.Value(identityContextKey{}).(*ClientIdentity)
+	return identity, ok
+}
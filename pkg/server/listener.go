@@ -0,0 +1,352 @@
+// Package server provides listeners for servers running inside an enclave behind a server tunnel of the enclave-bridge.
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/certs"
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
+	"github.com/DIMO-Network/enclave-bridge/pkg/proxyproto"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tracing"
+	"github.com/mdlayher/vsock"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// acmeALPNProto is the protocol of TLS-ALPN-01 challenges answered by acme.CertManager.GetCertificate.
+	acmeALPNProto = "acme-tls/1"
+)
+
+// ErrNoListenPort is returned by Listen when the settings have no port for this enclave.
+var ErrNoListenPort = errors.New("no enclave listen port for this enclave")
+
+// Option configures a Listener.
+type Option func(*Listener)
+
+// WithTLS terminates TLS in the enclave with certificates from getCertificate,
+// e.g. certs.GetCertificatesFromSettings or acme.CertManager.GetCertificate.
+func WithTLS(getCertificate certs.GetCertificateFunc) Option {
+	return func(l *Listener) {
+		l.tlsConfig = &tls.Config{
+			GetCertificate: getCertificate,
+			NextProtos:     []string{"http/1.1", acmeALPNProto},
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+}
+
+// WithTLSConfig terminates TLS in the enclave with tlsConfig, e.g. to offer HTTP/2 to a net/http server
+// by adding "h2" to NextProtos.
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(l *Listener) {
+		l.tlsConfig = tlsConfig
+	}
+}
+
+// WithLogger sets the logger for connections that are dropped before they are accepted.
+// Defaults to zerolog.DefaultContextLogger.
+func WithLogger(logger *zerolog.Logger) Option {
+	return func(l *Listener) {
+		l.logger = logger
+	}
+}
+
+// WithTracer records a span for every accepted connection that lasts until the connection is closed, replacing
+// the tracer of the global tracer provider. It is a child of the bridge span of the connection if the server
+// tunnel propagates traces.
+func WithTracer(tracer trace.Tracer) Option {
+	return func(l *Listener) {
+		l.tracer = tracer
+	}
+}
+
+// Listener accepts connections forwarded by a server tunnel. If the tunnel uses mutual TLS, the client
+// identity the bridge sends before each connection is read before Accept returns it and available from Identity.
+// Headers are read concurrently, so a connection whose header has not arrived yet, e.g. one the bridge keeps in
+// its warm pool, does not hold up the connections behind it.
+// If the tunnel propagates traces, the trace context is read from the PROXY protocol header and available
+// from SpanContext. Open connections are tracked so Shutdown can drain them.
+type Listener struct {
+	listener    net.Listener
+	identity    string
+	traceHeader bool
+	tlsConfig   *tls.Config
+	logger      *zerolog.Logger
+	tracer      trace.Tracer
+
+	mu      sync.Mutex
+	conns   map[*Conn]struct{}
+	drained chan struct{}
+
+	// acceptOnce starts acceptLoop, which sends connections to accepted once their header is read.
+	// acceptErr is the error that stopped the loop, set before acceptDone is closed.
+	acceptOnce sync.Once
+	accepted   chan acceptResult
+	acceptDone chan struct{}
+	acceptErr  error
+}
+
+// acceptResult is a connection whose header was read, or an error of the underlying listener.
+type acceptResult struct {
+	conn *Conn
+	err  error
+}
+
+// Listen creates a vsock listener for the server tunnel configured by settings.
+// If settings has multiple targets, the port of the target with the context ID of this enclave is used.
+func Listen(settings *config.ServerSettings, options ...Option) (*Listener, error) {
+	port, err := listenPort(settings)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := vsock.Listen(port, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on vsock port %d: %w", port, err)
+	}
+	return NewListener(listener, settings, options...), nil
+}
+
+// NewListener wraps listener to accept connections forwarded by the server tunnel configured by settings.
+func NewListener(listener net.Listener, settings *config.ServerSettings, options ...Option) *Listener {
+	l := &Listener{
+		listener: listener,
+		logger:   zerolog.Ctx(context.Background()),
+		tracer:   otel.Tracer(tracing.ScopeName),
+		conns:    map[*Conn]struct{}{},
+
+		accepted:   make(chan acceptResult),
+		acceptDone: make(chan struct{}),
+	}
+	if settings.MutualTLS.Enabled {
+		l.identity = settings.MutualTLS.ClientIdentity
+		if l.identity == "" {
+			l.identity = config.ClientIdentityProxyProtocol
+		}
+	}
+	l.traceHeader = settings.PropagateTrace
+	for _, option := range options {
+		option(l)
+	}
+	return l
+}
+
+func listenPort(settings *config.ServerSettings) (uint32, error) {
+	if len(settings.Targets) == 0 {
+		return settings.EnclaveListenPort, nil
+	}
+	cid, err := vsock.ContextID()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get context ID: %w", err)
+	}
+	for _, target := range settings.Targets {
+		if target.CID == cid {
+			return target.Port, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: context ID %d", ErrNoListenPort, cid)
+}
+
+// Accept waits for the next connection. Connections whose client identity can not be read are closed and skipped.
+// The returned connection is a *tls.Conn wrapping a *Conn if TLS is enabled and a *Conn otherwise.
+func (l *Listener) Accept() (net.Conn, error) {
+	if l.identity == "" && !l.traceHeader {
+		rawConn, err := l.listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := l.newConn(rawConn)
+		if err != nil {
+			_ = rawConn.Close()
+			return nil, err
+		}
+		return l.wrapTLS(conn), nil
+	}
+	l.acceptOnce.Do(func() {
+		go l.acceptLoop()
+	})
+	select {
+	case result := <-l.accepted:
+		if result.err != nil {
+			return nil, result.err
+		}
+		return l.wrapTLS(result.conn), nil
+	case <-l.acceptDone:
+		return nil, l.acceptErr
+	}
+}
+
+// acceptLoop accepts connections until the underlying listener is closed and reads the header of each
+// connection in its own goroutine.
+func (l *Listener) acceptLoop() {
+	for {
+		rawConn, err := l.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			l.acceptErr = err
+			close(l.acceptDone)
+			return
+		}
+		if err != nil {
+			l.accepted <- acceptResult{err: err}
+			continue
+		}
+		go func() {
+			conn, err := l.newConn(rawConn)
+			if err != nil {
+				l.logger.Warn().Err(err).Msg("Dropping connection without client identity or trace header")
+				_ = rawConn.Close()
+				return
+			}
+			select {
+			case l.accepted <- acceptResult{conn: conn}:
+			case <-l.acceptDone:
+				_ = conn.Close()
+			}
+		}()
+	}
+}
+
+// wrapTLS terminates TLS on conn if TLS is enabled.
+func (l *Listener) wrapTLS(conn *Conn) net.Conn {
+	if l.tlsConfig != nil {
+		return tls.Server(conn, l.tlsConfig)
+	}
+	return conn
+}
+
+// Close stops accepting connections. Open connections are not closed.
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+// Addr returns the address of the underlying listener.
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Shutdown stops accepting connections and waits until all open connections are closed.
+// Connections still open when ctx is done are closed and the context's error is returned.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	err := l.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("failed to close listener: %w", err)
+	}
+	l.mu.Lock()
+	if len(l.conns) == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	if l.drained == nil {
+		l.drained = make(chan struct{})
+	}
+	drained := l.drained
+	l.mu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	conns := make([]*Conn, 0, len(l.conns))
+	for conn := range l.conns {
+		conns = append(conns, conn)
+	}
+	l.mu.Unlock()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+	return fmt.Errorf("failed to drain %d connections: %w", len(conns), ctx.Err())
+}
+
+// newConn tracks rawConn and reads the client identity and trace context sent by the bridge.
+func (l *Listener) newConn(rawConn net.Conn) (*Conn, error) {
+	conn := &Conn{Conn: rawConn, listener: l}
+	ctx := context.Background()
+	if l.identity != "" || l.traceHeader {
+		format := l.identity
+		if format == "" {
+			format = config.ClientIdentityProxyProtocol
+		}
+		_ = rawConn.SetReadDeadline(time.Now().Add(enclave.ClientIdentityTimeout))
+		reader := bufio.NewReader(rawConn)
+		identity, traceparent, err := readIdentity(reader, format)
+		if err != nil {
+			return nil, err
+		}
+		_ = rawConn.SetReadDeadline(time.Time{})
+		conn.reader = reader
+		if l.identity != "" {
+			conn.identity = identity
+		}
+		if traceparent != "" {
+			// An invalid trace context only loses the link to the bridge span.
+			ctx, _ = tracing.ContextWithTraceparent(ctx, traceparent)
+		}
+	}
+	ctx, conn.span = l.tracer.Start(ctx, "enclave-server.conn", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("server.address", rawConn.LocalAddr().String())))
+	conn.spanContext = trace.SpanContextFromContext(ctx)
+	l.mu.Lock()
+	l.conns[conn] = struct{}{}
+	l.mu.Unlock()
+	return conn, nil
+}
+
+func (l *Listener) untrack(conn *Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, conn)
+	if len(l.conns) == 0 && l.drained != nil {
+		close(l.drained)
+		l.drained = nil
+	}
+}
+
+// readIdentity reads the client identity in the given format from the start of a connection.
+// The PROXY protocol header also carries the traceparent if the server tunnel propagates traces.
+func readIdentity(reader *bufio.Reader, format string) (*ClientIdentity, string, error) {
+	if format == config.ClientIdentityHeader {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read client identity: %w", err)
+		}
+		subject, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), enclave.ClientIdentityPrefix)
+		if !ok {
+			return nil, "", fmt.Errorf("invalid client identity line: %q", line)
+		}
+		return &ClientIdentity{Subject: subject}, "", nil
+	}
+	header, err := proxyproto.Read(reader)
+	if err != nil {
+		return nil, "", err
+	}
+	traceparent, _ := header.TLV(proxyproto.TypeTraceparent)
+	identity := &ClientIdentity{Source: header.Source}
+	if subject, ok := header.TLV(proxyproto.TypeClientSubject); ok {
+		identity.Subject = string(subject)
+	}
+	if ssl, ok := header.TLV(proxyproto.TypeSSL); ok {
+		_, subTLVs, err := proxyproto.ParseSSLTLV(ssl)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, tlv := range subTLVs {
+			if tlv.Type == proxyproto.SubtypeSSLCN {
+				identity.CommonName = string(tlv.Value)
+			}
+		}
+	}
+	return identity, string(traceparent), nil
+}
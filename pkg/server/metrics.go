@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/mdlayher/vsock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// metricsDrainTimeout is how long ServeMetrics waits for a running scrape on shutdown.
+	metricsDrainTimeout      = 5 * time.Second
+	metricsReadHeaderTimeout = 10 * time.Second
+)
+
+// ErrMetricsDisabled is returned by ListenMetrics when the settings have no metrics port.
+var ErrMetricsDisabled = errors.New("no enclave metrics port configured")
+
+// ListenMetrics creates the vsock listener the bridge scrapes the enclave's metrics from.
+func ListenMetrics(settings *config.MetricsSettings) (net.Listener, error) {
+	if settings.EnclaveListenPort == 0 {
+		return nil, ErrMetricsDisabled
+	}
+	listener, err := vsock.Listen(settings.EnclaveListenPort, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on vsock port %d: %w", settings.EnclaveListenPort, err)
+	}
+	return listener, nil
+}
+
+// ServeMetrics serves the metrics of gatherer at /metrics on listener until ctx is done.
+// The prometheus.DefaultGatherer is used if gatherer is nil.
+func ServeMetrics(ctx context.Context, listener net.Listener, gatherer prometheus.Gatherer) error {
+	if gatherer == nil {
+		gatherer = prometheus.DefaultGatherer
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: metricsReadHeaderTimeout}
+	return Serve(ctx, NewListener(listener, &config.ServerSettings{}), server, metricsDrainTimeout)
+}
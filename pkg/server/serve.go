@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Server is a server that can serve a listener and shut down gracefully, like *http.Server.
+type Server interface {
+	Serve(listener net.Listener) error
+	Shutdown(ctx context.Context) error
+}
+
+type fiberServer struct {
+	app *fiber.App
+}
+
+// Fiber adapts a fiber app to Server.
+func Fiber(app *fiber.App) Server {
+	return fiberServer{app: app}
+}
+
+func (f fiberServer) Serve(listener net.Listener) error {
+	return f.app.Listener(listener)
+}
+
+func (f fiberServer) Shutdown(ctx context.Context) error {
+	return f.app.ShutdownWithContext(ctx)
+}
+
+// Serve runs server on listener until ctx is done. It then shuts the server down and waits up to
+// drainTimeout for open connections to finish before closing them.
+func Serve(ctx context.Context, listener *Listener, server Server, drainTimeout time.Duration) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	select {
+	case err := <-serveErr:
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("failed to serve: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+	}
+
+	drainCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), drainTimeout)
+	defer cancel()
+	var errs []error
+	if err := server.Shutdown(drainCtx); err != nil {
+		errs = append(errs, fmt.Errorf("failed to shut down server: %w", err))
+	}
+	// Hijacked connections, e.g. websockets, are not closed by the server.
+	if err := listener.Shutdown(drainCtx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := <-serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		errs = append(errs, fmt.Errorf("failed to serve: %w", err))
+	}
+	return errors.Join(errs...)
+}
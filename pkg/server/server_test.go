@@ -0,0 +1,299 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
+	"github.com/DIMO-Network/enclave-bridge/pkg/proxyproto"
+	"github.com/DIMO-Network/enclave-bridge/pkg/server"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tracing"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func listen(t *testing.T, settings *config.ServerSettings, options ...server.Option) *server.Listener {
+	t.Helper()
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return server.NewListener(tcpListener, settings, options...)
+}
+
+// serve runs srv on listener until the test ends.
+func serve(t *testing.T, listener *server.Listener, srv server.Server) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(ctx, listener, srv, time.Second)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+}
+
+// request sends a GET request on conn after prefix and returns the response body.
+func request(conn net.Conn, prefix []byte) (string, error) {
+	if _, err := conn.Write(prefix); err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: enclave\r\nConnection: close\r\n\r\n"); err != nil {
+		return "", err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestHTTPServerProxyProtocolIdentity(t *testing.T) {
+	t.Parallel()
+	listener := listen(t, &config.ServerSettings{MutualTLS: config.MutualTLSSettings{Enabled: true}})
+	serve(t, listener, &http.Server{
+		ReadHeaderTimeout: time.Second,
+		ConnContext:       server.ConnContext,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, ok := server.IdentityFromContext(r.Context())
+			if !ok {
+				http.Error(w, "no identity", http.StatusUnauthorized)
+				return
+			}
+			_, _ = fmt.Fprintf(w, "%s|%s|%s", identity.CommonName, identity.Subject, r.RemoteAddr)
+		}),
+	})
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+	header := &proxyproto.Header{
+		Source:      &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000},
+		Destination: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 8443},
+		TLVs: []proxyproto.TLV{
+			proxyproto.SSLTLV("TLS 1.3", "client-a"),
+			{Type: proxyproto.TypeClientSubject, Value: []byte("CN=client-a,O=DIMO")},
+		},
+	}
+	prefix, err := header.Format()
+	require.NoError(t, err)
+	body, err := request(conn, prefix)
+	require.NoError(t, err)
+	require.Equal(t, "client-a|CN=client-a,O=DIMO|192.0.2.1:40000", body)
+}
+
+func TestFiberServerHeaderIdentityWithTLS(t *testing.T) {
+	t.Parallel()
+	cert := selfSignedCert(t)
+	listener := listen(t,
+		&config.ServerSettings{MutualTLS: config.MutualTLSSettings{Enabled: true, ClientIdentity: config.ClientIdentityHeader}},
+		server.WithTLS(func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return &cert, nil }),
+	)
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Get("/", func(c *fiber.Ctx) error {
+		identity, ok := server.Identity(c.Context().Conn())
+		if !ok {
+			return fiber.ErrUnauthorized
+		}
+		return c.SendString(identity.Subject)
+	})
+	serve(t, listener, server.Fiber(app))
+
+	rawConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer rawConn.Close() //nolint:errcheck
+	_, err = io.WriteString(rawConn, enclave.ClientIdentityPrefix+"CN=client-b\n")
+	require.NoError(t, err)
+	conn := tls.Client(rawConn, &tls.Config{InsecureSkipVerify: true}) //nolint:gosec // self-signed test certificate
+	body, err := request(conn, nil)
+	require.NoError(t, err)
+	require.Equal(t, "CN=client-b", body)
+}
+
+func TestListenerJoinsBridgeTrace(t *testing.T) {
+	t.Parallel()
+	listener := listen(t, &config.ServerSettings{PropagateTrace: true},
+		server.WithTracer(sdktrace.NewTracerProvider().Tracer(tracing.ScopeName)))
+	serve(t, listener, &http.Server{
+		ReadHeaderTimeout: time.Second,
+		ConnContext:       server.ConnContext,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, hasIdentity := server.IdentityFromContext(r.Context())
+			sc := trace.SpanContextFromContext(r.Context())
+			_, _ = fmt.Fprintf(w, "%t|%s|%t", hasIdentity, sc.TraceID(), sc.IsSampled())
+		}),
+	})
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+	header := &proxyproto.Header{
+		Source:      &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000},
+		Destination: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 8443},
+		TLVs: []proxyproto.TLV{
+			{Type: proxyproto.TypeTraceparent, Value: []byte("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")},
+		},
+	}
+	prefix, err := header.Format()
+	require.NoError(t, err)
+	body, err := request(conn, prefix)
+	require.NoError(t, err)
+	require.Equal(t, "false|4bf92f3577b34da6a3ce929d0e0e4736|true", body)
+}
+
+func TestListenerDropsConnectionsWithoutIdentity(t *testing.T) {
+	t.Parallel()
+	listener := listen(t, &config.ServerSettings{MutualTLS: config.MutualTLSSettings{Enabled: true}})
+	serve(t, listener, &http.Server{
+		ReadHeaderTimeout: time.Second,
+		Handler:           http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+	})
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: enclave\r\n\r\n")
+	require.NoError(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestServeDrainsConnections(t *testing.T) {
+	t.Parallel()
+	listener := listen(t, &config.ServerSettings{})
+	handlerStarted := make(chan struct{})
+	releaseHandler := make(chan struct{})
+	srv := &http.Server{
+		ReadHeaderTimeout: time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			close(handlerStarted)
+			<-releaseHandler
+			_, _ = io.WriteString(w, "done")
+		}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(ctx, listener, srv, 5*time.Second)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+	body := make(chan string, 1)
+	go func() {
+		resp, err := request(conn, nil)
+		if err != nil {
+			resp = err.Error()
+		}
+		body <- resp
+	}()
+	<-handlerStarted
+	cancel()
+
+	// The listener stops accepting while the in-flight request is drained.
+	require.Eventually(t, func() bool {
+		probe, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return true
+		}
+		_ = probe.Close()
+		return false
+	}, time.Second, 10*time.Millisecond)
+	close(releaseHandler)
+	require.Equal(t, "done", <-body)
+	require.NoError(t, <-done)
+}
+
+func TestServeClosesConnectionsAfterDrainTimeout(t *testing.T) {
+	t.Parallel()
+	listener := listen(t, &config.ServerSettings{})
+	hijacked := make(chan struct{})
+	srv := &http.Server{
+		ReadHeaderTimeout: time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			// Hijacked connections are not tracked by the http.Server, only by the Listener.
+			_, _, err := http.NewResponseController(w).Hijack()
+			if err == nil {
+				close(hijacked)
+			}
+		}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(ctx, listener, srv, 100*time.Millisecond)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: enclave\r\n\r\n")
+	require.NoError(t, err)
+	<-hijacked
+	cancel()
+
+	require.ErrorIs(t, <-done, context.DeadlineExceeded)
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "enclave"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestListenerReadsHeadersConcurrently(t *testing.T) {
+	t.Parallel()
+	listener := listen(t, &config.ServerSettings{MutualTLS: config.MutualTLSSettings{Enabled: true}})
+	serve(t, listener, &http.Server{
+		ReadHeaderTimeout: time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = io.WriteString(w, "ok")
+		}),
+	})
+
+	// An idle connection, like one in the bridge's warm pool, has not sent its header yet.
+	idle, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close() //nolint:errcheck
+	time.Sleep(50 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+	require.NoError(t, conn.SetDeadline(time.Now().Add(2*time.Second)))
+	prefix, err := (&proxyproto.Header{}).Format()
+	require.NoError(t, err)
+	body, err := request(conn, prefix)
+	require.NoError(t, err)
+	require.Equal(t, "ok", body)
+}
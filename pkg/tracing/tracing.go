@@ -0,0 +1,81 @@
+// Package tracing propagates the trace context of connections through the bridge to and from the enclave in the
+// W3C traceparent format, so a request can be followed from the host into the enclave and out through a client
+// tunnel. Spans are recorded with OpenTelemetry and exported to a collector by a tracer provider from
+// NewTracerProvider.
+//
+// Components without a tracer use the global tracer provider. Until an app sets one with otel.SetTracerProvider,
+// it records no spans but still passes the trace context of the parent on, so connections keep joining the trace
+// of their caller when tracing is disabled.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TraceparentKey is the key of the trace context in the target line of a client tunnel.
+const TraceparentKey = "traceparent"
+
+// ScopeName is the instrumentation scope of the spans recorded by the bridge and its enclave packages.
+const ScopeName = "github.com/DIMO-Network/enclave-bridge"
+
+// ErrInvalidTraceparent is returned when a traceparent can not be parsed.
+var ErrInvalidTraceparent = errors.New("invalid traceparent")
+
+var propagator = propagation.TraceContext{}
+
+// Traceparent returns the W3C traceparent of the span context of ctx, or an empty string if it has none.
+func Traceparent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get(TraceparentKey)
+}
+
+// ContextWithTraceparent returns a copy of ctx carrying the remote span context of a W3C traceparent, e.g. the
+// one received from the bridge. Spans started from the returned context are children of it.
+func ContextWithTraceparent(ctx context.Context, traceparent string) (context.Context, error) {
+	extracted := propagator.Extract(context.Background(), propagation.MapCarrier{TraceparentKey: traceparent})
+	sc := trace.SpanContextFromContext(extracted)
+	if !sc.IsValid() {
+		return ctx, fmt.Errorf("%w: %q", ErrInvalidTraceparent, traceparent)
+	}
+	return trace.ContextWithRemoteSpanContext(ctx, sc), nil
+}
+
+// RecordError records err on span and marks the span as failed. It does nothing if err is nil.
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// NewTracerProvider creates a tracer provider that exports the spans of serviceName in batches to the OTLP/HTTP
+// traces endpoint, e.g. http://localhost:4318/v1/traces. Inside the enclave, pass
+// otlptracehttp.WithHTTPClient with a client.NewHTTPClient to reach a collector through a client tunnel.
+// Shut the provider down to export the queued spans.
+func NewTracerProvider(serviceName, endpoint string, opts ...otlptracehttp.Option) (*sdktrace.TracerProvider, error) {
+	if endpoint == "" {
+		return nil, errors.New("OTLP endpoint is required")
+	}
+	exporter, err := otlptracehttp.New(context.Background(), append([]otlptracehttp.Option{
+		otlptracehttp.WithEndpointURL(endpoint),
+	}, opts...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	), nil
+}
@@ -0,0 +1,164 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/tracing"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collectedSpan is an exported OTLP span with the service name of its resource.
+type collectedSpan struct {
+	Service string
+	*tracepb.Span
+}
+
+// startCollector starts a stand-in OTLP/HTTP collector that sends every received span to the returned channel.
+func startCollector(t *testing.T) (string, <-chan collectedSpan) {
+	t.Helper()
+	spans := make(chan collectedSpan, 16)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unexpected headers", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var request collectortrace.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, resourceSpans := range request.GetResourceSpans() {
+			var service string
+			for _, attr := range resourceSpans.GetResource().GetAttributes() {
+				if attr.GetKey() == "service.name" {
+					service = attr.GetValue().GetStringValue()
+				}
+			}
+			for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+				for _, span := range scopeSpans.GetSpans() {
+					spans <- collectedSpan{Service: service, Span: span}
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	t.Cleanup(collector.Close)
+	return collector.URL + "/v1/traces", spans
+}
+
+func TestTraceparent(t *testing.T) {
+	t.Parallel()
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx, err := tracing.ContextWithTraceparent(context.Background(), traceparent)
+	require.NoError(t, err)
+	sc := trace.SpanContextFromContext(ctx)
+	require.True(t, sc.IsValid())
+	require.True(t, sc.IsRemote())
+	require.True(t, sc.IsSampled())
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID().String())
+	require.Equal(t, "00f067aa0ba902b7", sc.SpanID().String())
+	require.Equal(t, traceparent, tracing.Traceparent(ctx))
+
+	ctx = trace.ContextWithSpanContext(ctx, sc.WithTraceFlags(0))
+	require.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", tracing.Traceparent(ctx))
+	require.Empty(t, tracing.Traceparent(context.Background()))
+
+	for _, invalid := range []string{
+		"",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0x",
+	} {
+		_, err := tracing.ContextWithTraceparent(context.Background(), invalid)
+		require.ErrorIs(t, err, tracing.ErrInvalidTraceparent, invalid)
+	}
+}
+
+func TestNoopTracerPropagates(t *testing.T) {
+	t.Parallel()
+	tracer := noop.NewTracerProvider().Tracer(tracing.ScopeName)
+	parent, err := tracing.ContextWithTraceparent(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.NoError(t, err)
+	ctx, span := tracer.Start(parent, "op")
+	tracing.RecordError(span, errors.New("failed"))
+	span.End()
+	require.Equal(t, tracing.Traceparent(parent), tracing.Traceparent(ctx))
+}
+
+func TestTracerProvider(t *testing.T) {
+	t.Parallel()
+	endpoint, spans := startCollector(t)
+	provider, err := tracing.NewTracerProvider("enclave-bridge", endpoint,
+		otlptracehttp.WithHeaders(map[string]string{"Authorization": "Bearer token"}))
+	require.NoError(t, err)
+	tracer := provider.Tracer(tracing.ScopeName)
+
+	ctx, root := tracer.Start(context.Background(), "server-tunnel", trace.WithSpanKind(trace.SpanKindServer))
+	_, child := tracer.Start(ctx, "vsock.dial", trace.WithSpanKind(trace.SpanKindClient))
+	child.SetAttributes(attribute.Int("enclave.cid", 16))
+	tracing.RecordError(child, errors.New("connection refused"))
+	tracing.RecordError(child, nil)
+	child.End()
+	root.SetAttributes(attribute.String("client.address", "192.0.2.1:40000"))
+	root.End()
+	require.NoError(t, provider.Shutdown(t.Context()))
+
+	exportedChild, exportedRoot := <-spans, <-spans
+	require.Empty(t, spans)
+	rootContext, childContext := root.SpanContext(), child.SpanContext()
+
+	require.Equal(t, "enclave-bridge", exportedRoot.Service)
+	require.Equal(t, "server-tunnel", exportedRoot.GetName())
+	require.Equal(t, tracepb.Span_SPAN_KIND_SERVER, exportedRoot.GetKind())
+	require.Equal(t, rootContext.TraceID().String(), hex.EncodeToString(exportedRoot.GetTraceId()))
+	require.Equal(t, rootContext.SpanID().String(), hex.EncodeToString(exportedRoot.GetSpanId()))
+	require.Empty(t, exportedRoot.GetParentSpanId())
+	require.Equal(t, "192.0.2.1:40000", exportedRoot.GetAttributes()[0].GetValue().GetStringValue())
+	require.Equal(t, tracepb.Status_STATUS_CODE_UNSET, exportedRoot.GetStatus().GetCode())
+
+	require.Equal(t, "vsock.dial", exportedChild.GetName())
+	require.Equal(t, exportedRoot.GetTraceId(), exportedChild.GetTraceId())
+	require.Equal(t, childContext.SpanID().String(), hex.EncodeToString(exportedChild.GetSpanId()))
+	require.Equal(t, exportedRoot.GetSpanId(), exportedChild.GetParentSpanId())
+	require.Equal(t, int64(16), exportedChild.GetAttributes()[0].GetValue().GetIntValue())
+	require.Equal(t, tracepb.Status_STATUS_CODE_ERROR, exportedChild.GetStatus().GetCode())
+	require.Equal(t, "connection refused", exportedChild.GetStatus().GetMessage())
+}
+
+func TestUnsampledSpansAreNotExported(t *testing.T) {
+	t.Parallel()
+	endpoint, spans := startCollector(t)
+	provider, err := tracing.NewTracerProvider("enclave-bridge", endpoint)
+	require.NoError(t, err)
+
+	parent, err := tracing.ContextWithTraceparent(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	require.NoError(t, err)
+	ctx, span := provider.Tracer(tracing.ScopeName).Start(parent, "op")
+	span.End()
+	require.NoError(t, provider.Shutdown(t.Context()))
+	require.Empty(t, spans)
+	propagated := trace.SpanContextFromContext(ctx)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", propagated.TraceID().String())
+	require.NotEqual(t, "00f067aa0ba902b7", propagated.SpanID().String())
+	require.False(t, propagated.IsSampled())
+}
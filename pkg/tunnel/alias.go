@@ -0,0 +1,111 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+)
+
+const unixBackendPrefix = "unix:"
+
+// AliasTable resolves alias names requested by the enclave to host-side backends.
+// The table can be replaced at runtime with Update.
+type AliasTable struct {
+	aliases atomic.Pointer[map[string]*aliasEntry]
+}
+
+type aliasEntry struct {
+	backends []string
+	// preferred is the index of the last backend that was dialed successfully.
+	preferred atomic.Uint32
+}
+
+// NewAliasTable creates a new AliasTable from the given settings.
+func NewAliasTable(settings config.AliasSettings) (*AliasTable, error) {
+	table := &AliasTable{}
+	if err := table.Update(settings); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// Update validates settings and atomically replaces the alias table.
+func (a *AliasTable) Update(settings config.AliasSettings) error {
+	aliases := make(map[string]*aliasEntry, len(settings))
+	for name, backends := range settings {
+		if len(backends) == 0 {
+			return fmt.Errorf("%w: alias %q has no backends", ErrInvalidAliasBackend, name)
+		}
+		for _, backend := range backends {
+			if err := validateBackend(backend); err != nil {
+				return fmt.Errorf("alias %q: %w", name, err)
+			}
+		}
+		aliases[name] = &aliasEntry{backends: backends}
+	}
+	a.aliases.Store(&aliases)
+	return nil
+}
+
+// DialContext dials a backend of the named alias. Backends are tried starting with the last one
+// that was dialed successfully, failing over to the next one on error.
+// TCP backends are dialed with dialer; unix socket backends are always dialed directly.
+func (a *AliasTable) DialContext(ctx context.Context, name string, dialer ContextDialer) (net.Conn, error) {
+	var entry *aliasEntry
+	if aliases := a.aliases.Load(); aliases != nil {
+		entry = (*aliases)[name]
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownAlias, name)
+	}
+
+	start := int(entry.preferred.Load())
+	var errs []error
+	for i := range entry.backends {
+		idx := (start + i) % len(entry.backends)
+		conn, err := dialBackend(ctx, entry.backends[idx], dialer)
+		if err == nil {
+			entry.preferred.Store(uint32(idx)) //nolint:gosec // idx is bounded by the number of backends
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("failed to dial any backend for alias %q: %w", name, errors.Join(errs...))
+}
+
+func dialBackend(ctx context.Context, backend string, dialer ContextDialer) (net.Conn, error) {
+	if path, ok := strings.CutPrefix(backend, unixBackendPrefix); ok {
+		unixDialer := &net.Dialer{Timeout: defaultDialTimeout}
+		return unixDialer.DialContext(ctx, "unix", unixSocketPath(path))
+	}
+	return dialer.DialContext(ctx, "tcp", backend)
+}
+
+func validateBackend(backend string) error {
+	if path, ok := strings.CutPrefix(backend, unixBackendPrefix); ok {
+		if unixSocketPath(path) == "" {
+			return fmt.Errorf("%w: %q is missing a socket path", ErrInvalidAliasBackend, backend)
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(backend); err != nil {
+		return fmt.Errorf("%w: %q: %w", ErrInvalidAliasBackend, backend, err)
+	}
+	return nil
+}
+
+// unixSocketPath accepts both unix:/path and unix:///path forms.
+func unixSocketPath(path string) string {
+	if strings.HasPrefix(path, "//") {
+		return strings.TrimPrefix(path, "//")
+	}
+	return path
+}
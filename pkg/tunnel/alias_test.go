@@ -0,0 +1,89 @@
+package tunnel_test
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tunnel"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// closedAddr returns a local address that refuses connections.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	require.NoError(t, listener.Close())
+	return addr
+}
+
+func TestClientTunnelAliasFailover(t *testing.T) {
+	t.Parallel()
+	target := startEchoServer(t)
+	aliases, err := tunnel.NewAliasTable(config.AliasSettings{
+		"postgres-primary": {closedAddr(t), target},
+	})
+	require.NoError(t, err)
+
+	clientTunnel := tunnel.NewClientTunnel(0, 0, zerolog.Nop())
+	clientTunnel.SetAliases(aliases)
+
+	roundTrip(t, clientTunnel, "alias:postgres-primary")
+	// The working backend is now preferred.
+	roundTrip(t, clientTunnel, "alias:postgres-primary")
+}
+
+func TestAliasTableUnixSocket(t *testing.T) {
+	t.Parallel()
+	socketPath := filepath.Join(t.TempDir(), "backend.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	defer listener.Close() //nolint:errcheck
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close() //nolint:errcheck
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	aliases, err := tunnel.NewAliasTable(config.AliasSettings{"local": {"unix://" + socketPath}})
+	require.NoError(t, err)
+	conn, err := aliases.DialContext(t.Context(), "local", &net.Dialer{})
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+}
+
+func TestAliasTableErrors(t *testing.T) {
+	t.Parallel()
+
+	t.Run("unknown alias", func(t *testing.T) {
+		t.Parallel()
+		aliases, err := tunnel.NewAliasTable(config.AliasSettings{"known": {"127.0.0.1:1"}})
+		require.NoError(t, err)
+		_, err = aliases.DialContext(t.Context(), "unknown", &net.Dialer{})
+		require.ErrorIs(t, err, tunnel.ErrUnknownAlias)
+	})
+
+	t.Run("invalid backend", func(t *testing.T) {
+		t.Parallel()
+		_, err := tunnel.NewAliasTable(config.AliasSettings{"bad": {"no-port"}})
+		require.ErrorIs(t, err, tunnel.ErrInvalidAliasBackend)
+	})
+
+	t.Run("update keeps previous table on error", func(t *testing.T) {
+		t.Parallel()
+		aliases, err := tunnel.NewAliasTable(config.AliasSettings{"db": {startEchoServer(t)}})
+		require.NoError(t, err)
+		require.Error(t, aliases.Update(config.AliasSettings{"db": {}}))
+		conn, err := aliases.DialContext(t.Context(), "db", &net.Dialer{})
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	})
+}
@@ -0,0 +1,100 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync/atomic"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+)
+
+// serverTarget is an enclave vsock endpoint that a server tunnel forwards connections to.
+type serverTarget struct {
+	cid  uint32
+	port uint32
+	// healthy is false once the target has been ejected by health checks.
+	healthy atomic.Bool
+	// active is the number of connections currently forwarded to the target.
+	active atomic.Int64
+	// consecutive check results used for ejection and restoration.
+	failures  int
+	successes int
+	// pool holds pre-dialed connections to the target. It is nil if the warm pool is disabled.
+	pool *warmPool
+}
+
+func newServerTarget(cid, port uint32) *serverTarget {
+	target := &serverTarget{cid: cid, port: port}
+	target.healthy.Store(true)
+	return target
+}
+
+// String returns the target as cid:port.
+func (t *serverTarget) String() string {
+	return fmt.Sprintf("%d:%d", t.cid, t.port)
+}
+
+// balancer picks a target for a new client connection.
+type balancer interface {
+	pick(clientAddr net.Addr, targets []*serverTarget) *serverTarget
+}
+
+func newBalancer(strategy string) (balancer, error) {
+	switch strategy {
+	case "", config.LoadBalancingRoundRobin:
+		return &roundRobinBalancer{}, nil
+	case config.LoadBalancingLeastConnections:
+		return leastConnectionsBalancer{}, nil
+	case config.LoadBalancingConsistentHash:
+		return consistentHashBalancer{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported load balancing strategy: %q", strategy)
+	}
+}
+
+// roundRobinBalancer cycles through the targets in order.
+type roundRobinBalancer struct {
+	next atomic.Uint64
+}
+
+func (r *roundRobinBalancer) pick(_ net.Addr, targets []*serverTarget) *serverTarget {
+	n := r.next.Add(1) - 1
+	return targets[n%uint64(len(targets))]
+}
+
+// leastConnectionsBalancer picks the target with the fewest active connections.
+type leastConnectionsBalancer struct{}
+
+func (leastConnectionsBalancer) pick(_ net.Addr, targets []*serverTarget) *serverTarget {
+	best := targets[0]
+	for _, target := range targets[1:] {
+		if target.active.Load() < best.active.Load() {
+			best = target
+		}
+	}
+	return best
+}
+
+// consistentHashBalancer uses rendezvous hashing on the client IP so a client keeps its target
+// as long as that target stays healthy, and only clients of an ejected target are moved.
+type consistentHashBalancer struct{}
+
+func (consistentHashBalancer) pick(clientAddr net.Addr, targets []*serverTarget) *serverTarget {
+	clientIP := clientAddr.String()
+	if host, _, err := net.SplitHostPort(clientIP); err == nil {
+		clientIP = host
+	}
+	var best *serverTarget
+	var bestScore uint64
+	for _, target := range targets {
+		hasher := fnv.New64a()
+		_, _ = hasher.Write([]byte(clientIP))
+		_ = binary.Write(hasher, binary.BigEndian, [2]uint32{target.cid, target.port})
+		if score := hasher.Sum64(); best == nil || score > bestScore {
+			best, bestScore = target, score
+		}
+	}
+	return best
+}
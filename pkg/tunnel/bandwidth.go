@@ -0,0 +1,173 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"golang.org/x/time/rate"
+)
+
+// Directions of traffic through a tunnel, used as a metrics label.
+const (
+	// directionInbound is traffic from the host to the enclave.
+	directionInbound = "inbound"
+	// directionOutbound is traffic from the enclave to the host.
+	directionOutbound = "outbound"
+)
+
+const (
+	quotaWindow      = 24 * time.Hour
+	quotaBucketWidth = time.Hour
+	quotaBuckets     = int64(quotaWindow / quotaBucketWidth)
+)
+
+// shaper limits the throughput of a tunnel and enforces its byte quota.
+type shaper struct {
+	settings config.BandwidthSettings
+	// tunnelLimiters are shared by every connection of the tunnel, keyed by direction.
+	tunnelLimiters map[string]*rate.Limiter
+	quota          *byteQuota
+}
+
+func newShaper(settings *config.BandwidthSettings, dailyQuotaBytes int64) (*shaper, error) {
+	if settings.TunnelBytesPerSecond < 0 || settings.TunnelBurstBytes < 0 ||
+		settings.ConnectionBytesPerSecond < 0 || settings.ConnectionBurstBytes < 0 {
+		return nil, errors.New("bandwidth limits must not be negative")
+	}
+	if dailyQuotaBytes < 0 {
+		return nil, errors.New("daily quota must not be negative")
+	}
+	s := &shaper{settings: *settings}
+	if settings.TunnelBytesPerSecond > 0 {
+		s.tunnelLimiters = map[string]*rate.Limiter{
+			directionInbound:  newLimiter(settings.TunnelBytesPerSecond, settings.TunnelBurstBytes),
+			directionOutbound: newLimiter(settings.TunnelBytesPerSecond, settings.TunnelBurstBytes),
+		}
+	}
+	if dailyQuotaBytes > 0 {
+		s.quota = &byteQuota{limit: dailyQuotaBytes}
+	}
+	return s, nil
+}
+
+func newLimiter(bytesPerSecond, burst int64) *rate.Limiter {
+	if burst <= 0 {
+		burst = bytesPerSecond
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(burst, math.MaxInt32)))
+}
+
+// quotaExceeded returns true if the tunnel has exhausted its byte quota.
+func (s *shaper) quotaExceeded() bool {
+	return s != nil && s.quota != nil && s.quota.remaining() <= 0
+}
+
+// reader wraps r of a single connection so reads are limited by the tunnel and connection limits of direction
+// and counted against the quota. If the tunnel is not limited r is returned as is.
+func (s *shaper) reader(ctx context.Context, r io.Reader, direction string) io.Reader {
+	if s == nil {
+		return r
+	}
+	shaped := &shapedReader{ctx: ctx, reader: r, quota: s.quota}
+	if limiter := s.tunnelLimiters[direction]; limiter != nil {
+		shaped.limiters = append(shaped.limiters, limiter)
+	}
+	if s.settings.ConnectionBytesPerSecond > 0 {
+		shaped.limiters = append(shaped.limiters,
+			newLimiter(s.settings.ConnectionBytesPerSecond, s.settings.ConnectionBurstBytes))
+	}
+	if len(shaped.limiters) == 0 && shaped.quota == nil {
+		return r
+	}
+	for _, limiter := range shaped.limiters {
+		if shaped.maxRead == 0 || limiter.Burst() < shaped.maxRead {
+			shaped.maxRead = limiter.Burst()
+		}
+	}
+	return shaped
+}
+
+// shapedReader delays reads until the limiters allow the bytes that were read.
+type shapedReader struct {
+	ctx      context.Context //nolint:containedctx // Reads are canceled with the connection's context.
+	reader   io.Reader
+	limiters []*rate.Limiter
+	quota    *byteQuota
+	// maxRead is the smallest limiter burst, reads larger than the burst could never be allowed.
+	maxRead int
+}
+
+func (r *shapedReader) Read(p []byte) (int, error) {
+	if r.quota != nil {
+		remaining := r.quota.remaining()
+		if remaining <= 0 {
+			return 0, ErrQuotaExceeded
+		}
+		if int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+	if r.maxRead > 0 && len(p) > r.maxRead {
+		p = p[:r.maxRead]
+	}
+	n, err := r.reader.Read(p)
+	if n == 0 {
+		return n, err
+	}
+	if r.quota != nil {
+		r.quota.consume(int64(n))
+	}
+	for _, limiter := range r.limiters {
+		if waitErr := limiter.WaitN(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// byteQuota counts bytes in hourly buckets over a rolling window.
+type byteQuota struct {
+	limit   int64
+	mu      sync.Mutex
+	buckets [quotaBuckets]quotaBucket
+}
+
+type quotaBucket struct {
+	start time.Time
+	bytes int64
+}
+
+// remaining returns the number of bytes left in the current window.
+func (q *byteQuota) remaining() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.limit - q.used(time.Now())
+}
+
+// consume counts n bytes against the quota.
+func (q *byteQuota) consume(n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	start := time.Now().Truncate(quotaBucketWidth)
+	bucket := &q.buckets[(start.UnixNano()/int64(quotaBucketWidth))%quotaBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = quotaBucket{start: start}
+	}
+	bucket.bytes += n
+}
+
+// used returns the number of bytes counted within the window ending at now. Must be called with the lock held.
+func (q *byteQuota) used(now time.Time) int64 {
+	var used int64
+	for _, bucket := range q.buckets {
+		if now.Sub(bucket.start) < quotaWindow {
+			used += bucket.bytes
+		}
+	}
+	return used
+}
@@ -0,0 +1,81 @@
+package tunnel_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tunnel"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientTunnelDailyQuota(t *testing.T) {
+	t.Parallel()
+	target := startEchoServer(t)
+	clientTunnel, err := tunnel.NewClientTunnelFromSettings(&config.ClientSettings{
+		// Enough for a single "ping" in each direction.
+		DailyQuotaBytes: 8,
+	}, zerolog.Nop())
+	require.NoError(t, err)
+
+	roundTrip(t, clientTunnel, target)
+
+	// The quota is exhausted so the request is denied without an ACK.
+	enclaveSide, bridgeSide := net.Pipe()
+	defer enclaveSide.Close() //nolint:errcheck
+	go clientTunnel.HandleConn(t.Context(), bridgeSide)
+	require.NoError(t, enclaveSide.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = enclaveSide.Write([]byte(target + "\n"))
+	require.NoError(t, err)
+	_, err = enclaveSide.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestClientTunnelConnectionBandwidth(t *testing.T) {
+	t.Parallel()
+	target := startEchoServer(t)
+	clientTunnel, err := tunnel.NewClientTunnelFromSettings(&config.ClientSettings{
+		Bandwidth: config.BandwidthSettings{
+			ConnectionBytesPerSecond: 20_000,
+			ConnectionBurstBytes:     1_000,
+		},
+	}, zerolog.Nop())
+	require.NoError(t, err)
+
+	enclaveSide, bridgeSide := net.Pipe()
+	defer enclaveSide.Close() //nolint:errcheck
+	go clientTunnel.HandleConn(t.Context(), bridgeSide)
+	require.NoError(t, enclaveSide.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = enclaveSide.Write([]byte(target + "\n"))
+	require.NoError(t, err)
+	reader := bufio.NewReader(enclaveSide)
+	ack, err := reader.ReadBytes('\n')
+	require.NoError(t, err)
+	require.Equal(t, enclave.ACK, ack)
+
+	// 5000 bytes at 20000 bytes/sec with a 1000 byte burst take at least 200ms.
+	payload := bytes.Repeat([]byte("x"), 5_000)
+	start := time.Now()
+	go func() { _, _ = enclaveSide.Write(payload) }()
+	resp := make([]byte, len(payload))
+	_, err = io.ReadFull(reader, resp)
+	require.NoError(t, err)
+	require.Equal(t, payload, resp)
+	require.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+}
+
+func TestInvalidBandwidthSettings(t *testing.T) {
+	t.Parallel()
+	_, err := tunnel.NewClientTunnelFromSettings(&config.ClientSettings{DailyQuotaBytes: -1}, zerolog.Nop())
+	require.Error(t, err)
+	_, err = tunnel.NewServerTunnelFromSettings(&config.ServerSettings{
+		Bandwidth: config.BandwidthSettings{TunnelBytesPerSecond: -1},
+	}, zerolog.Nop())
+	require.Error(t, err)
+}
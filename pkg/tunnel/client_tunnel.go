@@ -2,17 +2,26 @@ package tunnel
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/DIMO-Network/enclave-bridge/pkg/audit"
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
 	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tracing"
 	"github.com/mdlayher/vsock"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -22,6 +31,13 @@ type ClientTunnel struct {
 	requestTimeout time.Duration
 	logger         *zerolog.Logger
 	pool           sync.Pool
+	dialer         ContextDialer
+	aliases        *AliasTable
+	shaper         *shaper
+	auditLog       *audit.Log
+	appName        string
+	sniFilter      *sniFilter
+	tracer         trace.Tracer
 }
 
 // Port returns the port of the ClientTunnel.
@@ -29,6 +45,7 @@ func (c *ClientTunnel) Port() uint32 {
 	return c.port
 }
 
+// NewClientTunnel creates a new ClientTunnel that dials targets directly.
 func NewClientTunnel(port uint32, requestTimeout time.Duration, logger zerolog.Logger) *ClientTunnel {
 	if requestTimeout == 0 {
 		requestTimeout = 5 * time.Minute
@@ -38,12 +55,49 @@ func NewClientTunnel(port uint32, requestTimeout time.Duration, logger zerolog.L
 		requestTimeout: requestTimeout,
 		logger:         &logger,
 		pool:           sync.Pool{New: func() any { b := make([]byte, bufSize); return &b }},
+		dialer:         &net.Dialer{Timeout: defaultDialTimeout},
+		tracer:         otel.Tracer(tracing.ScopeName),
 	}
 }
 
+// NewClientTunnelFromSettings creates a new ClientTunnel from the given settings.
+// If an upstream proxy is configured, targets are dialed through it.
+func NewClientTunnelFromSettings(settings *config.ClientSettings, logger zerolog.Logger) (*ClientTunnel, error) {
+	clientTunnel := NewClientTunnel(settings.EnclaveDialPort, settings.RequestTimeout, logger)
+	dialer, err := NewUpstreamDialer(&settings.Proxy, &net.Dialer{Timeout: defaultDialTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upstream dialer: %w", err)
+	}
+	clientTunnel.dialer = dialer
+	clientTunnel.shaper, err = newShaper(&settings.Bandwidth, settings.DailyQuotaBytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bandwidth settings: %w", err)
+	}
+	clientTunnel.sniFilter = newSNIFilter(&settings.SNIFilter)
+	return clientTunnel, nil
+}
+
+// SetAliases sets the alias table used to resolve targets prefixed with enclave.AliasPrefix.
+func (c *ClientTunnel) SetAliases(aliases *AliasTable) {
+	c.aliases = aliases
+}
+
+// SetAuditLog sets the log that records every target requested by the enclave of appName.
+func (c *ClientTunnel) SetAuditLog(auditLog *audit.Log, appName string) {
+	c.auditLog = auditLog
+	c.appName = appName
+}
+
+// SetTracer sets the tracer that records a span for every target request and its dial, replacing the tracer of
+// the global tracer provider. Spans join the trace the enclave sends on the target line.
+func (c *ClientTunnel) SetTracer(tracer trace.Tracer) {
+	c.tracer = tracer
+}
+
 // HandleConn dial a vsock connection and copy data in both directions.
 func (c *ClientTunnel) HandleConn(ctx context.Context, vsockConn net.Conn) {
 	defer vsockConn.Close() //nolint:errcheck
+	start := time.Now()
 	// Create a context with timeout for the entire operation
 	requestCtx, cancel := context.WithTimeout(ctx, c.requestTimeout)
 	defer cancel()
@@ -58,27 +112,73 @@ func (c *ClientTunnel) HandleConn(ctx context.Context, vsockConn net.Conn) {
 		return
 	}
 	// Remove the newline character
-	targetAddress := string(targetLine[:len(targetLine)-1])
+	targetAddress, traceparent := parseTargetLine(string(targetLine[:len(targetLine)-1]))
 	c.logger.Trace().Msgf("Received target request: %s", targetAddress)
+	if traceparent != "" {
+		requestCtx, err = tracing.ContextWithTraceparent(requestCtx, traceparent)
+		if err != nil {
+			c.logger.Debug().Err(err).Msg("Ignoring trace context of target request")
+		}
+	}
+	requestCtx, span := c.tracer.Start(requestCtx, "client-tunnel", trace.WithSpanKind(trace.SpanKindServer))
 
-	// Use a dialer with context
-	dialer := &net.Dialer{
-		Timeout: 10 * time.Second,
+	record := &audit.Record{
+		Time:       start,
+		AppName:    c.appName,
+		EnclaveCID: EnclaveCID(vsockConn),
+		Target:     targetAddress,
+		Outcome:    audit.OutcomeSuccess,
 	}
+	defer c.writeAudit(record, start)
+	defer endClientSpan(span, record)
 
-	targetConn, err := dialer.DialContext(requestCtx, "tcp", targetAddress)
+	portLabel := strconv.FormatUint(uint64(c.port), 10)
+	if c.shaper.quotaExceeded() {
+		quotaDeniedConnectionsTotal.WithLabelValues(portLabel).Inc()
+		c.logger.Warn().Err(ErrQuotaExceeded).Str("target", targetAddress).Msg("Denying target request")
+		record.Outcome, record.Error = audit.OutcomeQuotaExceeded, ErrQuotaExceeded.Error()
+		return
+	}
+
+	dialCtx, dialSpan := c.tracer.Start(requestCtx, "target.dial", trace.WithSpanKind(trace.SpanKindClient))
+	targetConn, err := c.dialTarget(dialCtx, targetAddress)
+	if err == nil {
+		dialSpan.SetAttributes(attribute.String("target.ip", remoteIP(targetConn)))
+	}
+	tracing.RecordError(dialSpan, err)
+	dialSpan.End()
 	if err != nil {
 		c.logger.Error().Err(err).Msg("Failed to dial target service")
+		record.Outcome, record.Error = audit.OutcomeDialFailed, err.Error()
 		return
 	}
 	defer targetConn.Close() //nolint:errcheck
+	record.ResolvedIP = remoteIP(targetConn)
 
 	_, err = vsockConn.Write(enclave.ACK)
 	if err != nil {
 		c.logger.Error().Err(err).Msg("Failed to write ACK to target service")
+		record.Outcome, record.Error = audit.OutcomeError, err.Error()
 		return
 	}
 
+	outbound := io.Reader(vsockConn)
+	if c.sniFilter.inspects(targetAddress) {
+		serverName, clientHello, err := c.sniFilter.inspect(vsockConn, targetAddress)
+		if err != nil {
+			sniViolationsTotal.WithLabelValues(portLabel).Inc()
+			c.logger.Warn().Err(err).Str("target", targetAddress).Str("serverName", serverName).Msg("Closing connection that violates TLS policy")
+			record.Outcome, record.Error = audit.OutcomePolicyViolation, err.Error()
+			return
+		}
+		// Forward the inspected ClientHello unchanged so the enclave's TLS session with the target is not affected.
+		outbound = io.MultiReader(bytes.NewReader(clientHello), vsockConn)
+	}
+
+	connected := *record
+	connected.Outcome = audit.OutcomeConnected
+	c.writeAudit(&connected, start)
+
 	// Create error group for goroutine coordination
 	group, _ := errgroup.WithContext(requestCtx)
 
@@ -86,8 +186,11 @@ func (c *ClientTunnel) HandleConn(ctx context.Context, vsockConn net.Conn) {
 	group.Go(func() error {
 		buf := c.pool.Get().(*[]byte)
 		defer c.pool.Put(buf)
-		_, err := io.CopyBuffer(targetConn, vsockConn, *buf)
+		n, err := io.CopyBuffer(targetConn, c.shaper.reader(requestCtx, outbound, directionOutbound), *buf)
+		record.BytesOutbound = n
+		tunnelBytesTotal.WithLabelValues("client", portLabel, directionOutbound).Add(float64(n))
 		if err != nil {
+			closeOnQuotaExceeded(err, vsockConn, targetConn)
 			return fmt.Errorf("failed to copy data from vsock client to TCP target: %w", err)
 		}
 		return nil
@@ -97,8 +200,11 @@ func (c *ClientTunnel) HandleConn(ctx context.Context, vsockConn net.Conn) {
 	group.Go(func() error {
 		buf := c.pool.Get().(*[]byte)
 		defer c.pool.Put(buf)
-		_, err := io.CopyBuffer(vsockConn, targetConn, *buf)
+		n, err := io.CopyBuffer(vsockConn, c.shaper.reader(requestCtx, targetConn, directionInbound), *buf)
+		record.BytesInbound = n
+		tunnelBytesTotal.WithLabelValues("client", portLabel, directionInbound).Add(float64(n))
 		if err != nil {
+			closeOnQuotaExceeded(err, vsockConn, targetConn)
 			return fmt.Errorf("failed to copy data from TCP target to vsock client: %w", err)
 		}
 		return nil
@@ -106,10 +212,99 @@ func (c *ClientTunnel) HandleConn(ctx context.Context, vsockConn net.Conn) {
 
 	// Wait for either an error or context cancellation
 	if err := group.Wait(); err != nil {
+		record.Outcome, record.Error = audit.OutcomeError, err.Error()
+		if errors.Is(err, ErrQuotaExceeded) {
+			record.Outcome = audit.OutcomeQuotaExceeded
+			quotaDeniedConnectionsTotal.WithLabelValues(portLabel).Inc()
+			c.logger.Warn().Err(err).Str("target", targetAddress).Msg("Closing connection")
+			return
+		}
 		c.logger.Error().Err(err).Msg("Connection error occurred")
 	}
 }
 
+// writeAudit writes the record of a target request to the audit log, if one is set.
+func (c *ClientTunnel) writeAudit(record *audit.Record, start time.Time) {
+	if c.auditLog == nil {
+		return
+	}
+	record.DurationMs = time.Since(start).Milliseconds()
+	if err := c.auditLog.Write(record); err != nil {
+		c.logger.Error().Err(err).Str("target", record.Target).Msg("Failed to write egress audit record")
+	}
+}
+
+// endClientSpan ends the span of a target request with the outcome recorded for the audit log.
+func endClientSpan(span trace.Span, record *audit.Record) {
+	span.SetAttributes(
+		attribute.String("target", record.Target),
+		attribute.Int64("enclave.cid", int64(record.EnclaveCID)),
+		attribute.String("outcome", record.Outcome),
+		attribute.Int64("bytes.inbound", record.BytesInbound),
+		attribute.Int64("bytes.outbound", record.BytesOutbound),
+	)
+	if record.Error != "" {
+		tracing.RecordError(span, errors.New(record.Error))
+	}
+	span.End()
+}
+
+// parseTargetLine splits the target line of the enclave into the target and the optional trace context,
+// sent as "<target> traceparent=<traceparent>" by client.Dialer.
+func parseTargetLine(line string) (string, string) {
+	target, params, _ := strings.Cut(line, " ")
+	var traceparent string
+	for param := range strings.FieldsSeq(params) {
+		if value, ok := strings.CutPrefix(param, tracing.TraceparentKey+"="); ok {
+			traceparent = value
+		}
+	}
+	return target, traceparent
+}
+
+// EnclaveCID returns the context ID of the enclave that opened conn, or 0 if conn is not a vsock connection.
+func EnclaveCID(conn net.Conn) uint32 {
+	if addr, ok := conn.RemoteAddr().(*vsock.Addr); ok {
+		return addr.ContextID
+	}
+	return 0
+}
+
+// remoteIP returns the IP address conn is connected to. Connections to unix sockets return the socket path.
+func remoteIP(conn net.Conn) string {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case nil:
+		return ""
+	default:
+		return addr.String()
+	}
+}
+
+// closeOnQuotaExceeded closes both sides of a connection once the quota is exceeded,
+// so the copy in the other direction does not keep the connection open.
+func closeOnQuotaExceeded(err error, conns ...net.Conn) {
+	if !errors.Is(err, ErrQuotaExceeded) {
+		return
+	}
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+// dialTarget dials the target address requested by the enclave, resolving aliases if needed.
+func (c *ClientTunnel) dialTarget(ctx context.Context, targetAddress string) (net.Conn, error) {
+	name, isAlias := strings.CutPrefix(targetAddress, enclave.AliasPrefix)
+	if !isAlias {
+		return c.dialer.DialContext(ctx, "tcp", targetAddress)
+	}
+	if c.aliases == nil {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownAlias, name)
+	}
+	return c.aliases.DialContext(ctx, name, c.dialer)
+}
+
 // ListenForTargetRequests listens for target requests on the vsock port.
 func (c *ClientTunnel) ListenForTargetRequests(ctx context.Context) error {
 	listener, err := vsock.ListenContextID(enclave.DefaultHostCID, c.port, nil)
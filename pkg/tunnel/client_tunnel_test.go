@@ -0,0 +1,94 @@
+package tunnel_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/audit"
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tunnel"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// recordWriter sends every audit record written by the tunnel to a channel.
+type recordWriter chan []byte
+
+func (r recordWriter) Write(p []byte) (int, error) {
+	r <- bytes.Clone(p)
+	return len(p), nil
+}
+
+// startPingServer starts a TCP server that echoes a single "ping" and closes the connection.
+func startPingServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close() //nolint:errcheck
+				_, _ = io.CopyN(conn, conn, 4)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestClientTunnelAuditLog(t *testing.T) {
+	t.Parallel()
+	target := startPingServer(t)
+	clientTunnel, err := tunnel.NewClientTunnelFromSettings(&config.ClientSettings{}, zerolog.Nop())
+	require.NoError(t, err)
+	records := make(recordWriter, 2)
+	clientTunnel.SetAuditLog(audit.NewLog(records, ""), "test-app")
+
+	roundTrip(t, clientTunnel, target)
+	connected := readAuditRecord(t, records)
+	require.Equal(t, audit.OutcomeConnected, connected.Outcome)
+	require.Equal(t, target, connected.Target)
+	require.Equal(t, "127.0.0.1", connected.ResolvedIP)
+	record := readAuditRecord(t, records)
+	require.Equal(t, connected.Hash, record.PrevHash)
+	require.Equal(t, "test-app", record.AppName)
+	require.Equal(t, target, record.Target)
+	require.Equal(t, "127.0.0.1", record.ResolvedIP)
+	require.Equal(t, audit.OutcomeSuccess, record.Outcome)
+	require.Equal(t, int64(4), record.BytesOutbound)
+	require.Equal(t, int64(4), record.BytesInbound)
+
+	enclaveSide, bridgeSide := net.Pipe()
+	defer enclaveSide.Close() //nolint:errcheck
+	go clientTunnel.HandleConn(t.Context(), bridgeSide)
+	_, err = enclaveSide.Write([]byte(closedAddr(t) + "\n"))
+	require.NoError(t, err)
+	failed := readAuditRecord(t, records)
+	require.Equal(t, audit.OutcomeDialFailed, failed.Outcome)
+	require.NotEmpty(t, failed.Error)
+	require.Equal(t, record.Hash, failed.PrevHash)
+}
+
+func readAuditRecord(t *testing.T, records recordWriter) audit.Record {
+	t.Helper()
+	select {
+	case line := <-records:
+		var record audit.Record
+		require.NoError(t, json.Unmarshal(bytes.TrimSpace(line), &record))
+		_, err := audit.Verify(strings.NewReader(string(line)), record.PrevHash)
+		require.NoError(t, err)
+		return record
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for audit record")
+		return audit.Record{}
+	}
+}
@@ -0,0 +1,116 @@
+package tunnel
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// negativeCacheTTL is how long answers without records or SOA are cached.
+const negativeCacheTTL = 30 * time.Second
+
+// dnsCache is a size bounded LRU cache of DNS answers that expire with their TTL.
+type dnsCache struct {
+	size   int
+	maxTTL time.Duration
+	mu     sync.Mutex
+	items  map[string]*list.Element
+	order  *list.List
+}
+
+type dnsCacheEntry struct {
+	key      string
+	msg      *dns.Msg
+	storedAt time.Time
+	expires  time.Time
+}
+
+// newDNSCache creates a cache of at most size answers. A cache with size zero stores nothing.
+func newDNSCache(size int, maxTTL time.Duration) *dnsCache {
+	return &dnsCache{
+		size:   size,
+		maxTTL: maxTTL,
+		items:  map[string]*list.Element{},
+		order:  list.New(),
+	}
+}
+
+// get returns a copy of the cached answer to question with TTLs reduced by the time it was cached, or nil.
+func (c *dnsCache) get(question dns.Question) *dns.Msg {
+	if c.size <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey(question)
+	element, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*dnsCacheEntry) //nolint:forcetypeassert // only entries are stored
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		c.order.Remove(element)
+		delete(c.items, key)
+		return nil
+	}
+	c.order.MoveToFront(element)
+	msg := entry.msg.Copy()
+	elapsed := uint32(now.Sub(entry.storedAt).Seconds())
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			header := rr.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			header.Ttl -= min(header.Ttl, elapsed)
+		}
+	}
+	return msg
+}
+
+// put caches a successful or NXDOMAIN answer for the lowest TTL of its records.
+func (c *dnsCache) put(question dns.Question, msg *dns.Msg) {
+	if c.size <= 0 || msg.Truncated || (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) {
+		return
+	}
+	ttl := min(answerTTL(msg), c.maxTTL)
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey(question)
+	now := time.Now()
+	entry := &dnsCacheEntry{key: key, msg: msg.Copy(), storedAt: now, expires: now.Add(ttl)}
+	if element, ok := c.items[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.items[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*dnsCacheEntry).key) //nolint:forcetypeassert // only entries are stored
+	}
+}
+
+// answerTTL returns the lowest TTL of the answer records, or the SOA minimum for negative answers.
+func answerTTL(msg *dns.Msg) time.Duration {
+	if len(msg.Answer) > 0 {
+		lowest := msg.Answer[0].Header().Ttl
+		for _, rr := range msg.Answer[1:] {
+			lowest = min(lowest, rr.Header().Ttl)
+		}
+		return time.Duration(lowest) * time.Second
+	}
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+		}
+	}
+	return negativeCacheTTL
+}
@@ -0,0 +1,182 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
+	"github.com/mdlayher/vsock"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultDNSTimeout     = 5 * time.Second
+	defaultDNSMaxCacheTTL = 5 * time.Minute
+	dnsIdleTimeout        = 30 * time.Second
+	resolvConfPath        = "/etc/resolv.conf"
+)
+
+// DNSTunnel answers DNS queries from the enclave by forwarding them to an upstream resolver.
+// Queries use DNS over TCP framing on the vsock connection. Only A, AAAA, SRV and TXT queries are answered.
+type DNSTunnel struct {
+	port      uint32
+	logger    *zerolog.Logger
+	upstream  string
+	udpClient *dns.Client
+	tcpClient *dns.Client
+	cache     *dnsCache
+}
+
+// NewDNSTunnel creates a new DNSTunnel from the given settings.
+func NewDNSTunnel(settings *config.DNSSettings, logger zerolog.Logger) (*DNSTunnel, error) {
+	upstream := settings.Upstream
+	if upstream == "" {
+		resolvConf, err := dns.ClientConfigFromFile(resolvConfPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream resolver from %s: %w", resolvConfPath, err)
+		}
+		if len(resolvConf.Servers) == 0 {
+			return nil, fmt.Errorf("no nameservers in %s", resolvConfPath)
+		}
+		upstream = net.JoinHostPort(resolvConf.Servers[0], resolvConf.Port)
+	}
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		return nil, fmt.Errorf("invalid upstream resolver %q: %w", upstream, err)
+	}
+	timeout := settings.Timeout
+	if timeout <= 0 {
+		timeout = defaultDNSTimeout
+	}
+	maxCacheTTL := settings.MaxCacheTTL
+	if maxCacheTTL <= 0 {
+		maxCacheTTL = defaultDNSMaxCacheTTL
+	}
+	return &DNSTunnel{
+		port:      settings.EnclaveDialPort,
+		logger:    &logger,
+		upstream:  upstream,
+		udpClient: &dns.Client{Net: "udp", Timeout: timeout},
+		tcpClient: &dns.Client{Net: "tcp", Timeout: timeout},
+		cache:     newDNSCache(settings.CacheSize, maxCacheTTL),
+	}, nil
+}
+
+// Port returns the port of the DNSTunnel.
+func (d *DNSTunnel) Port() uint32 {
+	return d.port
+}
+
+// HandleConn answers DNS queries on the connection until it is closed or idle.
+func (d *DNSTunnel) HandleConn(ctx context.Context, vsockConn net.Conn) {
+	defer vsockConn.Close() //nolint:errcheck
+	stop := context.AfterFunc(ctx, func() {
+		_ = vsockConn.SetDeadline(time.Now())
+	})
+	defer stop()
+	conn := &dns.Conn{Conn: vsockConn}
+	for {
+		_ = vsockConn.SetReadDeadline(time.Now().Add(dnsIdleTimeout))
+		req, err := conn.ReadMsg()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && ctx.Err() == nil {
+				d.logger.Debug().Err(err).Msg("Failed to read DNS query")
+			}
+			return
+		}
+		resp := d.resolve(ctx, req)
+		if err := conn.WriteMsg(resp); err != nil {
+			d.logger.Error().Err(err).Msg("Failed to write DNS response")
+			return
+		}
+	}
+}
+
+// resolve answers a single query from the cache or the upstream resolver.
+func (d *DNSTunnel) resolve(ctx context.Context, req *dns.Msg) *dns.Msg {
+	if len(req.Question) != 1 || req.Question[0].Qclass != dns.ClassINET || !supportedQueryType(req.Question[0].Qtype) {
+		dnsQueriesTotal.WithLabelValues(queryTypeLabel(req), "refused").Inc()
+		return new(dns.Msg).SetRcode(req, dns.RcodeRefused)
+	}
+	question := req.Question[0]
+	queryType := dns.TypeToString[question.Qtype]
+	if resp := d.cache.get(question); resp != nil {
+		dnsQueriesTotal.WithLabelValues(queryType, "cache_hit").Inc()
+		resp.Id = req.Id
+		return resp
+	}
+
+	resp, err := d.exchange(ctx, req)
+	if err != nil {
+		dnsQueriesTotal.WithLabelValues(queryType, "error").Inc()
+		d.logger.Warn().Err(err).Str("name", question.Name).Str("type", queryType).Msg("Failed to resolve DNS query")
+		return new(dns.Msg).SetRcode(req, dns.RcodeServerFailure)
+	}
+	dnsQueriesTotal.WithLabelValues(queryType, "upstream").Inc()
+	d.cache.put(question, resp)
+	return resp
+}
+
+// exchange forwards a query to the upstream resolver over UDP, retrying over TCP if the answer was truncated.
+func (d *DNSTunnel) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := d.udpClient.ExchangeContext(ctx, req, d.upstream)
+	if err == nil && resp.Truncated {
+		resp, _, err = d.tcpClient.ExchangeContext(ctx, req, d.upstream)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("upstream %s: %w", d.upstream, err)
+	}
+	return resp, nil
+}
+
+// ListenForTargetRequests listens for DNS connections on the vsock port.
+func (d *DNSTunnel) ListenForTargetRequests(ctx context.Context) error {
+	listener, err := vsock.ListenContextID(enclave.DefaultHostCID, d.port, nil)
+	if err != nil {
+		return fmt.Errorf("failed to listen for DNS queries: %w", err)
+	}
+	d.logger.Info().Msgf("Listening for DNS queries on port %d, forwarding to %s", d.port, d.upstream)
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close() //nolint:errcheck
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			d.logger.Error().Err(err).Msg("Failed to accept DNS connection")
+			continue
+		}
+		go d.HandleConn(ctx, conn)
+	}
+}
+
+func supportedQueryType(qtype uint16) bool {
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeSRV, dns.TypeTXT:
+		return true
+	default:
+		return false
+	}
+}
+
+func queryTypeLabel(req *dns.Msg) string {
+	if len(req.Question) != 1 || !supportedQueryType(req.Question[0].Qtype) {
+		return "other"
+	}
+	return dns.TypeToString[req.Question[0].Qtype]
+}
+
+// cacheKey identifies a question case-insensitively.
+func cacheKey(question dns.Question) string {
+	return strings.ToLower(question.Name) + "/" + dns.TypeToString[question.Qtype]
+}
@@ -0,0 +1,97 @@
+package tunnel_test
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tunnel"
+	"github.com/miekg/dns"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// startDNSServer starts an upstream resolver that answers A queries for example.test.
+func startDNSServer(t *testing.T, queries *atomic.Int32) string {
+	t.Helper()
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &dns.Server{PacketConn: packetConn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		queries.Add(1)
+		resp := new(dns.Msg).SetReply(req)
+		question := req.Question[0]
+		if !strings.EqualFold(question.Name, "example.test.") {
+			resp.Rcode = dns.RcodeNameError
+		} else if question.Qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("192.0.2.10"),
+			})
+		}
+		_ = w.WriteMsg(resp)
+	})}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return packetConn.LocalAddr().String()
+}
+
+func TestDNSTunnel(t *testing.T) {
+	t.Parallel()
+	var queries atomic.Int32
+	dnsTunnel, err := tunnel.NewDNSTunnel(&config.DNSSettings{
+		Upstream:  startDNSServer(t, &queries),
+		CacheSize: 10,
+	}, zerolog.Nop())
+	require.NoError(t, err)
+
+	enclaveSide, bridgeSide := net.Pipe()
+	defer enclaveSide.Close() //nolint:errcheck
+	go dnsTunnel.HandleConn(t.Context(), bridgeSide)
+	require.NoError(t, enclaveSide.SetDeadline(time.Now().Add(5*time.Second)))
+	conn := &dns.Conn{Conn: enclaveSide}
+	exchange := func(name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		require.NoError(t, conn.WriteMsg(new(dns.Msg).SetQuestion(name, qtype)))
+		resp, err := conn.ReadMsg()
+		require.NoError(t, err)
+		return resp
+	}
+
+	// The second query is answered from the cache.
+	for range 2 {
+		resp := exchange("Example.Test.", dns.TypeA)
+		require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		require.Len(t, resp.Answer, 1)
+		require.Equal(t, "192.0.2.10", resp.Answer[0].(*dns.A).A.String())
+	}
+	require.Equal(t, int32(1), queries.Load())
+
+	require.Equal(t, dns.RcodeNameError, exchange("missing.test.", dns.TypeA).Rcode)
+	require.Equal(t, dns.RcodeRefused, exchange("example.test.", dns.TypeMX).Rcode)
+	require.Equal(t, int32(2), queries.Load())
+}
+
+func TestDNSTunnelUpstreamFailure(t *testing.T) {
+	t.Parallel()
+	dnsTunnel, err := tunnel.NewDNSTunnel(&config.DNSSettings{
+		Upstream: closedAddr(t),
+		Timeout:  100 * time.Millisecond,
+	}, zerolog.Nop())
+	require.NoError(t, err)
+
+	enclaveSide, bridgeSide := net.Pipe()
+	defer enclaveSide.Close() //nolint:errcheck
+	go dnsTunnel.HandleConn(t.Context(), bridgeSide)
+	require.NoError(t, enclaveSide.SetDeadline(time.Now().Add(5*time.Second)))
+	conn := &dns.Conn{Conn: enclaveSide}
+	require.NoError(t, conn.WriteMsg(new(dns.Msg).SetQuestion("example.test.", dns.TypeA)))
+	resp, err := conn.ReadMsg()
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+
+	_, err = tunnel.NewDNSTunnel(&config.DNSSettings{Upstream: "not an address"}, zerolog.Nop())
+	require.Error(t, err)
+}
@@ -0,0 +1,22 @@
+package tunnel
+
+// TunnelError is a typed error for tunnel-related errors.
+type TunnelError string
+
+func (e TunnelError) Error() string { return string(e) }
+
+const (
+	// ErrUnknownAlias is returned when the enclave requests an alias that is not configured.
+	ErrUnknownAlias = TunnelError("unknown alias")
+	// ErrInvalidAliasBackend is returned when an alias backend address can not be parsed.
+	ErrInvalidAliasBackend = TunnelError("invalid alias backend")
+	// ErrNoHealthyTargets is returned when a server tunnel refuses a connection because every target is unhealthy.
+	ErrNoHealthyTargets = TunnelError("no healthy targets")
+	// ErrQuotaExceeded is returned when a client tunnel has transferred its daily byte quota.
+	ErrQuotaExceeded = TunnelError("byte quota exceeded")
+	// ErrClientNotAllowed is returned when a host client certificate is not in the allowlist of a server tunnel.
+	ErrClientNotAllowed = TunnelError("client certificate not allowed")
+	// ErrSNINotAllowed is returned when the enclave sends a connection to a TLS port that is not TLS
+	// or whose server name is not allowed.
+	ErrSNINotAllowed = TunnelError("TLS server name not allowed")
+)
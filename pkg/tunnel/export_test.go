@@ -0,0 +1,11 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+)
+
+// SetDialFunc replaces the vsock dialer of the ServerTunnel so tests can use TCP stand-ins.
+func (v *ServerTunnel) SetDialFunc(dial func(ctx context.Context, cid, port uint32) (net.Conn, error)) {
+	v.dial = dial
+}
@@ -0,0 +1,98 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+)
+
+// prober checks the health of a target over an established connection.
+type prober func(ctx context.Context, conn net.Conn) error
+
+func newProber(settings *config.HealthCheckSettings) (prober, error) {
+	switch settings.Type {
+	case "", config.HealthCheckTCP:
+		return probeTCP, nil
+	case config.HealthCheckHTTP:
+		return probeHTTP(settings.Path, ""), nil
+	case config.HealthCheckHTTPS:
+		return func(ctx context.Context, conn net.Conn) error {
+			tlsConn, err := probeTLSHandshake(ctx, conn, settings.ServerName)
+			if err != nil {
+				return err
+			}
+			return probeHTTP(settings.Path, settings.ServerName)(ctx, tlsConn)
+		}, nil
+	case config.HealthCheckTLS:
+		return func(ctx context.Context, conn net.Conn) error {
+			_, err := probeTLSHandshake(ctx, conn, settings.ServerName)
+			return err
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported health check type: %q", settings.Type)
+	}
+}
+
+// probeTCP succeeds once the connection has been established.
+func probeTCP(context.Context, net.Conn) error {
+	return nil
+}
+
+// probeHTTP sends a GET request for path and expects a 2xx or 3xx response.
+func probeHTTP(path, host string) prober {
+	if path == "" {
+		path = "/"
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return func(ctx context.Context, conn net.Conn) error {
+		setDeadlineFromContext(ctx, conn)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+host+path, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create health check request: %w", err)
+		}
+		req.Header.Set("User-Agent", "enclave-bridge-health-check")
+		req.Close = true
+		if err := req.Write(conn); err != nil {
+			return fmt.Errorf("failed to write health check request: %w", err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			return fmt.Errorf("failed to read health check response: %w", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("unhealthy status: %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+// probeTLSHandshake completes a TLS handshake with the target.
+// The certificate is not verified since the probe only checks that the enclave is serving TLS.
+func probeTLSHandshake(ctx context.Context, conn net.Conn, serverName string) (*tls.Conn, error) {
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true, //nolint:gosec // liveness probe only, the enclave certificate is verified by clients.
+		MinVersion:         tls.VersionTLS12,
+	})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("failed TLS handshake: %w", err)
+	}
+	return tlsConn, nil
+}
+
+func setDeadlineFromContext(ctx context.Context, conn net.Conn) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+}
@@ -0,0 +1,134 @@
+package tunnel_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/server"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tunnel"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// newProbedTunnel creates a server tunnel whose single target is served by server.
+func newProbedTunnel(t *testing.T, server *httptest.Server, healthCheck config.HealthCheckSettings) *tunnel.ServerTunnel {
+	t.Helper()
+	serverTunnel, err := tunnel.NewServerTunnelFromSettings(&config.ServerSettings{
+		EnclaveCID:        16,
+		EnclaveListenPort: 5001,
+		HealthCheck:       healthCheck,
+	}, zerolog.Nop())
+	require.NoError(t, err)
+	addr := strings.TrimPrefix(strings.TrimPrefix(server.URL, "http://"), "https://")
+	serverTunnel.SetDialFunc(func(ctx context.Context, _, _ uint32) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", addr)
+	})
+	t.Cleanup(serverTunnel.Stop)
+	return serverTunnel
+}
+
+func TestServerTunnelHTTPHealthCheck(t *testing.T) {
+	t.Parallel()
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	serverTunnel := newProbedTunnel(t, server, config.HealthCheckSettings{
+		Type:                config.HealthCheckHTTP,
+		Path:                "/health",
+		Interval:            10 * time.Millisecond,
+		UnhealthyThreshold:  1,
+		RefuseWhenUnhealthy: true,
+	})
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go func() { _ = serverTunnel.RunHealthChecks(ctx) }()
+
+	require.Eventually(t, func() bool { return !serverTunnel.Healthy() }, time.Second, 5*time.Millisecond)
+
+	// New connections are closed without being forwarded.
+	clientSide, bridgeSide := net.Pipe()
+	go serverTunnel.HandleConn(bridgeSide)
+	require.NoError(t, clientSide.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err := clientSide.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	healthy.Store(true)
+	require.Eventually(t, serverTunnel.Healthy, time.Second, 5*time.Millisecond)
+}
+
+func TestServerTunnelTLSProbe(t *testing.T) {
+	t.Parallel()
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer tlsServer.Close()
+	plainServer := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer plainServer.Close()
+	targets := []config.EnclaveTarget{{CID: 16, Port: 5001}}
+
+	for _, probeType := range []string{config.HealthCheckTLS, config.HealthCheckHTTPS} {
+		healthCheck := config.HealthCheckSettings{Type: probeType, ServerName: "example.com"}
+		ctx, cancel := context.WithTimeout(t.Context(), 2*time.Second)
+		require.NoError(t, newProbedTunnel(t, tlsServer, healthCheck).Probe(ctx, targets))
+		require.Error(t, newProbedTunnel(t, plainServer, healthCheck).Probe(ctx, targets))
+		cancel()
+	}
+}
+
+func TestServerTunnelInvalidProbe(t *testing.T) {
+	t.Parallel()
+	_, err := tunnel.NewServerTunnelFromSettings(&config.ServerSettings{
+		HealthCheck: config.HealthCheckSettings{Type: "udp"},
+	}, zerolog.Nop())
+	require.Error(t, err)
+}
+
+func TestServerTunnelHealthCheckSendsHeader(t *testing.T) {
+	t.Parallel()
+	settings := &config.ServerSettings{
+		EnclaveCID:        16,
+		EnclaveListenPort: 5001,
+		PropagateTrace:    true,
+		HealthCheck: config.HealthCheckSettings{
+			Type:     config.HealthCheckHTTP,
+			Path:     "/health",
+			Interval: 10 * time.Millisecond,
+		},
+	}
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener := server.NewListener(tcpListener, settings)
+	httpServer := &http.Server{
+		ReadHeaderTimeout: time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/health" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	}
+	go func() { _ = httpServer.Serve(listener) }()
+	t.Cleanup(func() { _ = httpServer.Close() })
+
+	serverTunnel, err := tunnel.NewServerTunnelFromSettings(settings, zerolog.Nop())
+	require.NoError(t, err)
+	t.Cleanup(serverTunnel.Stop)
+	serverTunnel.SetDialFunc(func(ctx context.Context, _, _ uint32) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", tcpListener.Addr().String())
+	})
+	require.NoError(t, serverTunnel.Probe(t.Context(), settings.EnclaveTargets()))
+}
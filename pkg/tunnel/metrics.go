@@ -0,0 +1,71 @@
+package tunnel
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "enclave_bridge"
+
+var (
+	targetHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "server_target_healthy",
+		Help:      "Whether a server tunnel target is passing health checks (1) or has been ejected (0).",
+	}, []string{"bridge_port", "target"})
+
+	healthChecksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "server_health_checks_total",
+		Help:      "Number of health checks of server tunnel targets by result.",
+	}, []string{"bridge_port", "target", "result"})
+
+	healthCheckDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "server_health_check_duration_seconds",
+		Help:      "Duration of health checks of server tunnel targets.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"bridge_port"})
+
+	refusedConnectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "server_refused_connections_total",
+		Help:      "Number of host connections refused because no server tunnel target was healthy.",
+	}, []string{"bridge_port"})
+
+	rejectedClientsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "server_rejected_clients_total",
+		Help:      "Number of host connections rejected because the client failed mutual TLS authentication.",
+	}, []string{"bridge_port"})
+
+	warmPoolCheckoutsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "server_warm_pool_checkouts_total",
+		Help:      "Number of vsock connections taken from the warm pool (hit) or dialed because it was empty (miss).",
+	}, []string{"bridge_port", "result"})
+
+	tunnelBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tunnel_bytes_total",
+		Help:      "Number of bytes forwarded by tunnels by direction (inbound to the enclave, outbound from the enclave).",
+	}, []string{"tunnel", "port", "direction"})
+
+	quotaDeniedConnectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "client_quota_denied_connections_total",
+		Help:      "Number of client tunnel connections denied or closed because the daily byte quota was exceeded.",
+	}, []string{"enclave_dial_port"})
+
+	sniViolationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "client_sni_violations_total",
+		Help:      "Number of client tunnel connections closed because they were not TLS or sent a server name that is not allowed.",
+	}, []string{"enclave_dial_port"})
+
+	dnsQueriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dns_queries_total",
+		Help:      "Number of DNS queries from the enclave by query type and result (cache_hit, upstream, refused, error).",
+	}, []string{"type", "result"})
+)
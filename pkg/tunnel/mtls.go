@@ -0,0 +1,103 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/certs"
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
+	"github.com/DIMO-Network/enclave-bridge/pkg/proxyproto"
+)
+
+const clientAuthHandshakeTimeout = 10 * time.Second
+
+// clientAuth terminates mutual TLS from host clients and passes the verified identity to the enclave.
+type clientAuth struct {
+	tlsConfig       *tls.Config
+	allowedSubjects []string
+	identity        string
+}
+
+// newClientAuth creates a clientAuth from settings. It returns nil if mutual TLS is disabled.
+func newClientAuth(settings *config.MutualTLSSettings) (*clientAuth, error) {
+	if !settings.Enabled {
+		return nil, nil //nolint:nilnil // mutual TLS is optional
+	}
+	switch settings.ClientIdentity {
+	case "", config.ClientIdentityProxyProtocol, config.ClientIdentityHeader:
+	default:
+		return nil, fmt.Errorf("unsupported client identity format: %q", settings.ClientIdentity)
+	}
+	getCertificate, err := certs.GetCertificatesFromSettings(&settings.ServerCert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+	caPEM, err := os.ReadFile(settings.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA bundle: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("client CA bundle does not contain any certificates")
+	}
+	return &clientAuth{
+		tlsConfig: &tls.Config{
+			GetCertificate: getCertificate,
+			ClientAuth:     tls.RequireAndVerifyClientCert,
+			ClientCAs:      clientCAs,
+			MinVersion:     tls.VersionTLS12,
+		},
+		allowedSubjects: settings.AllowedSubjects,
+		identity:        settings.ClientIdentity,
+	}, nil
+}
+
+// handshake completes the TLS handshake with a host client and checks its certificate against the allowlist.
+func (a *clientAuth) handshake(ctx context.Context, conn net.Conn) (*tls.Conn, error) {
+	tlsConn := tls.Server(conn, a.tlsConfig)
+	handshakeCtx, cancel := context.WithTimeout(ctx, clientAuthHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+		return nil, fmt.Errorf("failed mutual TLS handshake: %w", err)
+	}
+	cert := tlsConn.ConnectionState().PeerCertificates[0]
+	if len(a.allowedSubjects) > 0 &&
+		!slices.Contains(a.allowedSubjects, cert.Subject.CommonName) &&
+		!slices.Contains(a.allowedSubjects, cert.Subject.String()) {
+		return nil, fmt.Errorf("%w: %q", ErrClientNotAllowed, cert.Subject.String())
+	}
+	return tlsConn, nil
+}
+
+// writeIdentity sends the verified identity of the client of tlsConn to the enclave.
+// extra TLVs are added to the PROXY protocol header and ignored by the header format.
+func (a *clientAuth) writeIdentity(w io.Writer, tlsConn *tls.Conn, extra ...proxyproto.TLV) error {
+	state := tlsConn.ConnectionState()
+	subject := state.PeerCertificates[0].Subject
+	if a.identity == config.ClientIdentityHeader {
+		if strings.ContainsAny(subject.String(), "\r\n") {
+			return fmt.Errorf("%w: subject contains a line break", ErrClientNotAllowed)
+		}
+		_, err := io.WriteString(w, enclave.ClientIdentityPrefix+subject.String()+"\n")
+		if err != nil {
+			return fmt.Errorf("failed to write client identity: %w", err)
+		}
+		return nil
+	}
+	header := proxyproto.NewHeader(tlsConn, append([]proxyproto.TLV{
+		proxyproto.SSLTLV(tls.VersionName(state.Version), subject.CommonName),
+		{Type: proxyproto.TypeClientSubject, Value: []byte(subject.String())},
+	}, extra...)...)
+	_, err := header.WriteTo(w)
+	return err
+}
@@ -0,0 +1,208 @@
+package tunnel_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
+	"github.com/DIMO-Network/enclave-bridge/pkg/proxyproto"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tunnel"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA is a certificate authority that issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue creates a certificate for commonName signed by the CA.
+func (c *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"DIMO"}},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, c.cert, &key.PublicKey, c.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeFiles writes the CA certificate and a server certificate to disk.
+func (c *testCA) writeFiles(t *testing.T) (caFile string, serverCert config.LocalCertConfig) {
+	t.Helper()
+	dir := t.TempDir()
+	caFile = filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0o600))
+
+	server := c.issue(t, "bridge.example.com", x509.ExtKeyUsageServerAuth)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(server.PrivateKey)
+	require.NoError(t, err)
+	serverCert = config.LocalCertConfig{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+	}
+	require.NoError(t, os.WriteFile(serverCert.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate[0]}), 0o600))
+	require.NoError(t, os.WriteFile(serverCert.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return caFile, serverCert
+}
+
+// newMutualTLSTunnel creates a server tunnel with mutual TLS whose target sends every received identity
+// header on the returned channel and echoes the rest of the stream.
+func newMutualTLSTunnel(t *testing.T, ca *testCA, clientIdentity string) (*tunnel.ServerTunnel, <-chan string) {
+	t.Helper()
+	caFile, serverCert := ca.writeFiles(t)
+	serverTunnel, err := tunnel.NewServerTunnelFromSettings(&config.ServerSettings{
+		EnclaveCID:        16,
+		EnclaveListenPort: 5001,
+		MutualTLS: config.MutualTLSSettings{
+			Enabled:         true,
+			ServerCert:      serverCert,
+			ClientCAFile:    caFile,
+			AllowedSubjects: []string{"allowed-service"},
+			ClientIdentity:  clientIdentity,
+		},
+	}, zerolog.Nop())
+	require.NoError(t, err)
+	t.Cleanup(serverTunnel.Stop)
+
+	identities := make(chan string, 1)
+	serverTunnel.SetDialFunc(func(context.Context, uint32, uint32) (net.Conn, error) {
+		bridgeSide, enclaveSide := net.Pipe()
+		go func() {
+			defer enclaveSide.Close() //nolint:errcheck
+			reader := bufio.NewReader(enclaveSide)
+			if clientIdentity == config.ClientIdentityHeader {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				identities <- strings.TrimSuffix(strings.TrimPrefix(line, enclave.ClientIdentityPrefix), "\n")
+			} else {
+				header, err := proxyproto.Read(reader)
+				if err != nil {
+					return
+				}
+				subject, _ := header.TLV(proxyproto.TypeClientSubject)
+				identities <- string(subject)
+			}
+			_, _ = io.Copy(enclaveSide, reader)
+		}()
+		return bridgeSide, nil
+	})
+	return serverTunnel, identities
+}
+
+// dialMutualTLS connects a client with cert to the tunnel through a TCP connection.
+func dialMutualTLS(t *testing.T, serverTunnel *tunnel.ServerTunnel, ca *testCA, cert tls.Certificate) (*tls.Conn, error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			serverTunnel.HandleConn(conn)
+		}
+	}()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+		ServerName:   "bridge.example.com",
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	return conn, nil
+}
+
+func TestServerTunnelMutualTLS(t *testing.T) {
+	t.Parallel()
+	ca := newTestCA(t)
+	for _, clientIdentity := range []string{config.ClientIdentityProxyProtocol, config.ClientIdentityHeader} {
+		t.Run(clientIdentity, func(t *testing.T) {
+			t.Parallel()
+			serverTunnel, identities := newMutualTLSTunnel(t, ca, clientIdentity)
+			conn, err := dialMutualTLS(t, serverTunnel, ca, ca.issue(t, "allowed-service", x509.ExtKeyUsageClientAuth))
+			require.NoError(t, err)
+
+			_, err = conn.Write([]byte("ping"))
+			require.NoError(t, err)
+			resp := make([]byte, 4)
+			_, err = io.ReadFull(conn, resp)
+			require.NoError(t, err)
+			require.Equal(t, "ping", string(resp))
+			require.Equal(t, "CN=allowed-service,O=DIMO", <-identities)
+		})
+	}
+}
+
+func TestServerTunnelMutualTLSRejectsClients(t *testing.T) {
+	t.Parallel()
+	ca := newTestCA(t)
+	serverTunnel, _ := newMutualTLSTunnel(t, ca, "")
+
+	// A certificate signed by the CA with a subject that is not allowed.
+	conn, err := dialMutualTLS(t, serverTunnel, ca, ca.issue(t, "other-service", x509.ExtKeyUsageClientAuth))
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+	}
+	require.Error(t, err)
+
+	// A certificate signed by another CA.
+	otherCA := newTestCA(t)
+	conn, err = dialMutualTLS(t, serverTunnel, ca, otherCA.issue(t, "allowed-service", x509.ExtKeyUsageClientAuth))
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+	}
+	require.Error(t, err)
+}
@@ -2,49 +2,233 @@ package tunnel
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
+	"github.com/DIMO-Network/enclave-bridge/pkg/proxyproto"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tracing"
 	"github.com/mdlayher/vsock"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 )
 
-const bufSize = 1024
+const (
+	bufSize = 1024
+
+	defaultUnhealthyThreshold = 2
+	defaultHealthyThreshold   = 1
+)
+
+// dialFunc dials a vsock endpoint.
+type dialFunc func(ctx context.Context, cid, port uint32) (net.Conn, error)
 
 // ServerTunnel implements tcpproxy.Target to forward connections to a VSock endpoint.
 type ServerTunnel struct {
-	cid       uint32
-	port      uint32
-	logger    *zerolog.Logger
-	parentCtx context.Context //nolint:containedctx // This is needed since we can't pass a context into the HandleConn function
-	cancel    context.CancelFunc
-	pool      sync.Pool
+	logger      *zerolog.Logger
+	parentCtx   context.Context //nolint:containedctx // This is needed since we can't pass a context into the HandleConn function
+	cancel      context.CancelFunc
+	pool        sync.Pool
+	targets     atomic.Pointer[[]*serverTarget]
+	balancer    balancer
+	healthCheck config.HealthCheckSettings
+	probe       prober
+	dial        dialFunc
+	// bridgePort is the host TCP port served by the tunnel, used as a metrics label.
+	bridgePort string
+	shaper     *shaper
+	clientAuth *clientAuth
+	warmPool   config.WarmPoolSettings
+	// warmPoolRefill wakes RunWarmPool after a connection was taken from a pool.
+	warmPoolRefill chan struct{}
+	tracer         trace.Tracer
+	propagateTrace bool
 }
 
-// Port returns the port of the ServerTunnel.
+// Port returns the port of the first current target of the ServerTunnel.
 func (v *ServerTunnel) Port() uint32 {
-	return v.port
+	if target := v.firstTarget(); target != nil {
+		return target.port
+	}
+	return 0
 }
 
-// CID returns the CID of the ServerTunnel.
+// CID returns the CID of the first current target of the ServerTunnel.
 func (v *ServerTunnel) CID() uint32 {
-	return v.cid
+	if target := v.firstTarget(); target != nil {
+		return target.cid
+	}
+	return 0
+}
+
+func (v *ServerTunnel) firstTarget() *serverTarget {
+	targets := *v.targets.Load()
+	if len(targets) == 0 {
+		return nil
+	}
+	return targets[0]
 }
 
 // NewServerTunnel creates a new ServerTunnel.
 func NewServerTunnel(cid uint32, port uint32, logger zerolog.Logger) *ServerTunnel {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &ServerTunnel{
-		cid:       cid,
-		port:      port,
+	serverTunnel := &ServerTunnel{
 		logger:    &logger,
 		parentCtx: ctx,
 		cancel:    cancel,
 		pool:      sync.Pool{New: func() any { b := make([]byte, bufSize); return &b }},
+		balancer:  &roundRobinBalancer{},
+		probe:     probeTCP,
+		dial:      dialVsock,
+		tracer:    otel.Tracer(tracing.ScopeName),
+
+		warmPoolRefill: make(chan struct{}, 1),
+	}
+	serverTunnel.targets.Store(&[]*serverTarget{newServerTarget(cid, port)})
+	return serverTunnel
+}
+
+// NewServerTunnelFromSettings creates a new ServerTunnel that balances connections across the targets in settings.
+func NewServerTunnelFromSettings(settings *config.ServerSettings, logger zerolog.Logger) (*ServerTunnel, error) {
+	targets := settings.EnclaveTargets()
+	lb, err := newBalancer(settings.LoadBalancing)
+	if err != nil {
+		return nil, err
+	}
+	probe, err := newProber(&settings.HealthCheck)
+	if err != nil {
+		return nil, err
+	}
+	shaper, err := newShaper(&settings.Bandwidth, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bandwidth settings: %w", err)
+	}
+	clientAuth, err := newClientAuth(&settings.MutualTLS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mutual TLS settings: %w", err)
+	}
+	if settings.PropagateTrace && clientAuth != nil && clientAuth.identity == config.ClientIdentityHeader {
+		return nil, errors.New("trace propagation requires the proxy-protocol client identity")
+	}
+	serverTunnel := NewServerTunnel(targets[0].CID, targets[0].Port, logger)
+	serverTunnel.bridgePort = strconv.FormatUint(uint64(settings.BridgeTCPPort), 10)
+	serverTunnel.warmPool = settings.WarmPool
+	// The header is written when a pooled connection is used, so it must not outlive the enclave's wait for it.
+	sendsHeader := clientAuth != nil || settings.PropagateTrace
+	if serverTunnel.warmPool.MaxAge <= 0 {
+		serverTunnel.warmPool.MaxAge = defaultWarmPoolMaxAge
+		if sendsHeader {
+			serverTunnel.warmPool.MaxAge = defaultHeaderWarmPoolMaxAge
+		}
+	}
+	if sendsHeader && serverTunnel.warmPool.MinIdle > 0 && serverTunnel.warmPool.MaxAge >= enclave.ClientIdentityTimeout {
+		return nil, fmt.Errorf("warm pool max age must be shorter than %s with mutual TLS or trace propagation",
+			enclave.ClientIdentityTimeout)
+	}
+	if serverTunnel.warmPool.RetryBackoff <= 0 {
+		serverTunnel.warmPool.RetryBackoff = defaultWarmPoolRetryBackoff
+	}
+	serverTunnel.SetTargets(targets)
+	serverTunnel.balancer = lb
+	serverTunnel.probe = probe
+	serverTunnel.healthCheck = settings.HealthCheck
+	serverTunnel.shaper = shaper
+	serverTunnel.clientAuth = clientAuth
+	serverTunnel.propagateTrace = settings.PropagateTrace
+	if serverTunnel.healthCheck.Timeout == 0 {
+		serverTunnel.healthCheck.Timeout = serverTunnel.healthCheck.Interval
+	}
+	if serverTunnel.healthCheck.UnhealthyThreshold <= 0 {
+		serverTunnel.healthCheck.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+	if serverTunnel.healthCheck.HealthyThreshold <= 0 {
+		serverTunnel.healthCheck.HealthyThreshold = defaultHealthyThreshold
 	}
+	return serverTunnel, nil
+}
+
+// SetTargets atomically replaces the targets of the ServerTunnel.
+// New connections are forwarded to the new targets while existing connections continue until they close.
+// Idle warm pool connections to the previous targets are closed.
+func (v *ServerTunnel) SetTargets(targets []config.EnclaveTarget) {
+	serverTargets := make([]*serverTarget, len(targets))
+	for i, target := range targets {
+		serverTargets[i] = newServerTarget(target.CID, target.Port)
+		serverTargets[i].pool = newWarmPool(&v.warmPool)
+	}
+	previous := v.targets.Swap(&serverTargets)
+	if previous != nil {
+		for _, target := range *previous {
+			target.pool.close()
+			targetHealthy.DeleteLabelValues(v.bridgePort, target.String())
+		}
+	}
+	for _, target := range serverTargets {
+		targetHealthy.WithLabelValues(v.bridgePort, target.String()).Set(1)
+	}
+}
+
+// SetTracer sets the tracer that records a span for every forwarded connection and its vsock dial, replacing the
+// tracer of the global tracer provider. The trace context is sent to the enclave in the PROXY protocol header, if
+// the tunnel sends one.
+func (v *ServerTunnel) SetTracer(tracer trace.Tracer) {
+	v.tracer = tracer
+}
+
+// Healthy returns false if every target of the ServerTunnel has been ejected by health checks.
+func (v *ServerTunnel) Healthy() bool {
+	for _, target := range *v.targets.Load() {
+		if target.healthy.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// ActiveConnections returns the number of connections currently forwarded by the ServerTunnel
+// to its current targets.
+func (v *ServerTunnel) ActiveConnections() int64 {
+	var active int64
+	for _, target := range *v.targets.Load() {
+		active += target.active.Load()
+	}
+	return active
+}
+
+// Probe runs the configured health check once against every target and returns an error if any of them fails.
+func (v *ServerTunnel) Probe(ctx context.Context, targets []config.EnclaveTarget) error {
+	var errs []error
+	for _, target := range targets {
+		err := v.checkTarget(ctx, target.CID, target.Port)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("vsock CID %d, Port %d: %w", target.CID, target.Port, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkTarget dials a target and runs the configured probe against it after the header the enclave expects.
+func (v *ServerTunnel) checkTarget(ctx context.Context, cid, port uint32) error {
+	conn, err := v.dial(ctx, cid, port)
+	if err != nil {
+		return fmt.Errorf("failed to dial: %w", err)
+	}
+	defer conn.Close() //nolint:errcheck
+	if err := v.writeProbeHeader(conn); err != nil {
+		return fmt.Errorf("failed to write connection header: %w", err)
+	}
+	return v.probe(ctx, conn)
 }
 
 // Stop stops the ServerTunnel.
@@ -55,14 +239,54 @@ func (v *ServerTunnel) Stop() {
 // HandleConn dial a vsock connection and copy data in both directions.
 func (v *ServerTunnel) HandleConn(conn net.Conn) {
 	defer conn.Close() //nolint:errcheck
+	ctx, span := v.tracer.Start(v.parentCtx, "server-tunnel", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("bridge.port", v.bridgePort),
+		attribute.String("client.address", conn.RemoteAddr().String()),
+	)
+	var tlsConn *tls.Conn
+	if v.clientAuth != nil {
+		var err error
+		tlsConn, err = v.clientAuth.handshake(v.parentCtx, conn)
+		if err != nil {
+			tracing.RecordError(span, err)
+			rejectedClientsTotal.WithLabelValues(v.bridgePort).Inc()
+			v.logger.Warn().Err(err).Str("client", conn.RemoteAddr().String()).Msg("Rejecting host client")
+			return
+		}
+		conn = tlsConn
+	}
 	// Create a vsock connection to the target
-	vsockConn, err := vsock.Dial(v.cid, v.port, nil)
+	_, dialSpan := v.tracer.Start(ctx, "vsock.dial", trace.WithSpanKind(trace.SpanKindClient))
+	target, vsockConn, err := v.dialTarget(conn.RemoteAddr())
+	if err == nil {
+		dialSpan.SetAttributes(attribute.String("enclave.target", target.String()))
+		span.SetAttributes(attribute.String("enclave.target", target.String()))
+	}
+	tracing.RecordError(dialSpan, err)
+	dialSpan.End()
+	tracing.RecordError(span, err)
+	if errors.Is(err, ErrNoHealthyTargets) {
+		refusedConnectionsTotal.WithLabelValues(v.bridgePort).Inc()
+		v.logger.Warn().Msg("Refusing connection, no healthy vsock targets")
+		return
+	}
 	if err != nil {
-		v.logger.Error().Err(err).Msgf("Failed to dial vsock CID %d, Port %d", v.cid, v.port)
+		v.logger.Error().Err(err).Msg("Failed to dial vsock target")
+		return
+	}
+	defer vsockConn.Close() //nolint:errcheck
+	target.active.Add(1)
+	defer target.active.Add(-1)
+
+	if err := v.writeHeader(vsockConn, conn, tlsConn, tracing.Traceparent(ctx)); err != nil {
+		tracing.RecordError(span, err)
+		v.logger.Error().Err(err).Msg("Failed to send connection header to vsock target")
 		return
 	}
 
-	v.logger.Trace().Msgf("Forwarding TCP connection to vsock CID %d, Port %d", v.cid, v.port)
+	v.logger.Trace().Msgf("Forwarding TCP connection to vsock CID %d, Port %d", target.cid, target.port)
 
 	// Create error group for goroutine coordination
 	group, _ := errgroup.WithContext(v.parentCtx)
@@ -71,7 +295,9 @@ func (v *ServerTunnel) HandleConn(conn net.Conn) {
 	group.Go(func() error {
 		buf := v.pool.Get().(*[]byte)
 		defer v.pool.Put(buf)
-		_, err := io.CopyBuffer(vsockConn, conn, *buf)
+		n, err := io.CopyBuffer(vsockConn, v.shaper.reader(v.parentCtx, conn, directionInbound), *buf)
+		tunnelBytesTotal.WithLabelValues("server", v.bridgePort, directionInbound).Add(float64(n))
+		span.SetAttributes(attribute.Int64("bytes.inbound", n))
 		if err != nil {
 			return fmt.Errorf("failed to copy data from TCP proxy to vsock server: %w", err)
 		}
@@ -82,7 +308,9 @@ func (v *ServerTunnel) HandleConn(conn net.Conn) {
 	group.Go(func() error {
 		buf := v.pool.Get().(*[]byte)
 		defer v.pool.Put(buf)
-		_, err := io.CopyBuffer(conn, vsockConn, *buf)
+		n, err := io.CopyBuffer(conn, v.shaper.reader(v.parentCtx, vsockConn, directionOutbound), *buf)
+		tunnelBytesTotal.WithLabelValues("server", v.bridgePort, directionOutbound).Add(float64(n))
+		span.SetAttributes(attribute.Int64("bytes.outbound", n))
 		if err != nil {
 			return fmt.Errorf("failed to copy data from vsock server to TCP client: %w", err)
 		}
@@ -91,6 +319,180 @@ func (v *ServerTunnel) HandleConn(conn net.Conn) {
 
 	// Wait for either an error or context cancellation
 	if err := group.Wait(); err != nil {
+		tracing.RecordError(span, err)
 		v.logger.Error().Err(err).Msg("Connection error occurred")
 	}
 }
+
+// writeHeader sends what the enclave reads before the data of a connection: the client identity with mutual TLS,
+// and a PROXY protocol header with the trace context if the tunnel propagates traces.
+func (v *ServerTunnel) writeHeader(w io.Writer, conn net.Conn, tlsConn *tls.Conn, traceparent string) error {
+	var tlvs []proxyproto.TLV
+	if traceparent != "" {
+		tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.TypeTraceparent, Value: []byte(traceparent)})
+	}
+	if tlsConn != nil {
+		return v.clientAuth.writeIdentity(w, tlsConn, tlvs...)
+	}
+	if !v.propagateTrace {
+		return nil
+	}
+	_, err := proxyproto.NewHeader(conn, tlvs...).WriteTo(w)
+	return err
+}
+
+// writeProbeHeader sends the header the enclave reads before the data of a health check connection whenever
+// writeHeader would send one: a local PROXY protocol header without TLVs, or an empty client identity line.
+func (v *ServerTunnel) writeProbeHeader(w io.Writer) error {
+	if v.clientAuth != nil && v.clientAuth.identity == config.ClientIdentityHeader {
+		_, err := io.WriteString(w, enclave.ClientIdentityPrefix+"\n")
+		return err
+	}
+	if v.clientAuth == nil && !v.propagateTrace {
+		return nil
+	}
+	_, err := (&proxyproto.Header{}).WriteTo(w)
+	return err
+}
+
+// dialTarget picks a target for the client and dials it. If the dial fails the remaining healthy targets are tried.
+func (v *ServerTunnel) dialTarget(clientAddr net.Addr) (*serverTarget, net.Conn, error) {
+	candidates := v.healthyTargets()
+	if len(candidates) == 0 {
+		return nil, nil, ErrNoHealthyTargets
+	}
+	var errs []error
+	for len(candidates) > 0 {
+		target := v.balancer.pick(clientAddr, candidates)
+		vsockConn, err := v.dialPooled(target)
+		if err == nil {
+			return target, vsockConn, nil
+		}
+		errs = append(errs, fmt.Errorf("failed to dial vsock CID %d, Port %d: %w", target.cid, target.port, err))
+		candidates = removeTarget(candidates, target)
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+// healthyTargets returns the targets that have not been ejected.
+// If every target has been ejected all targets are returned so connections are still attempted,
+// unless the tunnel is configured to refuse connections while unhealthy.
+func (v *ServerTunnel) healthyTargets() []*serverTarget {
+	targets := *v.targets.Load()
+	healthy := make([]*serverTarget, 0, len(targets))
+	for _, target := range targets {
+		if target.healthy.Load() {
+			healthy = append(healthy, target)
+		}
+	}
+	if len(healthy) == 0 {
+		if v.healthCheck.RefuseWhenUnhealthy {
+			return nil
+		}
+		v.logger.Warn().Msg("No healthy vsock targets, trying all targets")
+		return append(healthy, targets...)
+	}
+	return healthy
+}
+
+// RunHealthChecks periodically dials every target and ejects targets that fail consecutive checks.
+// It blocks until the context is canceled. If health checks are disabled it returns immediately.
+func (v *ServerTunnel) RunHealthChecks(ctx context.Context) error {
+	if v.healthCheck.Interval <= 0 {
+		return nil
+	}
+	ticker := time.NewTicker(v.healthCheck.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			v.checkTargets(ctx)
+		}
+	}
+}
+
+// checkTargets runs a single health check against every target concurrently.
+func (v *ServerTunnel) checkTargets(ctx context.Context) {
+	targets := *v.targets.Load()
+	var wg sync.WaitGroup
+	results := make([]error, len(targets))
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, v.healthCheck.Timeout)
+			defer cancel()
+			start := time.Now()
+			results[i] = v.checkTarget(checkCtx, target.cid, target.port)
+			healthCheckDuration.WithLabelValues(v.bridgePort).Observe(time.Since(start).Seconds())
+		}()
+	}
+	wg.Wait()
+	for i, target := range targets {
+		v.recordCheck(target, results[i])
+	}
+}
+
+// recordCheck updates the health of a target from the result of a check.
+func (v *ServerTunnel) recordCheck(target *serverTarget, err error) {
+	if err != nil {
+		healthChecksTotal.WithLabelValues(v.bridgePort, target.String(), "failure").Inc()
+		target.successes = 0
+		target.failures++
+		if target.healthy.Load() && target.failures >= v.healthCheck.UnhealthyThreshold {
+			target.healthy.Store(false)
+			targetHealthy.WithLabelValues(v.bridgePort, target.String()).Set(0)
+			v.logger.Warn().Err(err).Str("target", target.String()).Msg("Ejecting unhealthy vsock target")
+		}
+		return
+	}
+	healthChecksTotal.WithLabelValues(v.bridgePort, target.String(), "success").Inc()
+	target.failures = 0
+	target.successes++
+	if !target.healthy.Load() && target.successes >= v.healthCheck.HealthyThreshold {
+		target.healthy.Store(true)
+		targetHealthy.WithLabelValues(v.bridgePort, target.String()).Set(1)
+		v.logger.Info().Str("target", target.String()).Msg("Restoring healthy vsock target")
+	}
+}
+
+func removeTarget(targets []*serverTarget, remove *serverTarget) []*serverTarget {
+	remaining := make([]*serverTarget, 0, len(targets))
+	for _, target := range targets {
+		if target != remove {
+			remaining = append(remaining, target)
+		}
+	}
+	return remaining
+}
+
+// dialVsock dials a vsock endpoint, returning early if the context is done.
+func dialVsock(ctx context.Context, cid, port uint32) (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	resultChan := make(chan dialResult, 1)
+	go func() {
+		conn, err := vsock.Dial(cid, port, nil)
+		if err != nil {
+			resultChan <- dialResult{err: err}
+			return
+		}
+		resultChan <- dialResult{conn: conn}
+	}()
+	select {
+	case <-ctx.Done():
+		go func() {
+			// Close the connection if the dial completes after we stopped waiting.
+			if result := <-resultChan; result.conn != nil {
+				_ = result.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	case result := <-resultChan:
+		return result.conn, result.err
+	}
+}
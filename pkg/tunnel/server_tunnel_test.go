@@ -0,0 +1,194 @@
+package tunnel_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tunnel"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEnclaves maps vsock targets to local TCP servers that reply with their own name.
+type fakeEnclaves struct {
+	mu    sync.Mutex
+	addrs map[string]string
+	dials map[string]int
+}
+
+func newFakeEnclaves(t *testing.T, targets ...config.EnclaveTarget) *fakeEnclaves {
+	t.Helper()
+	enclaves := &fakeEnclaves{addrs: map[string]string{}, dials: map[string]int{}}
+	for _, target := range targets {
+		name := fmt.Sprintf("%d:%d", target.CID, target.Port)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte(name + "\n"))
+				_ = conn.Close()
+			}
+		}()
+		enclaves.addrs[name] = listener.Addr().String()
+	}
+	return enclaves
+}
+
+// stop makes a target refuse connections.
+func (f *fakeEnclaves) stop(target config.EnclaveTarget) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.addrs, fmt.Sprintf("%d:%d", target.CID, target.Port))
+}
+
+// dialCount returns how many times a target has been dialed for a client connection.
+func (f *fakeEnclaves) dialCount(target config.EnclaveTarget) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dials[fmt.Sprintf("%d:%d", target.CID, target.Port)]
+}
+
+func (f *fakeEnclaves) dial(ctx context.Context, cid, port uint32) (net.Conn, error) {
+	f.mu.Lock()
+	name := fmt.Sprintf("%d:%d", cid, port)
+	if _, isHealthCheck := ctx.Deadline(); !isHealthCheck {
+		f.dials[name]++
+	}
+	addr, ok := f.addrs[name]
+	f.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("connection refused")
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// tcpAddrConn is a net.Conn with a fixed remote address.
+type tcpAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *tcpAddrConn) RemoteAddr() net.Addr { return c.remote }
+
+// connectFrom sends a connection from clientIP through the tunnel and returns the name of the target that answered.
+func connectFrom(t *testing.T, serverTunnel *tunnel.ServerTunnel, clientIP string) string {
+	t.Helper()
+	clientSide, bridgeSide := net.Pipe()
+	defer clientSide.Close() //nolint:errcheck
+	remote := &net.TCPAddr{IP: net.ParseIP(clientIP), Port: 40000}
+	go serverTunnel.HandleConn(&tcpAddrConn{Conn: bridgeSide, remote: remote})
+	require.NoError(t, clientSide.SetDeadline(time.Now().Add(5*time.Second)))
+	line, err := bufio.NewReader(clientSide).ReadString('\n')
+	require.NoError(t, err)
+	return line
+}
+
+func newBalancedTunnel(t *testing.T, strategy string, targets []config.EnclaveTarget) (*tunnel.ServerTunnel, *fakeEnclaves) {
+	t.Helper()
+	enclaves := newFakeEnclaves(t, targets...)
+	serverTunnel, err := tunnel.NewServerTunnelFromSettings(&config.ServerSettings{
+		Targets:       targets,
+		LoadBalancing: strategy,
+		HealthCheck: config.HealthCheckSettings{
+			Interval:           10 * time.Millisecond,
+			UnhealthyThreshold: 1,
+		},
+	}, zerolog.Nop())
+	require.NoError(t, err)
+	serverTunnel.SetDialFunc(enclaves.dial)
+	t.Cleanup(serverTunnel.Stop)
+	return serverTunnel, enclaves
+}
+
+var testTargets = []config.EnclaveTarget{{CID: 16, Port: 5001}, {CID: 17, Port: 5001}}
+
+func TestServerTunnelRoundRobin(t *testing.T) {
+	t.Parallel()
+	serverTunnel, _ := newBalancedTunnel(t, config.LoadBalancingRoundRobin, testTargets)
+
+	seen := map[string]int{}
+	for range 4 {
+		seen[connectFrom(t, serverTunnel, "10.0.0.1")]++
+	}
+	require.Equal(t, map[string]int{"16:5001\n": 2, "17:5001\n": 2}, seen)
+}
+
+func TestServerTunnelConsistentHash(t *testing.T) {
+	t.Parallel()
+	serverTunnel, _ := newBalancedTunnel(t, config.LoadBalancingConsistentHash, testTargets)
+
+	first := connectFrom(t, serverTunnel, "192.0.2.10")
+	for range 5 {
+		require.Equal(t, first, connectFrom(t, serverTunnel, "192.0.2.10"))
+	}
+}
+
+func TestServerTunnelFailover(t *testing.T) {
+	t.Parallel()
+	serverTunnel, enclaves := newBalancedTunnel(t, config.LoadBalancingRoundRobin, testTargets)
+	enclaves.stop(testTargets[0])
+
+	// Failed dials fall through to the remaining target.
+	for range 3 {
+		require.Equal(t, "17:5001\n", connectFrom(t, serverTunnel, "10.0.0.1"))
+	}
+}
+
+func TestServerTunnelHealthChecks(t *testing.T) {
+	t.Parallel()
+	serverTunnel, enclaves := newBalancedTunnel(t, config.LoadBalancingRoundRobin, testTargets)
+	enclaves.stop(testTargets[0])
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go func() { _ = serverTunnel.RunHealthChecks(ctx) }()
+
+	// Once a health check ejects the stopped target, new connections no longer dial it.
+	require.Eventually(t, func() bool {
+		dials := enclaves.dialCount(testTargets[0])
+		for range 2 {
+			require.Equal(t, "17:5001\n", connectFrom(t, serverTunnel, "10.0.0.1"))
+		}
+		return dials == enclaves.dialCount(testTargets[0])
+	}, time.Second, 20*time.Millisecond)
+}
+
+func TestServerTunnelInvalidStrategy(t *testing.T) {
+	t.Parallel()
+	_, err := tunnel.NewServerTunnelFromSettings(&config.ServerSettings{LoadBalancing: "random"}, zerolog.Nop())
+	require.Error(t, err)
+}
+
+func TestServerTunnelSetTargets(t *testing.T) {
+	t.Parallel()
+	blue := config.EnclaveTarget{CID: 16, Port: 5001}
+	green := config.EnclaveTarget{CID: 17, Port: 5001}
+	enclaves := newFakeEnclaves(t, blue, green)
+	serverTunnel := tunnel.NewServerTunnel(blue.CID, blue.Port, zerolog.Nop())
+	serverTunnel.SetDialFunc(enclaves.dial)
+	t.Cleanup(serverTunnel.Stop)
+
+	require.Equal(t, "16:5001\n", connectFrom(t, serverTunnel, "10.0.0.1"))
+	require.NoError(t, serverTunnel.Probe(t.Context(), []config.EnclaveTarget{green}))
+
+	serverTunnel.SetTargets([]config.EnclaveTarget{green})
+	require.Equal(t, green.CID, serverTunnel.CID())
+	require.Equal(t, green.Port, serverTunnel.Port())
+	for range 3 {
+		require.Equal(t, "17:5001\n", connectFrom(t, serverTunnel, "10.0.0.1"))
+	}
+
+	enclaves.stop(green)
+	require.Error(t, serverTunnel.Probe(t.Context(), []config.EnclaveTarget{green}))
+}
@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
+)
+
+// sniPeekTimeout is how long the enclave has to send its ClientHello after the ACK.
+const sniPeekTimeout = 10 * time.Second
+
+// errClientHelloRead aborts the TLS handshake used to parse the ClientHello.
+var errClientHelloRead = errors.New("client hello read")
+
+// sniFilter checks the server name of connections to TLS ports.
+type sniFilter struct {
+	tlsPorts     []uint16
+	allowedNames []string
+}
+
+// newSNIFilter creates an sniFilter from settings. It returns nil if inspection is disabled.
+func newSNIFilter(settings *config.SNIFilterSettings) *sniFilter {
+	if len(settings.TLSPorts) == 0 {
+		return nil
+	}
+	allowedNames := make([]string, len(settings.AllowedServerNames))
+	for i, name := range settings.AllowedServerNames {
+		allowedNames[i] = strings.ToLower(strings.TrimSuffix(name, "."))
+	}
+	return &sniFilter{tlsPorts: settings.TLSPorts, allowedNames: allowedNames}
+}
+
+// inspects reports whether connections to targetAddress must be inspected.
+// Alias targets are not inspected since their backends are chosen by the bridge operator.
+func (f *sniFilter) inspects(targetAddress string) bool {
+	if f == nil || strings.HasPrefix(targetAddress, enclave.AliasPrefix) {
+		return false
+	}
+	_, portStr, err := net.SplitHostPort(targetAddress)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return false
+	}
+	return slices.Contains(f.tlsPorts, uint16(port))
+}
+
+// inspect reads the ClientHello from conn and checks its server name against the requested target.
+// It returns the server name and the bytes read, which must be forwarded to the target before the rest of conn.
+func (f *sniFilter) inspect(conn net.Conn, targetAddress string) (string, []byte, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(sniPeekTimeout))
+	defer conn.SetReadDeadline(time.Time{}) //nolint:errcheck
+	var peeked bytes.Buffer
+	serverName, err := readServerName(io.TeeReader(conn, &peeked))
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %w", ErrSNINotAllowed, err)
+	}
+	host, _, _ := net.SplitHostPort(targetAddress)
+	if err := f.check(serverName, host); err != nil {
+		return serverName, nil, err
+	}
+	return serverName, peeked.Bytes(), nil
+}
+
+// check verifies that serverName is consistent with the requested host and in the allowlist.
+func (f *sniFilter) check(serverName, host string) error {
+	if serverName == "" {
+		return fmt.Errorf("%w: ClientHello has no server name", ErrSNINotAllowed)
+	}
+	serverName = strings.ToLower(serverName)
+	if net.ParseIP(host) == nil && !strings.EqualFold(strings.TrimSuffix(host, "."), serverName) {
+		return fmt.Errorf("%w: %q does not match requested host %q", ErrSNINotAllowed, serverName, host)
+	}
+	if len(f.allowedNames) == 0 {
+		return nil
+	}
+	for _, allowed := range f.allowedNames {
+		if serverName == allowed {
+			return nil
+		}
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok && strings.HasSuffix(serverName, suffix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q", ErrSNINotAllowed, serverName)
+}
+
+// readServerName parses a TLS ClientHello from r and returns its server name.
+// The handshake is run against a connection that can not be written to and aborted once the ClientHello is parsed.
+func readServerName(r io.Reader) (string, error) {
+	var serverName string
+	err := tls.Server(readOnlyConn{reader: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errClientHelloRead) {
+		return "", fmt.Errorf("failed to read TLS ClientHello: %w", err)
+	}
+	return serverName, nil
+}
+
+// readOnlyConn is a net.Conn that reads from reader and fails every write,
+// so the aborted handshake sends nothing to the enclave.
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)     { return c.reader.Read(p) }
+func (readOnlyConn) Write([]byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (readOnlyConn) Close() error                     { return nil }
+func (readOnlyConn) LocalAddr() net.Addr              { return nil }
+func (readOnlyConn) RemoteAddr() net.Addr             { return nil }
+func (readOnlyConn) SetDeadline(time.Time) error      { return nil }
+func (readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
+func (readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,101 @@
+package tunnel_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/audit"
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tunnel"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientTunnelSNIFilter(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	t.Cleanup(server.Close)
+	_, portStr, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	for _, tc := range []struct {
+		name       string
+		target     string
+		serverName string
+		allowed    []string
+		plaintext  bool
+		violation  bool
+	}{
+		// httptest certificates are issued for example.com and its subdomains.
+		{name: "allowed", target: "127.0.0.1:" + portStr, serverName: "example.com", allowed: []string{"example.com"}},
+		{name: "allowed wildcard", target: "127.0.0.1:" + portStr, serverName: "api.example.com", allowed: []string{"*.example.com"}},
+		{name: "not allowed", target: "127.0.0.1:" + portStr, serverName: "example.com", allowed: []string{"*.example.com"}, violation: true},
+		{name: "host mismatch", target: "localhost:" + portStr, serverName: "example.com", violation: true},
+		{name: "not TLS", target: "127.0.0.1:" + portStr, plaintext: true, violation: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			clientTunnel, err := tunnel.NewClientTunnelFromSettings(&config.ClientSettings{
+				SNIFilter: config.SNIFilterSettings{TLSPorts: []uint16{uint16(port)}, AllowedServerNames: tc.allowed},
+			}, zerolog.Nop())
+			require.NoError(t, err)
+			records := make(recordWriter, 1)
+			clientTunnel.SetAuditLog(audit.NewLog(records, ""), "test-app")
+
+			enclaveSide, bridgeSide := net.Pipe()
+			defer enclaveSide.Close() //nolint:errcheck
+			go clientTunnel.HandleConn(t.Context(), bridgeSide)
+			require.NoError(t, enclaveSide.SetDeadline(time.Now().Add(5*time.Second)))
+			_, err = enclaveSide.Write([]byte(tc.target + "\n"))
+			require.NoError(t, err)
+			ack := make([]byte, len(enclave.ACK))
+			_, err = io.ReadFull(enclaveSide, ack)
+			require.NoError(t, err)
+
+			var conn net.Conn = enclaveSide
+			if !tc.plaintext {
+				conn = tls.Client(enclaveSide, &tls.Config{ServerName: tc.serverName, RootCAs: roots, MinVersion: tls.VersionTLS12})
+			}
+			req, err := http.NewRequest(http.MethodGet, "/", nil)
+			require.NoError(t, err)
+			// net.Pipe writes block until read, so the request is written concurrently.
+			go func() { _ = req.Write(conn) }()
+			resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+			if tc.violation {
+				require.Error(t, err)
+				record := readAuditRecord(t, records)
+				require.Equal(t, audit.OutcomePolicyViolation, record.Outcome)
+				require.Contains(t, record.Error, tunnel.ErrSNINotAllowed.Error())
+				return
+			}
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, "ok", string(body))
+		})
+	}
+}
+
+func TestClientTunnelSNIFilterIgnoresOtherPorts(t *testing.T) {
+	t.Parallel()
+	clientTunnel, err := tunnel.NewClientTunnelFromSettings(&config.ClientSettings{
+		SNIFilter: config.SNIFilterSettings{TLSPorts: []uint16{443}},
+	}, zerolog.Nop())
+	require.NoError(t, err)
+	roundTrip(t, clientTunnel, startPingServer(t))
+}
@@ -4,21 +4,28 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/DIMO-Network/enclave-bridge/pkg/enclave"
+	"github.com/DIMO-Network/enclave-bridge/pkg/logs"
 	"github.com/mdlayher/vsock"
 	"github.com/rs/zerolog"
 )
 
-// StdoutTunnel is a tunnel that copies data from the vsock connection to stdout.
+// StdoutTunnel forwards log lines from enclaves to a sink, which writes JSON to stdout by default.
+// Every line is parsed into a logs.Entry with the CID and app name of the enclave and the connection it was
+// received on, so lines from concurrent connections are never interleaved and can be told apart.
 type StdoutTunnel struct {
-	port   uint32
-	logger *zerolog.Logger
-	pool   sync.Pool
+	port          uint32
+	logger        *zerolog.Logger
+	sink          logs.Sink
+	maxLineLength int
+	appNames      sync.Map
+	connIDs       atomic.Uint64
 }
 
 // Port returns the port of the ClientTunnel.
@@ -28,22 +35,52 @@ func (c *StdoutTunnel) Port() uint32 {
 
 // NewStdoutTunnel creates a new StdoutTunnel.
 func NewStdoutTunnel(port uint32, logger zerolog.Logger) *StdoutTunnel {
+	formatter, _ := logs.NewFormatter(logs.FormatJSON)
 	return &StdoutTunnel{
-		port:   port,
-		logger: &logger,
-		pool:   sync.Pool{New: func() any { b := make([]byte, bufSize); return &b }},
+		port:          port,
+		logger:        &logger,
+		sink:          logs.NewWriterSink(os.Stdout, formatter),
+		maxLineLength: logs.DefaultMaxLineLength,
 	}
 }
 
-// HandleConn dial a vsock connection and copy data in both directions.
+// SetSink sets the sink that receives the forwarded log entries.
+func (c *StdoutTunnel) SetSink(sink logs.Sink) {
+	c.sink = sink
+}
+
+// SetAppName sets the app name added to log lines from the enclave with the given CID.
+func (c *StdoutTunnel) SetAppName(cid uint32, appName string) {
+	c.appNames.Store(cid, appName)
+}
+
+func (c *StdoutTunnel) appName(cid uint32) string {
+	appName, _ := c.appNames.Load(cid)
+	name, _ := appName.(string)
+	return name
+}
+
+// HandleConn reads log lines from a vsock connection and writes them to the sink.
 func (c *StdoutTunnel) HandleConn(vsockConn net.Conn) {
 	defer vsockConn.Close() //nolint:errcheck
-	buf := c.pool.Get().(*[]byte)
-	defer c.pool.Put(buf)
-	_, err := io.CopyBuffer(os.Stdout, vsockConn, *buf)
+	source := logs.Source{EnclaveCID: EnclaveCID(vsockConn), ConnID: c.connIDs.Add(1)}
+	err := logs.ReadLines(vsockConn, c.maxLineLength, func(line []byte, truncated bool) error {
+		if len(line) == 0 {
+			return nil
+		}
+		// The app name is only known once the enclave completed its handshake.
+		source.AppName = c.appName(source.EnclaveCID)
+		entry := logs.ParseLine(line, source, time.Now())
+		if truncated {
+			entry.Fields[logs.FieldTruncated] = true
+		}
+		if err := c.sink.WriteEntry(entry); err != nil {
+			c.logger.Error().Err(err).Msg("Failed to write enclave log line")
+		}
+		return nil
+	})
 	if err != nil {
-		c.logger.Error().Err(err).Msg("Failed to copy data from vsock to stdout")
-		return
+		c.logger.Error().Err(err).Msg("Failed to read log lines from vsock")
 	}
 }
 
@@ -0,0 +1,65 @@
+package tunnel_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/logs"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tunnel"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStdoutTunnelFramesLines(t *testing.T) {
+	t.Parallel()
+	var output bytes.Buffer
+	formatter, err := logs.NewFormatter(logs.FormatJSON)
+	require.NoError(t, err)
+	stdoutTunnel := tunnel.NewStdoutTunnel(4999, zerolog.Nop())
+	stdoutTunnel.SetSink(logs.NewWriterSink(&output, formatter))
+
+	const conns, linesPerConn = 4, 50
+	var wg sync.WaitGroup
+	for i := range conns {
+		enclaveSide, bridgeSide := net.Pipe()
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			stdoutTunnel.HandleConn(bridgeSide)
+		}()
+		go func() {
+			defer wg.Done()
+			defer enclaveSide.Close() //nolint:errcheck
+			for j := range linesPerConn {
+				line := fmt.Sprintf(`{"level":"info","message":"%d-%d %s"}`+"\n", i, j, strings.Repeat("x", 100))
+				// Write every line in pieces so lines are torn if they are not framed.
+				for piece := range strings.SplitSeq(line, " ") {
+					_, _ = enclaveSide.Write([]byte(piece + " "))
+				}
+			}
+			_, _ = enclaveSide.Write([]byte("plain text line\n"))
+		}()
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	require.Len(t, lines, conns*(linesPerConn+1))
+	connIDs := map[float64]int{}
+	for _, line := range lines {
+		var fields map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &fields), line)
+		require.Contains(t, fields, logs.FieldReceivedAt)
+		connID, ok := fields[logs.FieldConnID].(float64)
+		require.True(t, ok)
+		connIDs[connID]++
+	}
+	require.Len(t, connIDs, conns)
+	for _, count := range connIDs {
+		require.Equal(t, linesPerConn+1, count)
+	}
+}
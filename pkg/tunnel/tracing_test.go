@@ -0,0 +1,87 @@
+package tunnel_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/audit"
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/proxyproto"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tracing"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tunnel"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestServerTunnelPropagatesTrace(t *testing.T) {
+	t.Parallel()
+	serverTunnel, err := tunnel.NewServerTunnelFromSettings(&config.ServerSettings{
+		EnclaveCID:        16,
+		EnclaveListenPort: 5001,
+		PropagateTrace:    true,
+	}, zerolog.Nop())
+	require.NoError(t, err)
+	t.Cleanup(serverTunnel.Stop)
+	serverTunnel.SetTracer(sdktrace.NewTracerProvider().Tracer(tracing.ScopeName))
+
+	headers := make(chan *proxyproto.Header, 1)
+	serverTunnel.SetDialFunc(func(context.Context, uint32, uint32) (net.Conn, error) {
+		bridgeSide, enclaveSide := net.Pipe()
+		go func() {
+			defer enclaveSide.Close() //nolint:errcheck
+			reader := bufio.NewReader(enclaveSide)
+			header, err := proxyproto.Read(reader)
+			if err != nil {
+				return
+			}
+			headers <- header
+			_, _ = io.Copy(enclaveSide, reader)
+		}()
+		return bridgeSide, nil
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close() //nolint:errcheck
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer clientConn.Close() //nolint:errcheck
+	bridgeConn, err := listener.Accept()
+	require.NoError(t, err)
+	go serverTunnel.HandleConn(bridgeConn)
+
+	select {
+	case header := <-headers:
+		require.Equal(t, clientConn.LocalAddr().String(), header.Source.String())
+		traceparent, ok := header.TLV(proxyproto.TypeTraceparent)
+		require.True(t, ok)
+		ctx, err := tracing.ContextWithTraceparent(context.Background(), string(traceparent))
+		require.NoError(t, err)
+		require.True(t, trace.SpanContextFromContext(ctx).IsSampled())
+	case <-time.After(5 * time.Second):
+		t.Fatal("no PROXY protocol header received")
+	}
+}
+
+func TestClientTunnelReadsTraceparent(t *testing.T) {
+	t.Parallel()
+	target := startPingServer(t)
+	clientTunnel, err := tunnel.NewClientTunnelFromSettings(&config.ClientSettings{}, zerolog.Nop())
+	require.NoError(t, err)
+	records := make(recordWriter, 2)
+	clientTunnel.SetAuditLog(audit.NewLog(records, ""), "test-app")
+	clientTunnel.SetTracer(sdktrace.NewTracerProvider().Tracer(tracing.ScopeName))
+
+	roundTrip(t, clientTunnel, target+" traceparent=00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	require.Equal(t, target, readAuditRecord(t, records).Target)
+
+	// An invalid trace context does not fail the request.
+	roundTrip(t, clientTunnel, target+" traceparent=invalid")
+	require.Equal(t, target, readAuditRecord(t, records).Target)
+}
@@ -0,0 +1,171 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"golang.org/x/net/proxy"
+)
+
+const defaultDialTimeout = 10 * time.Second
+
+// ContextDialer dials a target address using a context. *net.Dialer implements ContextDialer.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// NewUpstreamDialer returns a dialer that connects to targets through the proxy described by settings.
+// Targets matching settings.NoProxy are dialed with forward directly.
+// If no proxy URL is configured, forward is returned unchanged.
+func NewUpstreamDialer(settings *config.ProxySettings, forward *net.Dialer) (ContextDialer, error) {
+	if settings == nil || settings.URL == "" {
+		return forward, nil
+	}
+	proxyURL, err := url.Parse(settings.URL)
+	if err != nil {
+		// The parse error quotes the URL, which can carry the proxy credentials.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("failed to parse proxy URL: %w", err)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("proxy URL %q is missing a host", proxyURL.Redacted())
+	}
+
+	var upstream proxy.Dialer
+	switch proxyURL.Scheme {
+	case "http", "https":
+		upstream = &httpConnectDialer{proxyURL: proxyURL, forward: forward}
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if proxyURL.User != nil {
+			password, _ := proxyURL.User.Password()
+			auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+		}
+		upstream, err = proxy.SOCKS5("tcp", hostPortWithDefault(proxyURL, "1080"), auth, forward)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create SOCKS5 dialer: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %q", proxyURL.Scheme)
+	}
+
+	if len(settings.NoProxy) == 0 {
+		return upstream.(ContextDialer), nil
+	}
+	perHost := proxy.NewPerHost(upstream, forward)
+	for _, entry := range settings.NoProxy {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "*":
+			// Everything bypasses the proxy.
+			return forward, nil
+		case strings.HasPrefix(entry, "."):
+			perHost.AddZone(entry)
+		default:
+			perHost.AddFromString(entry)
+		}
+	}
+	return perHost, nil
+}
+
+// httpConnectDialer tunnels connections through an HTTP proxy using the CONNECT method.
+type httpConnectDialer struct {
+	proxyURL *url.URL
+	forward  *net.Dialer
+}
+
+// Dial implements proxy.Dialer.
+func (h *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	return h.DialContext(context.Background(), network, addr)
+}
+
+// DialContext dials the proxy and issues a CONNECT request for addr.
+func (h *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	defaultPort := "80"
+	if h.proxyURL.Scheme == "https" {
+		defaultPort = "443"
+	}
+	proxyAddr := hostPortWithDefault(h.proxyURL, defaultPort)
+	conn, err := h.forward.DialContext(ctx, network, proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial proxy %s: %w", proxyAddr, err)
+	}
+	if h.proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: h.proxyURL.Hostname(), MinVersion: tls.VersionTLS12})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed TLS handshake with proxy: %w", err)
+		}
+		conn = tlsConn
+	}
+
+	// Make sure the CONNECT exchange respects the context deadline.
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{}) //nolint:errcheck
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if h.proxyURL.User != nil {
+		password, _ := h.proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(h.proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to write CONNECT request: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		// The proxy already sent bytes from the target, keep them.
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose reads are served from a bufio.Reader first.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read reads from the buffered reader.
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+func hostPortWithDefault(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
@@ -0,0 +1,210 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+)
+
+const (
+	defaultWarmPoolMaxAge = 30 * time.Second
+	// defaultHeaderWarmPoolMaxAge is the default maximum age of idle connections of tunnels that send a header,
+	// which the enclave waits for at most enclave.ClientIdentityTimeout.
+	defaultHeaderWarmPoolMaxAge = 5 * time.Second
+	defaultWarmPoolRetryBackoff = 25 * time.Millisecond
+	maxWarmPoolRetryBackoff     = time.Second
+	// warmPoolRefillInterval is how often pools are checked for expired connections when no connection is taken.
+	warmPoolRefillInterval = time.Second
+)
+
+// pooledConn is an idle pre-dialed vsock connection.
+type pooledConn struct {
+	net.Conn
+	dialedAt time.Time
+}
+
+// warmPool holds idle vsock connections to a single target.
+type warmPool struct {
+	minIdle int
+	maxAge  time.Duration
+	mu      sync.Mutex
+	idle    []pooledConn
+	closed  bool
+}
+
+// newWarmPool creates a pool for a target, or returns nil if the pool is disabled.
+func newWarmPool(settings *config.WarmPoolSettings) *warmPool {
+	if settings.MinIdle <= 0 {
+		return nil
+	}
+	return &warmPool{minIdle: settings.MinIdle, maxAge: settings.MaxAge}
+}
+
+// get returns the oldest live idle connection, closing expired and dead connections on the way.
+// It returns nil if no idle connection is available.
+func (p *warmPool) get() net.Conn {
+	if p == nil {
+		return nil
+	}
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		conn := p.idle[0]
+		p.idle = p.idle[1:]
+		p.mu.Unlock()
+		if time.Since(conn.dialedAt) < p.maxAge && alive(conn.Conn) {
+			return conn.Conn
+		}
+		_ = conn.Close()
+	}
+}
+
+// put adds a connection to the pool. It returns false if the pool is closed or full.
+func (p *warmPool) put(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || len(p.idle) >= p.minIdle {
+		return false
+	}
+	p.idle = append(p.idle, pooledConn{Conn: conn, dialedAt: time.Now()})
+	return true
+}
+
+// missing closes expired connections and returns the number of connections needed to reach minIdle.
+func (p *warmPool) missing() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0
+	}
+	live := p.idle[:0]
+	for _, conn := range p.idle {
+		if time.Since(conn.dialedAt) < p.maxAge {
+			live = append(live, conn)
+		} else {
+			_ = conn.Close()
+		}
+	}
+	clear(p.idle[len(live):])
+	p.idle = live
+	return p.minIdle - len(p.idle)
+}
+
+// close closes the idle connections and stops the pool from accepting new ones.
+func (p *warmPool) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, conn := range p.idle {
+		_ = conn.Close()
+	}
+	p.idle = nil
+}
+
+// alive reports whether an idle connection is still open and has not received data.
+// Connections that do not expose their file descriptor are assumed to be alive.
+func alive(conn net.Conn) bool {
+	syscallConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	rawConn, err := syscallConn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	isAlive := false
+	err = rawConn.Read(func(fd uintptr) bool {
+		var buf [1]byte
+		n, _, err := syscall.Recvfrom(int(fd), buf[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		// Nothing to read means the peer neither closed the connection nor sent data.
+		isAlive = n < 0 && errors.Is(err, syscall.EAGAIN)
+		return true
+	})
+	return err == nil && isAlive
+}
+
+// RunWarmPool keeps the warm pool of every target filled until the context is canceled.
+// If the warm pool is disabled it returns immediately.
+func (v *ServerTunnel) RunWarmPool(ctx context.Context) error {
+	if v.warmPool.MinIdle <= 0 {
+		return nil
+	}
+	ticker := time.NewTicker(warmPoolRefillInterval)
+	defer ticker.Stop()
+	for {
+		v.fillWarmPools(ctx)
+		select {
+		case <-ctx.Done():
+			for _, target := range *v.targets.Load() {
+				target.pool.close()
+			}
+			return nil
+		case <-ticker.C:
+		case <-v.warmPoolRefill:
+		}
+	}
+}
+
+// fillWarmPools dials connections to the healthy targets until each pool has the minimum number of idle connections.
+func (v *ServerTunnel) fillWarmPools(ctx context.Context) {
+	for _, target := range *v.targets.Load() {
+		if target.pool == nil || !target.healthy.Load() {
+			continue
+		}
+		for range target.pool.missing() {
+			conn, err := v.dial(ctx, target.cid, target.port)
+			if err != nil {
+				if ctx.Err() == nil {
+					v.logger.Debug().Err(err).Str("target", target.String()).Msg("Failed to fill warm pool")
+				}
+				break
+			}
+			if !target.pool.put(conn) {
+				_ = conn.Close()
+				break
+			}
+		}
+	}
+}
+
+// dialPooled returns an idle connection to target from its warm pool, or dials one with retries.
+func (v *ServerTunnel) dialPooled(target *serverTarget) (net.Conn, error) {
+	if target.pool != nil {
+		conn := target.pool.get()
+		select {
+		case v.warmPoolRefill <- struct{}{}:
+		default:
+		}
+		if conn != nil {
+			warmPoolCheckoutsTotal.WithLabelValues(v.bridgePort, "hit").Inc()
+			return conn, nil
+		}
+		warmPoolCheckoutsTotal.WithLabelValues(v.bridgePort, "miss").Inc()
+	}
+	backoff := v.warmPool.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		conn, err := v.dial(v.parentCtx, target.cid, target.port)
+		if err == nil || attempt >= v.warmPool.DialRetries {
+			return conn, err
+		}
+		v.logger.Debug().Err(err).Str("target", target.String()).Msgf("Retrying vsock dial in %s", backoff)
+		select {
+		case <-v.parentCtx.Done():
+			return nil, fmt.Errorf("%w: %w", err, v.parentCtx.Err())
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxWarmPoolRetryBackoff)
+	}
+}
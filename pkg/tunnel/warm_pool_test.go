@@ -0,0 +1,224 @@
+package tunnel_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/tunnel"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/require"
+)
+
+// pongEnclave is a stand-in enclave server that answers a line with "pong" once the client has spoken.
+type pongEnclave struct {
+	addr string
+	mu   sync.Mutex
+	// conns are the accepted connections that are still open.
+	conns []net.Conn
+	dials int
+	// failDials is the number of upcoming dials that fail.
+	failDials int
+	refuse    bool
+}
+
+func newPongEnclave(t *testing.T) *pongEnclave {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	enclave := &pongEnclave{addr: listener.Addr().String()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			enclave.mu.Lock()
+			enclave.conns = append(enclave.conns, conn)
+			enclave.mu.Unlock()
+			go func() {
+				defer conn.Close() //nolint:errcheck
+				if _, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+					_, _ = io.WriteString(conn, "pong\n")
+				}
+			}()
+		}
+	}()
+	return enclave
+}
+
+func (p *pongEnclave) dial(ctx context.Context, _, _ uint32) (net.Conn, error) {
+	p.mu.Lock()
+	p.dials++
+	if p.refuse || p.failDials > 0 {
+		p.failDials--
+		p.mu.Unlock()
+		return nil, errors.New("connection refused")
+	}
+	p.mu.Unlock()
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", p.addr)
+}
+
+func (p *pongEnclave) dialCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dials
+}
+
+// closeAll closes every accepted connection from the enclave side.
+func (p *pongEnclave) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.conns = nil
+}
+
+func (p *pongEnclave) setRefuse(refuse bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refuse = refuse
+}
+
+func newPooledTunnel(t *testing.T, enclave *pongEnclave, warmPool config.WarmPoolSettings) *tunnel.ServerTunnel {
+	t.Helper()
+	serverTunnel, err := tunnel.NewServerTunnelFromSettings(&config.ServerSettings{
+		EnclaveCID:        3,
+		EnclaveListenPort: 5001,
+		BridgeTCPPort:     8080,
+		WarmPool:          warmPool,
+	}, zerolog.Nop())
+	require.NoError(t, err)
+	serverTunnel.SetDialFunc(enclave.dial)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serverTunnel.RunWarmPool(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+	return serverTunnel
+}
+
+// ping sends a line through the tunnel and returns the reply.
+func ping(serverTunnel *tunnel.ServerTunnel) (string, error) {
+	client, server := net.Pipe()
+	defer client.Close() //nolint:errcheck
+	go serverTunnel.HandleConn(server)
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(client, "ping\n"); err != nil {
+		return "", err
+	}
+	return bufio.NewReader(client).ReadString('\n')
+}
+
+func TestServerTunnelWarmPool(t *testing.T) {
+	t.Parallel()
+	enclave := newPongEnclave(t)
+	serverTunnel := newPooledTunnel(t, enclave, config.WarmPoolSettings{MinIdle: 2})
+	require.Eventually(t, func() bool { return enclave.dialCount() == 2 }, time.Second, 10*time.Millisecond)
+
+	// Pooled connections are used without dialing.
+	enclave.setRefuse(true)
+	for range 2 {
+		reply, err := ping(serverTunnel)
+		require.NoError(t, err)
+		require.Equal(t, "pong\n", reply)
+	}
+	_, err := ping(serverTunnel)
+	require.Error(t, err)
+
+	// The pool is refilled once dials succeed again.
+	enclave.setRefuse(false)
+	require.Eventually(t, func() bool {
+		enclave.setRefuse(true)
+		defer enclave.setRefuse(false)
+		_, err := ping(serverTunnel)
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+}
+
+func TestServerTunnelWarmPoolSkipsClosedConnections(t *testing.T) {
+	t.Parallel()
+	enclave := newPongEnclave(t)
+	serverTunnel := newPooledTunnel(t, enclave, config.WarmPoolSettings{MinIdle: 2})
+	require.Eventually(t, func() bool { return enclave.dialCount() == 2 }, time.Second, 10*time.Millisecond)
+
+	enclave.closeAll()
+	time.Sleep(50 * time.Millisecond)
+	reply, err := ping(serverTunnel)
+	require.NoError(t, err)
+	require.Equal(t, "pong\n", reply)
+}
+
+func TestServerTunnelWarmPoolMaxAge(t *testing.T) {
+	t.Parallel()
+	enclave := newPongEnclave(t)
+	newPooledTunnel(t, enclave, config.WarmPoolSettings{MinIdle: 1, MaxAge: 100 * time.Millisecond})
+	// Expired connections are replaced by the periodic refill.
+	require.Eventually(t, func() bool { return enclave.dialCount() >= 2 }, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestServerTunnelDialRetries(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name      string
+		retries   int
+		failDials int
+		fails     bool
+	}{
+		{name: "recovers", retries: 2, failDials: 2},
+		{name: "gives up", retries: 1, failDials: 2, fails: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			enclave := newPongEnclave(t)
+			enclave.failDials = tc.failDials
+			serverTunnel := newPooledTunnel(t, enclave, config.WarmPoolSettings{
+				DialRetries:  tc.retries,
+				RetryBackoff: time.Millisecond,
+			})
+			reply, err := ping(serverTunnel)
+			if tc.fails {
+				require.Error(t, err)
+				require.Equal(t, tc.retries+1, enclave.dialCount())
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "pong\n", reply)
+			require.Equal(t, tc.failDials+1, enclave.dialCount())
+		})
+	}
+}
+
+func TestServerTunnelWarmPoolMaxAgeWithHeader(t *testing.T) {
+	t.Parallel()
+	caFile, serverCert := newTestCA(t).writeFiles(t)
+	settings := &config.ServerSettings{
+		EnclaveCID:        16,
+		EnclaveListenPort: 5001,
+		MutualTLS: config.MutualTLSSettings{
+			Enabled:      true,
+			ServerCert:   serverCert,
+			ClientCAFile: caFile,
+		},
+		WarmPool: config.WarmPoolSettings{MinIdle: 1},
+	}
+	serverTunnel, err := tunnel.NewServerTunnelFromSettings(settings, zerolog.Nop())
+	require.NoError(t, err)
+	serverTunnel.Stop()
+
+	// Pooled connections would outlive the enclave's wait for the header written when they are used.
+	settings.WarmPool.MaxAge = 20 * time.Second
+	_, err = tunnel.NewServerTunnelFromSettings(settings, zerolog.Nop())
+	require.Error(t, err)
+}
@@ -0,0 +1,203 @@
+package watchdog
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// HeartbeatVersion is the version of the heartbeat messages sent by this package.
+// Version 0 is the legacy heartbeat that carries only the raw enclave ID.
+const HeartbeatVersion = 1
+
+// HeartbeatVersionEnvVar is the key of the highest heartbeat version the bridge supports in the environment the
+// bridge sends during the handshake. Bridges that do not set it only accept legacy heartbeats.
+// The handshake removes it before the environment is handed to the app.
+const HeartbeatVersionEnvVar = "ENCLAVE_BRIDGE_HEARTBEAT_VERSION"
+
+// legacyHeartbeatLength is the length of a legacy heartbeat without its newline.
+const legacyHeartbeatLength = 16
+
+// State is the health state an enclave declares in its heartbeats.
+type State string
+
+const (
+	// StateStarting is declared while the enclave is not ready to serve yet.
+	StateStarting State = "starting"
+	// StateReady is declared while the enclave is serving normally.
+	StateReady State = "ready"
+	// StateDegraded is declared while the enclave serves with reduced functionality, e.g. a dependency is down.
+	StateDegraded State = "degraded"
+	// StateDraining is declared while the enclave finishes its open work before it stops.
+	StateDraining State = "draining"
+)
+
+// HeartbeatMessage is a heartbeat sent between the enclave and the bridge.
+type HeartbeatMessage struct {
+	// Version is the version of the message format.
+	Version int `json:"v"`
+	// EnclaveID is the ID of the enclave the heartbeat belongs to.
+	EnclaveID uuid.UUID `json:"enclaveId"`
+	// Uptime is the time since the sender's watchdog was created.
+	Uptime time.Duration `json:"uptime"`
+	// AppVersion is the version of the app set with NewStatus.
+	AppVersion string `json:"appVersion,omitempty"`
+	// State is the health state of the sender.
+	State State `json:"state,omitempty"`
+	// MemoryBytes is the memory obtained from the OS by the Go runtime of the sender.
+	MemoryBytes uint64 `json:"memoryBytes"`
+	// Goroutines is the number of goroutines of the sender.
+	Goroutines int `json:"goroutines"`
+	// Custom holds key/values set with Status.Set.
+	Custom map[string]string `json:"custom,omitempty"`
+	// Counter increases with every heartbeat authenticated with a session key, so replayed heartbeats are rejected.
+	Counter uint64 `json:"counter,omitempty"`
+
+	// ReceivedAt is when the heartbeat was received. It is not sent.
+	ReceivedAt time.Time `json:"-"`
+
+	// payload is the encoding the MAC was computed over.
+	payload []byte
+	// mac is the hex encoded MAC that followed the encoding, or nil if the heartbeat was not authenticated.
+	mac []byte
+}
+
+// ParseHeartbeat parses a heartbeat line without its newline. Legacy heartbeats are returned with version 0
+// and only the enclave ID set. The MAC of an authenticated heartbeat is kept for the watchdog to verify.
+func ParseHeartbeat(line []byte) (*HeartbeatMessage, error) {
+	if len(line) == legacyHeartbeatLength {
+		enclaveID, err := uuid.FromBytes(line)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidHeartbeat, err)
+		}
+		return &HeartbeatMessage{EnclaveID: enclaveID}, nil
+	}
+	line, mac := splitMAC(line)
+	message := HeartbeatMessage{payload: line, mac: mac}
+	if err := json.Unmarshal(line, &message); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidHeartbeat, err)
+	}
+	if message.Version < 1 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidHeartbeat, message.Version)
+	}
+	return &message, nil
+}
+
+// splitMAC splits an authenticated heartbeat into its encoding and the MAC that follows it after a space.
+// The MAC is nil if the line does not end in a hex encoded MAC after a JSON object, e.g. a space in a status value.
+func splitMAC(line []byte) ([]byte, []byte) {
+	i := len(line) - macLength - 1
+	if i <= 0 || line[i] != ' ' {
+		return line, nil
+	}
+	payload, mac := line[:i], line[i+1:]
+	if _, err := hex.DecodeString(string(mac)); err != nil || !json.Valid(payload) {
+		return line, nil
+	}
+	return payload, mac
+}
+
+// Encode encodes the heartbeat as a line in the format of version, which is the legacy format if it is 0.
+func (m *HeartbeatMessage) Encode(version int) ([]byte, error) {
+	if version == 0 {
+		return append(m.EnclaveID.Bytes(), '\n'), nil
+	}
+	message := *m
+	message.Version = version
+	encoded, err := json.Marshal(&message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode heartbeat: %w", err)
+	}
+	return append(encoded, '\n'), nil
+}
+
+// encodeSigned encodes the heartbeat in the current version followed by a space and its MAC under key.
+func (m *HeartbeatMessage) encodeSigned(key []byte) ([]byte, error) {
+	encoded, err := m.Encode(HeartbeatVersion)
+	if err != nil {
+		return nil, err
+	}
+	payload := encoded[:len(encoded)-1]
+	mac := signHeartbeat(key, payload)
+	line := append(payload, ' ')
+	line = append(line, mac...)
+	return append(line, '\n'), nil
+}
+
+// Status is the app version, health state and custom key/values an enclave reports in its heartbeats.
+// It is safe for concurrent use.
+type Status struct {
+	appVersion string
+
+	mu     sync.Mutex
+	state  State
+	custom map[string]string
+}
+
+// NewStatus creates a status for appVersion in StateStarting. Set StateReady once the enclave serves.
+func NewStatus(appVersion string) *Status {
+	return &Status{
+		appVersion: appVersion,
+		state:      StateStarting,
+		custom:     map[string]string{},
+	}
+}
+
+// SetState sets the health state reported with the next heartbeat.
+func (s *Status) SetState(state State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+}
+
+// State returns the current health state.
+func (s *Status) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Set sets a custom key/value reported with the next heartbeat. Values that parse as numbers are exported as
+// metrics by the bridge if it lists the key in ENCLAVE_BRIDGE_HEARTBEAT_METRIC_KEYS.
+func (s *Status) Set(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.custom[key] = value
+}
+
+// Delete removes a custom key/value.
+func (s *Status) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.custom, key)
+}
+
+// newHeartbeatMessage describes the current process. Without a status the sender is reported as ready.
+func newHeartbeatMessage(enclaveID uuid.UUID, startedAt time.Time, status *Status) *HeartbeatMessage {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	message := &HeartbeatMessage{
+		Version:     HeartbeatVersion,
+		EnclaveID:   enclaveID,
+		Uptime:      time.Since(startedAt),
+		State:       StateReady,
+		MemoryBytes: memStats.Sys,
+		Goroutines:  runtime.NumGoroutine(),
+	}
+	if status != nil {
+		status.mu.Lock()
+		message.AppVersion = status.appVersion
+		message.State = status.state
+		if len(status.custom) > 0 {
+			message.Custom = maps.Clone(status.custom)
+		}
+		status.mu.Unlock()
+	}
+	return message
+}
@@ -0,0 +1,14 @@
+package watchdog
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "enclave_bridge"
+
+var rejectedHeartbeatsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "watchdog_rejected_heartbeats_total",
+	Help:      "Number of heartbeats rejected by the watchdog by reason.",
+}, []string{"reason"})
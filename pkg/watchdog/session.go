@@ -0,0 +1,90 @@
+package watchdog
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/gofrs/uuid"
+)
+
+// SessionKeyEnvVar is the key of the bridge's session public key in the environment the bridge sends during the
+// handshake. The handshake removes it before the environment is handed to the app.
+const SessionKeyEnvVar = "ENCLAVE_BRIDGE_WATCHDOG_SESSION_KEY"
+
+// sessionKeyLength is the length of the session key and of the keys derived from it.
+const sessionKeyLength = 32
+
+// macLength is the length of the hex encoded MAC that follows an authenticated heartbeat.
+var macLength = hex.EncodedLen(sha256.Size)
+
+// Labels of the keys derived from the session key, so heartbeats of one side can not be reflected to it.
+const (
+	enclaveKeyLabel = "enclave heartbeats"
+	bridgeKeyLabel  = "bridge heartbeats"
+)
+
+// KeyExchange is one side of the X25519 key exchange that establishes the session key of the heartbeats.
+// The bridge sends its public key in the environment and the enclave sends its public key in the watchdog settings.
+type KeyExchange struct {
+	privateKey *ecdh.PrivateKey
+}
+
+// NewKeyExchange generates a new key pair for a handshake.
+func NewKeyExchange() (*KeyExchange, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session key pair: %w", err)
+	}
+	return &KeyExchange{privateKey: privateKey}, nil
+}
+
+// PublicKey returns the public key sent to the peer.
+func (k *KeyExchange) PublicKey() []byte {
+	return k.privateKey.PublicKey().Bytes()
+}
+
+// SessionKey derives the session key shared with the owner of peerPublicKey for the heartbeats of enclaveID.
+func (k *KeyExchange) SessionKey(peerPublicKey []byte, enclaveID uuid.UUID) ([]byte, error) {
+	publicKey, err := ecdh.X25519().NewPublicKey(peerPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid session public key: %w", err)
+	}
+	secret, err := k.privateKey.ECDH(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret: %w", err)
+	}
+	key, err := hkdf.Key(sha256.New, secret, enclaveID.Bytes(), "enclave-bridge watchdog", sessionKeyLength)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive session key: %w", err)
+	}
+	return key, nil
+}
+
+// WithSessionKey authenticates heartbeats with a session key established during the handshake.
+// Heartbeats are sent with a MAC and a counter, and received heartbeats without a valid MAC or with a counter that
+// is not greater than the last one are rejected by HandleConn without failing the watchdog.
+func WithSessionKey(key []byte) Option {
+	return func(w *Watchdog) {
+		w.enclaveKey = deriveKey(key, enclaveKeyLabel)
+		w.bridgeKey = deriveKey(key, bridgeKeyLabel)
+	}
+}
+
+// deriveKey derives the key of one direction from the session key.
+func deriveKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// signHeartbeat returns the hex encoded MAC of an encoded heartbeat without its newline.
+func signHeartbeat(key, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return hex.AppendEncode(nil, mac.Sum(nil))
+}
@@ -0,0 +1,177 @@
+package watchdog_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DIMO-Network/enclave-bridge/pkg/config"
+	"github.com/DIMO-Network/enclave-bridge/pkg/watchdog"
+	"github.com/gofrs/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// exchangeSessionKeys runs the key exchange of a handshake and returns the session keys of both sides.
+func exchangeSessionKeys(t *testing.T, enclaveID uuid.UUID) ([]byte, []byte) {
+	t.Helper()
+	bridgeExchange, err := watchdog.NewKeyExchange()
+	require.NoError(t, err)
+	enclaveExchange, err := watchdog.NewKeyExchange()
+	require.NoError(t, err)
+	bridgeKey, err := bridgeExchange.SessionKey(enclaveExchange.PublicKey(), enclaveID)
+	require.NoError(t, err)
+	enclaveKey, err := enclaveExchange.SessionKey(bridgeExchange.PublicKey(), enclaveID)
+	require.NoError(t, err)
+	return bridgeKey, enclaveKey
+}
+
+// captureHeartbeat returns the first heartbeat line a client side watchdog sends.
+func captureHeartbeat(t *testing.T, dog *watchdog.Watchdog) []byte {
+	t.Helper()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	enclaveSide, testSide := net.Pipe()
+	defer testSide.Close() //nolint:errcheck
+	go func() {
+		_ = dog.StartClientSide(ctx, func() (net.Conn, error) {
+			return enclaveSide, nil
+		})
+	}()
+	require.NoError(t, testSide.SetReadDeadline(time.Now().Add(2*time.Second)))
+	line, err := bufio.NewReader(testSide).ReadBytes('\n')
+	require.NoError(t, err)
+	return line
+}
+
+func TestSessionKeyExchange(t *testing.T) {
+	t.Parallel()
+	enclaveID := uuid.Must(uuid.NewV4())
+	bridgeKey, enclaveKey := exchangeSessionKeys(t, enclaveID)
+	require.Equal(t, bridgeKey, enclaveKey)
+	require.Len(t, bridgeKey, 32)
+
+	otherKey, _ := exchangeSessionKeys(t, enclaveID)
+	require.NotEqual(t, bridgeKey, otherKey)
+
+	keyExchange, err := watchdog.NewKeyExchange()
+	require.NoError(t, err)
+	_, err = keyExchange.SessionKey([]byte("short"), enclaveID)
+	require.Error(t, err)
+}
+
+func TestWatchdogAuthenticatedHeartbeats(t *testing.T) {
+	t.Parallel()
+	interval := 100 * time.Millisecond
+	enclaveID := uuid.Must(uuid.NewV4())
+	bridgeKey, enclaveKey := exchangeSessionKeys(t, enclaveID)
+	settings := &config.WatchdogSettings{EnclaveID: enclaveID, Interval: interval}
+	dog, err := watchdog.New(settings, watchdog.WithSessionKey(bridgeKey))
+	require.NoError(t, err)
+	// A status value that looks like the end of the encoding does not hide the MAC.
+	status := watchdog.NewStatus("v1")
+	status.Set("k", "} x")
+	enclaveDog, err := watchdog.New(settings, watchdog.WithSessionKey(enclaveKey), watchdog.WithStatus(status))
+	require.NoError(t, err)
+	require.True(t, dog.Authenticated())
+	unauthenticated, err := watchdog.New(settings)
+	require.NoError(t, err)
+	require.False(t, unauthenticated.Authenticated())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- dog.StartServerSide(ctx, listener)
+	}()
+	go func() {
+		errCh <- enclaveDog.StartClientSide(ctx, func() (net.Conn, error) {
+			return net.Dial("tcp", listener.Addr().String())
+		})
+	}()
+
+	require.Eventually(t, func() bool {
+		return dog.LastHeartbeat() != nil && dog.LastHeartbeat().Counter > 1 &&
+			enclaveDog.LastHeartbeat() != nil && enclaveDog.LastHeartbeat().Counter > 1
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, watchdog.HeartbeatVersion, enclaveDog.LastHeartbeat().Version)
+	require.Equal(t, "} x", dog.LastHeartbeat().Custom["k"])
+	require.Empty(t, errCh)
+}
+
+func TestWatchdogRejectsForgedHeartbeats(t *testing.T) {
+	t.Parallel()
+	enclaveID := uuid.Must(uuid.NewV4())
+	bridgeKey, enclaveKey := exchangeSessionKeys(t, enclaveID)
+	// The long interval keeps the bridge side from sending heartbeats on the unbuffered pipes.
+	dog, err := watchdog.New(&config.WatchdogSettings{EnclaveID: enclaveID, Interval: 10 * time.Second},
+		watchdog.WithSessionKey(bridgeKey))
+	require.NoError(t, err)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- dog.Run(t.Context())
+	}()
+	handle := func(lines ...[]byte) error {
+		bridgeSide, enclaveSide := net.Pipe()
+		result := make(chan error, 1)
+		go func() {
+			result <- dog.HandleConn(t.Context(), bridgeSide)
+		}()
+		for _, line := range lines {
+			if _, err := enclaveSide.Write(line); err != nil {
+				break
+			}
+		}
+		_ = enclaveSide.Close()
+		select {
+		case err := <-result:
+			return err
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout waiting for HandleConn to return")
+			return nil
+		}
+	}
+
+	enclaveDog, err := watchdog.New(&config.WatchdogSettings{EnclaveID: enclaveID, Interval: 50 * time.Millisecond},
+		watchdog.WithSessionKey(enclaveKey))
+	require.NoError(t, err)
+	signed := captureHeartbeat(t, enclaveDog)
+	unsigned, err := (&watchdog.HeartbeatMessage{EnclaveID: enclaveID, Counter: 100}).Encode(watchdog.HeartbeatVersion)
+	require.NoError(t, err)
+	forged := append(unsigned[:len(unsigned)-1:len(unsigned)-1], []byte(" "+strings.Repeat("0", 64)+"\n")...)
+
+	require.ErrorIs(t, handle(append(enclaveID.Bytes(), '\n')), watchdog.ErrUnauthenticatedHeartbeat)
+	require.ErrorIs(t, handle(unsigned), watchdog.ErrUnauthenticatedHeartbeat)
+	require.ErrorIs(t, handle(forged), watchdog.ErrInvalidHeartbeatMAC)
+	require.Nil(t, dog.LastHeartbeat())
+
+	require.NoError(t, handle(signed))
+	require.NotNil(t, dog.LastHeartbeat())
+	require.ErrorIs(t, handle(signed), watchdog.ErrHeartbeatReplay)
+
+	// Heartbeats signed for the bridge side are not accepted from the enclave side.
+	bridgeDog, err := watchdog.New(&config.WatchdogSettings{EnclaveID: enclaveID, Interval: 50 * time.Millisecond},
+		watchdog.WithSessionKey(enclaveKey))
+	require.NoError(t, err)
+	reflected, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		_ = bridgeDog.StartServerSide(t.Context(), reflected)
+	}()
+	conn, err := net.Dial("tcp", reflected.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+	_, err = conn.Write(signed)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	bridgeLine, err := bufio.NewReader(conn).ReadBytes('\n')
+	require.NoError(t, err)
+	require.ErrorIs(t, handle(bridgeLine), watchdog.ErrInvalidHeartbeatMAC)
+
+	// Rejected heartbeats do not fail the watchdog.
+	require.Empty(t, errCh)
+}
@@ -1,9 +1,13 @@
 package watchdog
 
 import (
+	"bufio"
 	"context"
+	"crypto/hmac"
+	"errors"
 	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/DIMO-Network/enclave-bridge/pkg/config"
@@ -25,27 +29,100 @@ const (
 	ErrEnclaveHeartbeatTimeout = WatchdogError("enclave heartbeat timeout")
 	// ErrEnclaveIDMismatch is returned when the enclave ID doesn't match the expected ID.
 	ErrEnclaveIDMismatch = WatchdogError("enclave ID mismatch")
+	// ErrInvalidHeartbeat is returned when a heartbeat can not be parsed.
+	ErrInvalidHeartbeat = WatchdogError("invalid heartbeat")
+	// ErrUnauthenticatedHeartbeat is returned when a heartbeat has no MAC although a session key is set.
+	ErrUnauthenticatedHeartbeat = WatchdogError("unauthenticated heartbeat")
+	// ErrInvalidHeartbeatMAC is returned when the MAC of a heartbeat does not match the session key.
+	ErrInvalidHeartbeatMAC = WatchdogError("invalid heartbeat MAC")
+	// ErrHeartbeatReplay is returned when the counter of a heartbeat is not greater than the last one received.
+	ErrHeartbeatReplay = WatchdogError("heartbeat replayed")
 )
 
+// Option configures a Watchdog.
+type Option func(*Watchdog)
+
+// WithStatus reports the app version, health state and custom key/values of status in every heartbeat.
+func WithStatus(status *Status) Option {
+	return func(w *Watchdog) {
+		w.status = status
+	}
+}
+
+// WithHeartbeatVersion sets the highest heartbeat version the peer advertised during the handshake.
+// The client side sends heartbeats in this version, and legacy heartbeats without this option, so enclaves keep
+// working with bridges that only accept legacy heartbeats.
+func WithHeartbeatVersion(version int) Option {
+	return func(w *Watchdog) {
+		w.peerMaxVersion = min(version, HeartbeatVersion)
+	}
+}
+
 // Watchdog is a struct that handles the enclave watchdog.
 type Watchdog struct {
 	enclaveID    uuid.UUID
 	interval     time.Duration
 	ticker       *time.Ticker
 	watchErrChan chan error
+	startedAt    time.Time
+	status       *Status
+	missedBeats  int
+	gracePeriod  time.Duration
+	// missed counts the intervals without a heartbeat since the last one.
+	missed atomic.Int32
+	// clientSide sends heartbeats in peerMaxVersion, while the server side answers in the version of the peer.
+	clientSide     bool
+	peerMaxVersion int
+	lastHeartbeat  atomic.Pointer[HeartbeatMessage]
+	// enclaveKey and bridgeKey authenticate the heartbeats sent by each side if a session key is set.
+	enclaveKey []byte
+	bridgeKey  []byte
+	// sentCounter and receivedCounter are the counters of the last authenticated heartbeats sent and received.
+	sentCounter     atomic.Uint64
+	receivedCounter atomic.Uint64
 }
 
 // New creates a new watchdog.
-func New(settings *config.WatchdogSettings) (*Watchdog, error) {
+func New(settings *config.WatchdogSettings, opts ...Option) (*Watchdog, error) {
 	if settings.EnclaveID == uuid.Nil {
 		return nil, ErrEnclaveIDRequired
 	}
-	return &Watchdog{
+	watchdog := &Watchdog{
 		enclaveID:    settings.EnclaveID,
 		interval:     settings.Interval,
 		ticker:       time.NewTicker(settings.Interval),
 		watchErrChan: make(chan error),
-	}, nil
+		startedAt:    time.Now(),
+		missedBeats:  max(settings.MissedBeats, 1),
+		gracePeriod:  settings.StartupGracePeriod,
+	}
+	for _, opt := range opts {
+		opt(watchdog)
+	}
+	return watchdog, nil
+}
+
+// LastHeartbeat returns the last heartbeat received from the peer, or nil if none was received yet.
+func (w *Watchdog) LastHeartbeat() *HeartbeatMessage {
+	return w.lastHeartbeat.Load()
+}
+
+// Authenticated reports whether heartbeats are authenticated with a session key.
+func (w *Watchdog) Authenticated() bool {
+	return w.enclaveKey != nil
+}
+
+// EnclaveID returns the ID of the enclave the watchdog expects heartbeats from.
+func (w *Watchdog) EnclaveID() uuid.UUID {
+	return w.enclaveID
+}
+
+// Run runs the watchdog for connections that are passed to HandleConn by the caller.
+// It returns an error if no heartbeat is received within the configured number of intervals or a heartbeat has the
+// wrong enclave ID. If the context is cancelled, the watchdog will stop without error. Run can be called again
+// after it failed to keep watching.
+func (w *Watchdog) Run(ctx context.Context) error {
+	return w.startTicker(ctx)
 }
 
 // StartServerSide starts the watchdog. The Watchdog will return an error if the accepted connection from the listener is not the correct enclave ID.
@@ -58,11 +135,18 @@ func (w *Watchdog) StartServerSide(ctx context.Context, listener net.Listener) e
 		for {
 			conn, err := listener.Accept()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
 				logger.Error().Err(err).Msg("failed to accept connection")
 				continue
 			}
 			// asynchronously handle the connection since we are the server.
-			go w.HandleConn(ctx, conn)
+			go func() {
+				if err := w.HandleConn(ctx, conn); err != nil {
+					logger.Warn().Err(err).Msg("watchdog connection closed")
+				}
+			}()
 		}
 	}()
 	return w.startTicker(ctx)
@@ -71,8 +155,11 @@ func (w *Watchdog) StartServerSide(ctx context.Context, listener net.Listener) e
 // StartClientSide starts the watchdog. The Watchdog will return an error if the accepted connection from the listener is not the correct enclave ID.
 // Or if no connection sends a heartbeat within the interval.
 // If the context is cancelled, the watchdog will stop without error.
+// The client side sends heartbeats in the version set with WithHeartbeatVersion, while the server side answers in
+// the version it receives, so enclaves and bridges built with older versions of this package keep working.
 func (w *Watchdog) StartClientSide(ctx context.Context, dial func() (net.Conn, error)) error {
 	logger := zerolog.Ctx(ctx).With().Str("component", "watchdog").Logger()
+	w.clientSide = true
 
 	retryBackoff := backoff.ExponentialBackOff{
 		InitialInterval:     time.Millisecond * 100,
@@ -82,7 +169,7 @@ func (w *Watchdog) StartClientSide(ctx context.Context, dial func() (net.Conn, e
 	}
 
 	go func() {
-		for {
+		for ctx.Err() == nil {
 			watchDogConn, err := dial()
 			if err != nil {
 				logger.Error().Err(err).Msg("watchdog client dial failed")
@@ -93,56 +180,194 @@ func (w *Watchdog) StartClientSide(ctx context.Context, dial func() (net.Conn, e
 			// Reset backoff on successful connection
 			retryBackoff.Reset()
 			// synchronously handle the connection since we are the one that initiated the connection.
-			w.HandleConn(ctx, watchDogConn)
+			if err := w.HandleConn(ctx, watchDogConn); err != nil {
+				logger.Warn().Err(err).Msg("watchdog connection closed")
+			}
 			watchDogConn.Close() //nolint:errcheck
 		}
 	}()
 	return w.startTicker(ctx)
 }
 
-// Start starts the watchdog.
+// Start starts the watchdog. It fails once missedBeats intervals in a row pass without a heartbeat; intervals
+// that start within the startup grace period after the watchdog was created are not counted, also when it is run again.
 func (w *Watchdog) startTicker(ctx context.Context) error {
+	logger := zerolog.Ctx(ctx).With().Str("component", "watchdog").Logger()
+	graceUntil := w.startedAt.Add(w.gracePeriod)
+	w.missed.Store(0)
 	w.ticker.Reset(w.interval)
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
-		case <-w.ticker.C:
-			return fmt.Errorf("%w: no heartbeat within %s", ErrEnclaveHeartbeatTimeout, w.interval)
+		case now := <-w.ticker.C:
+			if now.Add(-w.interval).Before(graceUntil) {
+				continue
+			}
+			missed := int(w.missed.Add(1))
+			if missed >= w.missedBeats {
+				return fmt.Errorf("%w: no heartbeat within %s", ErrEnclaveHeartbeatTimeout, time.Duration(missed)*w.interval)
+			}
+			logger.Warn().Msgf("missed heartbeat %d of %d", missed, w.missedBeats)
 		case watchErr := <-w.watchErrChan:
 			return watchErr
 		}
 	}
 }
 
-// HandleConn handles a connection from the enclave.
-func (w *Watchdog) HandleConn(ctx context.Context, conn net.Conn) {
+// HandleConn handles a connection from the enclave. It returns nil when the connection or the context is closed,
+// and the reason otherwise.
+// Without a session key, a heartbeat that can not be parsed or has the wrong enclave ID also fails the watchdog.
+// With a session key, heartbeats that fail authentication only close the connection and are reported with
+// ErrUnauthenticatedHeartbeat, ErrInvalidHeartbeatMAC or ErrHeartbeatReplay, so a process that knows the enclave
+// ID can neither keep the watchdog alive nor make it fail.
+func (w *Watchdog) HandleConn(ctx context.Context, conn net.Conn) error {
 	defer conn.Close() //nolint:errcheck
+	var peerVersion atomic.Int64
 	go func() {
-		err := Heartbeat(ctx, append(w.enclaveID.Bytes(), '\n'), conn, w.interval)
+		err := w.sendHeartbeats(ctx, conn, &peerVersion)
 		if err != nil {
 			logger := zerolog.Ctx(ctx).With().Str("component", "watchdog").Logger()
 			logger.Error().Err(err).Msg("watchdog heartbeat failed")
 		}
 	}()
+	// Lines are read through one buffered reader, so heartbeats that arrive together are not lost.
+	reader := bufio.NewReader(conn)
 	for {
-		enclaveID, err := enclave.ReadBytesWithContext(ctx, conn, '\n')
+		line, err := readHeartbeatLine(ctx, reader)
 		if err != nil {
 			// This will error if something happens to the connection or the context is cancelled
 			// In either case, we don't need to do anything.
-			return
+			return nil
 		}
-		// Remove the newline character
-		enclaveID = enclaveID[:len(enclaveID)-1]
-		if w.enclaveID != uuid.FromBytesOrNil(enclaveID) {
-			w.watchErrChan <- fmt.Errorf("%w: got %v, expected %v",
-				ErrEnclaveIDMismatch, uuid.FromBytesOrNil(enclaveID), w.enclaveID)
-			return
+		message, err := ParseHeartbeat(line)
+		if err == nil {
+			err = w.authenticate(message)
 		}
+		if err == nil && w.enclaveID != message.EnclaveID {
+			err = fmt.Errorf("%w: got %v, expected %v", ErrEnclaveIDMismatch, message.EnclaveID, w.enclaveID)
+		}
+		if err != nil {
+			rejectedHeartbeatsTotal.WithLabelValues(rejectReason(err)).Inc()
+			if w.enclaveKey == nil {
+				select {
+				case w.watchErrChan <- err:
+				case <-ctx.Done():
+				}
+			}
+			return err
+		}
+		message.ReceivedAt = time.Now()
+		w.lastHeartbeat.Store(message)
+		peerVersion.Store(int64(min(message.Version, HeartbeatVersion)))
+		w.missed.Store(0)
 		w.ticker.Reset(w.interval)
 	}
 }
 
+// authenticate verifies the MAC and counter of a heartbeat from the peer if a session key is set.
+// Counters are tracked across connections, so heartbeats captured on one connection can not be replayed on another.
+func (w *Watchdog) authenticate(message *HeartbeatMessage) error {
+	if w.enclaveKey == nil {
+		return nil
+	}
+	key := w.enclaveKey
+	if w.clientSide {
+		key = w.bridgeKey
+	}
+	if message.mac == nil {
+		return ErrUnauthenticatedHeartbeat
+	}
+	if !hmac.Equal(message.mac, signHeartbeat(key, message.payload)) {
+		return ErrInvalidHeartbeatMAC
+	}
+	for {
+		last := w.receivedCounter.Load()
+		if message.Counter <= last {
+			return fmt.Errorf("%w: counter %d is not greater than %d", ErrHeartbeatReplay, message.Counter, last)
+		}
+		if w.receivedCounter.CompareAndSwap(last, message.Counter) {
+			return nil
+		}
+	}
+}
+
+// rejectReason returns the reason label of a rejected heartbeat.
+func rejectReason(err error) string {
+	switch {
+	case errors.Is(err, ErrUnauthenticatedHeartbeat):
+		return "unauthenticated"
+	case errors.Is(err, ErrInvalidHeartbeatMAC):
+		return "invalid_mac"
+	case errors.Is(err, ErrHeartbeatReplay):
+		return "replay"
+	case errors.Is(err, ErrEnclaveIDMismatch):
+		return "enclave_id_mismatch"
+	default:
+		return "invalid"
+	}
+}
+
+// sendHeartbeats sends a heartbeat every half interval, in the version the peer advertised on the client side and
+// in the last version received from the peer on the server side. Heartbeats authenticated with a session key are
+// always sent in the current version, since only peers that support it establish a session key.
+func (w *Watchdog) sendHeartbeats(ctx context.Context, conn net.Conn, peerVersion *atomic.Int64) error {
+	ticker := time.NewTicker(w.interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			version := int(peerVersion.Load())
+			if w.clientSide {
+				version = w.peerMaxVersion
+			}
+			if w.enclaveKey != nil {
+				version = HeartbeatVersion
+			}
+			heartbeat := &HeartbeatMessage{EnclaveID: w.enclaveID}
+			if version > 0 {
+				heartbeat = newHeartbeatMessage(w.enclaveID, w.startedAt, w.status)
+			}
+			var message []byte
+			var err error
+			if w.enclaveKey == nil {
+				message, err = heartbeat.Encode(version)
+			} else {
+				key := w.bridgeKey
+				if w.clientSide {
+					key = w.enclaveKey
+				}
+				heartbeat.Counter = w.sentCounter.Add(1)
+				message, err = heartbeat.encodeSigned(key)
+			}
+			if err != nil {
+				return err
+			}
+			if _, err := conn.Write(message); err != nil {
+				return fmt.Errorf("failed to write to conn: %w", err)
+			}
+		}
+	}
+}
+
+// readHeartbeatLine reads a heartbeat without its newline. A legacy heartbeat is the raw enclave ID, which can
+// contain newline bytes itself, so shorter lines are joined with the following ones. Versioned heartbeats are longer.
+func readHeartbeatLine(ctx context.Context, reader *bufio.Reader) ([]byte, error) {
+	line, err := enclave.ReadBytesWithContext(ctx, reader, '\n')
+	for err == nil && len(line) <= legacyHeartbeatLength {
+		var next []byte
+		next, err = enclave.ReadBytesWithContext(ctx, reader, '\n')
+		line = append(line, next...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Remove the newline character
+	return line[:len(line)-1], nil
+}
+
 // NewStandardSettings returns a standard watchdog settings.
 func NewStandardSettings() config.WatchdogSettings {
 	return config.WatchdogSettings{
@@ -151,7 +376,7 @@ func NewStandardSettings() config.WatchdogSettings {
 	}
 }
 
-// Heartbeat sends a heartbeat to a watchdog.
+// Heartbeat sends a legacy heartbeat to a watchdog. Watchdog.HandleConn sends versioned heartbeats.
 func Heartbeat(ctx context.Context, uuidMessage []byte, watchDogConn net.Conn, interval time.Duration) error {
 	ticker := time.NewTicker(interval / 2)
 	defer ticker.Stop()
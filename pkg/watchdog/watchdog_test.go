@@ -2,6 +2,7 @@ package watchdog_test
 
 import (
 	"context"
+	"io"
 	"net"
 	"os"
 	"testing"
@@ -209,3 +210,180 @@ func TestWatchdogContextCancellation(t *testing.T) {
 		t.Fatal("timeout waiting for watchdog to exit after cancellation")
 	}
 }
+
+func TestWatchdogVersionedHeartbeat(t *testing.T) {
+	t.Parallel()
+	interval := 100 * time.Millisecond
+	dog, listener, enclaveID := setupWatchdogTest(t, interval)
+	defer listener.Close() //nolint:errcheck
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go func() {
+		_ = dog.StartServerSide(ctx, listener)
+	}()
+
+	status := watchdog.NewStatus("v1.2.3")
+	status.SetState(watchdog.StateDegraded)
+	status.Set("queue_depth", "12")
+	status.Set("removed", "x")
+	status.Delete("removed")
+	require.Equal(t, watchdog.StateDegraded, status.State())
+	enclaveDog, err := watchdog.New(&config.WatchdogSettings{EnclaveID: enclaveID, Interval: interval},
+		watchdog.WithStatus(status), watchdog.WithHeartbeatVersion(watchdog.HeartbeatVersion))
+	require.NoError(t, err)
+	go func() {
+		_ = enclaveDog.StartClientSide(ctx, func() (net.Conn, error) {
+			return net.Dial("tcp", listener.Addr().String())
+		})
+	}()
+
+	require.Eventually(t, func() bool {
+		return dog.LastHeartbeat() != nil && enclaveDog.LastHeartbeat() != nil &&
+			enclaveDog.LastHeartbeat().Version == watchdog.HeartbeatVersion
+	}, 2*time.Second, 10*time.Millisecond)
+	heartbeat := dog.LastHeartbeat()
+	require.Equal(t, watchdog.HeartbeatVersion, heartbeat.Version)
+	require.Equal(t, enclaveID, heartbeat.EnclaveID)
+	require.Equal(t, "v1.2.3", heartbeat.AppVersion)
+	require.Equal(t, watchdog.StateDegraded, heartbeat.State)
+	require.Equal(t, map[string]string{"queue_depth": "12"}, heartbeat.Custom)
+	require.Positive(t, heartbeat.Uptime)
+	require.Positive(t, heartbeat.MemoryBytes)
+	require.Positive(t, heartbeat.Goroutines)
+	require.WithinDuration(t, time.Now(), heartbeat.ReceivedAt, time.Second)
+
+	// The server side reports itself as ready without a status.
+	require.Equal(t, watchdog.StateReady, enclaveDog.LastHeartbeat().State)
+}
+
+func TestWatchdogAnswersLegacyHeartbeats(t *testing.T) {
+	t.Parallel()
+	interval := 100 * time.Millisecond
+	dog, listener, enclaveID := setupWatchdogTest(t, interval)
+	defer listener.Close() //nolint:errcheck
+	go func() {
+		_ = dog.StartServerSide(t.Context(), listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+	_, err = conn.Write(append(enclaveID.Bytes(), '\n'))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	reply := make([]byte, 17)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, append(enclaveID.Bytes(), '\n'), reply)
+	heartbeat := dog.LastHeartbeat()
+	require.NotNil(t, heartbeat)
+	require.Zero(t, heartbeat.Version)
+	require.Equal(t, enclaveID, heartbeat.EnclaveID)
+}
+
+func TestWatchdogSendsLegacyHeartbeatsByDefault(t *testing.T) {
+	t.Parallel()
+	enclaveID := uuid.Must(uuid.NewV4())
+	// Without an advertised version the bridge may predate versioned heartbeats.
+	enclaveDog, err := watchdog.New(&config.WatchdogSettings{EnclaveID: enclaveID, Interval: 50 * time.Millisecond})
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close() //nolint:errcheck
+	go func() {
+		_ = enclaveDog.StartClientSide(t.Context(), func() (net.Conn, error) {
+			return net.Dial("tcp", listener.Addr().String())
+		})
+	}()
+
+	conn, err := listener.Accept()
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	heartbeat := make([]byte, 17)
+	_, err = io.ReadFull(conn, heartbeat)
+	require.NoError(t, err)
+	require.Equal(t, append(enclaveID.Bytes(), '\n'), heartbeat)
+}
+
+func TestParseHeartbeat(t *testing.T) {
+	t.Parallel()
+	enclaveID := uuid.Must(uuid.NewV4())
+	heartbeat := &watchdog.HeartbeatMessage{EnclaveID: enclaveID, State: watchdog.StateReady, Custom: map[string]string{"k": "v"}}
+	line, err := heartbeat.Encode(watchdog.HeartbeatVersion)
+	require.NoError(t, err)
+	require.Equal(t, byte('\n'), line[len(line)-1])
+	parsed, err := watchdog.ParseHeartbeat(line[:len(line)-1])
+	require.NoError(t, err)
+	require.Equal(t, watchdog.HeartbeatVersion, parsed.Version)
+	require.Equal(t, enclaveID, parsed.EnclaveID)
+	require.Equal(t, heartbeat.Custom, parsed.Custom)
+
+	// A space after a closing brace in a status value is not taken for the MAC of an authenticated heartbeat.
+	heartbeat.Custom = map[string]string{"k": "} x"}
+	line, err = heartbeat.Encode(watchdog.HeartbeatVersion)
+	require.NoError(t, err)
+	parsed, err = watchdog.ParseHeartbeat(line[:len(line)-1])
+	require.NoError(t, err)
+	require.Equal(t, heartbeat.Custom, parsed.Custom)
+
+	legacy, err := heartbeat.Encode(0)
+	require.NoError(t, err)
+	parsed, err = watchdog.ParseHeartbeat(legacy[:len(legacy)-1])
+	require.NoError(t, err)
+	require.Zero(t, parsed.Version)
+	require.Equal(t, enclaveID, parsed.EnclaveID)
+
+	for _, invalid := range []string{"", "not a heartbeat", `{"v":0,"enclaveId":"` + enclaveID.String() + `"}`} {
+		_, err := watchdog.ParseHeartbeat([]byte(invalid))
+		require.ErrorIs(t, err, watchdog.ErrInvalidHeartbeat, invalid)
+	}
+}
+
+func TestWatchdogInvalidHeartbeat(t *testing.T) {
+	t.Parallel()
+	dog, listener, _ := setupWatchdogTest(t, 10*time.Second)
+	defer listener.Close() //nolint:errcheck
+	errCh := make(chan error)
+	go func() {
+		errCh <- dog.StartServerSide(t.Context(), listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+	_, err = conn.Write([]byte(`{"v":1,"enclaveId":"not-a-uuid"}` + "\n"))
+	require.NoError(t, err)
+
+	select {
+	case err := <-errCh:
+		require.ErrorIs(t, err, watchdog.ErrInvalidHeartbeat)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for watchdog to return error")
+	}
+}
+
+func TestWatchdogMissedBeats(t *testing.T) {
+	t.Parallel()
+	interval := 50 * time.Millisecond
+	dog, err := watchdog.New(&config.WatchdogSettings{
+		EnclaveID:          uuid.Must(uuid.NewV4()),
+		Interval:           interval,
+		MissedBeats:        3,
+		StartupGracePeriod: 4 * interval,
+	})
+	require.NoError(t, err)
+
+	start := time.Now()
+	err = dog.Run(t.Context())
+	require.ErrorIs(t, err, watchdog.ErrEnclaveHeartbeatTimeout)
+	// The grace period and three missed intervals pass before the watchdog fails.
+	require.GreaterOrEqual(t, time.Since(start), 7*interval)
+
+	// The watchdog keeps watching when it is run again, without another grace period.
+	start = time.Now()
+	err = dog.Run(t.Context())
+	require.ErrorIs(t, err, watchdog.ErrEnclaveHeartbeatTimeout)
+	require.Less(t, time.Since(start), 6*interval)
+}